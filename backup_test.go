@@ -12,8 +12,8 @@ import (
 	"github.com/spf13/afero"
 )
 
-func fakePullCommand(command string, args ...string) (cmd *exec.Cmd) {
-	cs := []string{"-test.run=TestHelperPullProcess", "--", command}
+func fakeFetchCommand(command string, args ...string) (cmd *exec.Cmd) {
+	cs := []string{"-test.run=TestHelperFetchProcess", "--", command}
 	cs = append(cs, args...)
 	cmd = exec.Command(os.Args[0], cs...)
 	cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1"}
@@ -58,10 +58,10 @@ func TestBackup(t *testing.T) {
 		t.Errorf("%s", stdoutStderr)
 	}
 
-	// Test pull
+	// Test fetch
 	repoDir := path.Join(backupDir, repo.Name)
 	appFS.MkdirAll(repoDir, 0771)
-	execCommand = fakePullCommand
+	execCommand = fakeFetchCommand
 	wg.Add(1)
 	stdoutStderr, err = backUp(backupDir, &repo, false, &wg)
 	if err != nil {
@@ -102,13 +102,26 @@ func TestBareBackup(t *testing.T) {
 	}
 }
 
-func TestHelperPullProcess(t *testing.T) {
+func TestHelperFetchProcess(t *testing.T) {
 	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
 		return
 	}
-	// Check that git command was executed
-	if os.Args[3] != "git" || os.Args[6] != "pull" {
-		fmt.Fprintf(os.Stdout, "Expected git pull to be executed. Got %v", os.Args[3:])
+	// Check that git commands updating a working copy were executed, and
+	// answer them as an up to date checkout of the default branch
+	if os.Args[3] != "git" {
+		fmt.Fprintf(os.Stdout, "Expected git to be executed. Got %v", os.Args[3:])
+		os.Exit(1)
+	}
+	switch strings.Join(os.Args[6:], " ") {
+	case "fetch --all --tags --prune --no-prune-tags", "remote set-head origin --auto", "status --porcelain --untracked-files=no":
+	case "symbolic-ref --short refs/remotes/origin/HEAD":
+		fmt.Fprintln(os.Stdout, "origin/main")
+	case "symbolic-ref --quiet --short HEAD":
+		fmt.Fprintln(os.Stdout, "main")
+	case "rev-list --left-right --count HEAD...refs/remotes/origin/main":
+		fmt.Fprintln(os.Stdout, "0\t0")
+	default:
+		fmt.Fprintf(os.Stdout, "Expected git fetch to be executed. Got %v", os.Args[3:])
 		os.Exit(1)
 	}
 	os.Exit(0)
@@ -234,11 +247,14 @@ func TestSetupBackupDir(t *testing.T) {
 	}
 
 	for _, tc := range testConfigs {
-		backupdir := setupBackupDir(&tc.backupRootDir, &tc.gitService, &tc.gitServiceUrl)
+		backupdir, err := setupBackupDir(&tc.backupRootDir, &tc.gitService, &tc.gitServiceUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
 		if backupdir != tc.wantBackupPath {
 			t.Errorf("Expected %s, Got %s", tc.wantBackupPath, backupdir)
 		}
-		_, err := appFS.Stat(backupdir)
+		_, err = appFS.Stat(backupdir)
 		if err != nil {
 			t.Error(err)
 		}
@@ -279,3 +295,27 @@ func TestCheckGitAvailability(t *testing.T) {
 		}
 	})
 }
+
+func TestNewGitCommandEnv(t *testing.T) {
+	defer func() {
+		gitEnv = nil
+	}()
+
+	gitEnv = nil
+	cmd := newGitCommand("-C", "/tmp/repo", "fetch")
+	if cmd.Env != nil {
+		t.Errorf("Expected the environment to be inherited, got: %v", cmd.Env)
+	}
+
+	gitEnv = gitConfigEnv([][2]string{{"http.proxy", "http://127.0.0.1:3128"}})
+	cmd = newGitCommand("-C", "/tmp/repo", "fetch")
+	env := strings.Join(cmd.Env, "\n")
+	for _, expected := range []string{"PATH=", "GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=http.proxy", "GIT_CONFIG_VALUE_0=http://127.0.0.1:3128"} {
+		if !strings.Contains(env, expected) {
+			t.Errorf("Expected %q in the environment", expected)
+		}
+	}
+	if cmd.Args[len(cmd.Args)-1] != "fetch" {
+		t.Errorf("Expected the arguments to be left alone, got: %v", cmd.Args)
+	}
+}
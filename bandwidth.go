@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// parseByteSize parses sizes such as 512K, 10MB or 1.5GiB into bytes.
+// Both the decimal and binary suffixes are treated as powers of 1024.
+func parseByteSize(value string) (int64, error) {
+	s := strings.TrimSpace(value)
+	if s == "" {
+		return 0, nil
+	}
+	upper := strings.ToUpper(s)
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffixes   []string
+		multiplier int64
+	}{
+		{[]string{"GIB", "GB", "G"}, 1 << 30},
+		{[]string{"MIB", "MB", "M"}, 1 << 20},
+		{[]string{"KIB", "KB", "K"}, 1 << 10},
+		{[]string{"B"}, 1},
+	} {
+		found := false
+		for _, suffix := range unit.suffixes {
+			if strings.HasSuffix(upper, suffix) {
+				upper = strings.TrimSpace(strings.TrimSuffix(upper, suffix))
+				multiplier = unit.multiplier
+				found = true
+				break
+			}
+		}
+		if found {
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(upper, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %q", value)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// throttledProxy is a local HTTP proxy which caps the bandwidth of all the
+// connections going through it. git is pointed at it for HTTPS transfers,
+// and SSH connections are tunnelled through it via a ProxyCommand.
+type throttledProxy struct {
+	listener net.Listener
+	server   *http.Server
+	limiter  *rate.Limiter
+	// upstream selects the proxy to forward to, if any
+	upstream func(*http.Request) (*url.URL, error)
+	// token authenticates the requests of this run's git commands, so
+	// that the other local users can't use the proxy
+	token string
+}
+
+// proxyTokenEnv is the environment variable handing the token of the
+// proxy to the netcat ProxyCommand, rather than its arguments which the
+// other local users can see
+const proxyTokenEnv = "GITBACKUP_PROXY_TOKEN"
+
+// proxyUser is the user name of the proxy's basic authentication
+const proxyUser = "gitbackup"
+
+// proxyAuthorization returns the Proxy-Authorization header of the
+// requests to the proxy with token
+func proxyAuthorization(token string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(proxyUser+":"+token))
+}
+
+// We have it here so that we can override it in the tests
+var proxyDial = func(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+// startThrottledProxy starts a proxy listening on the loopback interface
+// allowing at most bytesPerSecond across all connections. The connections
+// go through the proxy upstream selects, if it's not nil.
+func startThrottledProxy(bytesPerSecond int64, upstream func(*http.Request) (*url.URL, error)) (*throttledProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	// Reads are split into chunks no larger than the burst
+	burst := int(bytesPerSecond)
+	if burst > 256*1024 {
+		burst = 256 * 1024
+	}
+	if burst < 1024 {
+		burst = 1024
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	p := throttledProxy{
+		listener: listener,
+		limiter:  rate.NewLimiter(rate.Limit(bytesPerSecond), burst),
+		upstream: upstream,
+		token:    hex.EncodeToString(token),
+	}
+	registerSecret(p.token)
+	p.server = &http.Server{Handler: http.HandlerFunc(p.handle)}
+	go p.server.Serve(listener)
+	return &p, nil
+}
+
+// Addr returns the address the proxy is listening on
+func (p *throttledProxy) Addr() string {
+	return p.listener.Addr().String()
+}
+
+// URL returns the proxy URL to be used for git's http.proxy setting,
+// with the credentials of the proxy
+func (p *throttledProxy) URL() string {
+	return "http://" + proxyUser + ":" + p.token + "@" + p.Addr()
+}
+
+// Close stops the proxy
+func (p *throttledProxy) Close() error {
+	return p.server.Close()
+}
+
+func (p *throttledProxy) handle(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Proxy-Authorization")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte(proxyAuthorization(p.token))) != 1 {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="gitbackup"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+	if r.Method != http.MethodConnect {
+		p.forward(w, r)
+		return
+	}
+
+	upstream, err := p.dial(r.Context(), r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	fmt.Fprint(client, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		p.copy(upstream, buffered)
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		p.copy(client, upstream)
+		closeWrite(client)
+	}()
+	wg.Wait()
+	upstream.Close()
+	client.Close()
+}
+
+// forward proxies plain HTTP requests (http:// clone URLs)
+func (p *throttledProxy) forward(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Host == "" {
+		http.Error(w, "not a proxy request", http.StatusBadRequest)
+		return
+	}
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	// The credentials of the upstream proxy are added by the transport
+	out.Header.Del("Proxy-Authorization")
+	if r.Body != nil {
+		out.Body = io.NopCloser(&throttledReader{ctx: r.Context(), r: r.Body, limiter: p.limiter})
+	}
+	transport := &http.Transport{DialContext: proxyDial, Proxy: p.upstream}
+	resp, err := transport.RoundTrip(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	p.copy(w, resp.Body)
+}
+
+// dial connects to address, through the upstream proxy if there is one
+func (p *throttledProxy) dial(ctx context.Context, address string) (net.Conn, error) {
+	if p.upstream == nil {
+		return proxyDial(ctx, "tcp", address)
+	}
+	proxyURL, err := p.upstream(&http.Request{URL: &url.URL{Scheme: "https", Host: address}})
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return proxyDial(ctx, "tcp", address)
+	}
+	return dialViaProxy(ctx, proxyURL, address)
+}
+
+// dialViaProxy opens a tunnel to address through the HTTP(S) proxy at
+// proxyURL with a CONNECT request
+func dialViaProxy(ctx context.Context, proxyURL *url.URL, address string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+	conn, err := proxyDial(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused to connect to %s: %s", proxyURL.Host, address, resp.Status)
+	}
+	// The server may have sent data (e.g. the SSH banner) along with the
+	// response of the proxy
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// bufferedConn is a connection whose reads go through a buffered reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(buf []byte) (int, error) {
+	return c.reader.Read(buf)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
+
+func (p *throttledProxy) copy(dst io.Writer, src io.Reader) {
+	io.Copy(dst, &throttledReader{ctx: context.Background(), r: src, limiter: p.limiter})
+}
+
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
+}
+
+// throttledReader waits for the rate limiter before handing out data
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (t *throttledReader) Read(buf []byte) (int, error) {
+	if len(buf) > t.limiter.Burst() {
+		buf = buf[:t.limiter.Burst()]
+	}
+	n, err := t.r.Read(buf)
+	if n > 0 {
+		if waitErr := t.limiter.WaitN(t.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// bandwidthLimitGitSettings returns the git configuration and environment
+// which make git send all its HTTP(S) and SSH traffic through the
+// throttled proxy. sshOptions are the ssh options of the target.
+func bandwidthLimitGitSettings(p *throttledProxy, sshOptions []string) ([][2]string, []string) {
+	// The credentials are sent upfront rather than after a 407
+	config := [][2]string{{"http.proxy", p.URL()}, {"http.proxyAuthMethod", "basic"}}
+
+	if len(sshOptions) == 0 && (os.Getenv("GIT_SSH_COMMAND") != "" || os.Getenv("GIT_SSH") != "") {
+		slog.Warn("GIT_SSH_COMMAND or GIT_SSH is set, the bandwidth limit only applies to HTTPS clones")
+		return config, nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		slog.Warn("Could not determine the gitbackup executable, the bandwidth limit only applies to HTTPS clones", "error", err)
+		return config, nil
+	}
+	proxyCommand := fmt.Sprintf("%s netcat %s %%h %%p", shellQuote(exe), p.Addr())
+	env := gitSSHEnv(append(append([]string{}, sshOptions...), "-o", "ProxyCommand="+proxyCommand))
+	return config, append(env, proxyTokenEnv+"="+p.token)
+}
+
+// shellQuote quotes s for use in the commands git runs via the shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// handleNetcat connects stdin and stdout to host:port through the HTTP
+// proxy at proxyAddr, with the token in $GITBACKUP_PROXY_TOKEN. It is used
+// as the SSH ProxyCommand when a bandwidth limit is set.
+func handleNetcat(proxyAddr, host, port string) error {
+	conn, err := net.DialTimeout("tcp", proxyAddr, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	target := net.JoinHostPort(host, port)
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: %s\r\n\r\n", target, target, proxyAuthorization(os.Getenv(proxyTokenEnv)))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy refused connection to %s: %s", target, resp.Status)
+	}
+
+	go func() {
+		io.Copy(conn, os.Stdin)
+		closeWrite(conn)
+	}()
+	_, err = io.Copy(os.Stdout, reader)
+	return err
+}
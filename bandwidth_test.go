@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	var testCases = []struct {
+		value     string
+		wantBytes int64
+		wantErr   bool
+	}{
+		{"", 0, false},
+		{"1024", 1024, false},
+		{"512K", 512 * 1024, false},
+		{"10MB", 10 * 1024 * 1024, false},
+		{"1.5GiB", 3 * 512 * 1024 * 1024, false},
+		{"100b", 100, false},
+		{"fast", 0, true},
+		{"-1M", 0, true},
+	}
+
+	for _, tc := range testCases {
+		got, err := parseByteSize(tc.value)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseByteSize(%q): unexpected error: %v", tc.value, err)
+			continue
+		}
+		if got != tc.wantBytes {
+			t.Errorf("parseByteSize(%q): expected %d, got %d", tc.value, tc.wantBytes, got)
+		}
+	}
+}
+
+func TestThrottledProxyConnect(t *testing.T) {
+	// An upstream server which echoes back what it receives
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	proxy, err := startThrottledProxy(1024*1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Other local users can't use the proxy
+	unauthenticated, err := net.Dial("tcp", proxy.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unauthenticated.Close()
+	fmt.Fprintf(unauthenticated, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: %s\r\n\r\n", upstream.Addr(), upstream.Addr(), proxyAuthorization("guess"))
+	resp, err := http.ReadResponse(bufio.NewReader(unauthenticated), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("Expected the proxy to require its credentials, got: %s", resp.Status)
+	}
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: %s\r\n\r\n", upstream.Addr(), upstream.Addr(), proxyAuthorization(proxy.token))
+	reader := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the proxy to establish the connection, got: %s", resp.Status)
+	}
+
+	fmt.Fprint(conn, "hello\n")
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello\n" {
+		t.Errorf("Expected data to be relayed, got: %q", line)
+	}
+}
+
+func TestBandwidthLimitGitSettings(t *testing.T) {
+	proxy, err := startThrottledProxy(1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	t.Setenv("GIT_SSH_COMMAND", "")
+	t.Setenv("GIT_SSH", "")
+	config, gitEnv := bandwidthLimitGitSettings(proxy, nil)
+	env := strings.Join(append(gitConfigEnv(config), gitEnv...), "\n")
+	for _, expected := range []string{
+		"GIT_CONFIG_COUNT=2",
+		"GIT_CONFIG_KEY_0=http.proxy",
+		"GIT_CONFIG_VALUE_0=http://gitbackup:" + proxy.token + "@" + proxy.Addr(),
+		"netcat " + proxy.Addr() + " %h %p",
+		"GITBACKUP_PROXY_TOKEN=" + proxy.token,
+	} {
+		if !strings.Contains(env, expected) {
+			t.Errorf("Expected %q in the git environment, got:\n%s", expected, env)
+		}
+	}
+
+	// We leave a user's own SSH command alone
+	t.Setenv("GIT_SSH_COMMAND", "ssh -i mykey")
+	config, gitEnv = bandwidthLimitGitSettings(proxy, nil)
+	env = strings.Join(append(gitConfigEnv(config), gitEnv...), "\n")
+	if strings.Contains(env, "GIT_SSH_COMMAND") {
+		t.Errorf("Expected GIT_SSH_COMMAND not to be overridden, got:\n%s", env)
+	}
+
+	// unless the target has SSH settings of its own
+	config, gitEnv = bandwidthLimitGitSettings(proxy, []string{"-i", "/keys/deploy"})
+	env = strings.Join(gitEnv, "\n")
+	if !strings.HasPrefix(env, "GIT_SSH_COMMAND=ssh '-i' '/keys/deploy' '-o' ") || !strings.Contains(env, "netcat "+proxy.Addr()) {
+		t.Errorf("Expected the target's SSH options along with the proxy command, got:\n%s", env)
+	}
+}
+
+func TestThrottledProxyUpstream(t *testing.T) {
+	// An upstream proxy which sends a banner right after accepting the
+	// tunnel, like an SSH server would, and then echoes back what it
+	// receives
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	requests := make(chan *http.Request, 1)
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		requests <- req
+		fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\nSSH-2.0-fake\n")
+		io.Copy(conn, reader)
+	}()
+
+	upstreamURL, _ := url.Parse("http://user:secret@" + upstream.Addr().String())
+	proxy, err := startThrottledProxy(1024*1024, http.ProxyURL(upstreamURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "CONNECT git.mycompany.com:22 HTTP/1.1\r\nHost: git.mycompany.com:22\r\nProxy-Authorization: %s\r\n\r\n", proxyAuthorization(proxy.token))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the proxy to establish the connection, got: %s", resp.Status)
+	}
+
+	req := <-requests
+	if req.Method != http.MethodConnect || req.Host != "git.mycompany.com:22" {
+		t.Errorf("Expected a CONNECT to git.mycompany.com:22 upstream, got %s %s", req.Method, req.Host)
+	}
+	if auth := req.Header.Get("Proxy-Authorization"); auth != "Basic dXNlcjpzZWNyZXQ=" {
+		t.Errorf("Expected the upstream proxy credentials, got %q", auth)
+	}
+
+	fmt.Fprint(conn, "hello\n")
+	for _, expected := range []string{"SSH-2.0-fake\n", "hello\n"} {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != expected {
+			t.Errorf("Expected %q to be relayed, got: %q", expected, line)
+		}
+	}
+}
@@ -1,17 +1,18 @@
 package main
 
 import (
-	"log"
+	"errors"
 	"os"
 	"strings"
 
 	bitbucket "github.com/ktrysmt/go-bitbucket"
 )
 
-func getBitbucketRepositories(
+func listBitbucketRepositories(
 	client *bitbucket.Client,
 	ignoreFork bool,
-) ([]*Repository, error) {
+	fn func(*Repository) error,
+) error {
 
 	// As of April 14, 2026 Atlassian removed the cross-workspace listing
 	// endpoints (/2.0/workspaces and /2.0/user/permissions/workspaces) under
@@ -21,42 +22,67 @@ func getBitbucketRepositories(
 	// (comma-separated).
 	workspacesEnv := os.Getenv("BITBUCKET_WORKSPACES")
 	if workspacesEnv == "" {
-		log.Fatal("BITBUCKET_WORKSPACES environment variable not set (comma-separated workspace slugs)")
+		return errors.New("BITBUCKET_WORKSPACES environment variable not set (comma-separated workspace slugs)")
 	}
 
-	var repositories []*Repository
-
 	for _, slug := range strings.Split(workspacesEnv, ",") {
 		slug = strings.TrimSpace(slug)
 		if slug == "" {
 			continue
 		}
 
-		options := &bitbucket.RepositoriesOptions{Owner: slug}
-
-		resp, err := client.Repositories.ListForAccount(options)
-		if err != nil {
-			return nil, err
-		}
+		// Fetch one page at a time rather than letting the client
+		// aggregate all the pages for us
+		page := 1
+		options := &bitbucket.RepositoriesOptions{Owner: slug, Page: &page}
 
-		for _, repo := range resp.Items {
-			if repo.Parent != nil && ignoreFork {
-				continue
+		for {
+			resp, err := client.Repositories.ListForAccount(options)
+			if err != nil {
+				return err
 			}
-			namespace := strings.Split(repo.Full_name, "/")[0]
 
-			httpsURL, sshURL := extractBitbucketCloneURLs(repo.Links)
-			cloneURL := getCloneURL(httpsURL, sshURL)
+			for _, repo := range resp.Items {
+				if repo.Parent != nil && ignoreFork {
+					continue
+				}
+				namespace := strings.Split(repo.Full_name, "/")[0]
+
+				httpsURL, sshURL := extractBitbucketCloneURLs(repo.Links)
+				cloneURL := getCloneURL(httpsURL, sshURL)
 
-			repositories = append(repositories, &Repository{
-				CloneURL:  cloneURL,
-				Name:      repo.Slug,
-				Namespace: namespace,
-				Private:   repo.Is_private,
-			})
+				r := &Repository{
+					CloneURL:  cloneURL,
+					Name:      repo.Slug,
+					Namespace: namespace,
+					Private:   repo.Is_private,
+				}
+				if repo.UpdatedOnTime != nil {
+					r.PushedAt = *repo.UpdatedOnTime
+				}
+				if repo.Parent != nil && objectPools {
+					r.ForkOf = forkNetworkRoot("bitbucket.org", repo.Parent.Full_name, func(name string) (string, error) {
+						owner, slug, _ := strings.Cut(name, "/")
+						parent, err := client.Repositories.Repository.Get(&bitbucket.RepositoryOptions{Owner: owner, RepoSlug: slug})
+						if err != nil || parent.Parent == nil {
+							return "", err
+						}
+						return parent.Parent.Full_name, nil
+					})
+				}
+				err := fn(r)
+				if err != nil {
+					return err
+				}
+			}
+
+			if len(resp.Items) == 0 || resp.Pagelen <= 0 || int32(page)*resp.Pagelen >= resp.Size {
+				break
+			}
+			page++
 		}
 	}
-	return repositories, nil
+	return nil
 }
 
 func extractBitbucketCloneURLs(links map[string]interface{}) (httpsURL, sshURL string) {
@@ -2,11 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
-	"os"
+	"strings"
 
 	"golang.org/x/oauth2"
 
@@ -16,37 +17,27 @@ import (
 	gitlab "github.com/xanzy/go-gitlab"
 
 	"github.com/99designs/keyring"
-	"github.com/cli/oauth/device"
 )
 
 var keyringServiceName = "gitbackup-cli"
 var gitbackupClientID = "7b56a77c7dfba0800524"
 
-func startOAuthFlow() string {
-	clientID := gitbackupClientID
-	scopes := []string{"repo", "user", "admin:org"}
-	httpClient := http.DefaultClient
-
-	code, err := device.RequestCode(httpClient, "https://github.com/login/device/code", clientID, scopes)
-	if err != nil {
-		panic(err)
-	}
-
-	fmt.Printf("Copy code: %s\n", code.UserCode)
-	fmt.Printf("then open: %s\n", code.VerificationURI)
-
-	accessToken, err := device.PollToken(httpClient, "https://github.com/login/oauth/access_token", clientID, code)
-	if err != nil {
-		panic(err)
-	}
-
-	return accessToken.Token
+// openKeyring opens the keyring gitbackup stores its tokens in. The
+// password of the file based keyring is only asked for interactively.
+func openKeyring() (keyring.Keyring, error) {
+	return keyring.Open(keyring.Config{
+		ServiceName: keyringServiceName,
+		FilePasswordFunc: func(prompt string) (string, error) {
+			if !interactive() {
+				return "", errors.New("the keyring password can't be asked for in a non-interactive run")
+			}
+			return keyring.TerminalPrompt(prompt)
+		},
+	})
 }
 
 func saveToken(service string, token string) error {
-	ring, err := keyring.Open(keyring.Config{
-		ServiceName: keyringServiceName,
-	})
+	ring, err := openKeyring()
 	if err != nil {
 		return err
 	}
@@ -59,9 +50,7 @@ func saveToken(service string, token string) error {
 }
 
 func getToken(service string) (string, error) {
-	ring, err := keyring.Open(keyring.Config{
-		ServiceName: keyringServiceName,
-	})
+	ring, err := openKeyring()
 	if err != nil {
 		return "", err
 	}
@@ -72,143 +61,253 @@ func getToken(service string) (string, error) {
 	return string(i.Data), nil
 }
 
-func newClient(service string, gitHostURL string) interface{} {
-	gitHostURLParsed := parseGitHostURL(gitHostURL, service)
+func deleteToken(service string) error {
+	ring, err := openKeyring()
+	if err != nil {
+		return err
+	}
+	return ring.Remove(service + "_TOKEN")
+}
 
-	switch service {
+// newClient creates the API client for the service of the target, with
+// the credentials from the configured sources. Unknown services return a
+// nil client.
+func newClient(c *appConfig) (interface{}, error) {
+	gitHostURLParsed, err := parseGitHostURL(c.gitHostURL, c.service)
+	if err != nil {
+		return nil, err
+	}
+	if err := configureHTTP(c.http); err != nil {
+		return nil, err
+	}
+
+	// Only GitHub App installation tokens change during a run
+	githubAppAuth = false
+	githubAppInstallationID = 0
+	gitAuthConfig = nil
+
+	switch c.service {
 	case "github":
-		return newGitHubClient(gitHostURLParsed)
+		return newGitHubClient(c, gitHostURLParsed)
 	case "gitlab":
-		return newGitLabClient(gitHostURLParsed)
+		return newGitLabClient(c, gitHostURLParsed)
 	case "bitbucket":
-		return newBitbucketClient(gitHostURLParsed)
+		return newBitbucketClient(c, gitHostURLParsed)
 	case "forgejo":
-		return newForgejoClient(gitHostURLParsed)
+		return newForgejoClient(c, gitHostURLParsed)
 	default:
-		return nil
+		return nil, nil
 	}
 }
 
 // parseGitHostURL parses the git host URL if provided
-func parseGitHostURL(gitHostURL string, service string) *url.URL {
+func parseGitHostURL(gitHostURL string, service string) (*url.URL, error) {
 	if len(gitHostURL) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	gitHostURLParsed, err := url.Parse(gitHostURL)
 	if err != nil {
-		log.Fatalf("Invalid git host URL: %s", gitHostURL)
+		return nil, fmt.Errorf("invalid git host URL: %s", gitHostURL)
 	}
 
 	// Only GitLab requires /api/v4/ to be appended
 	if service == "gitlab" {
 		api, _ := url.Parse("api/v4/")
-		return gitHostURLParsed.ResolveReference(api)
+		return gitHostURLParsed.ResolveReference(api), nil
 	}
-	return gitHostURLParsed
+	return gitHostURLParsed, nil
 }
 
-// newGitHubClient creates a new GitHub client
-func newGitHubClient(gitHostURLParsed *url.URL) *github.Client {
-	githubToken := getOrCreateGitHubToken()
-	gitHostToken = githubToken
+// newHTTPClient returns the HTTP client used by the provider API clients.
+// It honours the rate limits reported by the git hosts and the HTTP
+// settings of the target.
+func newHTTPClient() *http.Client {
+	return &http.Client{Transport: newRateLimitTransport(httpTransport)}
+}
 
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: githubToken},
-	)
-	tc := oauth2.NewClient(context.Background(), ts)
+// newGitHubClient creates a new GitHub client, authenticated with a token
+// or as a GitHub App installation
+func newGitHubClient(c *appConfig, gitHostURLParsed *url.URL) (*github.Client, error) {
+	apiURL, uploadURL, err := githubAPIURLs(c.githubAPIURL, c.githubUploadURL, gitHostURLParsed)
+	if err != nil {
+		return nil, err
+	}
+
+	var ts oauth2.TokenSource
+	if c.githubApp.enabled() {
+		appTS, err := newGitHubAppTokenSource(c.githubApp, apiURL, c.githubNamespaceWhitelist)
+		if err != nil {
+			return nil, err
+		}
+		token, err := appTS.Token()
+		if err != nil {
+			return nil, err
+		}
+		gitHostToken = token.AccessToken
+		githubAppAuth = true
+		gitAuthConfig = githubAppGitAuth(appTS, gitHostName(c.service, c.gitHostURL))
+		ts = appTS
+	} else {
+		githubToken, err := getOrCreateGitHubToken(c)
+		if err != nil {
+			return nil, err
+		}
+		gitHostToken = githubToken
+		ts = oauth2.StaticTokenSource(
+			&oauth2.Token{AccessToken: githubToken},
+		)
+	}
+
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, newHTTPClient())
+	tc := oauth2.NewClient(ctx, ts)
 	client := github.NewClient(tc)
 
-	if gitHostURLParsed != nil {
-		client.BaseURL = gitHostURLParsed
+	if apiURL != nil {
+		client.BaseURL = apiURL
+		client.UploadURL = uploadURL
 	}
-	return client
+	return client, nil
 }
 
-// getOrCreateGitHubToken retrieves or creates a GitHub token
-func getOrCreateGitHubToken() string {
-	githubToken := os.Getenv("GITHUB_TOKEN")
-	if githubToken != "" {
-		return githubToken
+// githubAPIURLs returns the API and upload URLs of a GitHub instance, or
+// nil for github.com. Explicitly configured URLs are used as they are,
+// otherwise they are derived from the web URL of the instance: GitHub
+// Enterprise Server serves its API below /api/v3/ and its uploads below
+// /api/uploads/, GitHub Enterprise Cloud with data residency (*.ghe.com)
+// on the api. and uploads. subdomains.
+func githubAPIURLs(apiURL, uploadURL string, webURL *url.URL) (*url.URL, *url.URL, error) {
+	var api, upload *url.URL
+	var err error
+
+	if apiURL != "" {
+		if api, err = parseBaseURL(apiURL); err != nil {
+			return nil, nil, err
+		}
+	} else if webURL != nil && !strings.EqualFold(webURL.Hostname(), knownServices["github"]) {
+		base := *webURL
+		if !strings.HasSuffix(base.Path, "/") {
+			base.Path += "/"
+		}
+		switch {
+		case strings.HasSuffix(base.Path, "/api/v3/"):
+			// Already the API URL, as the earlier versions expected
+			api = &base
+		case strings.HasSuffix(strings.ToLower(base.Hostname()), ".ghe.com"):
+			api = &url.URL{Scheme: base.Scheme, Host: "api." + base.Host, Path: "/"}
+			upload = &url.URL{Scheme: base.Scheme, Host: "uploads." + base.Host, Path: "/"}
+		default:
+			api = base.ResolveReference(&url.URL{Path: "api/v3/"})
+		}
+	}
+	if api == nil {
+		return nil, nil, nil
 	}
 
-	githubToken, err := getToken("GITHUB")
-	if err != nil {
-		githubToken = startOAuthFlow()
+	switch {
+	case uploadURL != "":
+		if upload, err = parseBaseURL(uploadURL); err != nil {
+			return nil, nil, err
+		}
+	case upload != nil:
+	case strings.HasSuffix(api.Path, "/api/v3/"):
+		upload = api.ResolveReference(&url.URL{Path: "../uploads/"})
+	default:
+		upload = api
 	}
+	return api, upload, nil
+}
 
-	if githubToken == "" {
-		log.Fatal("GitHub token not available")
+// parseBaseURL parses an absolute API base URL, making sure it ends with a
+// slash so that the API paths are resolved below it
+func parseBaseURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid API URL: %s", rawURL)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
 	}
+	return u, nil
+}
 
-	err = saveToken("GITHUB", githubToken)
-	if err != nil {
-		log.Fatal("Error saving token")
+// getOrCreateGitHubToken retrieves a GitHub token from the configured
+// sources. Interactive runs fall back to logging in with the OAuth device
+// flow, the others fail.
+func getOrCreateGitHubToken(c *appConfig) (string, error) {
+	cred, err := resolveCredentials("github", credentialHost(c.service, c.gitHostURL), c.credentials)
+	if err == nil {
+		return cred.Token, nil
+	}
+	if !errors.Is(err, errNoCredentials) || !interactive() {
+		return "", err
 	}
 
-	return githubToken
+	slog.Info("No GitHub credentials found, logging in")
+	token, err := login(c, loginOptions{})
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
 }
 
 // newGitLabClient creates a new GitLab client
-func newGitLabClient(gitHostURLParsed *url.URL) *gitlab.Client {
-	gitlabToken := os.Getenv("GITLAB_TOKEN")
-	if gitlabToken == "" {
-		log.Fatal("GITLAB_TOKEN environment variable not set")
+func newGitLabClient(c *appConfig, gitHostURLParsed *url.URL) (*gitlab.Client, error) {
+	cred, err := resolveCredentials(c.service, credentialHost(c.service, c.gitHostURL), c.credentials)
+	if err != nil {
+		return nil, err
 	}
+	gitlabToken := cred.Token
 	gitHostToken = gitlabToken
 
-	var baseUrlOption gitlab.ClientOptionFunc
+	options := []gitlab.ClientOptionFunc{gitlab.WithHTTPClient(newHTTPClient())}
 	if gitHostURLParsed != nil {
-		baseUrlOption = gitlab.WithBaseURL(gitHostURLParsed.String())
+		options = append(options, gitlab.WithBaseURL(gitHostURLParsed.String()))
 	}
 
-	client, err := gitlab.NewClient(gitlabToken, baseUrlOption)
+	client, err := gitlab.NewClient(gitlabToken, options...)
 	if err != nil {
-		log.Fatalf("Error creating gitlab client: %v", err)
+		return nil, fmt.Errorf("error creating gitlab client: %v", err)
 	}
-	return client
+	return client, nil
 }
 
 // newBitbucketClient creates a new Bitbucket client
-func newBitbucketClient(gitHostURLParsed *url.URL) *bitbucket.Client {
+func newBitbucketClient(c *appConfig, gitHostURLParsed *url.URL) (*bitbucket.Client, error) {
 	// Atlassian API tokens are scoped to the Atlassian account, which is
 	// identified by an email address rather than a Bitbucket username.
 	// Prefer BITBUCKET_EMAIL for clarity and fall back to BITBUCKET_USERNAME
 	// for backwards compatibility with legacy app-password setups.
-	bitbucketEmailOrUsername := os.Getenv("BITBUCKET_EMAIL")
-	if bitbucketEmailOrUsername == "" {
-		bitbucketEmailOrUsername = os.Getenv("BITBUCKET_USERNAME")
+	cred, err := resolveCredentials(c.service, credentialHost(c.service, c.gitHostURL), c.credentials)
+	if err != nil {
+		return nil, err
 	}
+	bitbucketEmailOrUsername := cred.Username
 	if bitbucketEmailOrUsername == "" {
-		log.Fatal("BITBUCKET_EMAIL or BITBUCKET_USERNAME environment variable not set")
-	}
-
-	bitbucketPasswordOrToken := os.Getenv("BITBUCKET_TOKEN")
-	if bitbucketPasswordOrToken == "" {
-		bitbucketPasswordOrToken = os.Getenv("BITBUCKET_PASSWORD")
-	}
-	if bitbucketPasswordOrToken == "" {
-		log.Fatal("BITBUCKET_TOKEN or BITBUCKET_PASSWORD environment variable not set")
+		return nil, errors.New("BITBUCKET_EMAIL or BITBUCKET_USERNAME environment variable not set")
 	}
+	bitbucketPasswordOrToken := cred.Token
 
 	gitHostToken = bitbucketPasswordOrToken
 	client, err := bitbucket.NewBasicAuth(bitbucketEmailOrUsername, bitbucketPasswordOrToken)
 	if err != nil {
-		log.Fatalf("Error creating Bitbucket client: %v", err)
+		return nil, fmt.Errorf("error creating Bitbucket client: %v", err)
 	}
+	client.HttpClient = newHTTPClient()
 
 	if gitHostURLParsed != nil {
 		client.SetApiBaseURL(*gitHostURLParsed)
 	}
-	return client
+	return client, nil
 }
 
 // newForgejoClient creates a new Forgejo client.
-func newForgejoClient(gitHostURLParsed *url.URL) *forgejo.Client {
-	forgejoToken := os.Getenv("FORGEJO_TOKEN")
-	if forgejoToken == "" {
-		log.Fatal("FORGEJO_TOKEN environment variable not set")
+func newForgejoClient(c *appConfig, gitHostURLParsed *url.URL) (*forgejo.Client, error) {
+	cred, err := resolveCredentials(c.service, credentialHost(c.service, c.gitHostURL), c.credentials)
+	if err != nil {
+		return nil, err
 	}
+	forgejoToken := cred.Token
 
 	url := "https://" + knownServices["forgejo"]
 	if gitHostURLParsed != nil {
@@ -217,11 +316,16 @@ func newForgejoClient(gitHostURLParsed *url.URL) *forgejo.Client {
 
 	gitHostToken = forgejoToken
 
-	log.Println("Creating forgejo client", url)
-	client, err := forgejo.NewClient(url, forgejo.SetToken(forgejoToken), forgejo.SetForgejoVersion(""))
+	slog.Info("Creating forgejo client", "url", url)
+	client, err := forgejo.NewClient(
+		url,
+		forgejo.SetHTTPClient(newHTTPClient()),
+		forgejo.SetToken(forgejoToken),
+		forgejo.SetForgejoVersion(""),
+	)
 	if err != nil {
-		log.Fatalf("Error creating forgejo client: %v", err)
+		return nil, fmt.Errorf("error creating forgejo client: %v", err)
 	}
 
-	return client
+	return client, nil
 }
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"net/url"
 	"os"
+	"strings"
 	"testing"
 
 	forgejo "codeberg.org/mvdkleijn/forgejo-sdk/forgejo/v2"
@@ -21,41 +23,45 @@ func TestNewClient(t *testing.T) {
 	expectedGitLabBaseURL := customGitHost.ResolveReference(api)
 
 	// Client for github.com
-	client := newClient("github", "")
+	client, _ := newClient(&appConfig{service: "github"})
 	client = client.(*github.Client)
 
-	// Client for Enterprise Github - should use the URL as-is, not append /api/v4/
-	client = newClient("github", customGitHost.String())
+	// Client for GitHub Enterprise Server - should use the API below /api/v3/
+	client, _ = newClient(&appConfig{service: "github", gitHostURL: customGitHost.String()})
 	gotBaseURL := client.(*github.Client).BaseURL
-	if gotBaseURL.String() != customGitHost.String() {
-		t.Errorf("Expected BaseURL to be: %v, Got: %v\n", customGitHost, gotBaseURL)
+	if gotBaseURL.String() != "https://git.mycompany.com/api/v3/" {
+		t.Errorf("Expected BaseURL to be: https://git.mycompany.com/api/v3/, Got: %v\n", gotBaseURL)
+	}
+	gotUploadURL := client.(*github.Client).UploadURL
+	if gotUploadURL.String() != "https://git.mycompany.com/api/uploads/" {
+		t.Errorf("Expected UploadURL to be: https://git.mycompany.com/api/uploads/, Got: %v\n", gotUploadURL)
 	}
 
 	// Client for gitlab.com
-	client = newClient("gitlab", "")
+	client, _ = newClient(&appConfig{service: "gitlab"})
 	client = client.(*gitlab.Client)
 
 	// Client for custom gitlab installation - should append /api/v4/
-	client = newClient("gitlab", customGitHost.String())
+	client, _ = newClient(&appConfig{service: "gitlab", gitHostURL: customGitHost.String()})
 	gotBaseURL = client.(*gitlab.Client).BaseURL()
 	if gotBaseURL.String() != expectedGitLabBaseURL.String() {
 		t.Errorf("Expected BaseURL to be: %v, Got: %v\n", expectedGitLabBaseURL, gotBaseURL)
 	}
 
 	// Client for bitbucket.com
-	client = newClient("bitbucket", "")
+	client, _ = newClient(&appConfig{service: "bitbucket"})
 	client = client.(*bitbucket.Client)
 
 	// Client for codeberg
-	client = newClient("forgejo", "")
+	client, _ = newClient(&appConfig{service: "forgejo"})
 	client = client.(*forgejo.Client)
 
 	// Client for forgejo
-	client = newClient("forgejo", customGitHost.String())
+	client, _ = newClient(&appConfig{service: "forgejo", gitHostURL: customGitHost.String()})
 	client = client.(*forgejo.Client)
 
 	// Not yet supported
-	client = newClient("notyetsupported", "")
+	client, _ = newClient(&appConfig{service: "notyetsupported"})
 	if client != nil {
 		t.Errorf("Expected nil")
 	}
@@ -71,7 +77,7 @@ func TestNewBitbucketClientWithToken(t *testing.T) {
 	os.Unsetenv("BITBUCKET_PASSWORD")
 	defer os.Unsetenv("BITBUCKET_TOKEN")
 
-	client := newClient("bitbucket", "")
+	client, _ := newClient(&appConfig{service: "bitbucket"})
 	if client == nil {
 		t.Fatal("Expected non-nil bitbucket client")
 	}
@@ -81,3 +87,79 @@ func TestNewBitbucketClientWithToken(t *testing.T) {
 		t.Errorf("Expected gitHostToken to be BITBUCKET_TOKEN value, got: %v", gitHostToken)
 	}
 }
+
+func TestNewClientMissingCredentials(t *testing.T) {
+	var testCases = []struct {
+		service string
+		envVar  string
+	}{
+		{"github", "GITHUB_TOKEN"},
+		{"gitlab", "GITLAB_TOKEN"},
+		{"bitbucket", "BITBUCKET_PASSWORD"},
+		{"forgejo", "FORGEJO_TOKEN"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.service, func(t *testing.T) {
+			setupRepositoryTests()
+			defer teardownRepositoryTests()
+			os.Unsetenv(tc.envVar)
+			defer func(get func(string) (string, error)) {
+				keyringGetToken = get
+			}(keyringGetToken)
+			keyringGetToken = func(string) (string, error) {
+				return "", errors.New("not found")
+			}
+			// Non-interactive runs fail instead of starting a login
+			defer func(f func() bool) {
+				stdinIsTerminal = f
+			}(stdinIsTerminal)
+			stdinIsTerminal = func() bool { return false }
+
+			client, err := newClient(&appConfig{service: tc.service})
+			if err == nil {
+				t.Fatalf("Expected an error when %s is not set, got client %v", tc.envVar, client)
+			}
+			if !strings.Contains(err.Error(), tc.envVar) {
+				t.Errorf("Expected the error to mention %s, got: %v", tc.envVar, err)
+			}
+		})
+	}
+}
+
+func TestGitHubAPIURLs(t *testing.T) {
+	var testCases = []struct {
+		apiURL         string
+		uploadURL      string
+		webURL         string
+		expectedAPI    string
+		expectedUpload string
+	}{
+		{"", "", "", "", ""},
+		{"", "", "https://github.com", "", ""},
+		{"", "", "https://git.mycompany.com", "https://git.mycompany.com/api/v3/", "https://git.mycompany.com/api/uploads/"},
+		{"", "", "https://git.mycompany.com/", "https://git.mycompany.com/api/v3/", "https://git.mycompany.com/api/uploads/"},
+		{"", "", "https://git.mycompany.com/api/v3", "https://git.mycompany.com/api/v3/", "https://git.mycompany.com/api/uploads/"},
+		{"", "", "https://octocorp.ghe.com", "https://api.octocorp.ghe.com/", "https://uploads.octocorp.ghe.com/"},
+		{"https://api.mycompany.com/github", "", "https://git.mycompany.com", "https://api.mycompany.com/github/", "https://api.mycompany.com/github/"},
+		{"https://git.mycompany.com/api/v3/", "https://uploads.mycompany.com", "", "https://git.mycompany.com/api/v3/", "https://uploads.mycompany.com/"},
+	}
+	for _, tc := range testCases {
+		webURL, _ := parseGitHostURL(tc.webURL, "github")
+		api, upload, err := githubAPIURLs(tc.apiURL, tc.uploadURL, webURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gotAPI, gotUpload string
+		if api != nil {
+			gotAPI, gotUpload = api.String(), upload.String()
+		}
+		if gotAPI != tc.expectedAPI || gotUpload != tc.expectedUpload {
+			t.Errorf("%+v: expected %q and %q, got %q and %q", tc, tc.expectedAPI, tc.expectedUpload, gotAPI, gotUpload)
+		}
+	}
+
+	if _, _, err := githubAPIURLs("git.mycompany.com/api/v3", "", nil); err == nil {
+		t.Error("Expected an error for an API URL without a scheme")
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// The clone strategies
+const (
+	// All the refs with their whole history, the default
+	cloneStrategyFull = "full"
+	// All the refs and their history, without the file contents which
+	// git fetches from the remote when they are needed
+	cloneStrategyBlobless = "blobless"
+	// All the refs, with only the latest commits of their history
+	cloneStrategyShallow = "shallow"
+	// A single branch with its whole history
+	cloneStrategySingleBranch = "single-branch"
+)
+
+var cloneStrategyNames = []string{cloneStrategyFull, cloneStrategyBlobless, cloneStrategyShallow, cloneStrategySingleBranch}
+
+// cloneStrategyFile records the strategy a repository was cloned with, in
+// its git directory
+const cloneStrategyFile = "gitbackup-clone.json"
+
+// cloneStrategy is how a repository is cloned and updated
+type cloneStrategy struct {
+	Strategy string `yaml:"strategy" json:"strategy"`
+	// Number of commits of history the shallow clones keep
+	Depth int `yaml:"depth,omitempty" json:"depth,omitempty"`
+	// Branch of the single-branch clones (default: the default branch)
+	Branch string `yaml:"branch,omitempty" json:"branch,omitempty"`
+}
+
+// cloneStrategyRule applies a clone strategy to the repositories matching
+// its patterns
+type cloneStrategyRule struct {
+	// Patterns of the repositories, e.g. owner/repo or owner/*. The rule
+	// applies to all the repositories if there are none.
+	Repositories  []string `yaml:"repositories,omitempty"`
+	cloneStrategy `yaml:",inline"`
+}
+
+// cloneStrategies is set per target: the clone strategy rules, the first
+// one matching a repository applies to it
+var cloneStrategies []cloneStrategyRule
+
+func (s cloneStrategy) full() bool {
+	return s.Strategy == "" || s.Strategy == cloneStrategyFull
+}
+
+// partial reports whether the clones lack objects of the history of their
+// refs, which git bundles can't be created without
+func (s cloneStrategy) partial() bool {
+	return s.Strategy == cloneStrategyBlobless || s.Strategy == cloneStrategyShallow
+}
+
+// matches reports whether a repository cloned with the strategy was cloned
+// with the configured one. The branch of the single-branch clones of the
+// default branch is recorded once they are cloned.
+func (s cloneStrategy) matches(configured cloneStrategy) bool {
+	if s.full() || configured.full() {
+		return s.full() == configured.full()
+	}
+	return s.Strategy == configured.Strategy && s.Depth == configured.Depth &&
+		(configured.Branch == "" || configured.Branch == s.Branch)
+}
+
+func (s cloneStrategy) String() string {
+	switch s.Strategy {
+	case cloneStrategyShallow:
+		return fmt.Sprintf("shallow clone, depth %d", s.Depth)
+	case cloneStrategySingleBranch:
+		if s.Branch != "" {
+			return "single branch " + s.Branch
+		}
+		return "single branch"
+	case cloneStrategyBlobless:
+		return "blobless clone"
+	}
+	return "full clone"
+}
+
+func (s cloneStrategy) validate() error {
+	if !contains(cloneStrategyNames, s.Strategy) {
+		return fmt.Errorf("unknown strategy: %q (must be one of %s)", s.Strategy, strings.Join(cloneStrategyNames, ", "))
+	}
+	if s.Strategy == cloneStrategyShallow && s.Depth <= 0 {
+		return errors.New("shallow clones need a positive depth")
+	}
+	if s.Strategy != cloneStrategyShallow && s.Depth != 0 {
+		return fmt.Errorf("depth only applies to shallow clones, not %s", s.Strategy)
+	}
+	if s.Strategy != cloneStrategySingleBranch && s.Branch != "" {
+		return fmt.Errorf("branch only applies to single-branch clones, not %s", s.Strategy)
+	}
+	return nil
+}
+
+func (r cloneStrategyRule) validate() error {
+	for _, pattern := range r.Repositories {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid repository pattern %q: %v", pattern, err)
+		}
+	}
+	return r.cloneStrategy.validate()
+}
+
+// validateCloneStrategies checks the clone strategy rules, and that the
+// partial clones aren't combined with settings which need all the objects
+func validateCloneStrategies(rules []cloneStrategyRule, objectPools bool, uploadFormat string) error {
+	for i, r := range rules {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("clone strategy %d: %v", i+1, err)
+		}
+		if !r.partial() {
+			continue
+		}
+		if objectPools {
+			return fmt.Errorf("%s clones can't share object pools", r.Strategy)
+		}
+		if uploadFormat != "" && uploadFormat != uploadFormatTar {
+			return fmt.Errorf("%s clones can only be uploaded as tar archives", r.Strategy)
+		}
+	}
+	return nil
+}
+
+// cloneStrategyFor returns the strategy new clones of repo are made with
+func cloneStrategyFor(repo *Repository) cloneStrategy {
+	name := repoFullName(repo)
+	for _, r := range cloneStrategies {
+		if matchRepository(name, r.Repositories) {
+			return r.cloneStrategy
+		}
+	}
+	return cloneStrategy{Strategy: cloneStrategyFull}
+}
+
+// cloneArgs returns the arguments of git clone for the strategy
+func (s cloneStrategy) cloneArgs() []string {
+	switch s.Strategy {
+	case cloneStrategyBlobless:
+		return []string{"--filter=blob:none"}
+	case cloneStrategyShallow:
+		// --depth only fetches the default branch otherwise
+		return []string{"--depth", strconv.Itoa(s.Depth), "--no-single-branch"}
+	case cloneStrategySingleBranch:
+		if s.Branch != "" {
+			return []string{"--single-branch", "--branch", s.Branch}
+		}
+		return []string{"--single-branch"}
+	}
+	return nil
+}
+
+// fetchArgs returns the arguments of the git command fetching the updates
+// of a repository cloned with the strategy, so that it stays as it was
+// cloned. Mirrors fetch all the refs and remove those which were deleted.
+// Working copies fetch the branches and tags of all their remotes, and
+// remove the remote-tracking branches which were deleted, but neither
+// their tags nor their local branches. The shallow and single-branch
+// working copies only get the tags of the commits they fetch, as when
+// they were cloned.
+func (s cloneStrategy) fetchArgs(repoDir string, bare bool) []string {
+	var args []string
+	switch {
+	case bare && s.Strategy != cloneStrategyShallow:
+		// git remote update doesn't report its progress
+		return []string{"-C", repoDir, "remote", "update", "--prune"}
+	case bare:
+		args = []string{"-C", repoDir, "fetch", "--prune"}
+	case s.Strategy == cloneStrategyShallow || s.Strategy == cloneStrategySingleBranch:
+		args = []string{"-C", repoDir, "fetch", "--all", "--prune", "--no-prune-tags"}
+	default:
+		args = []string{"-C", repoDir, "fetch", "--all", "--tags", "--prune", "--no-prune-tags"}
+	}
+	if s.Strategy == cloneStrategyShallow {
+		args = append(args, "--depth", strconv.Itoa(s.Depth))
+	}
+	args = append(args, gitProgressArgs()...)
+	if bare {
+		args = append(args, "origin")
+	}
+	return args
+}
+
+// cloneStrategyPath returns the path of the file recording the strategy of
+// the repository at repoDir
+func cloneStrategyPath(repoDir string, bare bool) string {
+	if bare {
+		return filepath.Join(repoDir, cloneStrategyFile)
+	}
+	return filepath.Join(repoDir, ".git", cloneStrategyFile)
+}
+
+// readCloneStrategy returns the strategy the repository at repoDir was
+// cloned with. Repositories without a recorded strategy are full clones.
+func readCloneStrategy(repoDir string, bare bool) (cloneStrategy, error) {
+	s := cloneStrategy{Strategy: cloneStrategyFull}
+	data, err := afero.ReadFile(appFS, cloneStrategyPath(repoDir, bare))
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return s, fmt.Errorf("error parsing %s: %v", cloneStrategyPath(repoDir, bare), err)
+	}
+	return s, nil
+}
+
+// recordCloneStrategy records the strategy the repository at repoDir was
+// cloned with, and the branch of the single-branch clones of the default
+// branch. Mirrors fetch all the refs, so the single-branch ones are limited
+// to their branch.
+func recordCloneStrategy(repoDir string, bare bool, s cloneStrategy) error {
+	if s.full() {
+		return nil
+	}
+	if s.Strategy == cloneStrategySingleBranch {
+		if s.Branch == "" {
+			out, err := newGitCommand("-C", repoDir, "symbolic-ref", "--short", "HEAD").Output()
+			if err != nil {
+				return fmt.Errorf("error reading the branch of the clone: %v", err)
+			}
+			s.Branch = strings.TrimSpace(string(out))
+		}
+		if bare {
+			refspec := "+refs/heads/" + s.Branch + ":refs/heads/" + s.Branch
+			if out, err := newGitCommand("-C", repoDir, "config", "remote.origin.fetch", refspec).CombinedOutput(); err != nil {
+				return fmt.Errorf("error limiting the clone to %s: %v: %s", s.Branch, err, out)
+			}
+		}
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(appFS, cloneStrategyPath(repoDir, bare), data, 0644)
+}
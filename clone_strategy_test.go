@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestCloneStrategyValidate(t *testing.T) {
+	var tests = []struct {
+		name  string
+		rule  cloneStrategyRule
+		valid bool
+	}{
+		{"full", cloneStrategyRule{cloneStrategy: cloneStrategy{Strategy: "full"}}, true},
+		{"blobless", cloneStrategyRule{Repositories: []string{"octocat/*"}, cloneStrategy: cloneStrategy{Strategy: "blobless"}}, true},
+		{"shallow", cloneStrategyRule{cloneStrategy: cloneStrategy{Strategy: "shallow", Depth: 50}}, true},
+		{"shallow without depth", cloneStrategyRule{cloneStrategy: cloneStrategy{Strategy: "shallow"}}, false},
+		{"single branch", cloneStrategyRule{cloneStrategy: cloneStrategy{Strategy: "single-branch", Branch: "main"}}, true},
+		{"depth of a full clone", cloneStrategyRule{cloneStrategy: cloneStrategy{Strategy: "full", Depth: 1}}, false},
+		{"branch of a blobless clone", cloneStrategyRule{cloneStrategy: cloneStrategy{Strategy: "blobless", Branch: "main"}}, false},
+		{"unknown strategy", cloneStrategyRule{cloneStrategy: cloneStrategy{Strategy: "treeless"}}, false},
+		{"invalid pattern", cloneStrategyRule{Repositories: []string{"octocat/["}, cloneStrategy: cloneStrategy{Strategy: "full"}}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.rule.validate()
+			if (err == nil) != tc.valid {
+				t.Errorf("validate() = %v, want valid %v", err, tc.valid)
+			}
+		})
+	}
+}
+
+func TestValidateCloneStrategies(t *testing.T) {
+	shallow := []cloneStrategyRule{{cloneStrategy: cloneStrategy{Strategy: "shallow", Depth: 1}}}
+	singleBranch := []cloneStrategyRule{{cloneStrategy: cloneStrategy{Strategy: "single-branch"}}}
+	var tests = []struct {
+		name        string
+		rules       []cloneStrategyRule
+		objectPools bool
+		format      string
+		valid       bool
+	}{
+		{"not uploaded", shallow, false, "", true},
+		{"tar archives", shallow, false, uploadFormatTar, true},
+		{"bundles", shallow, false, uploadFormatBundle, false},
+		{"incremental bundles", shallow, false, uploadFormatIncremental, false},
+		{"object pools", shallow, true, "", false},
+		{"single branch bundles", singleBranch, true, uploadFormatBundle, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateCloneStrategies(tc.rules, tc.objectPools, tc.format)
+			if (err == nil) != tc.valid {
+				t.Errorf("validateCloneStrategies() = %v, want valid %v", err, tc.valid)
+			}
+		})
+	}
+}
+
+func TestCloneStrategyFor(t *testing.T) {
+	oldCloneStrategies := cloneStrategies
+	defer func() { cloneStrategies = oldCloneStrategies }()
+	cloneStrategies = []cloneStrategyRule{
+		{Repositories: []string{"octocat/monorepo"}, cloneStrategy: cloneStrategy{Strategy: "shallow", Depth: 10}},
+		{Repositories: []string{"octocat/*"}, cloneStrategy: cloneStrategy{Strategy: "blobless"}},
+	}
+
+	var tests = []struct {
+		repo string
+		want string
+	}{
+		{"monorepo", "shallow"},
+		{"other", "blobless"},
+	}
+	for _, tc := range tests {
+		if got := cloneStrategyFor(&Repository{Namespace: "octocat", Name: tc.repo}); got.Strategy != tc.want {
+			t.Errorf("cloneStrategyFor(octocat/%s) = %q, want %q", tc.repo, got.Strategy, tc.want)
+		}
+	}
+	if got := cloneStrategyFor(&Repository{Namespace: "other", Name: "repo"}); !got.full() {
+		t.Errorf("repository matching no rule is cloned with %q", got.Strategy)
+	}
+}
+
+func TestCloneStrategyConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, defaultConfigFile)
+	os.WriteFile(configPath, []byte(`service: github
+gitlab:
+  project_membership_type: all
+clone_strategies:
+  - repositories: [octocat/monorepo]
+    strategy: shallow
+    depth: 50
+`), 0644)
+
+	c, err := buildTestConfig([]string{"-config", configPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []cloneStrategyRule{{Repositories: []string{"octocat/monorepo"}, cloneStrategy: cloneStrategy{Strategy: "shallow", Depth: 50}}}
+	if !reflect.DeepEqual(c.cloneStrategies, want) {
+		t.Errorf("clone strategies = %+v, want %+v", c.cloneStrategies, want)
+	}
+
+	// The strategy of the flags comes first
+	c, err = buildTestConfig([]string{"-config", configPath, "-clone.strategy", "single-branch", "-clone.repositories", "octocat/a,octocat/b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append([]cloneStrategyRule{{Repositories: []string{"octocat/a", "octocat/b"}, cloneStrategy: cloneStrategy{Strategy: "single-branch"}}}, want...)
+	if !reflect.DeepEqual(c.cloneStrategies, want) {
+		t.Errorf("clone strategies = %+v, want %+v", c.cloneStrategies, want)
+	}
+
+	// Bundles can't be created from shallow clones
+	c, err = buildTestConfig([]string{"-config", configPath, "-s3.endpoint", "s3.amazonaws.com", "-s3.bucket", "backups"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateConfig(c); err == nil || !strings.Contains(err.Error(), "tar archives") {
+		t.Errorf("validateConfig() with bundles = %v", err)
+	}
+}
+
+func TestBackUpCloneStrategies(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	oldFS, oldCloneStrategies := appFS, cloneStrategies
+	defer func() { appFS, cloneStrategies = oldFS, oldCloneStrategies }()
+	appFS = afero.NewOsFs()
+
+	var tests = []struct {
+		name     string
+		strategy cloneStrategy
+		bare     bool
+		// check checks the repository backed up at repoDir
+		check func(t *testing.T, repoDir string)
+	}{
+		{"shallow mirror", cloneStrategy{Strategy: "shallow", Depth: 1}, true, func(t *testing.T, repoDir string) {
+			if got := gitTest(t, "-C", repoDir, "rev-list", "--count", "feature"); got != "1" {
+				t.Errorf("shallow clone has %s commits, want 1", got)
+			}
+		}},
+		{"shallow", cloneStrategy{Strategy: "shallow", Depth: 1}, false, func(t *testing.T, repoDir string) {
+			if got := gitTest(t, "-C", repoDir, "rev-list", "--count", "HEAD"); got != "1" {
+				t.Errorf("shallow clone has %s commits, want 1", got)
+			}
+		}},
+		{"blobless mirror", cloneStrategy{Strategy: "blobless"}, true, func(t *testing.T, repoDir string) {
+			if got := gitTest(t, "-C", repoDir, "config", "remote.origin.partialclonefilter"); got != "blob:none" {
+				t.Errorf("partial clone filter = %q", got)
+			}
+		}},
+		{"single-branch mirror", cloneStrategy{Strategy: "single-branch"}, true, func(t *testing.T, repoDir string) {
+			if got := gitTest(t, "-C", repoDir, "for-each-ref", "--format=%(refname)", "refs/heads"); strings.Contains(got, "feature") {
+				t.Errorf("single-branch clone has the branches %q", got)
+			}
+		}},
+		{"single-branch", cloneStrategy{Strategy: "single-branch", Branch: "feature"}, false, func(t *testing.T, repoDir string) {
+			if got := gitTest(t, "-C", repoDir, "branch", "-r", "--format=%(refname:short)"); got != "origin/feature" {
+				t.Errorf("single-branch clone has the branches %q", got)
+			}
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// The upstream repository, cloned through file:// as git
+			// ignores --depth and --filter for local paths
+			hosted := t.TempDir()
+			work := filepath.Join(hosted, "work")
+			newTestRepository(t, work)
+			gitTest(t, "-C", work, "commit", "-q", "--allow-empty", "-m", "second")
+			gitTest(t, "-C", work, "branch", "feature")
+			upstream := filepath.Join(hosted, "repo.git")
+			gitTest(t, "clone", "-q", "--bare", work, upstream)
+			gitTest(t, "-C", upstream, "config", "uploadpack.allowFilter", "true")
+
+			backupDir := t.TempDir()
+			repo := &Repository{Namespace: "octocat", Name: "repo", CloneURL: "file://" + filepath.ToSlash(upstream)}
+			cloneStrategies = []cloneStrategyRule{{Repositories: []string{"octocat/*"}, cloneStrategy: tc.strategy}}
+			backUpRepo := func() {
+				t.Helper()
+				var wg sync.WaitGroup
+				wg.Add(1)
+				if out, err := backUp(backupDir, repo, tc.bare, &wg); err != nil {
+					t.Fatalf("backUp: %v: %s", err, out)
+				}
+			}
+			repoDir := getRepoDir(backupDir, repo, tc.bare)
+
+			backUpRepo()
+			tc.check(t, repoDir)
+			recorded, err := readCloneStrategy(repoDir, tc.bare)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if recorded.Strategy != tc.strategy.Strategy || recorded.Strategy == cloneStrategySingleBranch && recorded.Branch == "" {
+				t.Errorf("recorded clone strategy = %+v, want %+v", recorded, tc.strategy)
+			}
+
+			// The updates keep the repository as it was cloned, even once
+			// the configured strategy changes
+			branch := gitTest(t, "-C", work, "symbolic-ref", "--short", "HEAD")
+			gitTest(t, "-C", work, "commit", "-q", "--allow-empty", "-m", "third")
+			gitTest(t, "-C", work, "checkout", "-q", "feature")
+			gitTest(t, "-C", work, "commit", "-q", "--allow-empty", "-m", "feature")
+			gitTest(t, "-C", work, "branch", "other")
+			gitTest(t, "-C", work, "checkout", "-q", "other")
+			gitTest(t, "-C", work, "commit", "-q", "--allow-empty", "-m", "other")
+			gitTest(t, "-C", work, "tag", "v1")
+			gitTest(t, "-C", work, "push", "-q", upstream, branch, "feature", "other", "v1")
+			cloneStrategies = nil
+			backUpRepo()
+			tc.check(t, repoDir)
+			if !tc.bare {
+				if head, upstream := gitTest(t, "-C", repoDir, "rev-parse", "HEAD"), gitTest(t, "-C", repoDir, "rev-parse", "@{upstream}"); head != upstream {
+					t.Errorf("checkout is at %s, its upstream branch at %s", head, upstream)
+				}
+			}
+			if got := gitTest(t, "-C", repoDir, "for-each-ref", "--format=%(refname)", "refs/heads/other", "refs/remotes/origin/other"); got != "" && tc.strategy.Strategy == cloneStrategySingleBranch {
+				t.Errorf("single-branch clone fetched %s", got)
+			}
+			if got := gitTest(t, "-C", repoDir, "for-each-ref", "--format=%(refname)", "refs/tags/v1"); got != "" && tc.strategy.Strategy == cloneStrategySingleBranch {
+				t.Errorf("single-branch clone fetched the tag of another branch: %s", got)
+			}
+			gitTest(t, "-C", repoDir, "fsck", "--no-progress", "--no-dangling")
+		})
+	}
+}
+
+func TestUploadPartialBackup(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	oldFS := appFS
+	defer func() { appFS = oldFS }()
+	appFS = afero.NewOsFs()
+
+	hosted := t.TempDir()
+	work := filepath.Join(hosted, "work")
+	newTestRepository(t, work)
+	gitTest(t, "-C", work, "commit", "-q", "--allow-empty", "-m", "second")
+	branch := gitTest(t, "-C", work, "symbolic-ref", "--short", "HEAD")
+	repo := &Repository{Namespace: "octocat", Name: "repo", CloneURL: "file://" + filepath.ToSlash(work)}
+
+	var tests = []struct {
+		name     string
+		strategy cloneStrategy
+		format   string
+		// check checks the restored repository
+		check func(t *testing.T, repoDir string)
+	}{
+		{"shallow tar", cloneStrategy{Strategy: "shallow", Depth: 1}, uploadFormatTar, func(t *testing.T, repoDir string) {
+			if got := gitTest(t, "-C", repoDir, "rev-parse", "--is-shallow-repository"); got != "true" {
+				t.Errorf("restored repository isn't shallow")
+			}
+		}},
+		{"single-branch bundle", cloneStrategy{Strategy: "single-branch"}, uploadFormatBundle, func(t *testing.T, repoDir string) {
+			if got, want := gitTest(t, "-C", repoDir, "config", "remote.origin.fetch"), "+refs/heads/"+branch+":refs/heads/"+branch; got != want {
+				t.Errorf("restored repository fetches %q, want %q", got, want)
+			}
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			repoDir := filepath.Join(t.TempDir(), "octocat", "repo.git")
+			gitTest(t, append(append([]string{"clone", "-q", "--mirror"}, tc.strategy.cloneArgs()...), repo.CloneURL, repoDir)...)
+			if err := recordCloneStrategy(repoDir, true, tc.strategy); err != nil {
+				t.Fatal(err)
+			}
+			store := &fsStore{fs: afero.NewOsFs(), dir: t.TempDir(), name: "local"}
+			u := &uploader{store: store, format: tc.format, manifest: &manifest{Repositories: map[string]manifestEntry{}}}
+			if err := u.upload(repoDir, repo, true); err != nil {
+				t.Fatal(err)
+			}
+			entry := u.manifest.Repositories["octocat/repo"]
+			if entry.Clone == nil || entry.Clone.Strategy != tc.strategy.Strategy {
+				t.Fatalf("clone strategy of the upload = %+v, want %+v", entry.Clone, tc.strategy)
+			}
+			if description := describeUpload(entry); !strings.Contains(description, "partial backup: "+entry.Clone.String()) {
+				t.Errorf("upload is described as %q", description)
+			}
+
+			dest := filepath.Join(t.TempDir(), "repo.git")
+			if err := restoreRepository(context.Background(), store, &decrypter{}, entry, dest); err != nil {
+				t.Fatal(err)
+			}
+			tc.check(t, dest)
+			if recorded, err := readCloneStrategy(dest, true); err != nil || recorded.Strategy != tc.strategy.Strategy {
+				t.Errorf("restored clone strategy = %+v, %v", recorded, err)
+			}
+			if err := verifyRepository(context.Background(), store, &decrypter{}, entry); err != nil {
+				t.Errorf("verifyRepository() = %v", err)
+			}
+		})
+	}
+
+	// git bundles lack the history shallow clones don't have
+	repoDir := filepath.Join(t.TempDir(), "repo.git")
+	gitTest(t, "clone", "-q", "--mirror", "--depth", "1", repo.CloneURL, repoDir)
+	recordCloneStrategy(repoDir, true, cloneStrategy{Strategy: "shallow", Depth: 1})
+	u := &uploader{store: &fsStore{fs: afero.NewOsFs(), dir: t.TempDir(), name: "local"}, format: uploadFormatBundle, manifest: &manifest{Repositories: map[string]manifestEntry{}}}
+	if err := u.upload(repoDir, repo, true); err == nil || !strings.Contains(err.Error(), "tar archive") {
+		t.Errorf("upload() of a shallow clone as a bundle = %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The orders in which repositories can be backed up
+const (
+	orderListed   = "listed"
+	orderPushed   = "pushed"
+	orderLargest  = "largest"
+	orderSmallest = "smallest"
+)
+
+var validOrders = []string{orderListed, orderPushed, orderLargest, orderSmallest}
+
+// cloneLimiter limits the number of concurrent clones, both overall and
+// for individual git hosts
+type cloneLimiter struct {
+	global chan bool
+
+	mu      sync.Mutex
+	perHost map[string]*hostQueue
+}
+
+// hostQueue holds the clones of a host waiting for one of its slots
+type hostQueue struct {
+	limit   int
+	running int
+	waiting []func()
+}
+
+func newCloneLimiter(maxConcurrent int, perHost map[string]int) *cloneLimiter {
+	if maxConcurrent <= 0 {
+		maxConcurrent = MaxConcurrentClones
+	}
+	l := cloneLimiter{
+		global:  make(chan bool, maxConcurrent),
+		perHost: make(map[string]*hostQueue),
+	}
+	for host, limit := range perHost {
+		if limit > 0 {
+			l.perHost[strings.ToLower(host)] = &hostQueue{limit: limit}
+		}
+	}
+	return &l
+}
+
+// run runs clone in a goroutine once a clone of a repository on host may
+// start. A clone waiting for a slot of a busy host is queued and doesn't
+// take a global slot, so run only blocks until a global slot is free, and
+// never on a single host: the repositories of the other hosts can use the
+// global slots meanwhile.
+func (l *cloneLimiter) run(host string, clone func()) {
+	l.mu.Lock()
+	q, ok := l.perHost[strings.ToLower(host)]
+	if ok && q.running == q.limit {
+		q.waiting = append(q.waiting, clone)
+		l.mu.Unlock()
+		return
+	}
+	if ok {
+		q.running++
+	}
+	l.mu.Unlock()
+
+	l.global <- true
+	go l.start(q, clone)
+}
+
+// start runs clone, which has a global slot and a slot of its host, then
+// the clones waiting for the host, which get its slot
+func (l *cloneLimiter) start(q *hostQueue, clone func()) {
+	for clone != nil {
+		clone()
+		<-l.global
+		if q == nil {
+			return
+		}
+		l.mu.Lock()
+		clone = nil
+		if len(q.waiting) > 0 {
+			clone, q.waiting = q.waiting[0], q.waiting[1:]
+		} else {
+			q.running--
+		}
+		l.mu.Unlock()
+		if clone != nil {
+			l.global <- true
+		}
+	}
+}
+
+// cloneURLHost returns the host name of a clone URL. Both URLs
+// (https://host/path, ssh://git@host:22/path) and the scp-like syntax
+// used for SSH (git@host:path) are understood.
+func cloneURLHost(cloneURL string) string {
+	if strings.Contains(cloneURL, "://") {
+		u, err := url.Parse(cloneURL)
+		if err != nil {
+			return ""
+		}
+		return u.Hostname()
+	}
+	hostPath := cloneURL
+	if i := strings.Index(hostPath, "@"); i != -1 {
+		hostPath = hostPath[i+1:]
+	}
+	if i := strings.Index(hostPath, ":"); i != -1 {
+		return hostPath[:i]
+	}
+	return ""
+}
+
+// parsePerHostConcurrency parses the per host concurrency limits
+// specified as host1=N,host2=M
+func parsePerHostConcurrency(value string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		host, limit, found := strings.Cut(item, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid per host concurrency %q (expected host=N)", item)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(limit))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid per host concurrency %q (expected a positive number)", item)
+		}
+		limits[strings.TrimSpace(host)] = n
+	}
+	return limits, nil
+}
+
+// sortRepositories orders the repositories according to the given order.
+// Repositories without the information needed for ordering are backed up
+// last, in the order they were listed.
+func sortRepositories(repos []*Repository, order string) {
+	switch order {
+	case orderPushed:
+		sort.SliceStable(repos, func(i, j int) bool {
+			return repos[i].PushedAt.After(repos[j].PushedAt)
+		})
+	case orderLargest:
+		sort.SliceStable(repos, func(i, j int) bool {
+			return repos[i].Size > repos[j].Size
+		})
+	case orderSmallest:
+		sort.SliceStable(repos, func(i, j int) bool {
+			if repos[i].Size == 0 || repos[j].Size == 0 {
+				return repos[j].Size == 0 && repos[i].Size != 0
+			}
+			return repos[i].Size < repos[j].Size
+		})
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 // appConfig holds the application configuration
 type appConfig struct {
+	// name of the target in the config file, if any
+	name          string
 	service       string
 	gitHostURL    string
 	backupDir     string
@@ -9,10 +11,52 @@ type appConfig struct {
 	ignoreFork    bool
 	useHTTPSClone bool
 	bare          bool
+	// whether forks share their objects through object pools
+	objectPools bool
+	verbose     bool
+	events      string
+	noProgress  bool
+	// cron-style schedule of the target in daemon mode
+	schedule string
+
+	// How the repositories are cloned, the first rule matching a
+	// repository applies to it
+	cloneStrategies []cloneStrategyRule
+
+	// Where the credentials for the git host come from
+	credentials credentialsConfig
+
+	// TLS, proxy and timeout settings for the git host
+	http httpConfig
+	// SSH key, host key and port settings for the SSH clones
+	ssh sshConfig
+	// Storage the backups are uploaded to, one at most
+	s3     s3Config
+	sftp   sftpConfig
+	webdav webdavConfig
+	// Keys the uploads are encrypted with
+	encryption encryptionConfig
+	// git maintenance of the repositories after they are updated
+	maintenance maintenanceConfig
+	// Who is told about the runs
+	notifications notificationsConfig
+	// Secret of the push webhooks received by serve-webhooks
+	pushWebhooks pushWebhooksConfig
+	// Basic authentication and access rules of gitbackup serve
+	serve serveConfig
+
+	// Concurrency and scheduling of the clones
+	maxConcurrentClones int
+	perHostConcurrency  map[string]int
+	order               string
+	bandwidthLimit      string
 
 	// GitHub specific configuration
 	githubRepoType                    string
+	githubAPIURL                      string
+	githubUploadURL                   string
 	githubNamespaceWhitelist          []string
+	githubApp                         githubAppConfig
 	githubCreateUserMigration         bool
 	githubCreateUserMigrationRetry    bool
 	githubCreateUserMigrationRetryMax int
@@ -36,6 +36,8 @@ func resolveConfigPath(configPath string) (string, error) {
 // Migration-related flags are intentionally excluded as they
 // are one-off operations better suited to CLI flags.
 type fileConfig struct {
+	// Name identifies a target in the targets list
+	Name          string        `yaml:"name,omitempty"`
 	Service       string        `yaml:"service"`
 	GitHostURL    string        `yaml:"githost_url"`
 	BackupDir     string        `yaml:"backup_dir"`
@@ -43,14 +45,93 @@ type fileConfig struct {
 	IgnoreFork    bool          `yaml:"ignore_fork"`
 	UseHTTPSClone bool          `yaml:"use_https_clone"`
 	Bare          bool          `yaml:"bare"`
+	ObjectPools   bool          `yaml:"object_pools,omitempty"`
 	GitHub        githubConfig  `yaml:"github"`
 	GitLab        gitlabConfig  `yaml:"gitlab"`
 	Forgejo       forgejoConfig `yaml:"forgejo"`
+
+	// How the repositories are cloned, e.g. shallow clones of the
+	// largest ones
+	CloneStrategies []cloneStrategyRule `yaml:"clone_strategies,omitempty"`
+
+	Concurrency    concurrencyConfig `yaml:"concurrency"`
+	Order          string            `yaml:"order"`
+	BandwidthLimit string            `yaml:"bandwidth_limit"`
+	// Schedule of the backups in daemon mode, e.g. "0 3 * * *"
+	Schedule string `yaml:"schedule,omitempty"`
+
+	Credentials credentialsConfig `yaml:"credentials,omitempty"`
+	HTTP        httpConfig        `yaml:"http,omitempty"`
+	SSH         sshConfig         `yaml:"ssh,omitempty"`
+	S3          s3Config          `yaml:"s3,omitempty"`
+	SFTP        sftpConfig        `yaml:"sftp,omitempty"`
+	WebDAV      webdavConfig      `yaml:"webdav,omitempty"`
+	Encryption  encryptionConfig  `yaml:"encryption,omitempty"`
+	Maintenance maintenanceConfig `yaml:"maintenance,omitempty"`
+
+	Notifications notificationsConfig `yaml:"notifications,omitempty"`
+	PushWebhooks  pushWebhooksConfig  `yaml:"push_webhooks,omitempty"`
+	Serve         serveConfig         `yaml:"serve,omitempty"`
+
+	// Targets lists the git hosts/accounts to back up in one run. Each
+	// target is decoded over the top level settings, so it only needs
+	// to specify what differs.
+	Targets []yaml.Node `yaml:"targets,omitempty"`
+}
+
+// targets returns the configuration of each target, or the top level
+// configuration if no targets are listed
+func (fc *fileConfig) targets() ([]fileConfig, error) {
+	if len(fc.Targets) == 0 {
+		return []fileConfig{*fc}, nil
+	}
+
+	var targets []fileConfig
+	names := map[string]bool{}
+	for i, node := range fc.Targets {
+		t := *fc
+		t.Name = ""
+		t.Targets = nil
+		// Maps would be merged into the top level ones otherwise
+		t.Concurrency.PerHost = make(map[string]int)
+		for host, limit := range fc.Concurrency.PerHost {
+			t.Concurrency.PerHost[host] = limit
+		}
+		// and so would pointers
+		if fc.Notifications.Email != nil {
+			email := *fc.Notifications.Email
+			t.Notifications.Email = &email
+		}
+		if err := node.Decode(&t); err != nil {
+			return nil, fmt.Errorf("error parsing target %d: %v", i+1, err)
+		}
+		if len(t.Targets) != 0 {
+			return nil, fmt.Errorf("target %d: targets can't be nested", i+1)
+		}
+		if t.Name == "" {
+			t.Name = fmt.Sprintf("%s-%d", t.Service, i+1)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("duplicate target name: %q", t.Name)
+		}
+		names[t.Name] = true
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+type concurrencyConfig struct {
+	Max     int            `yaml:"max"`
+	PerHost map[string]int `yaml:"per_host"`
 }
 
 type githubConfig struct {
 	RepoType           string   `yaml:"repo_type"`
 	NamespaceWhitelist []string `yaml:"namespace_whitelist"`
+	// GitHub Enterprise Server: derived from githost_url if not set
+	APIURL    string          `yaml:"api_url,omitempty"`
+	UploadURL string          `yaml:"upload_url,omitempty"`
+	App       githubAppConfig `yaml:"app,omitempty"`
 }
 
 type gitlabConfig struct {
@@ -83,6 +164,12 @@ func defaultFileConfig() fileConfig {
 		Forgejo: forgejoConfig{
 			RepoType: "user",
 		},
+		Concurrency: concurrencyConfig{
+			Max:     MaxConcurrentClones,
+			PerHost: map[string]int{},
+		},
+		Order:          orderListed,
+		BandwidthLimit: "",
 	}
 }
 
@@ -125,7 +212,7 @@ func handleInitConfig(configPath string) error {
 // Migration-related fields are left at their zero values since they
 // are CLI-only flags.
 func fileConfigToAppConfig(fc *fileConfig) *appConfig {
-	return &appConfig{
+	c := appConfig{
 		service:                     fc.Service,
 		gitHostURL:                  fc.GitHostURL,
 		backupDir:                   fc.BackupDir,
@@ -133,12 +220,43 @@ func fileConfigToAppConfig(fc *fileConfig) *appConfig {
 		ignoreFork:                  fc.IgnoreFork,
 		useHTTPSClone:               fc.UseHTTPSClone,
 		bare:                        fc.Bare,
+		objectPools:                 fc.ObjectPools,
+		cloneStrategies:             fc.CloneStrategies,
 		githubRepoType:              fc.GitHub.RepoType,
 		githubNamespaceWhitelist:    fc.GitHub.NamespaceWhitelist,
+		githubAPIURL:                fc.GitHub.APIURL,
+		githubUploadURL:             fc.GitHub.UploadURL,
+		githubApp:                   fc.GitHub.App,
 		gitlabProjectVisibility:     fc.GitLab.ProjectVisibility,
 		gitlabProjectMembershipType: fc.GitLab.ProjectMembershipType,
 		forgejoRepoType:             fc.Forgejo.RepoType,
+		maxConcurrentClones:         fc.Concurrency.Max,
+		perHostConcurrency:          fc.Concurrency.PerHost,
+		order:                       fc.Order,
+		bandwidthLimit:              fc.BandwidthLimit,
+		name:                        fc.Name,
+		credentials:                 fc.Credentials,
+		http:                        fc.HTTP,
+		ssh:                         fc.SSH,
+		s3:                          fc.S3,
+		sftp:                        fc.SFTP,
+		webdav:                      fc.WebDAV,
+		encryption:                  fc.Encryption,
+		maintenance:                 fc.Maintenance,
+		schedule:                    fc.Schedule,
+		notifications:               fc.Notifications,
+		pushWebhooks:                fc.PushWebhooks,
+		serve:                       fc.Serve,
+	}
+
+	// Config files written before these settings existed
+	if c.maxConcurrentClones == 0 {
+		c.maxConcurrentClones = MaxConcurrentClones
 	}
+	if c.order == "" {
+		c.order = orderListed
+	}
+	return &c
 }
 
 // loadConfigFile reads and parses the config file at the given path,
@@ -175,63 +293,143 @@ func handleValidateConfig(configPath string) error {
 		return err
 	}
 
+	targets, err := cfg.targets()
+	if err != nil {
+		return err
+	}
+
+	var errors []string
+	for _, t := range targets {
+		prefix := ""
+		if len(cfg.Targets) != 0 {
+			prefix = fmt.Sprintf("target %s: ", t.Name)
+		}
+		for _, e := range validateFileConfig(&t) {
+			errors = append(errors, prefix+e)
+		}
+	}
+
+	if len(errors) > 0 {
+		fmt.Println("Validation errors:")
+		for _, e := range errors {
+			fmt.Printf("  - %s\n", e)
+		}
+		return fmt.Errorf("config validation failed")
+	}
+
+	fmt.Printf("%s is valid\n", path)
+	return nil
+}
+
+// validateFileConfig validates the settings of a single target and
+// returns the problems found
+func validateFileConfig(t *fileConfig) []string {
 	var errors []string
 
 	// Validate service
-	if _, ok := knownServices[cfg.Service]; !ok {
-		errors = append(errors, fmt.Sprintf("invalid service: %q (must be github, gitlab, bitbucket, or forgejo)", cfg.Service))
+	if _, ok := knownServices[t.Service]; !ok {
+		errors = append(errors, fmt.Sprintf("invalid service: %q (must be github, gitlab, bitbucket, or forgejo)", t.Service))
 	}
 
 	// Validate service-specific field values
-	switch cfg.Service {
+	switch t.Service {
 	case "github":
-		if !contains([]string{"all", "owner", "member", "starred"}, cfg.GitHub.RepoType) {
-			errors = append(errors, fmt.Sprintf("invalid github.repo_type: %q (must be all, owner, member, or starred)", cfg.GitHub.RepoType))
+		if !contains([]string{"all", "owner", "member", "starred"}, t.GitHub.RepoType) {
+			errors = append(errors, fmt.Sprintf("invalid github.repo_type: %q (must be all, owner, member, or starred)", t.GitHub.RepoType))
 		}
 	case "gitlab":
-		if !contains([]string{"internal", "public", "private"}, cfg.GitLab.ProjectVisibility) {
-			errors = append(errors, fmt.Sprintf("invalid gitlab.project_visibility: %q (must be internal, public, or private)", cfg.GitLab.ProjectVisibility))
+		if !contains([]string{"internal", "public", "private"}, t.GitLab.ProjectVisibility) {
+			errors = append(errors, fmt.Sprintf("invalid gitlab.project_visibility: %q (must be internal, public, or private)", t.GitLab.ProjectVisibility))
 		}
-		if !validGitlabProjectMembership(cfg.GitLab.ProjectMembershipType) {
-			errors = append(errors, fmt.Sprintf("invalid gitlab.project_membership_type: %q (must be all, owner, member, or starred)", cfg.GitLab.ProjectMembershipType))
+		if !validGitlabProjectMembership(t.GitLab.ProjectMembershipType) {
+			errors = append(errors, fmt.Sprintf("invalid gitlab.project_membership_type: %q (must be all, owner, member, or starred)", t.GitLab.ProjectMembershipType))
 		}
 	case "forgejo":
-		if !contains([]string{"user", "starred"}, cfg.Forgejo.RepoType) {
-			errors = append(errors, fmt.Sprintf("invalid forgejo.repo_type: %q (must be user or starred)", cfg.Forgejo.RepoType))
+		if !contains([]string{"user", "starred"}, t.Forgejo.RepoType) {
+			errors = append(errors, fmt.Sprintf("invalid forgejo.repo_type: %q (must be user or starred)", t.Forgejo.RepoType))
 		}
 	}
 
-	// Validate required environment variables
-	switch cfg.Service {
-	case "github":
-		if os.Getenv("GITHUB_TOKEN") == "" {
-			errors = append(errors, "GITHUB_TOKEN environment variable not set")
-		}
-	case "gitlab":
-		if os.Getenv("GITLAB_TOKEN") == "" {
-			errors = append(errors, "GITLAB_TOKEN environment variable not set")
+	// Validate concurrency and scheduling settings
+	if t.Concurrency.Max < 0 {
+		errors = append(errors, fmt.Sprintf("invalid concurrency.max: %d (must be a positive number)", t.Concurrency.Max))
+	}
+	for host, limit := range t.Concurrency.PerHost {
+		if limit <= 0 {
+			errors = append(errors, fmt.Sprintf("invalid concurrency.per_host for %s: %d (must be a positive number)", host, limit))
 		}
-	case "bitbucket":
-		if os.Getenv("BITBUCKET_USERNAME") == "" {
-			errors = append(errors, "BITBUCKET_USERNAME environment variable not set")
+	}
+	if t.Order != "" && !contains(validOrders, t.Order) {
+		errors = append(errors, fmt.Sprintf("invalid order: %q (must be listed, pushed, largest, or smallest)", t.Order))
+	}
+	if _, err := parseByteSize(t.BandwidthLimit); err != nil {
+		errors = append(errors, fmt.Sprintf("invalid bandwidth_limit: %v", err))
+	}
+	if t.Schedule != "" {
+		if _, err := parseSchedule(t.Schedule); err != nil {
+			errors = append(errors, err.Error())
 		}
-		if os.Getenv("BITBUCKET_TOKEN") == "" && os.Getenv("BITBUCKET_PASSWORD") == "" {
-			errors = append(errors, "BITBUCKET_TOKEN or BITBUCKET_PASSWORD environment variable must be set")
+	}
+	if err := t.SSH.validate(); err != nil {
+		errors = append(errors, fmt.Sprintf("invalid ssh settings: %v", err))
+	}
+	if err := t.S3.validate(); err != nil {
+		errors = append(errors, fmt.Sprintf("invalid s3 settings: %v", err))
+	}
+	if err := t.SFTP.validate(); err != nil {
+		errors = append(errors, fmt.Sprintf("invalid sftp settings: %v", err))
+	}
+	if err := t.WebDAV.validate(); err != nil {
+		errors = append(errors, fmt.Sprintf("invalid webdav settings: %v", err))
+	}
+	if err := t.Encryption.validate(); err != nil {
+		errors = append(errors, fmt.Sprintf("invalid encryption settings: %v", err))
+	}
+	if err := validateCloneStrategies(t.CloneStrategies, false, ""); err != nil {
+		errors = append(errors, fmt.Sprintf("invalid clone_strategies: %v", err))
+	}
+	if err := t.Maintenance.validate(); err != nil {
+		errors = append(errors, fmt.Sprintf("invalid maintenance settings: %v", err))
+	}
+	if err := t.Notifications.validate(); err != nil {
+		errors = append(errors, fmt.Sprintf("invalid notifications settings: %v", err))
+	}
+	if t.PushWebhooks.SecretEnv != "" && t.PushWebhooks.SecretFile != "" {
+		errors = append(errors, "push_webhooks needs either secret_env or secret_file, not both")
+	}
+	if err := t.Serve.validate(); err != nil {
+		errors = append(errors, fmt.Sprintf("invalid serve settings: %v", err))
+	}
+	if err := t.HTTP.validate(); err != nil {
+		errors = append(errors, fmt.Sprintf("invalid http settings: %v", err))
+	} else if _, err := t.HTTP.tlsConfig(); err != nil {
+		errors = append(errors, fmt.Sprintf("invalid http settings: %v", err))
+	}
+
+	if t.Service == "github" && t.GitHub.App.enabled() {
+		if !t.UseHTTPSClone {
+			errors = append(errors, "github.app needs use_https_clone, installation tokens can't authenticate SSH clones")
 		}
-	case "forgejo":
-		if os.Getenv("FORGEJO_TOKEN") == "" {
-			errors = append(errors, "FORGEJO_TOKEN environment variable not set")
+		if t.GitHub.App.AppID == 0 || t.GitHub.App.PrivateKeyFile == "" {
+			errors = append(errors, "github.app needs both app_id and private_key_file")
+		} else if keyPath, err := expandHome(t.GitHub.App.PrivateKeyFile); err != nil {
+			errors = append(errors, fmt.Sprintf("invalid github.app.private_key_file: %v", err))
+		} else if _, err := os.Stat(keyPath); err != nil {
+			errors = append(errors, fmt.Sprintf("invalid github.app.private_key_file: %v", err))
 		}
 	}
 
-	if len(errors) > 0 {
-		fmt.Println("Validation errors:")
-		for _, e := range errors {
-			fmt.Printf("  - %s\n", e)
+	// Validate that the credentials can be found. A GitHub App mints
+	// its own tokens.
+	githubApp := t.Service == "github" && t.GitHub.App.enabled()
+	if _, ok := knownServices[t.Service]; ok && !githubApp {
+		cred, err := resolveCredentials(t.Service, credentialHost(t.Service, t.GitHostURL), t.Credentials)
+		if err != nil {
+			errors = append(errors, err.Error())
+		} else if t.Service == "bitbucket" && cred.Username == "" {
+			errors = append(errors, "BITBUCKET_EMAIL or BITBUCKET_USERNAME environment variable (or credentials.username) not set")
 		}
-		return fmt.Errorf("config validation failed")
 	}
 
-	fmt.Printf("%s is valid\n", path)
-	return nil
+	return errors
 }
@@ -5,22 +5,32 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/urfave/cli/v2"
 	"gopkg.in/yaml.v3"
 )
 
 // buildTestConfig creates a minimal cli.App with appFlags(), runs it with the
-// given args, and returns the appConfig produced by buildConfig.
+// given args, and returns the first appConfig produced by buildConfigs.
 func buildTestConfig(args []string) (*appConfig, error) {
-	var result *appConfig
+	configs, err := buildTestConfigs(args)
+	if err != nil {
+		return nil, err
+	}
+	return configs[0], nil
+}
+
+// buildTestConfigs returns all the appConfigs produced by buildConfigs
+func buildTestConfigs(args []string) ([]*appConfig, error) {
+	var result []*appConfig
 	var buildErr error
 
 	app := &cli.App{
 		Name:  "gitbackup",
 		Flags: appFlags(),
 		Action: func(cCtx *cli.Context) error {
-			result, buildErr = buildConfig(cCtx)
+			result, buildErr = buildConfigs(cCtx)
 			return buildErr
 		},
 	}
@@ -232,3 +242,245 @@ func TestHandleValidateConfigInvalidRepoType(t *testing.T) {
 		t.Fatal("Expected validation error for invalid repo_type")
 	}
 }
+
+func TestInitConfigConcurrencySettings(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, defaultConfigFile)
+
+	os.WriteFile(configPath, []byte("service: gitlab\nconcurrency:\n  max: 8\n  per_host:\n    gitlab.example.com: 2\norder: pushed\nbandwidth_limit: 10M\n"), 0644)
+
+	c, err := buildTestConfig([]string{"-config", configPath})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if c.maxConcurrentClones != 8 {
+		t.Errorf("Expected concurrency 8, got: %v", c.maxConcurrentClones)
+	}
+	if c.perHostConcurrency["gitlab.example.com"] != 2 {
+		t.Errorf("Expected per host concurrency of 2, got: %v", c.perHostConcurrency)
+	}
+	if c.order != orderPushed {
+		t.Errorf("Expected order 'pushed', got: %v", c.order)
+	}
+	if c.bandwidthLimit != "10M" {
+		t.Errorf("Expected bandwidth limit '10M', got: %v", c.bandwidthLimit)
+	}
+
+	// CLI flags override the config file
+	c, err = buildTestConfig([]string{"-config", configPath, "-concurrency", "4", "-concurrency.perHost", "gitlab.example.com=1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if c.maxConcurrentClones != 4 || c.perHostConcurrency["gitlab.example.com"] != 1 {
+		t.Errorf("Expected CLI flags to override the config file, got: %v %v", c.maxConcurrentClones, c.perHostConcurrency)
+	}
+
+	// Config files without these settings get the defaults
+	os.WriteFile(configPath, []byte("service: gitlab\n"), 0644)
+	c, err = buildTestConfig([]string{"-config", configPath})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if c.maxConcurrentClones != MaxConcurrentClones || c.order != orderListed {
+		t.Errorf("Expected default concurrency and order, got: %v %v", c.maxConcurrentClones, c.order)
+	}
+}
+
+func TestInitConfigHTTPSettings(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, defaultConfigFile)
+
+	os.WriteFile(configPath, []byte("service: gitlab\nhttp:\n  ca_file: /etc/ssl/internal-ca.pem\n  proxy: http://proxy.example.com:3128\n  timeout: 30s\n"), 0644)
+
+	c, err := buildTestConfig([]string{"-config", configPath})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	expected := httpConfig{CAFile: "/etc/ssl/internal-ca.pem", Proxy: "http://proxy.example.com:3128", Timeout: 30 * time.Second}
+	if c.http != expected {
+		t.Errorf("Expected HTTP settings %+v, got: %+v", expected, c.http)
+	}
+
+	// CLI flags override the config file
+	c, err = buildTestConfig([]string{"-config", configPath, "-http.timeout", "1m", "-http.insecureSkipVerify"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if c.http.Timeout != time.Minute || !c.http.InsecureSkipVerify || c.http.CAFile != expected.CAFile {
+		t.Errorf("Expected CLI flags to override the config file, got: %+v", c.http)
+	}
+
+	// The client certificate needs its key
+	c, err = buildTestConfig([]string{"-config", configPath, "-http.clientCert", "client.crt"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := validateConfig(c); err == nil {
+		t.Error("Expected an error for a client certificate without a key")
+	}
+}
+
+func TestHandleValidateConfigInvalidConcurrency(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, defaultConfigFile)
+
+	os.WriteFile(configPath, []byte("service: github\nconcurrency:\n  per_host:\n    github.com: 0\norder: random\n"), 0644)
+	os.Setenv("GITHUB_TOKEN", "testtoken")
+	defer os.Unsetenv("GITHUB_TOKEN")
+
+	err := handleValidateConfig(configPath)
+	if err == nil {
+		t.Fatal("Expected validation error for invalid concurrency settings")
+	}
+}
+
+func TestInitConfigTargets(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, defaultConfigFile)
+
+	config := `service: github
+ignore_fork: true
+concurrency:
+  per_host:
+    github.com: 4
+notifications:
+  chat:
+    - url: https://hooks.slack.com/services/T000/B000/XXXX
+  email:
+    host: smtp.example.com
+    from: gitbackup@example.com
+    to: [ops@example.com]
+targets:
+  - name: personal
+  - name: work-gitlab
+    service: gitlab
+    githost_url: https://gitlab.example.com
+    notifications:
+      when: always
+      email:
+        to: [gitlab-admins@example.com]
+    concurrency:
+      per_host:
+        gitlab.example.com: 2
+    credentials:
+      token_file: /run/secrets/gitlab
+  - service: forgejo
+    ignore_fork: false
+`
+	os.WriteFile(configPath, []byte(config), 0644)
+
+	configs, err := buildTestConfigs([]string{"-config", configPath, "-backupdir", tmpDir})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(configs) != 3 {
+		t.Fatalf("Expected 3 targets, got %d", len(configs))
+	}
+
+	personal, work, forgejo := configs[0], configs[1], configs[2]
+	if personal.name != "personal" || personal.service != "github" || !personal.ignoreFork {
+		t.Errorf("Expected the personal target to inherit the top level settings, got %+v", personal)
+	}
+	if work.service != "gitlab" || !work.ignoreFork || work.credentials.TokenFile != "/run/secrets/gitlab" {
+		t.Errorf("Unexpected work target: %+v", work)
+	}
+	if work.perHostConcurrency["github.com"] != 4 || work.perHostConcurrency["gitlab.example.com"] != 2 {
+		t.Errorf("Expected the per host limits to be merged, got %v", work.perHostConcurrency)
+	}
+	if _, ok := personal.perHostConcurrency["gitlab.example.com"]; ok {
+		t.Errorf("Target settings leaked into another target: %v", personal.perHostConcurrency)
+	}
+	if work.backupDir != filepath.Join(tmpDir, "gitlab.example.com") {
+		t.Errorf("Unexpected backup dir: %s", work.backupDir)
+	}
+	if work.notifications.When != notifyAlways || len(work.notifications.Chat) != 1 ||
+		work.notifications.Email.Host != "smtp.example.com" || work.notifications.Email.To[0] != "gitlab-admins@example.com" {
+		t.Errorf("Expected the notifications to be merged, got %+v", work.notifications)
+	}
+	if personal.notifications.When != "" || personal.notifications.Email.To[0] != "ops@example.com" {
+		t.Errorf("Target settings leaked into another target: %+v", personal.notifications)
+	}
+	if forgejo.name != "forgejo-3" || forgejo.ignoreFork {
+		t.Errorf("Unexpected forgejo target: %+v", forgejo)
+	}
+
+	// A single target can be selected
+	configs, err = buildTestConfigs([]string{"-config", configPath, "-backupdir", tmpDir, "-target", "work-gitlab"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(configs) != 1 || configs[0].name != "work-gitlab" {
+		t.Errorf("Expected only the work-gitlab target, got %v", configs)
+	}
+	_, err = buildTestConfigs([]string{"-config", configPath, "-backupdir", tmpDir, "-target", "nope"})
+	if err == nil {
+		t.Error("Expected an error for an unknown target")
+	}
+}
+
+func TestHandleValidateConfigTargets(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, defaultConfigFile)
+	tokenFile := filepath.Join(tmpDir, "token")
+	os.WriteFile(tokenFile, []byte("secret"), 0600)
+
+	config := fmt.Sprintf(`service: gitlab
+targets:
+  - name: one
+    credentials:
+      token_file: %s
+  - name: one
+`, tokenFile)
+	os.WriteFile(configPath, []byte(config), 0644)
+	if err := handleValidateConfig(configPath); err == nil {
+		t.Error("Expected validation error for duplicate target names")
+	}
+
+	config = fmt.Sprintf(`service: gitlab
+gitlab:
+  project_visibility: internal
+  project_membership_type: all
+targets:
+  - name: one
+    credentials:
+      token_file: %s
+`, tokenFile)
+	os.WriteFile(configPath, []byte(config), 0644)
+	if err := handleValidateConfig(configPath); err != nil {
+		t.Errorf("Expected valid config, got: %v", err)
+	}
+
+	config = `service: gitlab
+targets:
+  - name: one
+    credentials:
+      token_file: /does/not/exist
+`
+	os.WriteFile(configPath, []byte(config), 0644)
+	if err := handleValidateConfig(configPath); err == nil {
+		t.Error("Expected validation error for a missing token file")
+	}
+}
+
+func TestHandleValidateConfigGitHubAppKeyInHome(t *testing.T) {
+	homeDir := t.TempDir()
+	oldHomeDir := gethomeDir
+	defer func() { gethomeDir = oldHomeDir }()
+	gethomeDir = func() (string, error) {
+		return homeDir, nil
+	}
+	os.MkdirAll(filepath.Join(homeDir, ".config", "gitbackup"), 0700)
+	os.WriteFile(filepath.Join(homeDir, ".config", "gitbackup", "app.pem"), []byte("key"), 0600)
+
+	configPath := filepath.Join(t.TempDir(), defaultConfigFile)
+	config := "service: github\nuse_https_clone: true\ngithub:\n  repo_type: all\n  app:\n    app_id: 1234\n    private_key_file: %s\ngitlab:\n  project_membership_type: all\n"
+	os.WriteFile(configPath, []byte(fmt.Sprintf(config, "~/.config/gitbackup/app.pem")), 0644)
+	if err := handleValidateConfig(configPath); err != nil {
+		t.Fatalf("Expected the key in the home directory to be found, got: %v", err)
+	}
+
+	os.WriteFile(configPath, []byte(fmt.Sprintf(config, "~/.config/gitbackup/missing.pem")), 0644)
+	if err := handleValidateConfig(configPath); err == nil {
+		t.Fatalf("Expected an error about the missing key, got: %v", err)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// credentialsConfig configures where the credentials of a target come
+// from. Each source which is configured is tried in turn: the environment
+// variable, the token file, the token command, the keyring and .netrc.
+// When none is configured, the service's environment variables, the
+// keyring and .netrc are tried.
+type credentialsConfig struct {
+	// Username for services which need one along with the token
+	// (Bitbucket), overriding BITBUCKET_EMAIL/BITBUCKET_USERNAME
+	Username string `yaml:"username,omitempty"`
+	// Environment variable holding the token instead of the service's
+	// default one (e.g. GITLAB_TOKEN)
+	TokenEnv string `yaml:"token_env,omitempty"`
+	// File holding the token
+	TokenFile string `yaml:"token_file,omitempty"`
+	// Command printing the token on the first line of its output
+	TokenCommand string `yaml:"token_command,omitempty"`
+	// Look the token up in the OS keyring
+	Keyring bool `yaml:"keyring,omitempty"`
+	// Key of the token in the keyring (default: <SERVICE>_TOKEN)
+	KeyringKey string `yaml:"keyring_key,omitempty"`
+	// Look the credentials up in .netrc
+	Netrc bool `yaml:"netrc,omitempty"`
+	// Path to the .netrc file (default: $NETRC or ~/.netrc)
+	NetrcFile string `yaml:"netrc_file,omitempty"`
+}
+
+// isZero reports whether no credential source has been configured
+func (cc credentialsConfig) isZero() bool {
+	return cc.TokenEnv == "" && cc.TokenFile == "" && cc.TokenCommand == "" &&
+		!cc.Keyring && cc.KeyringKey == "" && !cc.Netrc && cc.NetrcFile == ""
+}
+
+// credential is a resolved set of credentials for a git host
+type credential struct {
+	Username string
+	Token    string
+	// Where the token came from, for the diagnostics
+	Source string
+}
+
+// The environment variables holding the token and the username of each
+// service, in order of preference
+var serviceTokenEnvVars = map[string][]string{
+	"github":    {"GITHUB_TOKEN"},
+	"gitlab":    {"GITLAB_TOKEN"},
+	"bitbucket": {"BITBUCKET_TOKEN", "BITBUCKET_PASSWORD"},
+	"forgejo":   {"FORGEJO_TOKEN"},
+}
+
+var serviceUsernameEnvVars = map[string][]string{
+	"bitbucket": {"BITBUCKET_EMAIL", "BITBUCKET_USERNAME"},
+}
+
+// errNoCredentials is returned when none of the credential sources has a
+// token for the target
+var errNoCredentials = errors.New("no credentials found")
+
+// We have it here so that we can override it in the tests
+var keyringGetToken = getToken
+
+// resolveCredentials looks up the credentials for service on host using
+// the configured sources
+func resolveCredentials(service, host string, cc credentialsConfig) (*credential, error) {
+	useDefaults := cc.isZero()
+	var tried []string
+	var cred *credential
+
+	envVars := serviceTokenEnvVars[service]
+	if cc.TokenEnv != "" {
+		envVars = []string{cc.TokenEnv}
+	}
+	if useDefaults || cc.TokenEnv != "" {
+		for _, name := range envVars {
+			tried = append(tried, "$"+name)
+			if token := os.Getenv(name); token != "" {
+				cred = &credential{Token: token, Source: "environment variable " + name}
+				break
+			}
+		}
+	}
+
+	if cred == nil && cc.TokenFile != "" {
+		tried = append(tried, "token_file")
+		token, err := readTokenFile(cc.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		cred = &credential{Token: token, Source: "token file " + cc.TokenFile}
+	}
+
+	if cred == nil && cc.TokenCommand != "" {
+		tried = append(tried, "token_command")
+		token, err := runTokenCommand(cc.TokenCommand)
+		if err != nil {
+			return nil, err
+		}
+		cred = &credential{Token: token, Source: "token command"}
+	}
+
+	if cred == nil && (useDefaults || cc.Keyring || cc.KeyringKey != "") {
+		key := keyringKey(service, cc)
+		tried = append(tried, "keyring")
+		if token, err := keyringToken(key); err == nil && token != "" {
+			cred = &credential{Token: token, Source: "keyring"}
+		} else if errors.Is(err, errLoginExpired) {
+			return nil, err
+		} else if err != nil {
+			slog.Debug("Token not found in the keyring", "key", key+"_TOKEN", "error", err)
+		}
+	}
+
+	if cred == nil && (useDefaults || cc.Netrc || cc.NetrcFile != "") {
+		tried = append(tried, ".netrc")
+		login, password, err := lookupNetrc(cc.NetrcFile, host)
+		if err != nil && (cc.Netrc || cc.NetrcFile != "") {
+			return nil, err
+		}
+		if password != "" {
+			cred = &credential{Username: login, Token: password, Source: ".netrc"}
+		}
+	}
+
+	if cred == nil {
+		if _, ok := oauthProviders[service]; ok {
+			return nil, fmt.Errorf("%w for %s (tried %s), please run `gitbackup login --service %s`", errNoCredentials, service, strings.Join(tried, ", "), service)
+		}
+		return nil, fmt.Errorf("%w for %s (tried %s)", errNoCredentials, service, strings.Join(tried, ", "))
+	}
+	registerSecret(cred.Token)
+
+	// The configured username takes precedence over the one in .netrc
+	if cc.Username != "" {
+		cred.Username = cc.Username
+	} else if cred.Username == "" {
+		for _, name := range serviceUsernameEnvVars[service] {
+			if username := os.Getenv(name); username != "" {
+				cred.Username = username
+				break
+			}
+		}
+	}
+	slog.Debug("Resolved credentials", "service", service, "host", host, "source", cred.Source)
+	return cred, nil
+}
+
+// credentialHost returns the host name used to look up the credentials
+// of a target in .netrc
+func credentialHost(service, gitHostURL string) string {
+	host := gitHostName(service, gitHostURL)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// keyringKey returns the name the token is stored under in the keyring,
+// without the _TOKEN suffix getToken and saveToken add
+func keyringKey(service string, cc credentialsConfig) string {
+	if cc.KeyringKey != "" {
+		return strings.TrimSuffix(cc.KeyringKey, "_TOKEN")
+	}
+	return strings.ToUpper(service)
+}
+
+// readPassword returns the password from the environment variable env or
+// the file path, whichever is set, or "" if neither is
+func readPassword(env, path string) (string, error) {
+	switch {
+	case env != "":
+		password := os.Getenv(env)
+		if password == "" {
+			return "", fmt.Errorf("environment variable %s not set", env)
+		}
+		registerSecret(password)
+		return password, nil
+	case path != "":
+		return readTokenFile(path)
+	}
+	return "", nil
+}
+
+// readTokenFile reads a token from a file, ignoring surrounding whitespace
+func readTokenFile(path string) (string, error) {
+	path, err := expandHome(path)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading token file: %v", err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		slog.Warn("Token file is accessible by other users", "path", path, "mode", info.Mode().Perm().String())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading token file: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// runTokenCommand runs command via the shell and returns the first line of
+// its output, so that password managers such as `pass show` can be used
+func runTokenCommand(command string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("error running token command: %v", err)
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	token := strings.TrimSpace(line)
+	if token == "" {
+		return "", errors.New("token command didn't print a token")
+	}
+	return token, nil
+}
+
+// lookupNetrc returns the login and password for host from the .netrc
+// file at path, $NETRC or ~/.netrc. A missing file is only an error if
+// it was asked for explicitly.
+func lookupNetrc(path, host string) (string, string, error) {
+	explicit := path != ""
+	if path == "" {
+		path = os.Getenv("NETRC")
+	}
+	if path == "" {
+		homeDir, err := gethomeDir()
+		if err != nil {
+			return "", "", err
+		}
+		name := ".netrc"
+		if runtime.GOOS == "windows" {
+			name = "_netrc"
+		}
+		path = filepath.Join(homeDir, name)
+	}
+	path, err := expandHome(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return "", "", nil
+		}
+		return "", "", fmt.Errorf("error reading netrc file: %v", err)
+	}
+	defer f.Close()
+
+	entry := findNetrcEntry(parseNetrc(f), host)
+	if entry == nil {
+		return "", "", nil
+	}
+	return entry.login, entry.password, nil
+}
+
+// netrcEntry is a machine (or the default) entry of a .netrc file
+type netrcEntry struct {
+	machine   string
+	isDefault bool
+	login     string
+	password  string
+}
+
+// parseNetrc parses the entries of a .netrc file
+func parseNetrc(r io.Reader) []netrcEntry {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanWords)
+
+	var entries []netrcEntry
+	current := -1
+	for scanner.Scan() {
+		switch scanner.Text() {
+		case "machine":
+			entries = append(entries, netrcEntry{})
+			current = len(entries) - 1
+			if scanner.Scan() {
+				entries[current].machine = scanner.Text()
+			}
+		case "default":
+			entries = append(entries, netrcEntry{isDefault: true})
+			current = len(entries) - 1
+		case "login":
+			if scanner.Scan() && current != -1 {
+				entries[current].login = scanner.Text()
+			}
+		case "password":
+			if scanner.Scan() && current != -1 {
+				entries[current].password = scanner.Text()
+			}
+		case "macdef":
+			// Ignore the macro definition up to the next entry
+			current = -1
+		}
+	}
+	return entries
+}
+
+// findNetrcEntry returns the entry for host, or the default entry
+func findNetrcEntry(entries []netrcEntry, host string) *netrcEntry {
+	var defaultEntry *netrcEntry
+	for i, entry := range entries {
+		if entry.isDefault && defaultEntry == nil {
+			defaultEntry = &entries[i]
+		} else if strings.EqualFold(entry.machine, host) {
+			return &entries[i]
+		}
+	}
+	return defaultEntry
+}
+
+// expandHome expands a leading ~ in path to the home directory
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	homeDir, err := gethomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, strings.TrimPrefix(path, "~")), nil
+}
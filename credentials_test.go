@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeKeyring replaces the keyring lookups with the given tokens
+func fakeKeyring(t *testing.T, tokens map[string]string) {
+	original := keyringGetToken
+	keyringGetToken = func(key string) (string, error) {
+		if token, ok := tokens[key]; ok {
+			return token, nil
+		}
+		return "", errors.New("The specified item could not be found in the keyring")
+	}
+	t.Cleanup(func() {
+		keyringGetToken = original
+	})
+}
+
+func TestResolveCredentials(t *testing.T) {
+	tmpDir := t.TempDir()
+	tokenFile := filepath.Join(tmpDir, "token")
+	os.WriteFile(tokenFile, []byte("  file-token\n"), 0600)
+	netrcFile := filepath.Join(tmpDir, "netrc")
+	os.WriteFile(netrcFile, []byte("machine gitlab.example.com login netrc-user password netrc-token\n"), 0600)
+
+	t.Setenv("GITLAB_TOKEN", "env-token")
+	t.Setenv("WORK_GITLAB_TOKEN", "work-env-token")
+	t.Setenv("NETRC", filepath.Join(tmpDir, "does-not-exist"))
+	fakeKeyring(t, map[string]string{"GITLAB": "keyring-token", "WORK_GITLAB": "work-keyring-token"})
+
+	var testCases = []struct {
+		name       string
+		cc         credentialsConfig
+		wantToken  string
+		wantUser   string
+		wantSource string
+	}{
+		{"defaults to the environment", credentialsConfig{}, "env-token", "", "environment variable GITLAB_TOKEN"},
+		{"custom environment variable", credentialsConfig{TokenEnv: "WORK_GITLAB_TOKEN"}, "work-env-token", "", "environment variable WORK_GITLAB_TOKEN"},
+		{"token file", credentialsConfig{TokenFile: tokenFile}, "file-token", "", "token file " + tokenFile},
+		{"keyring", credentialsConfig{Keyring: true}, "keyring-token", "", "keyring"},
+		{"keyring key", credentialsConfig{KeyringKey: "WORK_GITLAB_TOKEN"}, "work-keyring-token", "", "keyring"},
+		{"netrc", credentialsConfig{NetrcFile: netrcFile}, "netrc-token", "netrc-user", ".netrc"},
+		{"configured username", credentialsConfig{NetrcFile: netrcFile, Username: "me"}, "netrc-token", "me", ".netrc"},
+		{"first source wins", credentialsConfig{TokenFile: tokenFile, Keyring: true}, "file-token", "", "token file " + tokenFile},
+		{"falls through to the next source", credentialsConfig{TokenEnv: "UNSET_TOKEN", Keyring: true}, "keyring-token", "", "keyring"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cred, err := resolveCredentials("gitlab", "gitlab.example.com", tc.cc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cred.Token != tc.wantToken || cred.Username != tc.wantUser || cred.Source != tc.wantSource {
+				t.Errorf("Expected %s/%s from %s, got %+v", tc.wantUser, tc.wantToken, tc.wantSource, cred)
+			}
+		})
+	}
+}
+
+func TestResolveCredentialsTokenCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+	cred, err := resolveCredentials("forgejo", "codeberg.org", credentialsConfig{TokenCommand: "printf 'cmd-token\\nsecond line\\n'"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.Token != "cmd-token" {
+		t.Errorf("Expected the first line of the output, got %q", cred.Token)
+	}
+
+	_, err = resolveCredentials("forgejo", "codeberg.org", credentialsConfig{TokenCommand: "exit 3"})
+	if err == nil || !strings.Contains(err.Error(), "token command") {
+		t.Errorf("Expected the failing token command to be reported, got %v", err)
+	}
+}
+
+func TestResolveCredentialsErrors(t *testing.T) {
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "does-not-exist"))
+	os.Unsetenv("FORGEJO_TOKEN")
+	fakeKeyring(t, nil)
+
+	_, err := resolveCredentials("forgejo", "codeberg.org", credentialsConfig{})
+	if !errors.Is(err, errNoCredentials) {
+		t.Fatalf("Expected errNoCredentials, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "$FORGEJO_TOKEN, keyring, .netrc") {
+		t.Errorf("Expected the error to list the sources tried, got %v", err)
+	}
+
+	// Explicitly configured sources which can't be read are errors
+	_, err = resolveCredentials("forgejo", "codeberg.org", credentialsConfig{TokenFile: "/does/not/exist"})
+	if err == nil || errors.Is(err, errNoCredentials) {
+		t.Errorf("Expected an error reading the token file, got %v", err)
+	}
+	_, err = resolveCredentials("forgejo", "codeberg.org", credentialsConfig{NetrcFile: "/does/not/exist"})
+	if err == nil || errors.Is(err, errNoCredentials) {
+		t.Errorf("Expected an error reading the netrc file, got %v", err)
+	}
+}
+
+func TestParseNetrc(t *testing.T) {
+	netrc := `machine github.com
+	login octocat
+	password gh-token
+macdef init
+	cd /pub
+
+machine gitlab.example.com login gl-user password gl-token
+default login anonymous password default-token
+`
+	entries := parseNetrc(strings.NewReader(netrc))
+
+	var testCases = []struct {
+		host         string
+		wantLogin    string
+		wantPassword string
+	}{
+		{"github.com", "octocat", "gh-token"},
+		{"GitLab.example.com", "gl-user", "gl-token"},
+		{"codeberg.org", "anonymous", "default-token"},
+	}
+	for _, tc := range testCases {
+		entry := findNetrcEntry(entries, tc.host)
+		if entry == nil || entry.login != tc.wantLogin || entry.password != tc.wantPassword {
+			t.Errorf("%s: expected %s/%s, got %+v", tc.host, tc.wantLogin, tc.wantPassword, entry)
+		}
+	}
+
+	entries = parseNetrc(strings.NewReader("machine github.com login octocat password gh-token\n"))
+	if entry := findNetrcEntry(entries, "bitbucket.org"); entry != nil {
+		t.Errorf("Expected no entry, got %+v", entry)
+	}
+}
+
+func TestCredentialHost(t *testing.T) {
+	if host := credentialHost("gitlab", "https://git.example.com:8443"); host != "git.example.com" {
+		t.Errorf("Expected git.example.com, got %s", host)
+	}
+	if host := credentialHost("bitbucket", ""); host != "bitbucket.org" {
+		t.Errorf("Expected bitbucket.org, got %s", host)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+const defaultHistorySize = 50
+
+// parseSchedule parses a cron-style schedule: the five standard fields,
+// the @hourly/@daily/@weekly/@monthly descriptors or @every <duration>,
+// optionally preceded by CRON_TZ=<time zone>
+func parseSchedule(spec string) (cron.Schedule, error) {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %v", spec, err)
+	}
+	return schedule, nil
+}
+
+// targetName returns the name of a target in the daemon's logs and history
+func targetName(c *appConfig) string {
+	if c.name != "" {
+		return c.name
+	}
+	return c.service + "@" + gitHostName(c.service, c.gitHostURL)
+}
+
+// runHistoryEntry is a run of a target in the daemon's history
+type runHistoryEntry struct {
+	Target     string     `json:"target"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt time.Time  `json:"finished_at"`
+	Error      string     `json:"error,omitempty"`
+	Report     *runReport `json:"report,omitempty"`
+}
+
+// succeeded reports whether the run backed up all the repositories of
+// its target
+func (e runHistoryEntry) succeeded() bool {
+	return e.Error == "" && (e.Report == nil || e.Report.Failed == 0)
+}
+
+// runHistory keeps the most recent runs, persisted to a JSON file so that
+// it survives restarts
+type runHistory struct {
+	mu      sync.Mutex
+	path    string
+	size    int
+	entries []runHistoryEntry
+}
+
+// defaultHistoryPath returns the default location of the run history
+func defaultHistoryPath() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("unable to determine cache directory: %v", err)
+	}
+	return filepath.Join(cacheDir, "gitbackup", "history.json"), nil
+}
+
+// loadRunHistory reads the history at path, if it exists
+func loadRunHistory(path string, size int) (*runHistory, error) {
+	h := &runHistory{path: path, size: size}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading the run history: %v", err)
+	}
+	if err := json.Unmarshal(data, &h.entries); err != nil {
+		return nil, fmt.Errorf("error parsing the run history %s: %v", path, err)
+	}
+	h.trim()
+	return h, nil
+}
+
+func (h *runHistory) trim() {
+	if h.size > 0 && len(h.entries) > h.size {
+		h.entries = h.entries[len(h.entries)-h.size:]
+	}
+}
+
+// add records a run and saves the history
+func (h *runHistory) add(entry runHistoryEntry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = append(h.entries, entry)
+	h.trim()
+	if h.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(h.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), 0700); err != nil {
+		return err
+	}
+	// Written to a temporary file first so that a crash can't leave a
+	// truncated history behind
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.path)
+}
+
+// list returns the runs, oldest first
+func (h *runHistory) list() []runHistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]runHistoryEntry{}, h.entries...)
+}
+
+// scheduledTarget is a target with its schedule and next run
+type scheduledTarget struct {
+	config   *appConfig
+	schedule cron.Schedule
+	next     time.Time
+}
+
+// daemon runs the backups of the targets on their schedules, one at a
+// time: the backups share the git settings of the process
+type daemon struct {
+	// load returns the configuration of the targets, (re)reading the
+	// config file
+	load func() ([]*appConfig, error)
+	// run backs up a target
+	run     func(*appConfig) (*runReport, error)
+	history *runHistory
+
+	mu      sync.Mutex
+	targets []*scheduledTarget
+	// Targets which are queued or running, so that runs don't overlap
+	pending map[string]bool
+	queue   chan *appConfig
+
+	// For the health of the targets: when the daemon started, when each
+	// target was last backed up successfully and how long after that its
+	// backup is stale (0 for twice the interval of its schedule)
+	started     time.Time
+	lastSuccess map[string]time.Time
+	staleAfter  time.Duration
+}
+
+func newDaemon(load func() ([]*appConfig, error), run func(*appConfig) (*runReport, error), history *runHistory) *daemon {
+	d := &daemon{
+		load:        load,
+		run:         run,
+		history:     history,
+		pending:     make(map[string]bool),
+		queue:       make(chan *appConfig, 100),
+		started:     time.Now(),
+		lastSuccess: make(map[string]time.Time),
+	}
+	for _, e := range history.list() {
+		if e.succeeded() {
+			d.lastSuccess[e.Target] = e.FinishedAt
+		}
+	}
+	return d
+}
+
+// reload reads the configuration and schedules of the targets. The
+// current configuration is kept if the new one is invalid.
+func (d *daemon) reload(now time.Time) error {
+	configs, err := d.load()
+	if err != nil {
+		return err
+	}
+
+	var targets []*scheduledTarget
+	for _, c := range configs {
+		if err := validateConfig(c); err != nil {
+			return targetError(c, err)
+		}
+		if c.schedule == "" {
+			slog.Warn("Target has no schedule, it won't be backed up", "target", targetName(c))
+			continue
+		}
+		schedule, err := parseSchedule(c.schedule)
+		if err != nil {
+			return targetError(c, err)
+		}
+		// The daemon's output goes to the logs
+		c.noProgress = true
+		targets = append(targets, &scheduledTarget{config: c, schedule: schedule, next: schedule.Next(now)})
+	}
+	if len(targets) == 0 {
+		return errors.New("none of the targets has a schedule")
+	}
+
+	d.mu.Lock()
+	d.targets = targets
+	d.mu.Unlock()
+	for _, t := range targets {
+		slog.Info("Scheduled target", "target", targetName(t.config), "schedule", t.config.schedule, "next", t.next.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// tick queues the targets which are due at now and returns when the next
+// one is due
+func (d *daemon) tick(now time.Time) time.Time {
+	d.mu.Lock()
+	var due []*appConfig
+	var next time.Time
+	for _, t := range d.targets {
+		if !t.next.After(now) {
+			due = append(due, t.config)
+			t.next = t.schedule.Next(now)
+		}
+		if next.IsZero() || t.next.Before(next) {
+			next = t.next
+		}
+	}
+	d.mu.Unlock()
+
+	for _, c := range due {
+		d.enqueue(c)
+	}
+	return next
+}
+
+// enqueue queues a run of a target, unless one is queued or running
+// already
+func (d *daemon) enqueue(c *appConfig) {
+	name := targetName(c)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pending[name] {
+		slog.Warn("Skipping the run of the target, the previous one hasn't finished", "target", name)
+		return
+	}
+	select {
+	case d.queue <- c:
+		d.pending[name] = true
+	default:
+		slog.Warn("Skipping the run of the target, too many runs are queued", "target", name)
+	}
+}
+
+// enqueueAll queues a run of all the targets
+func (d *daemon) enqueueAll() {
+	d.mu.Lock()
+	targets := append([]*scheduledTarget{}, d.targets...)
+	d.mu.Unlock()
+	for _, t := range targets {
+		d.enqueue(t.config)
+	}
+}
+
+// worker runs the queued backups one after the other until ctx is done
+func (d *daemon) worker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case c := <-d.queue:
+			d.runTarget(c)
+		}
+	}
+}
+
+// runTarget backs up a target and records the run in the history
+func (d *daemon) runTarget(c *appConfig) {
+	name := targetName(c)
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, name)
+		d.mu.Unlock()
+	}()
+
+	slog.Info("Starting the backup of the target", "target", name)
+	entry := runHistoryEntry{Target: name, StartedAt: time.Now()}
+	report, err := d.run(c)
+	entry.FinishedAt = time.Now()
+	entry.Report = report
+	if err != nil {
+		entry.Error = redact(err.Error())
+		slog.Error("Backing up target failed", "target", name, "error", err)
+	} else {
+		slog.Info("Backing up target finished", "target", name, "duration", entry.FinishedAt.Sub(entry.StartedAt).Round(time.Second).String())
+	}
+	if runSucceeded(report, err) {
+		d.mu.Lock()
+		d.lastSuccess[name] = entry.FinishedAt
+		d.mu.Unlock()
+	}
+	if err := d.history.add(entry); err != nil {
+		slog.Error("Error saving the run history", "error", err)
+	}
+}
+
+// health reports whether the targets were backed up recently enough. A
+// target which hasn't been backed up successfully yet is stale once the
+// threshold has passed since the daemon started.
+func (d *daemon) health(now time.Time) healthStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := healthStatus{Status: "ok", Targets: []targetHealth{}}
+	for _, t := range d.targets {
+		name := targetName(t.config)
+		staleAfter := d.staleAfter
+		if staleAfter == 0 {
+			next := t.schedule.Next(now)
+			staleAfter = 2 * t.schedule.Next(next).Sub(next)
+		}
+		th := targetHealth{Target: name, StaleAfter: staleAfter.String()}
+		since := d.started
+		if last, ok := d.lastSuccess[name]; ok {
+			th.LastSuccess = &last
+			since = last
+		}
+		if now.Sub(since) > staleAfter {
+			th.Stale = true
+			status.Status = "stale"
+		}
+		status.Targets = append(status.Targets, th)
+	}
+	return status
+}
+
+// serve schedules the runs until ctx is done, reloading the configuration
+// on reload. It returns once the running backup, if any, has finished.
+func (d *daemon) serve(ctx context.Context, reload <-chan os.Signal, runNow bool) error {
+	if err := d.reload(time.Now()); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.worker(ctx)
+	}()
+	if runNow {
+		d.enqueueAll()
+	}
+
+	next := d.tick(time.Now())
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			<-done
+			return nil
+		case <-reload:
+			timer.Stop()
+			slog.Info("Reloading the configuration")
+			if err := d.reload(time.Now()); err != nil {
+				slog.Error("Reloading the configuration failed, keeping the current one", "error", err)
+			}
+			next = d.tick(time.Now())
+		case now := <-timer.C:
+			next = d.tick(now)
+		}
+	}
+}
+
+// printRunHistory prints the runs in the history, most recent first
+func printRunHistory(entries []runHistoryEntry, out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STARTED\tTARGET\tDURATION\tCLONED\tUPDATED\tFAILED\tRESULT")
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		var cloned, updated, failed int
+		if e.Report != nil {
+			cloned, updated, failed = e.Report.Cloned, e.Report.Updated, e.Report.Failed
+		}
+		result := "ok"
+		if e.Error != "" {
+			result = e.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%s\n",
+			e.StartedAt.Local().Format("2006-01-02 15:04:05"), e.Target,
+			e.FinishedAt.Sub(e.StartedAt).Round(time.Second), cloned, updated, failed, result)
+	}
+	w.Flush()
+}
+
+// daemonOptions are the settings of the daemon itself
+type daemonOptions struct {
+	historyPath string
+	historySize int
+	runNow      bool
+	// Address of the HTTP server serving the metrics and the health of
+	// the targets, if any
+	listen     string
+	staleAfter time.Duration
+}
+
+// handleDaemon runs the backups on their schedules until gitbackup is
+// interrupted or terminated, reloading the configuration on SIGHUP
+func handleDaemon(load func() ([]*appConfig, error), opts daemonOptions) error {
+	historyPath := opts.historyPath
+	if historyPath == "" {
+		path, err := defaultHistoryPath()
+		if err != nil {
+			return err
+		}
+		historyPath = path
+	}
+	history, err := loadRunHistory(historyPath, opts.historySize)
+	if err != nil {
+		return err
+	}
+	d := newDaemon(load, backUpTarget, history)
+	d.staleAfter = opts.staleAfter
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	go func() {
+		<-stop
+		slog.Info("Stopping once the running backup has finished, interrupt again to stop now")
+		cancel()
+		<-stop
+		os.Exit(1)
+	}()
+
+	if opts.listen != "" {
+		runMetrics = newBackupMetrics()
+		for target, t := range d.lastSuccess {
+			runMetrics.setLastSuccess(target, t)
+		}
+		if err := serveMetrics(ctx, opts.listen, runMetrics, d); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("Starting the daemon", "history", historyPath)
+	return d.serve(ctx, reload, opts.runNow)
+}
+
+// handleHistory prints the run history of the daemon
+func handleHistory(historyPath string, out io.Writer) error {
+	if historyPath == "" {
+		path, err := defaultHistoryPath()
+		if err != nil {
+			return err
+		}
+		historyPath = path
+	}
+	history, err := loadRunHistory(historyPath, 0)
+	if err != nil {
+		return err
+	}
+	printRunHistory(history.list(), out)
+	return nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	from := time.Date(2026, 1, 1, 12, 30, 0, 0, time.UTC)
+	var testCases = []struct {
+		spec     string
+		expected time.Time
+		wantErr  bool
+	}{
+		{"0 3 * * *", time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC), false},
+		{"*/15 * * * *", time.Date(2026, 1, 1, 12, 45, 0, 0, time.UTC), false},
+		{"@daily", time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC), false},
+		{"@every 6h", from.Add(6 * time.Hour), false},
+		{"CRON_TZ=UTC 0 3 * * 1", time.Date(2026, 1, 5, 3, 0, 0, 0, time.UTC), false},
+		{"0 3 * *", time.Time{}, true},
+		{"sometimes", time.Time{}, true},
+	}
+	for _, tc := range testCases {
+		schedule, err := parseSchedule(tc.spec)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: expected an error: %v, got %v", tc.spec, tc.wantErr, err)
+			continue
+		}
+		if err == nil {
+			if next := schedule.Next(from).UTC(); !next.Equal(tc.expected) {
+				t.Errorf("%s: expected the next run at %v, got %v", tc.spec, tc.expected, next)
+			}
+		}
+	}
+}
+
+func TestRunHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gitbackup", "history.json")
+	history, err := loadRunHistory(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"first", "second", "third"} {
+		if err := history.add(runHistoryEntry{Target: target, Report: &runReport{Cloned: 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the most recent runs are kept, across restarts
+	history, err = loadRunHistory(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := history.list()
+	if len(entries) != 2 || entries[0].Target != "second" || entries[1].Target != "third" {
+		t.Errorf("Expected the two most recent runs, got %+v", entries)
+	}
+
+	var out bytes.Buffer
+	if err := handleHistory(path, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[1], "third") || !strings.Contains(lines[2], "second") {
+		t.Errorf("Expected the most recent run first, got:\n%s", out.String())
+	}
+
+	os.WriteFile(path, []byte("not json"), 0600)
+	if _, err := loadRunHistory(path, 2); err == nil {
+		t.Error("Expected an error for a corrupted history")
+	}
+}
+
+// daemonTestConfig returns a valid target configuration
+func daemonTestConfig(name, schedule string) *appConfig {
+	return &appConfig{
+		name:                        name,
+		service:                     "github",
+		schedule:                    schedule,
+		gitlabProjectMembershipType: "all",
+		maxConcurrentClones:         MaxConcurrentClones,
+		order:                       orderListed,
+	}
+}
+
+func TestDaemonSchedule(t *testing.T) {
+	configs := []*appConfig{
+		daemonTestConfig("hourly", "@every 1h"),
+		daemonTestConfig("daily", "@every 24h"),
+		daemonTestConfig("manual", ""),
+	}
+	load := func() ([]*appConfig, error) {
+		return configs, nil
+	}
+	run := func(c *appConfig) (*runReport, error) {
+		if c.name == "daily" {
+			return nil, errors.New("github 502")
+		}
+		return &runReport{Updated: 3}, nil
+	}
+	d := newDaemon(load, run, &runHistory{size: 10})
+
+	now := time.Now().Truncate(time.Second)
+	if err := d.reload(now); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.targets) != 2 {
+		t.Fatalf("Expected the targets with a schedule, got %d", len(d.targets))
+	}
+	if next := d.tick(now); !next.Equal(now.Add(time.Hour)) {
+		t.Errorf("Expected the next run in an hour, got %v", next)
+	}
+	if len(d.queue) != 0 {
+		t.Errorf("Expected no runs to be queued yet, got %d", len(d.queue))
+	}
+
+	// A run isn't queued while the previous one hasn't finished
+	d.tick(now.Add(time.Hour))
+	d.tick(now.Add(2 * time.Hour))
+	if len(d.queue) != 1 {
+		t.Fatalf("Expected one run to be queued, got %d", len(d.queue))
+	}
+	d.runTarget(<-d.queue)
+	next := d.tick(now.Add(24 * time.Hour))
+	if len(d.queue) != 2 {
+		t.Fatalf("Expected both targets to be queued, got %d", len(d.queue))
+	}
+	if !next.Equal(now.Add(25 * time.Hour)) {
+		t.Errorf("Expected the next run in 25 hours, got %v", next)
+	}
+	d.runTarget(<-d.queue)
+	d.runTarget(<-d.queue)
+
+	entries := d.history.list()
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 runs in the history, got %+v", entries)
+	}
+	if entries[0].Target != "hourly" || entries[0].Report.Updated != 3 || entries[0].Error != "" {
+		t.Errorf("Unexpected history entry: %+v", entries[0])
+	}
+	if entries[2].Target != "daily" || entries[2].Error != "github 502" {
+		t.Errorf("Unexpected history entry: %+v", entries[2])
+	}
+
+	// An invalid configuration doesn't replace the current one
+	configs = []*appConfig{daemonTestConfig("hourly", "every hour")}
+	if err := d.reload(now); err == nil {
+		t.Error("Expected an error for an invalid schedule")
+	}
+	if len(d.targets) != 2 {
+		t.Errorf("Expected the current targets to be kept, got %d", len(d.targets))
+	}
+	configs = []*appConfig{daemonTestConfig("manual", "")}
+	if err := d.reload(now); err == nil {
+		t.Error("Expected an error without any scheduled targets")
+	}
+}
+
+func TestDaemonServe(t *testing.T) {
+	ran := make(chan string, 10)
+	load := func() ([]*appConfig, error) {
+		return []*appConfig{daemonTestConfig("weekly", "@weekly")}, nil
+	}
+	run := func(c *appConfig) (*runReport, error) {
+		ran <- c.name
+		return &runReport{}, nil
+	}
+	d := newDaemon(load, run, &runHistory{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reload := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- d.serve(ctx, reload, true)
+	}()
+
+	select {
+	case name := <-ran:
+		if name != "weekly" {
+			t.Errorf("Expected the weekly target to run, got %s", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the targets to run when the daemon starts")
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the daemon to stop")
+	}
+	if entries := d.history.list(); len(entries) != 1 {
+		t.Errorf("Expected the run in the history, got %+v", entries)
+	}
+}
+
+func TestDaemonHealth(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	history := &runHistory{entries: []runHistoryEntry{
+		{Target: "hourly", FinishedAt: now.Add(-90 * time.Minute)},
+		{Target: "daily", FinishedAt: now.Add(-time.Hour), Report: &runReport{Failed: 1}},
+	}}
+	load := func() ([]*appConfig, error) {
+		return []*appConfig{daemonTestConfig("hourly", "@every 1h"), daemonTestConfig("daily", "@every 24h")}, nil
+	}
+	run := func(c *appConfig) (*runReport, error) {
+		return &runReport{}, nil
+	}
+	d := newDaemon(load, run, history)
+	if err := d.reload(now); err != nil {
+		t.Fatal(err)
+	}
+
+	// The last successful runs are read from the history
+	health := d.health(now)
+	if health.Status != "ok" || len(health.Targets) != 2 {
+		t.Fatalf("Expected the targets to be healthy, got %+v", health)
+	}
+	if last := health.Targets[0].LastSuccess; last == nil || !last.Equal(now.Add(-90*time.Minute)) {
+		t.Errorf("Expected the last success from the history, got %v", last)
+	}
+	if health.Targets[1].LastSuccess != nil || health.Targets[1].StaleAfter != "48h0m0s" {
+		t.Errorf("Unexpected health of the daily target: %+v", health.Targets[1])
+	}
+
+	health = d.health(now.Add(time.Hour))
+	if health.Status != "stale" || !health.Targets[0].Stale || health.Targets[1].Stale {
+		t.Errorf("Expected the hourly target to be stale, got %+v", health)
+	}
+	d.runTarget(daemonTestConfig("hourly", "@every 1h"))
+	if health = d.health(now.Add(time.Hour)); health.Status != "ok" {
+		t.Errorf("Expected the targets to be healthy after a run, got %+v", health)
+	}
+
+	d.staleAfter = 30 * time.Minute
+	if health = d.health(time.Now().Add(time.Hour)); health.Status != "stale" || !health.Targets[1].Stale {
+		t.Errorf("Expected the targets to be stale, got %+v", health)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import "errors"
+
+// freeDiskSpace isn't supported on this platform
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, errors.New("checking the free disk space isn't supported on this platform")
+}
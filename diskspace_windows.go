@@ -0,0 +1,17 @@
+package main
+
+import "golang.org/x/sys/windows"
+
+// freeDiskSpace returns the space available to the user on the volume
+// holding path
+func freeDiskSpace(path string) (uint64, error) {
+	pathPtr, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var available uint64
+	if err := windows.GetDiskFreeSpaceEx(pathPtr, &available, nil, nil); err != nil {
+		return 0, err
+	}
+	return available, nil
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v34/github"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+// The results of the doctor checks
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+// doctorCheck is the result of one of the checks of `gitbackup doctor`
+type doctorCheck struct {
+	Name   string
+	Status string
+	Detail string
+	// What to do about a warning or a failure
+	Hint string
+}
+
+// The oldest git version supporting GIT_CONFIG_COUNT, which gitbackup
+// passes its git configuration with
+var minGitVersion = [3]int{2, 31, 0}
+
+// Free space in the backup directory below which a warning is shown
+const minFreeDiskSpace = 1 << 30
+
+// Tokens expiring sooner than this are reported
+const tokenExpiryWarning = 14 * 24 * time.Hour
+
+// How long the git access checks may take
+var gitCheckTimeout = time.Minute
+
+// errStopListing stops listing the repositories once one has been found
+var errStopListing = errors.New("stop listing")
+
+// handleDoctor checks that each target can be backed up, printing the
+// results to out. It fails if any check fails.
+func handleDoctor(configs []*appConfig, out io.Writer) error {
+	// The checks mustn't start a login
+	nonInteractive = true
+
+	failed := 0
+	for i, c := range configs {
+		if i > 0 {
+			fmt.Fprintln(out)
+		}
+		title := fmt.Sprintf("%s on %s", c.service, gitHostName(c.service, c.gitHostURL))
+		if c.name != "" {
+			title = fmt.Sprintf("Target %s: %s", c.name, title)
+		}
+		fmt.Fprintln(out, title)
+		for _, check := range doctorChecks(c) {
+			printDoctorCheck(out, check)
+			if check.Status == checkFail {
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d check(s) failed", failed)
+	}
+	return nil
+}
+
+// printDoctorCheck prints the result of a check with its hint
+func printDoctorCheck(out io.Writer, check doctorCheck) {
+	status := map[string]string{checkOK: "[ok]  ", checkWarn: "[warn]", checkFail: "[FAIL]"}[check.Status]
+	fmt.Fprintf(out, "  %s %s: %s\n", status, check.Name, redact(check.Detail))
+	if check.Hint != "" && check.Status != checkOK {
+		fmt.Fprintf(out, "         %s\n", check.Hint)
+	}
+}
+
+// doctorChecks runs the checks for a target, stopping at the first
+// failure the later checks depend on
+func doctorChecks(c *appConfig) []doctorCheck {
+	if err := validateConfig(c); err != nil {
+		return []doctorCheck{{Name: "configuration", Status: checkFail, Detail: err.Error()}}
+	}
+	checks := []doctorCheck{checkGitVersion()}
+	checks = append(checks, checkBackupDir(c.backupDir)...)
+
+	if c.http != (httpConfig{}) {
+		if _, err := newTransport(c.http); err != nil {
+			return append(checks, doctorCheck{"HTTP settings", checkFail, err.Error(),
+				"Check the CA bundle and client certificate files of the target"})
+		}
+		checks = append(checks, doctorCheck{Name: "HTTP settings", Status: checkOK, Detail: "CA bundle, client certificate and proxy settings loaded"})
+	}
+
+	if c.ssh.PrivateKey != "" || c.ssh.KnownHosts != "" {
+		checks = append(checks, checkSSHSettings(c.ssh))
+	}
+
+	client, err := newClient(c)
+	if err != nil {
+		return append(checks, doctorCheck{"credentials", checkFail, err.Error(),
+			"Set a token for the target (see the Credentials section of the README)"})
+	}
+	username, err := getUsername(client, c.service)
+	if err != nil {
+		return append(checks, doctorCheck{"authentication", checkFail, err.Error(),
+			"Check that the token is valid and hasn't been revoked or expired"})
+	}
+	identity := username
+	if githubAppAuth {
+		identity = githubAppIdentity(c.githubApp)
+	}
+	checks = append(checks, doctorCheck{Name: "authentication", Status: checkOK, Detail: "authenticated as " + identity})
+	checks = append(checks, checkToken(client, c)...)
+
+	// Set the global variables used to build the clone URLs
+	useHTTPSClone = &c.useHTTPSClone
+	ignorePrivate = &c.ignorePrivate
+	sshPort = c.ssh.Port
+	gitHostUsername = username
+	gitConfig, err = c.http.gitSettings(false)
+	if err != nil {
+		return append(checks, doctorCheck{"HTTP settings", checkFail, err.Error(), ""})
+	}
+	sshOptions, err := c.ssh.options()
+	if err != nil {
+		return append(checks, doctorCheck{"SSH settings", checkFail, err.Error(), ""})
+	}
+	// ssh mustn't prompt for passphrases or host keys
+	if len(sshOptions) > 0 || (os.Getenv("GIT_SSH_COMMAND") == "" && os.Getenv("GIT_SSH") == "") {
+		gitEnv = gitSSHEnv(append(sshOptions, "-o", "BatchMode=yes"))
+	}
+	defer func() {
+		gitConfig, gitEnv = nil, nil
+	}()
+
+	var repo *Repository
+	err = walkRepositories(
+		client,
+		c.service,
+		c.githubRepoType,
+		c.githubNamespaceWhitelist,
+		c.gitlabProjectVisibility,
+		c.gitlabProjectMembershipType,
+		c.ignoreFork,
+		c.forgejoRepoType,
+		func(r *Repository) error {
+			repo = r
+			return errStopListing
+		},
+	)
+	if err != nil && !errors.Is(err, errStopListing) {
+		return append(checks, doctorCheck{"repositories", checkFail, "error listing the repositories: " + err.Error(),
+			"Check that the token can list repositories"})
+	}
+	if repo == nil {
+		return append(checks, doctorCheck{"repositories", checkWarn, "no repositories to back up",
+			"Check the repository type, visibility and namespace settings of the target"})
+	}
+	return append(checks, checkGitAccess(c, repo)...)
+}
+
+// checkSSHSettings checks that the SSH key and known_hosts file of a
+// target can be read
+func checkSSHSettings(sc sshConfig) doctorCheck {
+	if sc.PrivateKey != "" {
+		path, err := expandHome(sc.PrivateKey)
+		if err == nil {
+			_, err = os.ReadFile(path)
+		}
+		if err != nil {
+			return doctorCheck{"SSH settings", checkFail, "error reading the private key: " + err.Error(), ""}
+		}
+	}
+	if sc.KnownHosts != "" {
+		path, err := expandHome(sc.KnownHosts)
+		if err == nil {
+			_, err = os.Stat(path)
+		}
+		if err != nil && sc.StrictHostKeyChecking != "accept-new" && sc.StrictHostKeyChecking != "no" {
+			return doctorCheck{"SSH settings", checkFail, "error reading the known_hosts file: " + err.Error(),
+				"Pin the host keys of the git host with `gitbackup pin-host-keys`"}
+		}
+	}
+	return doctorCheck{Name: "SSH settings", Status: checkOK, Detail: "private key and known_hosts file found"}
+}
+
+// checkGitVersion checks that git is installed and recent enough
+func checkGitVersion() doctorCheck {
+	if err := checkGitAvailability(); err != nil {
+		return doctorCheck{"git", checkFail, err.Error(), ""}
+	}
+	out, err := execCommand(gitCommand, "version").Output()
+	if err != nil {
+		return doctorCheck{"git", checkFail, "error running git version: " + err.Error(), ""}
+	}
+	versionOutput := strings.TrimSpace(string(out))
+	version, ok := parseGitVersion(versionOutput)
+	if !ok {
+		return doctorCheck{"git", checkWarn, "unrecognized version: " + versionOutput, ""}
+	}
+	for i := range version {
+		if version[i] != minGitVersion[i] {
+			if version[i] < minGitVersion[i] {
+				return doctorCheck{"git", checkWarn, versionOutput,
+					fmt.Sprintf("Please upgrade to git %d.%d or later, the bandwidth limit and GitHub App authentication need it", minGitVersion[0], minGitVersion[1])}
+			}
+			break
+		}
+	}
+	return doctorCheck{Name: "git", Status: checkOK, Detail: versionOutput}
+}
+
+// Matches the output of git version, e.g. "git version 2.39.3 (Apple Git-145)"
+// or "git version 2.45.1.windows.1"
+var gitVersionRegexp = regexp.MustCompile(`^git version (\d+)\.(\d+)(?:\.(\d+))?`)
+
+// parseGitVersion parses the output of git version
+func parseGitVersion(s string) ([3]int, bool) {
+	var version [3]int
+	m := gitVersionRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return version, false
+	}
+	for i := range version {
+		version[i], _ = strconv.Atoi(m[i+1])
+	}
+	return version, true
+}
+
+// checkBackupDir checks that the backup directory is writable and has
+// free space
+func checkBackupDir(dir string) []doctorCheck {
+	f, err := os.CreateTemp(dir, ".gitbackup-doctor-")
+	if err != nil {
+		return []doctorCheck{{"backup directory", checkFail, err.Error(),
+			"Check the permissions of the backup directory or choose another one with -backupdir"}}
+	}
+	f.Close()
+	os.Remove(f.Name())
+	checks := []doctorCheck{{Name: "backup directory", Status: checkOK, Detail: dir + " is writable"}}
+
+	free, err := freeDiskSpace(dir)
+	switch {
+	case err != nil:
+		checks = append(checks, doctorCheck{Name: "disk space", Status: checkWarn, Detail: err.Error()})
+	case free < minFreeDiskSpace:
+		checks = append(checks, doctorCheck{"disk space", checkWarn, formatBytes(int64(free)) + " available",
+			"Free up some space before the backups fill the disk"})
+	default:
+		checks = append(checks, doctorCheck{Name: "disk space", Status: checkOK, Detail: formatBytes(int64(free)) + " available"})
+	}
+	return checks
+}
+
+// checkToken inspects the scopes and the expiry of the token, where the
+// API of the service exposes them
+func checkToken(client interface{}, c *appConfig) []doctorCheck {
+	switch c.service {
+	case "github":
+		if githubAppAuth {
+			return []doctorCheck{{Name: "token", Status: checkOK, Detail: "GitHub App installation token, refreshed automatically"}}
+		}
+		return checkGitHubToken(client.(*github.Client), c)
+	case "gitlab":
+		return checkGitLabToken(client.(*gitlab.Client), c)
+	}
+	return []doctorCheck{{Name: "token", Status: checkOK, Detail: "the scopes of the token aren't exposed by the " + c.service + " API"}}
+}
+
+// checkGitHubToken checks the scopes of a classic token, which GitHub
+// returns in the X-OAuth-Scopes header, and its expiry
+func checkGitHubToken(client *github.Client, c *appConfig) []doctorCheck {
+	_, resp, err := client.Users.Get(context.Background(), "")
+	if err != nil {
+		return []doctorCheck{{Name: "token", Status: checkWarn, Detail: "error inspecting the token: " + err.Error()}}
+	}
+
+	var checks []doctorCheck
+	if values, ok := resp.Header[http.CanonicalHeaderKey("X-OAuth-Scopes")]; !ok {
+		checks = append(checks, doctorCheck{Name: "token scopes", Status: checkOK,
+			Detail: "fine-grained token, its permissions aren't exposed by the API"})
+	} else {
+		scopes := splitScopes(strings.Join(values, ","))
+		switch {
+		case contains(scopes, "repo"):
+			checks = append(checks, doctorCheck{Name: "token scopes", Status: checkOK, Detail: strings.Join(scopes, ", ")})
+		case c.ignorePrivate && contains(scopes, "public_repo"):
+			checks = append(checks, doctorCheck{Name: "token scopes", Status: checkOK, Detail: strings.Join(scopes, ", ")})
+		default:
+			checks = append(checks, doctorCheck{"token scopes", checkFail, "missing the repo scope (has: " + strings.Join(scopes, ", ") + ")",
+				"Add the repo scope to the token, or private repositories can't be backed up"})
+		}
+	}
+
+	// e.g. "2026-11-01 00:00:00 UTC"
+	var expiresAt time.Time
+	if expiration := resp.Header.Get("GitHub-Authentication-Token-Expiration"); expiration != "" {
+		expiresAt, _ = time.Parse("2006-01-02 15:04:05 MST", expiration)
+	}
+	return append(checks, checkTokenExpiry(expiresAt))
+}
+
+// checkGitLabToken checks the scopes and the expiry of a personal access
+// token
+func checkGitLabToken(client *gitlab.Client, c *appConfig) []doctorCheck {
+	token, _, err := client.PersonalAccessTokens.GetSinglePersonalAccessToken()
+	if err != nil {
+		// OAuth tokens aren't personal access tokens
+		return []doctorCheck{{Name: "token", Status: checkOK, Detail: "the scopes of the token can't be inspected: " + err.Error()}}
+	}
+	if token.Revoked || !token.Active {
+		return []doctorCheck{{"token", checkFail, "the token is no longer active", "Create a new token"}}
+	}
+
+	var checks []doctorCheck
+	scopes := token.Scopes
+	switch {
+	case contains(scopes, "api"):
+		checks = append(checks, doctorCheck{Name: "token scopes", Status: checkOK, Detail: strings.Join(scopes, ", ")})
+	case contains(scopes, "read_api") && (!c.useHTTPSClone || contains(scopes, "read_repository")):
+		checks = append(checks, doctorCheck{Name: "token scopes", Status: checkOK, Detail: strings.Join(scopes, ", ")})
+	default:
+		checks = append(checks, doctorCheck{"token scopes", checkFail, "missing scopes (has: " + strings.Join(scopes, ", ") + ")",
+			"The token needs the api scope, or read_api (and read_repository to clone over HTTPS)"})
+	}
+
+	var expiresAt time.Time
+	if token.ExpiresAt != nil {
+		expiresAt = time.Time(*token.ExpiresAt)
+	}
+	return append(checks, checkTokenExpiry(expiresAt))
+}
+
+// splitScopes splits a comma separated list of scopes
+func splitScopes(s string) []string {
+	var scopes []string
+	for _, scope := range strings.Split(s, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// checkTokenExpiry reports tokens which have expired or expire soon. A
+// zero expiresAt means that the token doesn't expire.
+func checkTokenExpiry(expiresAt time.Time) doctorCheck {
+	if expiresAt.IsZero() {
+		return doctorCheck{Name: "token expiry", Status: checkOK, Detail: "no expiry date"}
+	}
+	detail := "expires on " + expiresAt.Format("2006-01-02")
+	switch remaining := time.Until(expiresAt); {
+	case remaining <= 0:
+		return doctorCheck{"token expiry", checkFail, "expired on " + expiresAt.Format("2006-01-02"), "Create a new token"}
+	case remaining < tokenExpiryWarning:
+		return doctorCheck{"token expiry", checkWarn, detail, "Renew the token before it expires"}
+	}
+	return doctorCheck{Name: "token expiry", Status: checkOK, Detail: detail}
+}
+
+// checkGitAccess checks that git can access repo over HTTPS and SSH. Only
+// the method used for the backups has to work.
+func checkGitAccess(c *appConfig, repo *Repository) []doctorCheck {
+	httpsURL, sshURL := httpsAndSSHURLs(repo.CloneURL)
+	sshURL = withSSHPort(sshURL, c.ssh.Port)
+	host := cloneURLHost(repo.CloneURL)
+
+	var checks []doctorCheck
+	for _, method := range []struct {
+		name string
+		url  string
+		used bool
+		hint string
+	}{
+		{"HTTPS access", httpsURL, c.useHTTPSClone, "Check that the token can read the contents of the repositories"},
+		{"SSH access", sshURL, !c.useHTTPSClone, "Add your SSH key to your account on " + host + ", or use -use-https-clone"},
+	} {
+		if method.url == "" {
+			continue
+		}
+		gitURL := method.url
+		if strings.HasPrefix(gitURL, "http") && gitAuthConfig == nil {
+			gitURL, _ = authenticatedCloneURL(gitURL)
+		}
+		output, err := runGitCheck("ls-remote", "--heads", gitURL)
+		check := doctorCheck{Name: method.name, Status: checkOK, Detail: "can read " + repoFullName(repo)}
+		if err != nil {
+			check = doctorCheck{method.name, checkFail, gitCheckError(err, output), method.hint}
+			if !method.used {
+				check.Status = checkWarn
+				check.Detail += " (not used for the backups)"
+			}
+		} else if !method.used {
+			check.Detail += " (not used for the backups)"
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// runGitCheck runs git without prompting for credentials, giving up after
+// gitCheckTimeout
+func runGitCheck(args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gitCheckTimeout)
+	defer cancel()
+	// The command as newGitCommand sets it up, killed once ctx expires
+	gitCmd := newGitCommand(args...)
+	cmd := exec.CommandContext(ctx, gitCmd.Path, gitCmd.Args[1:]...)
+	cmd.Env = gitCmd.Env
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, "GIT_TERMINAL_PROMPT=0")
+	// ssh may keep the output open after git is killed
+	cmd.WaitDelay = 5 * time.Second
+
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("git %s timed out", args[0])
+	}
+	return output, err
+}
+
+// gitCheckError returns the most useful line of the output of a failed
+// git command
+func gitCheckError(err error, output []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	for _, line := range lines {
+		if strings.HasPrefix(line, "fatal:") || strings.Contains(line, "Permission denied") {
+			return strings.TrimSpace(line)
+		}
+	}
+	if line := strings.TrimSpace(lines[0]); line != "" {
+		return line
+	}
+	return err.Error()
+}
+
+// httpsAndSSHURLs returns the HTTPS and SSH clone URLs of a repository
+// from either of them, e.g. https://github.com/org/repo.git and
+// git@github.com:org/repo.git
+func httpsAndSSHURLs(cloneURL string) (string, string) {
+	if strings.HasPrefix(cloneURL, "https://") || strings.HasPrefix(cloneURL, "http://") {
+		u, err := url.Parse(cloneURL)
+		if err != nil {
+			return cloneURL, ""
+		}
+		return cloneURL, "git@" + u.Hostname() + ":" + strings.TrimPrefix(u.Path, "/")
+	}
+	if strings.HasPrefix(cloneURL, "ssh://") {
+		u, err := url.Parse(cloneURL)
+		if err != nil {
+			return "", cloneURL
+		}
+		return "https://" + u.Hostname() + u.Path, cloneURL
+	}
+	// scp-like syntax: [user@]host:path
+	hostPart, path, ok := strings.Cut(cloneURL, ":")
+	if !ok {
+		return "", cloneURL
+	}
+	if _, host, ok := strings.Cut(hostPart, "@"); ok {
+		hostPart = host
+	}
+	return "https://" + hostPart + "/" + strings.TrimPrefix(path, "/"), cloneURL
+}
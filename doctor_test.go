@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fakeDoctorGitCommand(command string, args ...string) (cmd *exec.Cmd) {
+	cs := []string{"-test.run=TestHelperDoctorProcess", "--", command}
+	cs = append(cs, args...)
+	cmd = exec.Command(os.Args[0], cs...)
+	cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1"}
+	return cmd
+}
+
+// TestHelperDoctorProcess fakes a git which can only access repositories
+// over HTTPS
+func TestHelperDoctorProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	switch os.Args[4] {
+	case "version":
+		fmt.Println("git version 2.30.1")
+	case "ls-remote":
+		if strings.Contains(os.Args[6], "unresponsive") {
+			time.Sleep(time.Minute)
+		}
+		if !strings.HasPrefix(os.Args[6], "https://") {
+			fmt.Println("git@github.com: Permission denied (publickey).")
+			fmt.Println("fatal: Could not read from remote repository.")
+			os.Exit(128)
+		}
+		fmt.Println("0123456789abcdef0123456789abcdef01234567\trefs/heads/main")
+	default:
+		fmt.Printf("Unexpected git command: %v", os.Args[3:])
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func TestRunGitCheckTimeout(t *testing.T) {
+	defer func(f func(string, ...string) *exec.Cmd, timeout time.Duration) {
+		execCommand = f
+		gitCheckTimeout = timeout
+	}(execCommand, gitCheckTimeout)
+	execCommand = fakeDoctorGitCommand
+
+	output, err := runGitCheck("ls-remote", "--heads", "https://github.com/octocat/repo.git")
+	if err != nil || !strings.Contains(string(output), "refs/heads/main") {
+		t.Errorf("Expected the refs, got %q, %v", output, err)
+	}
+
+	gitCheckTimeout = 500 * time.Millisecond
+	start := time.Now()
+	_, err = runGitCheck("ls-remote", "--heads", "https://unresponsive.example.com/repo.git")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("runGitCheck returned after %s", elapsed)
+	}
+}
+
+func TestParseGitVersion(t *testing.T) {
+	var testCases = []struct {
+		output   string
+		expected [3]int
+		ok       bool
+	}{
+		{"git version 2.43.0", [3]int{2, 43, 0}, true},
+		{"git version 2.39.3 (Apple Git-145)", [3]int{2, 39, 3}, true},
+		{"git version 2.45.1.windows.1", [3]int{2, 45, 1}, true},
+		{"git version 3.0", [3]int{3, 0, 0}, true},
+		{"not git", [3]int{}, false},
+	}
+	for _, tc := range testCases {
+		version, ok := parseGitVersion(tc.output)
+		if version != tc.expected || ok != tc.ok {
+			t.Errorf("%q: expected %v %v, got %v %v", tc.output, tc.expected, tc.ok, version, ok)
+		}
+	}
+}
+
+func TestHTTPSAndSSHURLs(t *testing.T) {
+	var testCases = []struct {
+		cloneURL string
+		httpsURL string
+		sshURL   string
+	}{
+		{"https://github.com/org/repo.git", "https://github.com/org/repo.git", "git@github.com:org/repo.git"},
+		{"git@github.com:org/repo.git", "https://github.com/org/repo.git", "git@github.com:org/repo.git"},
+		{"ssh://git@gitlab.example.com:2222/group/repo.git", "https://gitlab.example.com/group/repo.git", "ssh://git@gitlab.example.com:2222/group/repo.git"},
+		{"https://gitlab.example.com:8443/group/repo.git", "https://gitlab.example.com:8443/group/repo.git", "git@gitlab.example.com:group/repo.git"},
+	}
+	for _, tc := range testCases {
+		httpsURL, sshURL := httpsAndSSHURLs(tc.cloneURL)
+		if httpsURL != tc.httpsURL || sshURL != tc.sshURL {
+			t.Errorf("%s: expected %s and %s, got %s and %s", tc.cloneURL, tc.httpsURL, tc.sshURL, httpsURL, sshURL)
+		}
+	}
+}
+
+func TestCheckTokenExpiry(t *testing.T) {
+	var testCases = []struct {
+		expiresAt time.Time
+		status    string
+	}{
+		{time.Time{}, checkOK},
+		{time.Now().Add(-time.Hour), checkFail},
+		{time.Now().Add(48 * time.Hour), checkWarn},
+		{time.Now().Add(90 * 24 * time.Hour), checkOK},
+	}
+	for _, tc := range testCases {
+		if check := checkTokenExpiry(tc.expiresAt); check.Status != tc.status {
+			t.Errorf("%v: expected %s, got %+v", tc.expiresAt, tc.status, check)
+		}
+	}
+}
+
+func TestHandleDoctor(t *testing.T) {
+	setupRepositoryTests()
+	defer teardownRepositoryTests()
+
+	defer func(f func(string, ...string) *exec.Cmd, l func(string) (string, error)) {
+		execCommand = f
+		lookPath = l
+	}(execCommand, lookPath)
+	execCommand = fakeDoctorGitCommand
+	lookPath = func(string) (string, error) { return "/usr/bin/git", nil }
+	defer func() {
+		nonInteractive = false
+		useHTTPSClone = nil
+		ignorePrivate = nil
+	}()
+
+	expiration := time.Now().Add(72 * time.Hour).UTC()
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-OAuth-Scopes", "read:org, public_repo")
+		w.Header().Set("GitHub-Authentication-Token-Expiration", expiration.Format("2006-01-02 15:04:05 MST"))
+		fmt.Fprint(w, `{"login": "octocat"}`)
+	})
+	mux.HandleFunc("/user/repos", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"full_name": "octocat/repo1", "name": "repo1", "clone_url": "https://github.com/octocat/repo1.git", "ssh_url": "git@github.com:octocat/repo1.git", "private": false, "fork": false, "owner": {"login": "octocat"}}]`)
+	})
+
+	c := &appConfig{
+		name:           "personal",
+		service:        "github",
+		gitHostURL:     server.URL + "/",
+		githubAPIURL:   server.URL + "/",
+		backupDir:      t.TempDir(),
+		githubRepoType: "all",
+		useHTTPSClone:  true,
+
+		gitlabProjectMembershipType: "all",
+		maxConcurrentClones:         MaxConcurrentClones,
+		order:                       orderListed,
+	}
+	var out bytes.Buffer
+	err := handleDoctor([]*appConfig{c}, &out)
+	if err == nil || err.Error() != "1 check(s) failed" {
+		t.Errorf("Expected the scopes check to fail, got %v", err)
+	}
+
+	output := out.String()
+	for _, expected := range []string{
+		"Target personal: github on 127.0.0.1",
+		"[warn] git: git version 2.30.1",
+		"[ok]   backup directory: " + c.backupDir + " is writable",
+		"[ok]   authentication: authenticated as octocat",
+		"[FAIL] token scopes: missing the repo scope (has: read:org, public_repo)",
+		"[warn] token expiry: expires on " + expiration.Format("2006-01-02"),
+		"[ok]   HTTPS access: can read octocat/repo1",
+		"[warn] SSH access: git@github.com: Permission denied (publickey). (not used for the backups)",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected the output to contain %q, got:\n%s", expected, output)
+		}
+	}
+	if strings.Contains(output, os.Getenv("GITHUB_TOKEN")) {
+		t.Errorf("Expected the token to be redacted, got:\n%s", output)
+	}
+
+	// Invalid configurations aren't checked any further
+	out.Reset()
+	err = handleDoctor([]*appConfig{{service: "gitea"}}, &out)
+	if err == nil || !strings.Contains(out.String(), "[FAIL] configuration") {
+		t.Errorf("Expected the configuration check to fail, got %v:\n%s", err, out.String())
+	}
+}
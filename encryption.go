@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// encryptionConfig configures the encryption of the uploaded repositories.
+// The public keys encrypt the uploads, the private keys are only needed to
+// restore and verify them.
+type encryptionConfig struct {
+	// age recipients, e.g. age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+	AgeRecipients     []string `yaml:"age_recipients,omitempty"`
+	AgeRecipientsFile string   `yaml:"age_recipients_file,omitempty"`
+	AgeIdentityFile   string   `yaml:"age_identity_file,omitempty"`
+	// Files with armored OpenPGP public keys
+	PGPPublicKeys     []string `yaml:"pgp_public_keys,omitempty"`
+	PGPPrivateKey     string   `yaml:"pgp_private_key,omitempty"`
+	PGPPassphraseEnv  string   `yaml:"pgp_passphrase_env,omitempty"`
+	PGPPassphraseFile string   `yaml:"pgp_passphrase_file,omitempty"`
+}
+
+// The encryption schemes, as recorded in the manifest
+const (
+	encryptionAge     = "age"
+	encryptionOpenPGP = "openpgp"
+)
+
+// scheme returns the encryption scheme of the uploads, or "" if they
+// aren't encrypted
+func (ec encryptionConfig) scheme() string {
+	switch {
+	case len(ec.AgeRecipients) > 0 || ec.AgeRecipientsFile != "":
+		return encryptionAge
+	case len(ec.PGPPublicKeys) > 0:
+		return encryptionOpenPGP
+	}
+	return ""
+}
+
+// validate checks the settings without loading any of the keys
+func (ec encryptionConfig) validate() error {
+	if (len(ec.AgeRecipients) > 0 || ec.AgeRecipientsFile != "") && len(ec.PGPPublicKeys) > 0 {
+		return errors.New("only one of age and OpenPGP can be used")
+	}
+	for _, recipient := range ec.AgeRecipients {
+		if _, err := age.ParseRecipients(strings.NewReader(recipient)); err != nil {
+			return fmt.Errorf("invalid age recipient %q: %v", recipient, err)
+		}
+	}
+	if ec.PGPPassphraseEnv != "" && ec.PGPPassphraseFile != "" {
+		return errors.New("only one of pgp_passphrase_env and pgp_passphrase_file can be specified")
+	}
+	return nil
+}
+
+// encrypter encrypts the uploads for the recipients
+type encrypter struct {
+	scheme        string
+	ageRecipients []age.Recipient
+	pgpEntities   openpgp.EntityList
+}
+
+// newEncrypter loads the public keys, it returns nil if the uploads aren't
+// encrypted
+func newEncrypter(ec encryptionConfig) (*encrypter, error) {
+	e := &encrypter{scheme: ec.scheme()}
+	switch e.scheme {
+	case "":
+		return nil, nil
+	case encryptionAge:
+		recipients := strings.Join(ec.AgeRecipients, "\n")
+		if ec.AgeRecipientsFile != "" {
+			data, err := readKeyFile(ec.AgeRecipientsFile)
+			if err != nil {
+				return nil, err
+			}
+			recipients += "\n" + string(data)
+		}
+		parsed, err := age.ParseRecipients(strings.NewReader(recipients))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing the age recipients: %v", err)
+		}
+		e.ageRecipients = parsed
+	case encryptionOpenPGP:
+		for _, keyFile := range ec.PGPPublicKeys {
+			entities, err := readPGPKeys(keyFile)
+			if err != nil {
+				return nil, err
+			}
+			e.pgpEntities = append(e.pgpEntities, entities...)
+		}
+	}
+	return e, nil
+}
+
+// name returns the encryption scheme, as recorded in the manifest, or "" if
+// the uploads aren't encrypted
+func (e *encrypter) name() string {
+	if e == nil {
+		return ""
+	}
+	return e.scheme
+}
+
+// extension returns the suffix of the names of the encrypted objects
+func (e *encrypter) extension() string {
+	if e == nil {
+		return ""
+	}
+	if e.scheme == encryptionAge {
+		return ".age"
+	}
+	return ".gpg"
+}
+
+// encrypt returns a writer encrypting what is written to it into w. The
+// encryption is only complete once the writer is closed, which doesn't
+// close w.
+func (e *encrypter) encrypt(w io.Writer) (io.WriteCloser, error) {
+	if e == nil {
+		return nopWriteCloser{w}, nil
+	}
+	if e.scheme == encryptionAge {
+		return age.Encrypt(w, e.ageRecipients...)
+	}
+	return openpgp.Encrypt(w, e.pgpEntities, nil, &openpgp.FileHints{IsBinary: true}, nil)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// decrypter decrypts the uploads with the private keys
+type decrypter struct {
+	ec          encryptionConfig
+	ageIdentity []age.Identity
+	pgpKeyring  openpgp.EntityList
+}
+
+// decrypt returns a reader decrypting r, which was encrypted with scheme.
+// The private keys are loaded the first time they are needed. The
+// integrity of the content is checked as it is read: reading fails if it
+// was tampered with.
+func (d *decrypter) decrypt(scheme string, r io.Reader) (io.Reader, error) {
+	switch scheme {
+	case "":
+		return r, nil
+	case encryptionAge:
+		if d.ageIdentity == nil {
+			if d.ec.AgeIdentityFile == "" {
+				return nil, errors.New("the repository is encrypted with age, please specify age_identity_file")
+			}
+			f, err := readKeyFile(d.ec.AgeIdentityFile)
+			if err != nil {
+				return nil, err
+			}
+			identities, err := age.ParseIdentities(bytes.NewReader(f))
+			if err != nil {
+				return nil, fmt.Errorf("error parsing the age identities: %v", err)
+			}
+			d.ageIdentity = identities
+		}
+		return age.Decrypt(r, d.ageIdentity...)
+	case encryptionOpenPGP:
+		if d.pgpKeyring == nil {
+			if d.ec.PGPPrivateKey == "" {
+				return nil, errors.New("the repository is encrypted with OpenPGP, please specify pgp_private_key")
+			}
+			keyring, err := readPGPKeys(d.ec.PGPPrivateKey)
+			if err != nil {
+				return nil, err
+			}
+			passphrase, err := readPassword(d.ec.PGPPassphraseEnv, d.ec.PGPPassphraseFile)
+			if err != nil {
+				return nil, err
+			}
+			for _, entity := range keyring {
+				if entity.PrivateKey != nil && entity.PrivateKey.Encrypted {
+					if passphrase == "" {
+						return nil, errors.New("the OpenPGP private key is protected by a passphrase, please specify pgp_passphrase_env or pgp_passphrase_file")
+					}
+					if err := entity.DecryptPrivateKeys([]byte(passphrase)); err != nil {
+						return nil, fmt.Errorf("error decrypting the OpenPGP private key: %v", err)
+					}
+				}
+			}
+			d.pgpKeyring = keyring
+		}
+		md, err := openpgp.ReadMessage(r, d.pgpKeyring, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting: %v", err)
+		}
+		return md.UnverifiedBody, nil
+	}
+	return nil, fmt.Errorf("unknown encryption: %q", scheme)
+}
+
+// readKeyFile reads a file with keys
+func readKeyFile(path string) ([]byte, error) {
+	path, err := expandHome(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading keys: %v", err)
+	}
+	return data, nil
+}
+
+// readPGPKeys reads the armored OpenPGP keys in a file
+func readPGPKeys(path string) (openpgp.EntityList, error) {
+	data, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the OpenPGP keys in %s: %v", path, err)
+	}
+	return entities, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+func TestEncryptionConfigValidate(t *testing.T) {
+	var tests = []struct {
+		name  string
+		ec    encryptionConfig
+		valid bool
+	}{
+		{"disabled", encryptionConfig{}, true},
+		{"age", encryptionConfig{AgeRecipients: []string{"age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"}}, true},
+		{"invalid age recipient", encryptionConfig{AgeRecipients: []string{"age1invalid"}}, false},
+		{"OpenPGP", encryptionConfig{PGPPublicKeys: []string{"backup.asc"}}, true},
+		{"age and OpenPGP", encryptionConfig{AgeRecipientsFile: "recipients.txt", PGPPublicKeys: []string{"backup.asc"}}, false},
+		{"two passphrases", encryptionConfig{PGPPublicKeys: []string{"backup.asc"}, PGPPassphraseEnv: "PASSPHRASE", PGPPassphraseFile: "passphrase"}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.ec.validate()
+			if (err == nil) != tc.valid {
+				t.Errorf("validate() = %v, want valid %v", err, tc.valid)
+			}
+		})
+	}
+}
+
+// newTestAgeKeys generates an age identity and returns the settings
+// encrypting for it
+func newTestAgeKeys(t *testing.T) encryptionConfig {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityFile := filepath.Join(t.TempDir(), "age.key")
+	if err := os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return encryptionConfig{
+		AgeRecipients:   []string{identity.Recipient().String()},
+		AgeIdentityFile: identityFile,
+	}
+}
+
+// newTestPGPKeys generates an OpenPGP key protected by passphrase and
+// returns the settings encrypting for it
+func newTestPGPKeys(t *testing.T, passphrase string) encryptionConfig {
+	entity, err := openpgp.NewEntity("gitbackup", "", "backup@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	writeArmored := func(name, blockType string, serialize func(io.Writer) error) string {
+		var buf bytes.Buffer
+		w, err := armor.Encode(&buf, blockType, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := serialize(w); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	publicKey := writeArmored("public.asc", openpgp.PublicKeyType, entity.Serialize)
+	if err := entity.EncryptPrivateKeys([]byte(passphrase), nil); err != nil {
+		t.Fatal(err)
+	}
+	privateKey := writeArmored("private.asc", openpgp.PrivateKeyType, func(w io.Writer) error {
+		return entity.SerializePrivateWithoutSigning(w, nil)
+	})
+	t.Setenv("TEST_PGP_PASSPHRASE", passphrase)
+	return encryptionConfig{
+		PGPPublicKeys:    []string{publicKey},
+		PGPPrivateKey:    privateKey,
+		PGPPassphraseEnv: "TEST_PGP_PASSPHRASE",
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	configs := map[string]func(t *testing.T) encryptionConfig{
+		encryptionAge:     newTestAgeKeys,
+		encryptionOpenPGP: func(t *testing.T) encryptionConfig { return newTestPGPKeys(t, "correct horse") },
+	}
+	for scheme, newKeys := range configs {
+		t.Run(scheme, func(t *testing.T) {
+			ec := newKeys(t)
+			e, err := newEncrypter(ec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.name() != scheme {
+				t.Fatalf("scheme = %q, want %q", e.name(), scheme)
+			}
+			plaintext := bytes.Repeat([]byte("source code "), 10000)
+			var ciphertext bytes.Buffer
+			w, err := e.encrypt(&ciphertext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(plaintext)
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(ciphertext.Bytes(), []byte("source code")) {
+				t.Fatal("ciphertext contains the plaintext")
+			}
+
+			d := &decrypter{ec: ec}
+			r, err := d.decrypt(scheme, bytes.NewReader(ciphertext.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil || !bytes.Equal(got, plaintext) {
+				t.Fatalf("decrypted %d bytes, %v, want %d bytes", len(got), err, len(plaintext))
+			}
+
+			// Tampering is detected
+			tampered := bytes.Clone(ciphertext.Bytes())
+			tampered[len(tampered)-40] ^= 1
+			r, err = d.decrypt(scheme, bytes.NewReader(tampered))
+			if err == nil {
+				_, err = io.ReadAll(r)
+			}
+			if err == nil {
+				t.Error("tampered ciphertext was decrypted")
+			}
+
+			// The private key is needed
+			_, err = (&decrypter{}).decrypt(scheme, bytes.NewReader(ciphertext.Bytes()))
+			if err == nil || !strings.Contains(err.Error(), "please specify") {
+				t.Errorf("decrypt() without a private key = %v", err)
+			}
+		})
+	}
+}
+
+func TestDecryptWrongPassphrase(t *testing.T) {
+	ec := newTestPGPKeys(t, "correct horse")
+	t.Setenv("TEST_PGP_PASSPHRASE", "battery staple")
+	_, err := (&decrypter{ec: ec}).decrypt(encryptionOpenPGP, strings.NewReader(""))
+	if err == nil || !strings.Contains(err.Error(), "error decrypting the OpenPGP private key") {
+		t.Errorf("decrypt() with the wrong passphrase = %v", err)
+	}
+}
+
+func TestEncrypterDisabled(t *testing.T) {
+	e, err := newEncrypter(encryptionConfig{})
+	if err != nil || e != nil {
+		t.Fatalf("newEncrypter() = %v, %v, want no encryption", e, err)
+	}
+	if e.name() != "" || e.extension() != "" {
+		t.Errorf("unencrypted uploads have scheme %q and extension %q", e.name(), e.extension())
+	}
+}
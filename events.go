@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The lifecycle events of a backup run
+const (
+	eventListingStarted  = "listing_started"
+	eventListingFinished = "listing_finished"
+	eventRepoStarted     = "repo_started"
+	eventRepoProgress    = "repo_progress"
+	eventRepoFinished    = "repo_finished"
+	eventRepoMaintained  = "repo_maintained"
+	eventRepoDiverged    = "repo_diverged"
+	eventRunFinished     = "run_finished"
+)
+
+// What happened to a repository during a run
+const (
+	actionClone  = "clone"
+	actionUpdate = "update"
+	actionSkip   = "skip"
+)
+
+// event is a single lifecycle event. With --events json, each event is
+// written as one line of JSON.
+type event struct {
+	Type            string     `json:"type"`
+	Time            time.Time  `json:"time"`
+	Service         string     `json:"service,omitempty"`
+	Repository      string     `json:"repository,omitempty"`
+	Action          string     `json:"action,omitempty"`
+	Status          string     `json:"status,omitempty"`
+	Error           string     `json:"error,omitempty"`
+	Bytes           int64      `json:"bytes,omitempty"`
+	DurationSeconds float64    `json:"duration_seconds,omitempty"`
+	Total           int        `json:"total,omitempty"`
+	Reason          string     `json:"reason,omitempty"`
+	Summary         *runReport `json:"summary,omitempty"`
+}
+
+// runReport summarises a backup run
+type runReport struct {
+	Service    string        `json:"service"`
+	Host       string        `json:"host"`
+	StartedAt  time.Time     `json:"started_at"`
+	FinishedAt time.Time     `json:"finished_at"`
+	Discovered int           `json:"discovered"`
+	Cloned     int           `json:"cloned"`
+	Updated    int           `json:"updated"`
+	Skipped    int           `json:"skipped"`
+	Failed     int           `json:"failed"`
+	Bytes      int64         `json:"bytes"`
+	Maintained int           `json:"maintained,omitempty"`
+	Reclaimed  int64         `json:"reclaimed_bytes,omitempty"`
+	Failures   []repoFailure `json:"failures,omitempty"`
+	// Working copies whose checkout couldn't be updated
+	Diverged []repoDivergence `json:"diverged,omitempty"`
+}
+
+// repoFailure records why backing up a repository failed
+type repoFailure struct {
+	Repository string `json:"repository"`
+	Error      string `json:"error"`
+	Output     string `json:"output,omitempty"`
+}
+
+// repoDivergence records why the checkout of a working copy wasn't updated
+type repoDivergence struct {
+	Repository string `json:"repository"`
+	Reason     string `json:"reason"`
+}
+
+// repoProgress is the state of a backup which is in progress
+type repoProgress struct {
+	Repository string
+	Action     string
+	Phase      string
+	Percent    int
+	Bytes      int64
+	StartedAt  time.Time
+}
+
+// progressSnapshot is the overall state of a run handed to the sinks
+// along with every event
+type progressSnapshot struct {
+	Listed      int
+	ListingDone bool
+	Done        int
+	Failed      int
+	Bytes       int64
+	Active      []repoProgress
+}
+
+// eventSink receives the events of a run
+type eventSink interface {
+	handleEvent(e event, s progressSnapshot)
+}
+
+// runProgress keeps track of a backup run and passes its events on to the
+// configured sinks. All the methods are safe to call on a nil *runProgress.
+type runProgress struct {
+	mutex       sync.Mutex
+	sinks       []eventSink
+	report      runReport
+	listingDone bool
+	active      map[string]*repoProgress
+}
+
+// The progress of the current run, reported to by the helper functions
+var runEvents *runProgress
+
+func newRunProgress(service, host string, sinks ...eventSink) *runProgress {
+	return &runProgress{
+		sinks: sinks,
+		report: runReport{
+			Service:   service,
+			Host:      host,
+			StartedAt: time.Now(),
+		},
+		active: make(map[string]*repoProgress),
+	}
+}
+
+// trackTransfers reports whether anything is interested in the transfer
+// progress of the individual git commands
+func (p *runProgress) trackTransfers() bool {
+	if p == nil {
+		return false
+	}
+	for _, sink := range p.sinks {
+		if _, ok := sink.(*metricsSink); !ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *runProgress) listingStarted() {
+	if p == nil {
+		return
+	}
+	p.emit(event{Type: eventListingStarted})
+}
+
+func (p *runProgress) repoListed() {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	p.report.Discovered++
+	p.mutex.Unlock()
+}
+
+func (p *runProgress) listingFinished() {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	p.listingDone = true
+	total := p.report.Discovered
+	p.mutex.Unlock()
+	p.emit(event{Type: eventListingFinished, Total: total})
+}
+
+func (p *runProgress) repoStarted(repo *Repository, action string) {
+	if p == nil {
+		return
+	}
+	name := repoFullName(repo)
+	p.mutex.Lock()
+	p.active[name] = &repoProgress{Repository: name, Action: action, StartedAt: time.Now()}
+	p.mutex.Unlock()
+	p.emit(event{Type: eventRepoStarted, Repository: name, Action: action})
+}
+
+// repoTransfer records the transfer progress reported by git
+func (p *runProgress) repoTransfer(repo *Repository, phase string, percent int, bytes int64) {
+	if p == nil {
+		return
+	}
+	name := repoFullName(repo)
+	p.mutex.Lock()
+	rp, ok := p.active[name]
+	if ok {
+		rp.Phase = phase
+		rp.Percent = percent
+		if bytes > rp.Bytes {
+			rp.Bytes = bytes
+		}
+	}
+	p.mutex.Unlock()
+	if ok {
+		p.emit(event{Type: eventRepoProgress, Repository: name})
+	}
+}
+
+func (p *runProgress) repoFinished(repo *Repository, action string, err error, output []byte) {
+	if p == nil {
+		return
+	}
+	name := repoFullName(repo)
+	e := event{Type: eventRepoFinished, Repository: name, Action: action, Status: "success"}
+
+	p.mutex.Lock()
+	if rp, ok := p.active[name]; ok {
+		e.Bytes = rp.Bytes
+		e.DurationSeconds = time.Since(rp.StartedAt).Seconds()
+		delete(p.active, name)
+	}
+	p.report.Bytes += e.Bytes
+	switch {
+	case err != nil:
+		e.Status = "failure"
+		e.Error = redact(err.Error())
+		p.report.Failed++
+		p.report.Failures = append(p.report.Failures, repoFailure{
+			Repository: name,
+			Error:      e.Error,
+			Output:     redact(string(output)),
+		})
+	case action == actionClone:
+		p.report.Cloned++
+	case action == actionUpdate:
+		p.report.Updated++
+	case action == actionSkip:
+		p.report.Skipped++
+	}
+	p.mutex.Unlock()
+
+	p.emit(e)
+}
+
+// repoMaintained records the git maintenance of a repository and the
+// space it reclaimed, in Bytes of the event
+func (p *runProgress) repoMaintained(repo *Repository, reclaimed int64) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	p.report.Maintained++
+	p.report.Reclaimed += reclaimed
+	p.mutex.Unlock()
+	p.emit(event{Type: eventRepoMaintained, Repository: repoFullName(repo), Bytes: reclaimed})
+}
+
+// repoDiverged records that the checkout of a working copy couldn't be
+// updated, which doesn't fail its backup
+func (p *runProgress) repoDiverged(repo *Repository, reason string) {
+	if p == nil {
+		return
+	}
+	name := repoFullName(repo)
+	p.mutex.Lock()
+	p.report.Diverged = append(p.report.Diverged, repoDivergence{Repository: name, Reason: reason})
+	p.mutex.Unlock()
+	p.emit(event{Type: eventRepoDiverged, Repository: name, Reason: reason})
+}
+
+// runFinished marks the end of the run and returns its report
+func (p *runProgress) runFinished() *runReport {
+	if p == nil {
+		return nil
+	}
+	p.mutex.Lock()
+	p.report.FinishedAt = time.Now()
+	report := p.report
+	p.mutex.Unlock()
+	p.emit(event{Type: eventRunFinished, Summary: &report})
+	return &report
+}
+
+func (p *runProgress) emit(e event) {
+	e.Time = time.Now()
+	e.Service = p.report.Service
+
+	p.mutex.Lock()
+	s := progressSnapshot{
+		Listed:      p.report.Discovered,
+		ListingDone: p.listingDone,
+		Done:        p.report.Cloned + p.report.Updated + p.report.Skipped + p.report.Failed,
+		Failed:      p.report.Failed,
+		Bytes:       p.report.Bytes,
+	}
+	for _, rp := range p.active {
+		s.Active = append(s.Active, *rp)
+		s.Bytes += rp.Bytes
+	}
+	p.mutex.Unlock()
+	sort.Slice(s.Active, func(i, j int) bool {
+		return s.Active[i].StartedAt.Before(s.Active[j].StartedAt)
+	})
+
+	for _, sink := range p.sinks {
+		sink.handleEvent(e, s)
+	}
+}
+
+// jsonEventSink writes one line of JSON per lifecycle event
+type jsonEventSink struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+func newJSONEventSink(w io.Writer) *jsonEventSink {
+	return &jsonEventSink{encoder: json.NewEncoder(w)}
+}
+
+func (j *jsonEventSink) handleEvent(e event, s progressSnapshot) {
+	// Transfer progress is far too chatty for wrapper scripts
+	if e.Type == eventRepoProgress {
+		return
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.encoder.Encode(e)
+}
+
+// repoFullName returns the namespace/name of a repository
+func repoFullName(repo *Repository) string {
+	if repo.Namespace == "" {
+		return repo.Name
+	}
+	return repo.Namespace + "/" + repo.Name
+}
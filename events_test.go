@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type recordingSink struct {
+	events    []event
+	snapshots []progressSnapshot
+}
+
+func (r *recordingSink) handleEvent(e event, s progressSnapshot) {
+	r.events = append(r.events, e)
+	r.snapshots = append(r.snapshots, s)
+}
+
+func TestRunProgressReport(t *testing.T) {
+	sink := recordingSink{}
+	p := newRunProgress("github", "github.com", &sink)
+
+	repo1 := &Repository{Namespace: "org", Name: "repo1"}
+	repo2 := &Repository{Namespace: "org", Name: "repo2"}
+	repo3 := &Repository{Namespace: "org", Name: "repo3"}
+
+	p.listingStarted()
+	for i := 0; i < 3; i++ {
+		p.repoListed()
+	}
+	p.listingFinished()
+
+	p.repoStarted(repo1, actionClone)
+	p.repoTransfer(repo1, "Receiving objects", 50, 2048)
+	p.repoFinished(repo1, actionClone, nil, nil)
+	p.repoStarted(repo2, actionUpdate)
+	p.repoFinished(repo2, actionUpdate, errors.New("exit status 1"), []byte("fatal: not a git repository"))
+	p.repoStarted(repo3, actionSkip)
+	p.repoFinished(repo3, actionSkip, nil, nil)
+	report := p.runFinished()
+
+	if report.Discovered != 3 || report.Cloned != 1 || report.Updated != 0 || report.Skipped != 1 || report.Failed != 1 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	if report.Bytes != 2048 {
+		t.Errorf("Expected 2048 bytes, got %d", report.Bytes)
+	}
+	if len(report.Failures) != 1 || report.Failures[0].Repository != "org/repo2" || report.Failures[0].Output != "fatal: not a git repository" {
+		t.Errorf("Unexpected failures: %+v", report.Failures)
+	}
+	if report.Service != "github" || report.Host != "github.com" {
+		t.Errorf("Unexpected service/host: %s %s", report.Service, report.Host)
+	}
+
+	var types []string
+	for _, e := range sink.events {
+		types = append(types, e.Type)
+	}
+	expected := "listing_started listing_finished repo_started repo_progress repo_finished repo_started repo_finished repo_started repo_finished run_finished"
+	if strings.Join(types, " ") != expected {
+		t.Errorf("Expected events %s, got %s", expected, strings.Join(types, " "))
+	}
+
+	// The transfer progress is part of the snapshot while the backup is active
+	progress := sink.snapshots[3]
+	if len(progress.Active) != 1 || progress.Active[0].Percent != 50 || progress.Bytes != 2048 {
+		t.Errorf("Unexpected snapshot: %+v", progress)
+	}
+	last := sink.snapshots[len(sink.snapshots)-1]
+	if last.Done != 3 || last.Failed != 1 || !last.ListingDone || len(last.Active) != 0 {
+		t.Errorf("Unexpected final snapshot: %+v", last)
+	}
+}
+
+func TestRunProgressNil(t *testing.T) {
+	var p *runProgress
+	repo := &Repository{Name: "repo"}
+
+	// None of these should panic
+	p.listingStarted()
+	p.repoListed()
+	p.listingFinished()
+	p.repoStarted(repo, actionClone)
+	p.repoTransfer(repo, "Receiving objects", 10, 10)
+	p.repoFinished(repo, actionClone, nil, nil)
+	if p.trackTransfers() {
+		t.Error("Expected transfers not to be tracked")
+	}
+	if report := p.runFinished(); report != nil {
+		t.Errorf("Expected no report, got %+v", report)
+	}
+}
+
+func TestJSONEventSink(t *testing.T) {
+	var out bytes.Buffer
+	p := newRunProgress("gitlab", "gitlab.com", newJSONEventSink(&out))
+	repo := &Repository{Namespace: "group", Name: "project"}
+
+	p.repoListed()
+	p.repoStarted(repo, actionClone)
+	p.repoTransfer(repo, "Receiving objects", 10, 100)
+	p.repoFinished(repo, actionClone, nil, nil)
+	p.runFinished()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 lines of events, got %d: %s", len(lines), out.String())
+	}
+
+	var finished event
+	if err := json.Unmarshal([]byte(lines[1]), &finished); err != nil {
+		t.Fatal(err)
+	}
+	if finished.Type != eventRepoFinished || finished.Repository != "group/project" ||
+		finished.Action != actionClone || finished.Status != "success" || finished.Service != "gitlab" {
+		t.Errorf("Unexpected event: %+v", finished)
+	}
+
+	var summary event
+	if err := json.Unmarshal([]byte(lines[2]), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Type != eventRunFinished || summary.Summary == nil || summary.Summary.Cloned != 1 || summary.Summary.Discovered != 1 {
+		t.Errorf("Unexpected summary: %+v", summary)
+	}
+}
@@ -2,73 +2,96 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
+	"strings"
 
 	forgejo "codeberg.org/mvdkleijn/forgejo-sdk/forgejo/v2"
 )
 
-func getForgejoRepositories(
+func listForgejoRepositories(
 	client *forgejo.Client,
 	forgejoRepoType string,
 	ignoreFork bool,
-) ([]*Repository, error) {
+	fn func(*Repository) error,
+) error {
 
 	switch forgejoRepoType {
 	case "starred":
 		user, _, err := client.GetMyUserInfo()
 		if err != nil {
-			log.Fatalf("Error fetching user info from forgejo: %v", err)
+			return fmt.Errorf("fetching user info from forgejo: %v", err)
 		}
 
-		log.Printf("Found user %s with ID %d", user.UserName, user.ID)
+		slog.Debug("Found forgejo user", "user", user.UserName, "id", user.ID)
 
-		repos, err := paginateForgejoRepositories(func(page int) ([]*forgejo.Repository, *forgejo.Response, error) {
+		err = paginateForgejoRepositories(client, func(page int) ([]*forgejo.Repository, *forgejo.Response, error) {
 			return client.SearchRepos(forgejo.SearchRepoOptions{
 				ListOptions:     forgejo.ListOptions{Page: page},
 				StarredByUserID: user.ID,
 			})
-		}, ignoreFork)
+		}, ignoreFork, fn)
 		if err != nil {
-			return nil, fmt.Errorf("fetching starred repositories from forgejo: %v", err)
+			return fmt.Errorf("fetching starred repositories from forgejo: %v", err)
 		}
 
-		return repos, nil
+		return nil
 	case "user", "":
-		repos, err := paginateForgejoRepositories(func(page int) ([]*forgejo.Repository, *forgejo.Response, error) {
+		err := paginateForgejoRepositories(client, func(page int) ([]*forgejo.Repository, *forgejo.Response, error) {
 			return client.ListMyRepos(forgejo.ListReposOptions{
 				ListOptions: forgejo.ListOptions{Page: page},
 			})
-		}, ignoreFork)
+		}, ignoreFork, fn)
 		if err != nil {
-			return nil, fmt.Errorf("fetching user repositories from forgejo: %v", err)
+			return fmt.Errorf("fetching user repositories from forgejo: %v", err)
 		}
 
-		return repos, nil
+		return nil
 	default:
-		return nil, fmt.Errorf("unknown repo type: %s", forgejoRepoType)
+		return fmt.Errorf("unknown repo type: %s", forgejoRepoType)
 	}
 }
 
-func paginateForgejoRepositories(fetch func(page int) ([]*forgejo.Repository, *forgejo.Response, error), ignoreFork bool) ([]*Repository, error) {
-	var repositories []*Repository
+func paginateForgejoRepositories(
+	client *forgejo.Client,
+	fetch func(page int) ([]*forgejo.Repository, *forgejo.Response, error),
+	ignoreFork bool,
+	fn func(*Repository) error,
+) error {
 	page := 1
 
 	for {
 		results, resp, err := fetch(page)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		for _, repo := range results {
 			if repo.Fork && ignoreFork {
 				continue
 			}
-			repositories = append(repositories, &Repository{
+			var forkOf string
+			if repo.Parent != nil && objectPools {
+				forkOf = forkNetworkRoot(cloneURLHost(repo.HTMLURL), repo.Parent.FullName, func(name string) (string, error) {
+					owner, name, _ := strings.Cut(name, "/")
+					parent, _, err := client.GetRepo(owner, name)
+					if err != nil || parent.Parent == nil {
+						return "", err
+					}
+					return parent.Parent.FullName, nil
+				})
+			}
+			err := fn(&Repository{
 				CloneURL:  getCloneURL(repo.CloneURL, repo.SSHURL),
 				Name:      repo.Name,
 				Namespace: repo.Owner.UserName,
 				Private:   repo.Private,
+				PushedAt:  repo.Updated,
+				Size:      int64(repo.Size) * 1024,
+				ForkOf:    forkOf,
 			})
+			if err != nil {
+				return err
+			}
 		}
 
 		if resp == nil || resp.NextPage == 0 {
@@ -78,5 +101,5 @@ func paginateForgejoRepositories(fetch func(page int) ([]*forgejo.Repository, *f
 		page = resp.NextPage
 	}
 
-	return repositories, nil
+	return nil
 }
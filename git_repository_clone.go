@@ -2,34 +2,163 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
+	"os"
 	"sync"
 )
 
-// handleGitRepositoryClone clones or updates all repositories for the configured service
-func handleGitRepositoryClone(client any, c *appConfig) error {
+// handleGitRepositoryClone clones or updates all repositories for the configured
+// service and returns a report of the run
+func handleGitRepositoryClone(client any, c *appConfig) (*runReport, error) {
 
 	// Check if git is available before proceeding
 	if err := checkGitAvailability(); err != nil {
-		return err
+		return nil, err
 	}
 
-	// Used for waiting for all the goroutines to finish before exiting
-	var wg sync.WaitGroup
-	defer wg.Wait()
+	// Report the progress of the run to the event stream and the
+	// progress display
+	var sinks []eventSink
+	if c.events == "json" {
+		sinks = append(sinks, newJSONEventSink(os.Stdout))
+	}
+	if runMetrics != nil {
+		sinks = append(sinks, runMetrics.sink(targetName(c)))
+	}
+	if !c.noProgress && stderrIsTerminal() {
+		display := newProgressDisplay(os.Stderr)
+		sinks = append(sinks, display)
+		setLogOutput(display)
+		defer setLogOutput(os.Stderr)
+	}
+	runEvents = newRunProgress(c.service, gitHostName(c.service, c.gitHostURL), sinks...)
+	defer func() {
+		runEvents = nil
+	}()
+
+	err := backUpRepositories(client, c)
+	report := runEvents.runFinished()
+	slog.Info("Backup finished", "discovered", report.Discovered, "cloned", report.Cloned,
+		"updated", report.Updated, "skipped", report.Skipped, "failed", report.Failed,
+		"maintained", report.Maintained, "reclaimed", report.Reclaimed, "diverged", len(report.Diverged))
+	return report, err
+}
+
+// setupGit sets the git settings of a target up for its backups and
+// returns a function restoring them once the backups are done
+func setupGit(c *appConfig) (cleanup func(), err error) {
+	var proxy *throttledProxy
+	cleanup = func() {
+		if proxy != nil {
+			proxy.Close()
+		}
+		gitConfig, gitEnv = nil, nil
+	}
+	defer func() {
+		if err != nil {
+			cleanup()
+		}
+	}()
+
+	// All git transfers go through a throttling proxy when the bandwidth
+	// is capped
+	bandwidthLimit, err := parseByteSize(c.bandwidthLimit)
+	if err != nil {
+		return nil, err
+	}
+	gitConfig, err = c.http.gitSettings(bandwidthLimit > 0)
+	if err != nil {
+		return nil, err
+	}
+	sshOptions, err := c.ssh.options()
+	if err != nil {
+		return nil, err
+	}
+	gitEnv = gitSSHEnv(sshOptions)
+	if bandwidthLimit > 0 {
+		// The throttled proxy forwards to the configured proxy
+		upstream, err := c.http.proxyFunc()
+		if err != nil {
+			return nil, err
+		}
+		proxy, err = startThrottledProxy(bandwidthLimit, upstream)
+		if err != nil {
+			return nil, fmt.Errorf("error starting bandwidth limiting proxy: %v", err)
+		}
+		proxyConfig, proxyEnv := bandwidthLimitGitSettings(proxy, sshOptions)
+		gitConfig = append(gitConfig, proxyConfig...)
+		if proxyEnv != nil {
+			gitEnv = proxyEnv
+		}
+	}
 
 	// Set global variables used by helper functions
 	useHTTPSClone = &c.useHTTPSClone
 	ignorePrivate = &c.ignorePrivate
+	sshPort = c.ssh.Port
+	objectPools = c.objectPools
+	cloneStrategies = c.cloneStrategies
+	return cleanup, nil
+}
 
-	tokens := make(chan bool, MaxConcurrentClones)
-	gitHostUsername = getUsername(client, c.service)
+// backUpRepositories lists the repositories and backs them up, returning
+// once all the backups are done
+func backUpRepositories(client any, c *appConfig) error {
+	// The git settings are only restored (and the bandwidth limiting
+	// proxy stopped) once all the clones are done, as wg.Wait() is
+	// deferred after them
+	cleanup, err := setupGit(c)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	saveManifest, err := setupUploads(c, true)
+	if err != nil {
+		return err
+	}
+	defer saveManifest()
+	saveMaintenance, err := setupMaintenance(c)
+	if err != nil {
+		return err
+	}
+	defer saveMaintenance()
+
+	// Used for waiting for all the goroutines to finish before exiting
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	limiter := newCloneLimiter(c.maxConcurrentClones, c.perHostConcurrency)
+	gitHostUsername, err = getUsername(client, c.service)
+	if err != nil {
+		return err
+	}
 
 	if len(gitHostUsername) == 0 && c.ignorePrivate && c.useHTTPSClone {
 		return fmt.Errorf("your Git host's username is needed for backing up private repositories via HTTPS")
 	}
 
-	repositories, err := getRepositories(
+	backUpRepo := func(repo *Repository) {
+		wg.Add(1)
+		limiter.run(cloneURLHost(repo.CloneURL), func() {
+			stdoutStderr, err := backUp(c.backupDir, repo, c.bare, &wg)
+			if err != nil {
+				repoLogger(repo).Error("Error backing up repository", "error", err, "output", stdoutStderr)
+			}
+		})
+	}
+
+	// Unless the repositories have to be ordered, they are handed to the
+	// clone pool as soon as they are listed, so the first clones start
+	// while we are still paginating. Listing is paused whenever all the
+	// clone slots are busy.
+	streaming := c.order == "" || c.order == orderListed
+	if streaming {
+		slog.Info("Backing up repositories as they are listed")
+	}
+	runEvents.listingStarted()
+	var listed []*Repository
+	numRepos := 0
+	err = walkRepositories(
 		client,
 		c.service,
 		c.githubRepoType,
@@ -38,25 +167,81 @@ func handleGitRepositoryClone(client any, c *appConfig) error {
 		c.gitlabProjectMembershipType,
 		c.ignoreFork,
 		c.forgejoRepoType,
+		func(repo *Repository) error {
+			numRepos++
+			runEvents.repoListed()
+			if streaming {
+				backUpRepo(repo)
+			} else {
+				listed = append(listed, repo)
+			}
+			return nil
+		},
 	)
 	if err != nil {
 		return err
 	}
-	if len(repositories) == 0 {
+	runEvents.listingFinished()
+	if numRepos == 0 {
 		return fmt.Errorf("no repositories retrieved")
 	}
 
-	log.Printf("Backing up %v repositories now..\n", len(repositories))
-	for _, repo := range repositories {
-		tokens <- true
-		wg.Add(1)
-		go func(repo *Repository) {
-			stdoutStderr, err := backUp(c.backupDir, repo, c.bare, &wg)
-			if err != nil {
-				log.Printf("Error backing up %s: %s\n", repo.Name, stdoutStderr)
-			}
-			<-tokens
-		}(repo)
+	if !streaming {
+		sortRepositories(listed, c.order)
+		slog.Info("Backing up repositories", "repos", len(listed), "order", c.order)
+		for _, repo := range listed {
+			backUpRepo(repo)
+		}
 	}
+
+	slog.Info("Listed repositories, waiting for the backups to finish", "repos", numRepos)
 	return nil
 }
+
+// backUpRepository clones or updates a single repository of a target, if
+// the target's listing includes it
+func backUpRepository(c *appConfig, repo *Repository) error {
+	if err := checkGitAvailability(); err != nil {
+		return err
+	}
+	client, err := newClient(c)
+	if err != nil {
+		return err
+	}
+	cleanup, err := setupGit(c)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	saveManifest, err := setupUploads(c, false)
+	if err != nil {
+		return err
+	}
+	defer saveManifest()
+	saveMaintenance, err := setupMaintenance(c)
+	if err != nil {
+		return err
+	}
+	defer saveMaintenance()
+
+	gitHostUsername, err = getUsername(client, c.service)
+	if err != nil {
+		return err
+	}
+	listed, err := listsRepository(client, c, repo)
+	if err != nil {
+		return err
+	}
+	if !listed {
+		repoLogger(repo).Info("Not backing up repository, the target's filters leave it out")
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	stdoutStderr, err := backUp(c.backupDir, repo, c.bare, &wg)
+	if err != nil {
+		repoLogger(repo).Error("Error backing up repository", "error", err, "output", stdoutStderr)
+	}
+	return err
+}
@@ -2,23 +2,31 @@ package main
 
 import (
 	"context"
+	"errors"
 	"strings"
 
 	"github.com/google/go-github/v34/github"
 )
 
-func getGithubRepositories(
+func listGithubRepositories(
 	client *github.Client,
 	githubRepoType string, githubNamespaceWhitelist []string,
 	ignoreFork bool,
-) ([]*Repository, error) {
-
-	var repositories []*Repository
+	fn func(*Repository) error,
+) error {
 
 	ctx := context.Background()
 
+	// An app installation has access to a fixed set of repositories
+	if githubAppAuth {
+		if githubRepoType == "starred" {
+			return errors.New("starred repositories can't be listed with GitHub App authentication")
+		}
+		return listGithubAppRepositories(ctx, client, githubNamespaceWhitelist, ignoreFork, fn)
+	}
+
 	if githubRepoType == "starred" {
-		return getGithubStarredRepositories(ctx, client, ignoreFork)
+		return listGithubStarredRepositories(ctx, client, ignoreFork, fn)
 	}
 
 	options := github.RepositoryListOptions{Type: githubRepoType}
@@ -26,7 +34,7 @@ func getGithubRepositories(
 	for {
 		repos, resp, err := client.Repositories.List(ctx, "", &options)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		for _, repo := range repos {
 			if *repo.Fork && ignoreFork {
@@ -47,29 +55,62 @@ func getGithubRepositories(
 			}
 
 			cloneURL := getCloneURL(httpsCloneURL, sshCloneURL)
-			repositories = append(repositories, &Repository{
+			err := fn(&Repository{
 				CloneURL:  cloneURL,
 				Name:      *repo.Name,
 				Namespace: namespace,
 				Private:   *repo.Private,
+				PushedAt:  repo.GetPushedAt().Time,
+				Size:      int64(repo.GetSize()) * 1024,
+				ForkOf:    githubForkOf(ctx, client, repo),
 			})
+			if err != nil {
+				return err
+			}
 		}
 		if resp.NextPage == 0 {
 			break
 		}
 		options.ListOptions.Page = resp.NextPage
 	}
-	return repositories, nil
+	return nil
 }
 
-func getGithubStarredRepositories(ctx context.Context, client *github.Client, ignoreFork bool) ([]*Repository, error) {
-	var repositories []*Repository
+// githubForkOf returns the full name of the repository at the root of the
+// fork network of repo if it is a fork. The lists of repositories don't
+// include it, so it is only looked up when forks share object pools, once
+// per fork for the life of the process.
+func githubForkOf(ctx context.Context, client *github.Client, repo *github.Repository) string {
+	if !repo.GetFork() || !objectPools {
+		return ""
+	}
+	if repo.Source != nil {
+		return repo.Source.GetFullName()
+	}
+	host := cloneURLHost(repo.GetCloneURL())
+	return forkNetworkRoot(host, repo.GetFullName(), func(name string) (string, error) {
+		owner, name, _ := strings.Cut(name, "/")
+		full, _, err := client.Repositories.Get(ctx, owner, name)
+		if err != nil {
+			return "", err
+		}
+		// The source is the root of the network, the only repository
+		// of the network which isn't a fork
+		if source := full.GetSource(); source != nil {
+			forkRoots.Store(host+" "+source.GetFullName(), source.GetFullName())
+			return source.GetFullName(), nil
+		}
+		return "", nil
+	})
+}
+
+func listGithubStarredRepositories(ctx context.Context, client *github.Client, ignoreFork bool, fn func(*Repository) error) error {
 	options := github.ActivityListStarredOptions{}
 
 	for {
 		stars, resp, err := client.Activity.ListStarred(ctx, "", &options)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		for _, star := range stars {
 			if *star.Repository.Fork && ignoreFork {
@@ -86,17 +127,23 @@ func getGithubStarredRepositories(ctx context.Context, client *github.Client, ig
 			}
 
 			cloneURL := getCloneURL(httpsCloneURL, sshCloneURL)
-			repositories = append(repositories, &Repository{
+			err := fn(&Repository{
 				CloneURL:  cloneURL,
 				Name:      *star.Repository.Name,
 				Namespace: namespace,
 				Private:   *star.Repository.Private,
+				PushedAt:  star.Repository.GetPushedAt().Time,
+				Size:      int64(star.Repository.GetSize()) * 1024,
+				ForkOf:    githubForkOf(ctx, client, star.Repository),
 			})
+			if err != nil {
+				return err
+			}
 		}
 		if resp.NextPage == 0 {
 			break
 		}
 		options.ListOptions.Page = resp.NextPage
 	}
-	return repositories, nil
+	return nil
 }
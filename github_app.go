@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v34/github"
+	"golang.org/x/oauth2"
+)
+
+// githubAppConfig configures authentication as a GitHub App installation
+// instead of with a personal token
+type githubAppConfig struct {
+	AppID          int64  `yaml:"app_id,omitempty"`
+	PrivateKeyFile string `yaml:"private_key_file,omitempty"`
+	// The installation is discovered if the app has a single one (or a
+	// single one in the namespace whitelist)
+	InstallationID int64 `yaml:"installation_id,omitempty"`
+}
+
+// enabled reports whether GitHub App authentication has been configured
+func (a githubAppConfig) enabled() bool {
+	return a.AppID != 0 || a.PrivateKeyFile != ""
+}
+
+// Set when the GitHub client authenticates as an app installation, which
+// has no user and lists its repositories differently
+var githubAppAuth bool
+
+// The installation the GitHub client authenticates as
+var githubAppInstallationID int64
+
+// The username for HTTPS git operations with an installation token
+const githubAppGitUsername = "x-access-token"
+
+// Installation tokens are refreshed this long before they expire, so that
+// a token doesn't expire in the middle of a clone
+const githubAppTokenEarlyExpiry = 10 * time.Minute
+
+// We have it here so that we can override it in the tests
+var githubAppNow = time.Now
+
+// newGitHubAppTokenSource returns a token source minting (and refreshing)
+// installation tokens for the app. apiURL is the API base URL of the
+// GitHub instance, or nil for github.com.
+func newGitHubAppTokenSource(app githubAppConfig, apiURL *url.URL, whitelist []string) (oauth2.TokenSource, error) {
+	if app.AppID == 0 || app.PrivateKeyFile == "" {
+		return nil, errors.New("GitHub App authentication needs both the app ID and the private key file")
+	}
+	keyPath, err := expandHome(app.PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the GitHub App private key: %v", err)
+	}
+	key, err := parseRSAPrivateKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the GitHub App private key: %v", err)
+	}
+
+	// The app itself authenticates with a short lived JWT
+	appClient := github.NewClient(&http.Client{
+		Transport: &githubAppJWTTransport{appID: app.AppID, key: key, base: newHTTPClient().Transport},
+	})
+	if apiURL != nil {
+		appClient.BaseURL = apiURL
+	}
+
+	installationID := app.InstallationID
+	if installationID == 0 {
+		installationID, err = discoverGitHubAppInstallation(appClient, whitelist)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	githubAppInstallationID = installationID
+	ts := &githubAppTokenSource{client: appClient, installationID: installationID}
+	return oauth2.ReuseTokenSourceWithExpiry(nil, ts, githubAppTokenEarlyExpiry), nil
+}
+
+// githubAppIdentity describes the app installation the GitHub client
+// authenticates as
+func githubAppIdentity(app githubAppConfig) string {
+	return fmt.Sprintf("GitHub App %d (installation %d)", app.AppID, githubAppInstallationID)
+}
+
+// discoverGitHubAppInstallation returns the ID of the app's installation if
+// there is only one, or only one for the accounts in the whitelist
+func discoverGitHubAppInstallation(appClient *github.Client, whitelist []string) (int64, error) {
+	var installations []*github.Installation
+	options := github.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := appClient.Apps.ListInstallations(context.Background(), &options)
+		if err != nil {
+			return 0, fmt.Errorf("error listing the GitHub App installations: %v", err)
+		}
+		installations = append(installations, page...)
+		if resp.NextPage == 0 {
+			break
+		}
+		options.Page = resp.NextPage
+	}
+
+	var candidates []*github.Installation
+	var accounts []string
+	for _, installation := range installations {
+		login := installation.GetAccount().GetLogin()
+		accounts = append(accounts, login)
+		if len(whitelist) == 0 || contains(whitelist, login) {
+			candidates = append(candidates, installation)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return 0, errors.New("the GitHub App has no installation to back up")
+	case 1:
+		slog.Info("Using GitHub App installation", "account", candidates[0].GetAccount().GetLogin(), "installation_id", candidates[0].GetID())
+		return candidates[0].GetID(), nil
+	}
+	return 0, fmt.Errorf("the GitHub App is installed on several accounts (%s), please specify the installation ID", strings.Join(accounts, ", "))
+}
+
+// githubAppTokenSource mints installation access tokens
+type githubAppTokenSource struct {
+	client         *github.Client
+	installationID int64
+}
+
+func (s *githubAppTokenSource) Token() (*oauth2.Token, error) {
+	token, _, err := s.client.Apps.CreateInstallationToken(context.Background(), s.installationID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating a GitHub App installation token: %v", err)
+	}
+	registerSecret(token.GetToken())
+	slog.Debug("Created GitHub App installation token", "installation_id", s.installationID, "expires_at", token.GetExpiresAt())
+	return &oauth2.Token{
+		AccessToken: token.GetToken(),
+		TokenType:   "token",
+		Expiry:      token.GetExpiresAt(),
+	}, nil
+}
+
+// githubAppJWTTransport authenticates requests as the app itself
+type githubAppJWTTransport struct {
+	appID int64
+	key   *rsa.PrivateKey
+	base  http.RoundTripper
+
+	mutex  sync.Mutex
+	jwt    string
+	expiry time.Time
+}
+
+func (t *githubAppJWTTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.token()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
+
+// token returns a JWT for the app, reusing it until shortly before it expires
+func (t *githubAppJWTTransport) token() (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := githubAppNow()
+	if t.jwt != "" && now.Before(t.expiry.Add(-time.Minute)) {
+		return t.jwt, nil
+	}
+	// GitHub accepts JWTs valid for at most 10 minutes. The issue time is
+	// backdated to allow for clock drift.
+	t.expiry = now.Add(9 * time.Minute)
+	jwt, err := signGitHubAppJWT(t.appID, t.key, now.Add(-time.Minute), t.expiry)
+	if err != nil {
+		return "", err
+	}
+	t.jwt = jwt
+	return jwt, nil
+}
+
+// signGitHubAppJWT creates an RS256 signed JWT identifying the app
+func signGitHubAppJWT(appID int64, key *rsa.PrivateKey, issuedAt, expiresAt time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": issuedAt.Unix(),
+		"exp": expiresAt.Unix(),
+		"iss": fmt.Sprint(appID),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// parseRSAPrivateKey parses a PEM encoded PKCS#1 or PKCS#8 RSA private key,
+// as downloaded from the GitHub App settings
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA private key")
+	}
+	return rsaKey, nil
+}
+
+// githubAppGitAuth returns the git configuration which authenticates HTTPS
+// git operations on host with the current installation token. It is
+// evaluated for every git command, so long runs pick up refreshed tokens.
+func githubAppGitAuth(ts oauth2.TokenSource, host string) func() [][2]string {
+	return func() [][2]string {
+		token, err := ts.Token()
+		if err != nil {
+			slog.Error("Error refreshing the GitHub App installation token", "error", err)
+			return nil
+		}
+		credentials := base64.StdEncoding.EncodeToString([]byte(githubAppGitUsername + ":" + token.AccessToken))
+		return [][2]string{
+			{"http.https://" + host + "/.extraHeader", "Authorization: Basic " + credentials},
+		}
+	}
+}
+
+// listGithubAppRepositories lists the repositories the app installation
+// has been granted access to
+func listGithubAppRepositories(
+	ctx context.Context,
+	client *github.Client,
+	githubNamespaceWhitelist []string,
+	ignoreFork bool,
+	fn func(*Repository) error,
+) error {
+	options := github.ListOptions{PerPage: 100}
+	for {
+		result, resp, err := client.Apps.ListRepos(ctx, &options)
+		if err != nil {
+			return err
+		}
+		for _, repo := range result.Repositories {
+			if repo.GetFork() && ignoreFork {
+				continue
+			}
+			namespace := strings.Split(repo.GetFullName(), "/")[0]
+			if len(githubNamespaceWhitelist) > 0 && !contains(githubNamespaceWhitelist, namespace) {
+				continue
+			}
+			err := fn(&Repository{
+				CloneURL:  getCloneURL(repo.GetCloneURL(), repo.GetSSHURL()),
+				Name:      repo.GetName(),
+				Namespace: namespace,
+				Private:   repo.GetPrivate(),
+				PushedAt:  repo.GetPushedAt().Time,
+				Size:      int64(repo.GetSize()) * 1024,
+				ForkOf:    githubForkOf(ctx, client, repo),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		options.Page = resp.NextPage
+	}
+	return nil
+}
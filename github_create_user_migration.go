@@ -2,11 +2,12 @@ package main
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"log/slog"
 	"time"
 )
 
-func handleGithubCreateUserMigration(client interface{}, c *appConfig) {
+func handleGithubCreateUserMigration(client interface{}, c *appConfig) error {
 	repos, err := getRepositories(
 		client,
 		c.service,
@@ -18,10 +19,10 @@ func handleGithubCreateUserMigration(client interface{}, c *appConfig) {
 		c.forgejoRepoType,
 	)
 	if err != nil {
-		log.Fatalf("Error getting list of repositories: %v", err)
+		return fmt.Errorf("error getting list of repositories: %v", err)
 	}
 
-	log.Printf("Creating a user migration for %d repos", len(repos))
+	slog.Info("Creating a user migration", "repos", len(repos))
 	m, err := createGithubUserMigration(
 		context.Background(),
 		client, repos,
@@ -29,7 +30,7 @@ func handleGithubCreateUserMigration(client interface{}, c *appConfig) {
 		c.githubCreateUserMigrationRetryMax,
 	)
 	if err != nil {
-		log.Fatalf("Error creating migration: %v", err)
+		return fmt.Errorf("error creating migration: %v", err)
 	}
 
 	if c.githubWaitForMigrationComplete {
@@ -41,27 +42,27 @@ func handleGithubCreateUserMigration(client interface{}, c *appConfig) {
 			migrationStatePollingDuration,
 		)
 		if err != nil {
-			log.Fatalf("Error querying/downloading migration: %v", err)
+			return fmt.Errorf("error querying/downloading migration: %v", err)
 		}
 	}
 
 	orgs, err := getGithubUserOwnedOrgs(context.Background(), client)
 	if err != nil {
-		log.Fatal("Error getting user organizations", err)
+		return fmt.Errorf("error getting user organizations: %v", err)
 	}
 	for _, o := range orgs {
 		orgRepos, err := getGithubOrgRepositories(context.Background(), client, o)
 		if err != nil {
-			log.Fatal("Error getting org repos", err)
+			return fmt.Errorf("error getting org repos: %v", err)
 		}
 		if len(orgRepos) == 0 {
-			log.Printf("No repos found in %s", *o.Login)
+			slog.Info("No repos found in organization", "org", *o.Login)
 			continue
 		}
-		log.Printf("Creating a org migration (%s) for %d repos", *o.Login, len(orgRepos))
+		slog.Info("Creating an org migration", "org", *o.Login, "repos", len(orgRepos))
 		oMigration, err := createGithubOrgMigration(context.Background(), client, *o.Login, orgRepos)
 		if err != nil {
-			log.Fatalf("Error creating migration: %v", err)
+			return fmt.Errorf("error creating migration: %v", err)
 		}
 		if c.githubWaitForMigrationComplete {
 			migrationStatePollingDuration := 60 * time.Second
@@ -76,4 +77,5 @@ func handleGithubCreateUserMigration(client interface{}, c *appConfig) {
 		}
 	}
 
+	return nil
 }
@@ -6,18 +6,18 @@ import (
 	gitlab "github.com/xanzy/go-gitlab"
 )
 
-func getGitlabRepositories(
+func listGitlabRepositories(
 	client *gitlab.Client,
 	gitlabProjectVisibility string, gitlabProjectMembershipType string,
 	ignoreFork bool,
-) ([]*Repository, error) {
-
-	var repositories []*Repository
+	fn func(*Repository) error,
+) error {
 
 	var visibility gitlab.VisibilityValue
 	var boolTrue bool = true
 
-	gitlabListOptions := gitlab.ListProjectsOptions{}
+	// Statistics gives us the repository size for ordering the backups
+	gitlabListOptions := gitlab.ListProjectsOptions{Statistics: &boolTrue}
 
 	switch gitlabProjectMembershipType {
 	case "owner":
@@ -49,25 +49,53 @@ func getGitlabRepositories(
 	for {
 		repos, resp, err := client.Projects.ListProjects(&gitlabListOptions)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		for _, repo := range repos {
 			if repo.ForkedFromProject != nil && ignoreFork {
 				continue
 			}
-			namespace := strings.Split(repo.PathWithNamespace, "/")[0]
-			cloneURL := getCloneURL(repo.WebURL, repo.SSHURLToRepo)
-			repositories = append(repositories, &Repository{
-				CloneURL:  cloneURL,
-				Name:      repo.Name,
-				Namespace: namespace,
-				Private:   repo.Visibility == "private",
-			})
+			r := gitlabRepository(repo, getCloneURL(repo.WebURL, repo.SSHURLToRepo))
+			if repo.LastActivityAt != nil {
+				r.PushedAt = *repo.LastActivityAt
+			}
+			if repo.Statistics != nil {
+				r.Size = repo.Statistics.RepositorySize
+			}
+			if parent := repo.ForkedFromProject; parent != nil && objectPools {
+				r.ForkOf = forkNetworkRoot(cloneURLHost(repo.WebURL), parent.PathWithNamespace, func(name string) (string, error) {
+					project, _, err := client.Projects.GetProject(name, nil)
+					if err != nil || project.ForkedFromProject == nil {
+						return "", err
+					}
+					return project.ForkedFromProject.PathWithNamespace, nil
+				})
+			}
+			err := fn(r)
+			if err != nil {
+				return err
+			}
 		}
 		if resp.NextPage == 0 {
 			break
 		}
 		gitlabListOptions.ListOptions.Page = resp.NextPage
 	}
-	return repositories, nil
+	return nil
+}
+
+// gitlabRepository returns the repository of a GitLab project, named the
+// same way whether it was listed or pushed to so that it is backed up in
+// the same directory
+func gitlabRepository(project *gitlab.Project, cloneURL string) *Repository {
+	r := &Repository{
+		CloneURL:  cloneURL,
+		Name:      project.Name,
+		Namespace: strings.Split(project.PathWithNamespace, "/")[0],
+		Private:   project.Visibility == gitlab.PrivateVisibility,
+	}
+	if project.PathWithNamespace != repoFullName(r) {
+		r.FullName = project.PathWithNamespace
+	}
+	return r
 }
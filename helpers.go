@@ -2,7 +2,11 @@ package main
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
 
 	forgejo "codeberg.org/mvdkleijn/forgejo-sdk/forgejo/v2"
 	"github.com/google/go-github/v34/github"
@@ -11,46 +15,51 @@ import (
 )
 
 // getUsername retrieves the username for the authenticated user from the git service
-func getUsername(client interface{}, service string) string {
+func getUsername(client interface{}, service string) (string, error) {
 
 	if client == nil {
-		log.Fatalf("Couldn't acquire a client to talk to %s", service)
+		return "", fmt.Errorf("couldn't acquire a client to talk to %s", service)
+	}
+
+	// Installation tokens don't belong to a user
+	if service == "github" && githubAppAuth {
+		return githubAppGitUsername, nil
 	}
 
 	if service == "github" {
 		ctx := context.Background()
 		user, _, err := client.(*github.Client).Users.Get(ctx, "")
 		if err != nil {
-			log.Fatal("Error retrieving username", err.Error())
+			return "", fmt.Errorf("error retrieving username: %v", err)
 		}
-		return *user.Login
+		return *user.Login, nil
 	}
 
 	if service == "gitlab" {
 		user, _, err := client.(*gitlab.Client).Users.CurrentUser()
 		if err != nil {
-			log.Fatal("Error retrieving username", err.Error())
+			return "", fmt.Errorf("error retrieving username: %v", err)
 		}
-		return user.Username
+		return user.Username, nil
 	}
 
 	if service == "bitbucket" {
 		user, err := client.(*bitbucket.Client).User.Profile()
 		if err != nil {
-			log.Fatal("Error retrieving username", err.Error())
+			return "", fmt.Errorf("error retrieving username: %v", err)
 		}
-		return user.Username
+		return user.Username, nil
 	}
 
 	if service == "forgejo" {
 		user, _, err := client.(*forgejo.Client).GetMyUserInfo()
 		if err != nil {
-			log.Fatal("Error retrieving username", err.Error())
+			return "", fmt.Errorf("error retrieving username: %v", err)
 		}
-		return user.UserName
+		return user.UserName, nil
 	}
 
-	return ""
+	return "", nil
 }
 
 // validGitlabProjectMembership checks if the given membership type is valid
@@ -79,5 +88,34 @@ func getCloneURL(httpsURL, sshURL string) string {
 	if useHTTPSClone != nil && *useHTTPSClone {
 		return httpsURL
 	}
-	return sshURL
+	return withSSHPort(sshURL, sshPort)
+}
+
+// withSSHPort adds port to an SSH clone URL which doesn't specify one.
+// The scp-like syntax (git@host:path) can't specify a port, so such URLs
+// are turned into ssh:// URLs.
+func withSSHPort(sshURL string, port int) string {
+	if port == 0 || port == 22 || sshURL == "" {
+		return sshURL
+	}
+	if strings.HasPrefix(sshURL, "ssh://") {
+		u, err := url.Parse(sshURL)
+		if err != nil || u.Port() != "" {
+			return sshURL
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(port))
+		return u.String()
+	}
+	if strings.Contains(sshURL, "://") {
+		return sshURL
+	}
+	hostPart, path, ok := strings.Cut(sshURL, ":")
+	if !ok {
+		return sshURL
+	}
+	userInfo := ""
+	if user, host, ok := strings.Cut(hostPart, "@"); ok {
+		userInfo, hostPart = user+"@", host
+	}
+	return "ssh://" + userInfo + net.JoinHostPort(hostPart, strconv.Itoa(port)) + "/" + strings.TrimPrefix(path, "/")
 }
\ No newline at end of file
@@ -67,3 +67,24 @@ func TestValidGitlabProjectMembership(t *testing.T) {
 		}
 	}
 }
+
+func TestWithSSHPort(t *testing.T) {
+	var testCases = []struct {
+		sshURL   string
+		port     int
+		expected string
+	}{
+		{"git@github.com:user/repo.git", 0, "git@github.com:user/repo.git"},
+		{"git@github.com:user/repo.git", 22, "git@github.com:user/repo.git"},
+		{"git@git.mycompany.com:user/repo.git", 2222, "ssh://git@git.mycompany.com:2222/user/repo.git"},
+		{"git.mycompany.com:user/repo.git", 2222, "ssh://git.mycompany.com:2222/user/repo.git"},
+		{"ssh://git@git.mycompany.com/user/repo.git", 2222, "ssh://git@git.mycompany.com:2222/user/repo.git"},
+		{"ssh://git@git.mycompany.com:7999/user/repo.git", 2222, "ssh://git@git.mycompany.com:7999/user/repo.git"},
+		{"https://git.mycompany.com/user/repo.git", 2222, "https://git.mycompany.com/user/repo.git"},
+	}
+	for _, tc := range testCases {
+		if got := withSSHPort(tc.sshURL, tc.port); got != tc.expected {
+			t.Errorf("%s with port %d: expected %s, got %s", tc.sshURL, tc.port, tc.expected, got)
+		}
+	}
+}
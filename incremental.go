@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bundleChain is the index of the bundles of a repository uploaded with
+// the incremental format: a full bundle followed by incremental ones, each
+// containing what changed since the previous one
+type bundleChain struct {
+	Repository string      `json:"repository"`
+	Bundles    []chainLink `json:"bundles"`
+}
+
+type chainLink struct {
+	Object string `json:"object"`
+	Full   bool   `json:"full"`
+	// Tips of the refs of the repository when the bundle was created
+	Refs map[string]string `json:"refs"`
+	// Commits the bundle is based on, which the previous bundles contain
+	Prerequisites []string  `json:"prerequisites,omitempty"`
+	Size          int64     `json:"size"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// chainName returns the name of the chain index of a repository
+func chainName(repo string) string {
+	return repo + ".chain.json"
+}
+
+func loadChain(ctx context.Context, store objectStore, name string) (*bundleChain, error) {
+	r, err := store.get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	chain := &bundleChain{}
+	if err := json.NewDecoder(r).Decode(chain); err != nil {
+		return nil, fmt.Errorf("error parsing the chain index %s: %v", name, err)
+	}
+	return chain, nil
+}
+
+func saveChain(ctx context.Context, store objectStore, name string, chain *bundleChain) error {
+	data, err := json.MarshalIndent(chain, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.put(ctx, name, bytes.NewReader(data), int64(len(data)))
+}
+
+// repoRefs returns the tips of the refs of the repository at repoDir
+func repoRefs(repoDir string) (map[string]string, error) {
+	cmd := newGitCommand("-C", repoDir, "for-each-ref", "--format=%(objectname) %(refname)")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("error listing the refs of %s: %v", repoDir, err)
+	}
+	refs := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if object, ref, ok := strings.Cut(line, " "); ok {
+			refs[ref] = object
+		}
+	}
+	return refs, nil
+}
+
+// runGitStdin runs git in repoDir with the lines on its standard input and
+// returns its output
+func runGitStdin(repoDir string, lines []string, args ...string) ([]byte, error) {
+	cmd := newGitCommand(append([]string{"-C", repoDir}, args...)...)
+	cmd.Stdin = strings.NewReader(strings.Join(lines, "\n") + "\n")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
+}
+
+// incrementBase returns the commits an incremental bundle of the
+// repository at repoDir can be based on, given the tips of its refs when
+// the previous bundle was created. ok is false if an incremental bundle
+// can't carry the changes: a ref was deleted, the previous tips are gone
+// or a ref now points to an object the previous bundles already contain,
+// which git leaves out of the bundle.
+func incrementBase(repoDir string, previous, current map[string]string) (base []string, ok bool, err error) {
+	seen := make(map[string]bool)
+	for ref, tip := range previous {
+		if _, exists := current[ref]; !exists {
+			return nil, false, nil
+		}
+		if !seen[tip] {
+			seen[tip] = true
+			base = append(base, tip)
+		}
+	}
+	if len(base) == 0 {
+		return nil, false, nil
+	}
+	sort.Strings(base)
+
+	out, err := runGitStdin(repoDir, base, "cat-file", "--batch-check")
+	if err != nil {
+		return nil, false, err
+	}
+	if bytes.Contains(out, []byte(" missing")) {
+		return nil, false, nil
+	}
+
+	excluded := make([]string, len(base))
+	for i, tip := range base {
+		excluded[i] = "^" + tip
+	}
+	out, err = runGitStdin(repoDir, excluded, "rev-list", "--objects", "--all", "--stdin")
+	if err != nil {
+		return nil, false, err
+	}
+	included := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		object, _, _ := strings.Cut(scanner.Text(), " ")
+		included[object] = true
+	}
+	for ref, tip := range current {
+		if previous[ref] != tip && !included[tip] {
+			return nil, false, nil
+		}
+	}
+	return base, true, nil
+}
+
+// writeIncrementalBundle writes a bundle of the refs of the repository at
+// repoDir which changed since the base commits to w
+func writeIncrementalBundle(repoDir string, base []string, w io.Writer) error {
+	excluded := make([]string, len(base))
+	for i, tip := range base {
+		excluded[i] = "^" + tip
+	}
+	cmd := newGitCommand("-C", repoDir, "bundle", "create", "-", "--all", "--stdin")
+	cmd.Stdin = strings.NewReader(strings.Join(excluded, "\n") + "\n")
+	var stderr bytes.Buffer
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error creating the incremental bundle of %s: %v: %s", repoDir, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// uploadIncremental uploads the changes of the repository at repoDir since
+// it was last uploaded as an incremental bundle, or a full bundle starting
+// a new chain if there is no chain to add to or the changes can't be
+// carried by an incremental bundle
+func (u *uploader) uploadIncremental(repoDir string, repo *Repository, bare bool, state string, clone *cloneStrategy, previous manifestEntry, uploaded bool) error {
+	ctx := context.Background()
+	logger := repoLogger(repo)
+	name := repoFullName(repo)
+	refs, err := repoRefs(repoDir)
+	if err != nil {
+		return err
+	}
+
+	var chain, oldChain *bundleChain
+	var base []string
+	if uploaded && previous.Format == uploadFormatIncremental && previous.Encryption == u.encrypter.name() {
+		oldChain, err = loadChain(ctx, u.store, previous.Object)
+		if err != nil {
+			logger.Warn("Error loading the chain of bundles, starting a new one", "error", err)
+		} else {
+			var ok bool
+			base, ok, err = incrementBase(repoDir, previous.Refs, refs)
+			if err != nil {
+				return err
+			}
+			if ok {
+				chain = oldChain
+			} else {
+				logger.Info("Refs were deleted or rewritten, starting a new chain of bundles")
+			}
+		}
+	}
+	full := chain == nil
+	if full {
+		chain = &bundleChain{Repository: name}
+		base = nil
+	}
+
+	now := time.Now().UTC()
+	kind := "incremental"
+	if full {
+		kind = "full"
+	}
+	// The position in the chain keeps the names of bundles created within
+	// the same second apart
+	object := fmt.Sprintf("%s.bundles/%s-%d-%s.bundle%s", name, now.Format("20060102T150405Z"), len(chain.Bundles), kind, u.encrypter.extension())
+	size, err := u.writeObject(logger, object, func(w io.Writer) error {
+		if full {
+			return writeBundle(repoDir, w)
+		}
+		return writeIncrementalBundle(repoDir, base, w)
+	})
+	if err != nil {
+		return err
+	}
+	chain.Bundles = append(chain.Bundles, chainLink{
+		Object:        object,
+		Full:          full,
+		Refs:          refs,
+		Prerequisites: base,
+		Size:          size,
+		CreatedAt:     now,
+	})
+	index := chainName(name)
+	if err := saveChain(ctx, u.store, index, chain); err != nil {
+		return err
+	}
+
+	// Remove what the new chain replaces
+	if uploaded && full {
+		if previous.Format == uploadFormatIncremental {
+			if oldChain != nil {
+				for _, link := range oldChain.Bundles {
+					if link.Object == object {
+						continue
+					}
+					if err := u.store.remove(ctx, link.Object); err != nil {
+						logger.Warn("Error removing the previous chain of bundles", "object", link.Object, "error", err)
+					}
+				}
+			}
+		} else if err := u.store.remove(ctx, previous.Object); err != nil {
+			logger.Warn("Error removing the previous upload of the repository", "object", previous.Object, "error", err)
+		}
+	}
+
+	var total int64
+	for _, link := range chain.Bundles {
+		total += link.Size
+	}
+	u.mu.Lock()
+	u.setEntry(name, &manifestEntry{
+		Object:     index,
+		Format:     uploadFormatIncremental,
+		State:      state,
+		Size:       total,
+		CloneURL:   repo.CloneURL,
+		Bare:       bare,
+		UploadedAt: now,
+		Encryption: u.encrypter.name(),
+		Refs:       refs,
+		Clone:      clone,
+	})
+	u.mu.Unlock()
+	return nil
+}
+
+// assembleBundles recreates a repository at repoDir from a full bundle
+// followed by incremental ones, and points it to cloneURL
+func assembleBundles(bundles []string, repoDir string, bare bool, cloneURL string) error {
+	source := bundles[0]
+	if len(bundles) > 1 {
+		mirror := repoDir
+		if !bare {
+			tmp, err := os.MkdirTemp("", "gitbackup-assemble-*")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(tmp)
+			mirror = filepath.Join(tmp, "repo.git")
+		}
+		if out, err := newGitCommand("clone", "--mirror", bundles[0], mirror).CombinedOutput(); err != nil {
+			return fmt.Errorf("error cloning the full bundle: %v: %s", err, out)
+		}
+		for i, bundle := range bundles[1:] {
+			if out, err := newGitCommand("-C", mirror, "fetch", "--quiet", bundle, "+refs/*:refs/*").CombinedOutput(); err != nil {
+				return fmt.Errorf("error applying incremental bundle %d: %v: %s", i+1, err, out)
+			}
+		}
+		source = mirror
+	}
+	if source != repoDir {
+		args := []string{"clone"}
+		if bare {
+			args = append(args, "--mirror")
+		}
+		if out, err := newGitCommand(append(args, source, repoDir)...).CombinedOutput(); err != nil {
+			return fmt.Errorf("error cloning the bundle: %v: %s", err, out)
+		}
+	}
+	// Point the repository back to the git host
+	if cloneURL != "" {
+		if out, err := newGitCommand("-C", repoDir, "remote", "set-url", "origin", cloneURL).CombinedOutput(); err != nil {
+			return fmt.Errorf("error setting the URL of origin: %v: %s", err, out)
+		}
+	}
+	return nil
+}
+
+// restoreChain recreates the repository of an entry uploaded with the
+// incremental format from its chain of bundles
+func restoreChain(ctx context.Context, store objectStore, d *decrypter, entry manifestEntry, repoDir string) error {
+	chain, err := loadChain(ctx, store, entry.Object)
+	if err != nil {
+		return err
+	}
+	if len(chain.Bundles) == 0 || !chain.Bundles[0].Full {
+		return fmt.Errorf("the chain index %s doesn't start with a full bundle", entry.Object)
+	}
+	var bundles []string
+	defer func() {
+		for _, bundle := range bundles {
+			os.Remove(bundle)
+		}
+	}()
+	for _, link := range chain.Bundles {
+		bundle, err := downloadObject(ctx, store, d, link.Object, entry.Encryption)
+		if err != nil {
+			return err
+		}
+		bundles = append(bundles, bundle)
+	}
+	return assembleBundles(bundles, repoDir, entry.Bare, entry.CloneURL)
+}
+
+// localChainBundles returns the bundles listed by a chain index file, which
+// are next to it as they are in the storage
+func localChainBundles(indexPath string) ([]string, error) {
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	chain := &bundleChain{}
+	if err := json.Unmarshal(data, chain); err != nil {
+		return nil, fmt.Errorf("error parsing the chain index %s: %v", indexPath, err)
+	}
+	var bundles []string
+	for _, link := range chain.Bundles {
+		bundles = append(bundles, filepath.Join(filepath.Dir(indexPath), path.Base(path.Dir(link.Object)), path.Base(link.Object)))
+	}
+	return bundles, nil
+}
+
+// bundleEncryption returns the encryption of a bundle file, from its
+// extension
+func bundleEncryption(bundle string) string {
+	switch filepath.Ext(bundle) {
+	case ".age":
+		return encryptionAge
+	case ".gpg":
+		return encryptionOpenPGP
+	}
+	return ""
+}
+
+// handleReassemble recreates a repository at dest from bundle files: a
+// full bundle followed by incremental ones, or the chain index listing
+// them. keys is only called if some of the bundles are encrypted.
+func handleReassemble(files []string, dest string, bare bool, cloneURL string, keys func() (encryptionConfig, error), out io.Writer) error {
+	if len(files) == 0 {
+		return errors.New("please specify the bundles or their chain index")
+	}
+	if dest == "" {
+		return errors.New("please specify the directory to reassemble the repository into")
+	}
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("%s already exists", dest)
+	}
+	bundles := files
+	if len(files) == 1 && strings.HasSuffix(files[0], ".chain.json") {
+		var err error
+		if bundles, err = localChainBundles(files[0]); err != nil {
+			return err
+		}
+	}
+
+	var d *decrypter
+	var plaintext []string
+	defer func() {
+		for _, bundle := range plaintext {
+			os.Remove(bundle)
+		}
+	}()
+	for i, bundle := range bundles {
+		encryption := bundleEncryption(bundle)
+		if encryption == "" {
+			continue
+		}
+		if d == nil {
+			ec, err := keys()
+			if err != nil {
+				return err
+			}
+			d = &decrypter{ec: ec}
+		}
+		f, err := os.Open(bundle)
+		if err != nil {
+			return err
+		}
+		decrypted, err := decryptFile(d, encryption, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("error decrypting %s: %v", bundle, err)
+		}
+		plaintext = append(plaintext, decrypted)
+		bundles[i] = decrypted
+	}
+
+	if err := assembleBundles(bundles, dest, bare, cloneURL); err != nil {
+		os.RemoveAll(dest)
+		return err
+	}
+	fmt.Fprintf(out, "Reassembled %s from %d bundles\n", dest, len(bundles))
+	return nil
+}
+
+// decryptFile decrypts r into a temporary file and returns its path
+func decryptFile(d *decrypter, encryption string, r io.Reader) (string, error) {
+	plaintext, err := d.decrypt(encryption, r)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp("", "gitbackup-reassemble-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmp, plaintext)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// gitTest runs git with a test identity and fails the test on errors
+func gitTest(t *testing.T, args ...string) string {
+	t.Helper()
+	args = append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+	out, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v: %s", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestUploadIncremental(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	oldFS := appFS
+	defer func() { appFS = oldFS }()
+	appFS = afero.NewOsFs()
+
+	var tests = []struct {
+		name       string
+		encryption func(t *testing.T) encryptionConfig
+	}{
+		{"plain", nil},
+		{"age", newTestAgeKeys},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			backupDir := t.TempDir()
+			repoDir := filepath.Join(backupDir, "octocat", "repo")
+			newTestRepository(t, repoDir)
+			repo := &Repository{Namespace: "octocat", Name: "repo", CloneURL: "https://github.com/octocat/repo.git"}
+			storeDir := t.TempDir()
+			c := &appConfig{service: "github", backupDir: backupDir}
+			if tc.encryption != nil {
+				c.encryption = tc.encryption(t)
+			}
+			store := &fsStore{fs: afero.NewOsFs(), dir: storeDir, name: "local"}
+			e, err := newEncrypter(c.encryption)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u := &uploader{store: store, format: uploadFormatIncremental, encrypter: e, manifest: &manifest{Repositories: map[string]manifestEntry{}}}
+
+			// upload uploads the repository and returns the kinds of the
+			// bundles of its chain
+			upload := func() []bool {
+				t.Helper()
+				if err := u.upload(repoDir, repo, false); err != nil {
+					t.Fatal(err)
+				}
+				chain, err := loadChain(context.Background(), store, chainName("octocat/repo"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				var full []bool
+				for _, link := range chain.Bundles {
+					full = append(full, link.Full)
+				}
+				return full
+			}
+			restore := func() string {
+				t.Helper()
+				dest := filepath.Join(t.TempDir(), "repo")
+				// Mirrors keep all the branches
+				entry := u.manifest.Repositories["octocat/repo"]
+				entry.Bare = true
+				if err := restoreChain(context.Background(), store, &decrypter{ec: c.encryption}, entry, dest); err != nil {
+					t.Fatal(err)
+				}
+				return gitTest(t, "-C", dest, "for-each-ref", "--format=%(objectname) %(refname)", "refs/heads", "refs/tags")
+			}
+			refs := func() string {
+				return gitTest(t, "-C", repoDir, "for-each-ref", "--format=%(objectname) %(refname)", "refs/heads", "refs/tags")
+			}
+
+			if got := upload(); !reflect.DeepEqual(got, []bool{true}) {
+				t.Fatalf("first upload created %v, want a full bundle", got)
+			}
+
+			// New commits, a branch and a tag are added to the chain
+			gitTest(t, "-C", repoDir, "commit", "-q", "--allow-empty", "-m", "second")
+			gitTest(t, "-C", repoDir, "branch", "feature")
+			gitTest(t, "-C", repoDir, "tag", "-a", "v1", "-m", "v1")
+			if got := upload(); !reflect.DeepEqual(got, []bool{true, false}) {
+				t.Fatalf("second upload created %v, want an incremental bundle", got)
+			}
+			gitTest(t, "-C", repoDir, "checkout", "-q", "feature")
+			gitTest(t, "-C", repoDir, "commit", "-q", "--allow-empty", "-m", "feature")
+			if got := upload(); !reflect.DeepEqual(got, []bool{true, false, false}) {
+				t.Fatalf("third upload created %v, want an incremental bundle", got)
+			}
+			if got, want := restore(), refs(); got != want {
+				t.Errorf("restored refs:\n%s\nwant:\n%s", got, want)
+			}
+
+			// Unchanged repositories aren't uploaded again
+			u.changed = false
+			if got := upload(); len(got) != 3 || u.changed {
+				t.Errorf("unchanged repository was uploaded again: %v", got)
+			}
+
+			// Deleting a ref starts a new chain, replacing the old one
+			chain, _ := loadChain(context.Background(), store, chainName("octocat/repo"))
+			gitTest(t, "-C", repoDir, "checkout", "-q", "-")
+			gitTest(t, "-C", repoDir, "branch", "-D", "feature")
+			if got := upload(); !reflect.DeepEqual(got, []bool{true}) {
+				t.Fatalf("upload after deleting a branch created %v, want a new full bundle", got)
+			}
+			// The full bundle keeps its name if it is created within the
+			// same second
+			for _, link := range chain.Bundles[1:] {
+				if _, err := store.get(context.Background(), link.Object); !errors.Is(err, errObjectNotFound) {
+					t.Errorf("bundle %s of the old chain wasn't removed: %v", link.Object, err)
+				}
+			}
+
+			// So does pointing a ref to a commit the chain already has
+			gitTest(t, "-C", repoDir, "commit", "-q", "--allow-empty", "-m", "third")
+			if got := upload(); !reflect.DeepEqual(got, []bool{true, false}) {
+				t.Fatalf("upload after a commit created %v, want an incremental bundle", got)
+			}
+			gitTest(t, "-C", repoDir, "reset", "-q", "--hard", "HEAD~1")
+			if got := upload(); !reflect.DeepEqual(got, []bool{true}) {
+				t.Fatalf("upload after a force-push created %v, want a new full bundle", got)
+			}
+			if got, want := restore(), refs(); got != want {
+				t.Errorf("restored refs:\n%s\nwant:\n%s", got, want)
+			}
+
+			// The repository can be reassembled from the downloaded bundles
+			gitTest(t, "-C", repoDir, "commit", "-q", "--allow-empty", "-m", "fourth")
+			upload()
+			keys := func() (encryptionConfig, error) { return c.encryption, nil }
+			dest := filepath.Join(t.TempDir(), "repo.git")
+			var out bytes.Buffer
+			if err := handleReassemble([]string{filepath.Join(storeDir, "octocat", "repo.chain.json")}, dest, true, repo.CloneURL, keys, &out); err != nil {
+				t.Fatal(err)
+			}
+			got := gitTest(t, "-C", dest, "for-each-ref", "--format=%(objectname) %(refname)", "refs/heads", "refs/tags")
+			if want := refs(); got != want {
+				t.Errorf("reassembled refs:\n%s\nwant:\n%s", got, want)
+			}
+			if origin := gitTest(t, "-C", dest, "remote", "get-url", "origin"); origin != repo.CloneURL {
+				t.Errorf("origin of the reassembled repository = %q, want %q", origin, repo.CloneURL)
+			}
+
+			// The uploads of the repository are removed when it is pruned
+			chain, _ = loadChain(context.Background(), store, chainName("octocat/repo"))
+			os.RemoveAll(repoDir)
+			os.MkdirAll(filepath.Join(backupDir, "octocat", "other"), 0755)
+			u.manifest.Repositories["octocat/other"] = manifestEntry{Object: "octocat/other.bundle"}
+			u.prune(backupDir)
+			for _, link := range append(chain.Bundles, chainLink{Object: chainName("octocat/repo")}) {
+				if _, err := store.get(context.Background(), link.Object); !errors.Is(err, errObjectNotFound) {
+					t.Errorf("%s of the pruned repository wasn't removed: %v", link.Object, err)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleReassembleBundles(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	repoDir := filepath.Join(t.TempDir(), "repo")
+	newTestRepository(t, repoDir)
+	bundles := t.TempDir()
+	full := filepath.Join(bundles, "full.bundle")
+	gitTest(t, "-C", repoDir, "bundle", "create", "-q", full, "--all")
+	tip := gitTest(t, "-C", repoDir, "rev-parse", "HEAD")
+	gitTest(t, "-C", repoDir, "commit", "-q", "--allow-empty", "-m", "second")
+	increment := filepath.Join(bundles, "incremental.bundle")
+	gitTest(t, "-C", repoDir, "bundle", "create", "-q", increment, "--all", "^"+tip)
+
+	noKeys := func() (encryptionConfig, error) {
+		return encryptionConfig{}, errors.New("unexpected decryption")
+	}
+	dest := filepath.Join(t.TempDir(), "repo")
+	var out bytes.Buffer
+	if err := handleReassemble([]string{full, increment}, dest, false, "", noKeys, &out); err != nil {
+		t.Fatal(err)
+	}
+	if got := gitTest(t, "-C", dest, "log", "--format=%s"); got != "second\ninitial" {
+		t.Errorf("reassembled history = %q", got)
+	}
+
+	// The increment can't be applied without the full bundle
+	err := handleReassemble([]string{increment}, filepath.Join(t.TempDir(), "repo"), false, "", noKeys, &out)
+	if err == nil {
+		t.Error("expected an error reassembling an incremental bundle on its own")
+	}
+	if err := handleReassemble([]string{full}, dest, false, "", noKeys, &out); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("handleReassemble() into an existing directory = %v", err)
+	}
+}
+
+func TestLocalChainBundles(t *testing.T) {
+	dir := t.TempDir()
+	index := filepath.Join(dir, "repo.chain.json")
+	os.WriteFile(index, []byte(`{"bundles": [
+		{"object": "octocat/repo.bundles/20240101T000000Z-0-full.bundle.age"},
+		{"object": "octocat/repo.bundles/20240102T000000Z-1-incremental.bundle.age"}
+	]}`), 0644)
+	got, err := localChainBundles(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(dir, "repo.bundles", "20240101T000000Z-0-full.bundle.age"),
+		filepath.Join(dir, "repo.bundles", "20240102T000000Z-1-incremental.bundle.age"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("localChainBundles() = %v, want %v", got, want)
+	}
+	if encryption := bundleEncryption(path.Base(want[0])); encryption != encryptionAge {
+		t.Errorf("bundleEncryption() = %q, want %q", encryption, encryptionAge)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+// locksDir is the directory of the lock files in the backup directory.
+// Namespaces can't start with a dot, so it doesn't clash with one.
+const locksDir = ".locks"
+
+// lockRepository takes the lock of a repository of backupDir, so that the
+// gitbackup processes sharing the backup directory, e.g. serve-webhooks and
+// the daemon, don't run git on the repository at the same time. It waits
+// for the process holding the lock, and returns the function releasing it.
+func lockRepository(backupDir string, repo *Repository) (unlock func(), err error) {
+	file := filepath.Join(backupDir, locksDir, filepath.FromSlash(repo.Namespace), repo.Name+".lock")
+	return lockPath(file, repoLogger(repo))
+}
+
+// lockManifest takes the lock of the manifest of the uploads of backupDir,
+// so that the processes sharing it don't overwrite each other's changes
+func lockManifest(backupDir string) (unlock func(), err error) {
+	return lockPath(filepath.Join(backupDir, locksDir, "manifest.lock"), slog.Default())
+}
+
+// lockPath takes an exclusive lock on file, waiting for another process
+// holding it. The lock is released when the process exits. The backups
+// kept in memory by the tests aren't locked.
+func lockPath(file string, logger *slog.Logger) (unlock func(), err error) {
+	if _, ok := appFS.(*afero.OsFs); !ok {
+		return func() {}, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	locked, err := lockFile(f, false)
+	if err == nil && !locked {
+		logger.Info("Waiting for another gitbackup process", "lock", file)
+		_, err = lockFile(f, true)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,40 @@
+//go:build solaris || aix
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile takes an exclusive lock on f. Unless wait is set, it returns
+// false rather than waiting if another process holds it. These systems
+// don't have flock, so we take a POSIX record lock which only keeps other
+// processes out.
+func lockFile(f *os.File, wait bool) (bool, error) {
+	cmd := unix.F_SETLK
+	if wait {
+		cmd = unix.F_SETLKW
+	}
+	lock := unix.Flock_t{Type: unix.F_WRLCK, Whence: io.SeekStart}
+	for {
+		err := unix.FcntlFlock(f.Fd(), cmd, &lock)
+		switch {
+		case err == nil:
+			return true, nil
+		case errors.Is(err, unix.EINTR):
+			continue
+		case errors.Is(err, unix.EAGAIN), errors.Is(err, unix.EACCES):
+			return false, nil
+		}
+		return false, err
+	}
+}
+
+func unlockFile(f *os.File) error {
+	lock := unix.Flock_t{Type: unix.F_UNLCK, Whence: io.SeekStart}
+	return unix.FcntlFlock(f.Fd(), unix.F_SETLK, &lock)
+}
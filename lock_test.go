@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestLockRepository(t *testing.T) {
+	oldFS := appFS
+	defer func() { appFS = oldFS }()
+	appFS = afero.NewOsFs()
+
+	backupDir := t.TempDir()
+	repo := &Repository{Namespace: "octocat", Name: "repo"}
+	unlock, err := lockRepository(backupDir, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock is only taken once the holder releases it
+	acquired := make(chan struct{})
+	go func() {
+		unlock, err := lockRepository(backupDir, repo)
+		if err != nil {
+			t.Error(err)
+		} else {
+			unlock()
+		}
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Expected the lock to be held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the lock to be released")
+	}
+
+	// Other repositories aren't locked
+	unlock, err = lockRepository(backupDir, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	other, err := lockRepository(backupDir, &Repository{Namespace: "octocat", Name: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other()
+}
+
+func TestSaveManifestMerges(t *testing.T) {
+	oldFS := appFS
+	defer func() { appFS = oldFS }()
+	appFS = afero.NewOsFs()
+
+	// Two processes backing up the same directory, e.g. serve-webhooks and
+	// the daemon, each with the manifest as it was when they started
+	ctx := context.Background()
+	backupDir := t.TempDir()
+	store := &fsStore{fs: afero.NewOsFs(), dir: filepath.Join(t.TempDir(), "github.com"), name: "test"}
+	before := time.Now().UTC()
+	saveManifest(ctx, store, &manifest{Repositories: map[string]manifestEntry{
+		"octocat/removed": {Object: "octocat/removed.bundle", UploadedAt: before},
+		"octocat/pushed":  {Object: "octocat/pushed.bundle", State: "old", UploadedAt: before},
+	}})
+	newTestUploader := func() *uploader {
+		m, err := loadManifest(ctx, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &uploader{store: store, format: uploadFormatBundle, manifest: m, backupDir: backupDir}
+	}
+	daemon, webhooks := newTestUploader(), newTestUploader()
+
+	webhooks.setEntry("octocat/pushed", &manifestEntry{Object: "octocat/pushed.bundle", State: "pushed", UploadedAt: before.Add(2 * time.Second)})
+	daemon.setEntry("octocat/pushed", &manifestEntry{Object: "octocat/pushed.bundle", State: "scheduled", UploadedAt: before.Add(time.Second)})
+	daemon.setEntry("octocat/new", &manifestEntry{Object: "octocat/new.bundle", UploadedAt: before.Add(time.Second)})
+	daemon.setEntry("octocat/removed", nil)
+	if err := webhooks.saveManifest(); err != nil {
+		t.Fatal(err)
+	}
+	if err := daemon.saveManifest(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := loadManifest(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Repositories) != 2 || m.Repositories["octocat/pushed"].State != "pushed" {
+		t.Errorf("Expected the latest uploads of both processes, got %+v", m.Repositories)
+	}
+	if _, ok := m.Repositories["octocat/new"]; !ok {
+		t.Errorf("Expected the new repository, got %+v", m.Repositories)
+	}
+}
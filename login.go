@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/oauth2"
+	"golang.org/x/term"
+)
+
+// The OAuth flows supported by `gitbackup login`
+const (
+	oauthFlowDevice = "device"
+	oauthFlowPKCE   = "pkce"
+)
+
+// oauthProvider describes how to log in to a service with OAuth
+type oauthProvider struct {
+	// The OAuth app registered for gitbackup, if any. Otherwise the
+	// client ID of an app registered by the user is needed.
+	clientID string
+	scopes   []string
+	// The flows the service supports, the first one being the default
+	flows []string
+	// The endpoint paths, relative to the web URL of the git host
+	deviceAuthPath string
+	tokenPath      string
+	authPath       string
+}
+
+var oauthProviders = map[string]oauthProvider{
+	"github": {
+		clientID:       gitbackupClientID,
+		scopes:         []string{"repo", "user", "admin:org"},
+		flows:          []string{oauthFlowDevice},
+		deviceAuthPath: "login/device/code",
+		tokenPath:      "login/oauth/access_token",
+		authPath:       "login/oauth/authorize",
+	},
+	"gitlab": {
+		scopes:         []string{"api"},
+		flows:          []string{oauthFlowDevice, oauthFlowPKCE},
+		deviceAuthPath: "oauth/authorize_device",
+		tokenPath:      "oauth/token",
+		authPath:       "oauth/authorize",
+	},
+	"forgejo": {
+		scopes:    []string{"read:repository", "read:user"},
+		flows:     []string{oauthFlowPKCE},
+		tokenPath: "login/oauth/access_token",
+		authPath:  "login/oauth/authorize",
+	},
+}
+
+// Set with -non-interactive, so that gitbackup never prompts for input
+var nonInteractive bool
+
+// We have it here so that we can override it in the tests
+var stdinIsTerminal = func() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// interactive reports whether gitbackup may prompt the user, e.g. to log
+// in or for the keyring password. Runs without a terminal, such as cron
+// jobs, fail instead.
+func interactive() bool {
+	return !nonInteractive && stdinIsTerminal()
+}
+
+// loginOptions are the settings of `gitbackup login`
+type loginOptions struct {
+	clientID     string
+	flow         string
+	scopes       []string
+	callbackPort int
+}
+
+// keyringLogin is what `gitbackup login` stores in the keyring, so that
+// expiring tokens can be refreshed
+type keyringLogin struct {
+	ClientID string        `json:"client_id"`
+	TokenURL string        `json:"token_url"`
+	Token    *oauth2.Token `json:"token"`
+}
+
+// errLoginExpired is returned when a login stored in the keyring has
+// expired and can't be refreshed
+var errLoginExpired = errors.New("the login has expired")
+
+// We have them here so that we can override them in the tests
+var keyringSetToken = saveToken
+var keyringDeleteToken = deleteToken
+var openBrowser = func(url string) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	if err := cmd.Start(); err != nil {
+		slog.Debug("Error opening the browser", "error", err)
+		return
+	}
+	go cmd.Wait()
+}
+
+// oauthWebURL returns the web URL of the git host, which the OAuth
+// endpoints are relative to
+func oauthWebURL(service, gitHostURL string) (*url.URL, error) {
+	if gitHostURL == "" {
+		return &url.URL{Scheme: "https", Host: knownServices[service], Path: "/"}, nil
+	}
+	u, err := url.Parse(gitHostURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid git host URL: %s", gitHostURL)
+	}
+	// The GitHub Enterprise URL is the one of its API
+	path := strings.TrimSuffix(u.Path, "/")
+	path = strings.TrimSuffix(path, "/api/v3")
+	return &url.URL{Scheme: u.Scheme, Host: u.Host, Path: path + "/"}, nil
+}
+
+// login logs in to the git host of the target with OAuth and stores the
+// token in the keyring
+func login(c *appConfig, opts loginOptions) (*oauth2.Token, error) {
+	provider, ok := oauthProviders[c.service]
+	if !ok {
+		return nil, fmt.Errorf("logging in to %s isn't supported, please use a token (see the Credentials section of the README)", c.service)
+	}
+	if !interactive() {
+		return nil, errors.New("logging in needs an interactive terminal")
+	}
+
+	webURL, err := oauthWebURL(c.service, c.gitHostURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := configureHTTP(c.http); err != nil {
+		return nil, err
+	}
+	clientID := opts.clientID
+	if clientID == "" {
+		clientID = provider.clientID
+	}
+	if clientID == "" {
+		return nil, fmt.Errorf("please register an OAuth application on %s and specify its client ID with -client-id", webURL.Host)
+	}
+	flow := opts.flow
+	if flow == "" {
+		flow = provider.flows[0]
+	}
+	if !contains(provider.flows, flow) {
+		return nil, fmt.Errorf("the %s flow isn't supported for %s (supported: %s)", flow, c.service, strings.Join(provider.flows, ", "))
+	}
+	scopes := opts.scopes
+	if len(scopes) == 0 {
+		scopes = provider.scopes
+	}
+
+	conf := oauth2.Config{
+		ClientID: clientID,
+		Scopes:   scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:       webURL.String() + provider.authPath,
+			TokenURL:      webURL.String() + provider.tokenPath,
+			DeviceAuthURL: webURL.String() + provider.deviceAuthPath,
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+	defer cancel()
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, newHTTPClient())
+
+	var token *oauth2.Token
+	if flow == oauthFlowDevice {
+		token, err = loginDeviceFlow(ctx, conf)
+	} else {
+		token, err = loginPKCEFlow(ctx, conf, opts.callbackPort)
+	}
+	if err != nil {
+		return nil, err
+	}
+	registerSecret(token.AccessToken)
+	registerSecret(token.RefreshToken)
+
+	err = saveKeyringLogin(keyringKey(c.service, c.credentials), keyringLogin{
+		ClientID: clientID,
+		TokenURL: conf.Endpoint.TokenURL,
+		Token:    token,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error saving token: %v", err)
+	}
+	return token, nil
+}
+
+// loginDeviceFlow runs the OAuth device authorization flow: the user
+// enters a code on the git host's website
+func loginDeviceFlow(ctx context.Context, conf oauth2.Config) (*oauth2.Token, error) {
+	code, err := conf.DeviceAuth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error starting the device flow: %v", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Copy code: %s\n", code.UserCode)
+	fmt.Fprintf(os.Stderr, "then open: %s\n", code.VerificationURI)
+
+	token, err := conf.DeviceAccessToken(ctx, code)
+	if err != nil {
+		return nil, fmt.Errorf("error completing the device flow: %v", err)
+	}
+	return token, nil
+}
+
+// loginPKCEFlow runs the OAuth authorization code flow with PKCE: the
+// user authorizes gitbackup in the browser, which is then redirected to a
+// server listening on the loopback interface
+func loginPKCEFlow(ctx context.Context, conf oauth2.Config, callbackPort int) (*oauth2.Token, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", callbackPort))
+	if err != nil {
+		return nil, fmt.Errorf("error listening for the OAuth callback: %v", err)
+	}
+	conf.RedirectURL = fmt.Sprintf("http://127.0.0.1:%d/callback", listener.Addr().(*net.TCPAddr).Port)
+
+	verifier := oauth2.GenerateVerifier()
+	state := oauth2.GenerateVerifier()
+
+	type callbackResult struct {
+		code string
+		err  error
+	}
+	results := make(chan callbackResult, 1)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/callback" {
+				http.NotFound(w, r)
+				return
+			}
+			query := r.URL.Query()
+			var result callbackResult
+			switch {
+			case query.Get("error") != "":
+				result.err = fmt.Errorf("authorization failed: %s %s", query.Get("error"), query.Get("error_description"))
+			case query.Get("state") != state:
+				result.err = errors.New("invalid state in the OAuth callback")
+			default:
+				result.code = query.Get("code")
+			}
+			if result.err != nil {
+				http.Error(w, result.err.Error(), http.StatusBadRequest)
+			} else {
+				fmt.Fprintln(w, "gitbackup is logged in, you can close this window.")
+			}
+			select {
+			case results <- result:
+			default:
+			}
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	authURL := conf.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier))
+	fmt.Fprintf(os.Stderr, "Open this URL in your browser to log in:\n%s\n", authURL)
+	openBrowser(authURL)
+
+	select {
+	case result := <-results:
+		if result.err != nil {
+			return nil, result.err
+		}
+		token, err := conf.Exchange(ctx, result.code, oauth2.VerifierOption(verifier))
+		if err != nil {
+			return nil, fmt.Errorf("error exchanging the authorization code: %v", err)
+		}
+		return token, nil
+	case <-ctx.Done():
+		return nil, errors.New("timed out waiting for the authorization in the browser")
+	}
+}
+
+// saveKeyringLogin stores a login in the keyring under key
+func saveKeyringLogin(key string, l keyringLogin) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return keyringSetToken(key, string(data))
+}
+
+// keyringToken returns the token stored in the keyring under key. Tokens
+// stored by `gitbackup login` are refreshed once they have expired.
+func keyringToken(key string) (string, error) {
+	data, err := keyringGetToken(key)
+	if err != nil || !strings.HasPrefix(data, "{") {
+		return data, err
+	}
+	var l keyringLogin
+	if err := json.Unmarshal([]byte(data), &l); err != nil || l.Token == nil {
+		return "", fmt.Errorf("invalid login in the keyring under %s_TOKEN", key)
+	}
+	registerSecret(l.Token.AccessToken)
+	registerSecret(l.Token.RefreshToken)
+	if l.Token.Valid() {
+		return l.Token.AccessToken, nil
+	}
+	if l.Token.RefreshToken == "" {
+		return "", fmt.Errorf("%w, please run `gitbackup login` again", errLoginExpired)
+	}
+
+	conf := oauth2.Config{ClientID: l.ClientID, Endpoint: oauth2.Endpoint{TokenURL: l.TokenURL}}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, newHTTPClient())
+	token, err := conf.TokenSource(ctx, l.Token).Token()
+	if err != nil {
+		return "", fmt.Errorf("%w and couldn't be refreshed (%v), please run `gitbackup login` again", errLoginExpired, err)
+	}
+	registerSecret(token.AccessToken)
+	registerSecret(token.RefreshToken)
+	slog.Debug("Refreshed the login token", "key", key+"_TOKEN", "expires_at", token.Expiry)
+
+	// The refresh token may have been rotated
+	l.Token = token
+	if err := saveKeyringLogin(key, l); err != nil {
+		slog.Warn("Error saving the refreshed token", "error", err)
+	}
+	return token.AccessToken, nil
+}
+
+// authTarget returns the target the login commands act on: the one
+// selected with -target, -service and -githost.url from the config file,
+// or the one described by the flags
+func authTarget(cCtx *cli.Context) (*appConfig, error) {
+	selected := cCtx.String("target")
+	service := cCtx.String("service")
+	gitHostURL := cCtx.String("githost.url")
+
+	resolvedPath, err := resolveConfigPath(cCtx.String("config"))
+	if err == nil {
+		if _, err := os.Stat(resolvedPath); err == nil {
+			fc, err := loadConfigFile(cCtx.String("config"))
+			if err != nil {
+				return nil, err
+			}
+			targets, err := fc.targets()
+			if err != nil {
+				return nil, err
+			}
+			var matches []fileConfig
+			for _, t := range targets {
+				if (selected == "" || t.Name == selected) &&
+					(service == "" || t.Service == service) &&
+					(gitHostURL == "" || t.GitHostURL == gitHostURL) {
+					matches = append(matches, t)
+				}
+			}
+			if len(matches) > 1 && selected == "" {
+				return nil, fmt.Errorf("several targets in %s match, please select one with -target", resolvedPath)
+			}
+			if len(matches) == 1 {
+				return fileConfigToAppConfig(&matches[0]), nil
+			}
+		}
+	}
+
+	if selected != "" {
+		return nil, fmt.Errorf("no target named %q", selected)
+	}
+	if _, ok := knownServices[service]; !ok {
+		return nil, errors.New("please specify a valid service with -service (github, gitlab, bitbucket or forgejo)")
+	}
+	return &appConfig{service: service, gitHostURL: gitHostURL}, nil
+}
+
+// handleLogin logs in to the git host of the target
+func handleLogin(c *appConfig, opts loginOptions) error {
+	if !c.credentials.isZero() && !c.credentials.Keyring && c.credentials.KeyringKey == "" {
+		slog.Warn("The credentials of the target don't include the keyring, add `keyring: true` to use the login")
+	}
+	if _, err := login(c, opts); err != nil {
+		return err
+	}
+	key := keyringKey(c.service, c.credentials)
+	fmt.Printf("Logged in to %s, the token is stored in the keyring as %s_TOKEN\n", gitHostName(c.service, c.gitHostURL), key)
+
+	// Tokens from the environment take precedence over the keyring
+	for _, name := range serviceTokenEnvVars[c.service] {
+		if os.Getenv(name) != "" && (c.credentials.isZero() || c.credentials.TokenEnv == name) {
+			slog.Warn("The environment variable takes precedence over the login", "variable", name)
+		}
+	}
+	return nil
+}
+
+// handleLogout removes the token of the target from the keyring
+func handleLogout(c *appConfig) error {
+	key := keyringKey(c.service, c.credentials)
+	if err := keyringDeleteToken(key); err != nil {
+		return fmt.Errorf("error removing %s_TOKEN from the keyring: %v", key, err)
+	}
+	fmt.Printf("Logged out of %s, removed %s_TOKEN from the keyring\n", gitHostName(c.service, c.gitHostURL), key)
+	return nil
+}
+
+// handleWhoami shows who gitbackup is authenticated as on the git host of
+// the target
+func handleWhoami(c *appConfig) error {
+	// Checking the credentials mustn't start a login
+	nonInteractive = true
+
+	client, err := newClient(c)
+	if err != nil {
+		return err
+	}
+	host := gitHostName(c.service, c.gitHostURL)
+	if githubAppAuth {
+		fmt.Printf("Authenticated to %s as %s\n", host, githubAppIdentity(c.githubApp))
+		return nil
+	}
+	username, err := getUsername(client, c.service)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Logged in to %s as %s\n", host, username)
+	return nil
+}
+
+// authFlags are the flags selecting the target of the login commands
+func authFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "config",
+			Usage: "Path to config file (default: OS config directory)",
+		},
+		&cli.StringFlag{
+			Name:  "target",
+			Usage: "Name of the target in the config file",
+		},
+		&cli.StringFlag{
+			Name:  "service",
+			Usage: "Git Hosted Service Name (github/gitlab/bitbucket/forgejo)",
+		},
+		&cli.StringFlag{
+			Name:  "githost.url",
+			Usage: "DNS of the custom Git host",
+		},
+	}
+}
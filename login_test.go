@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/oauth2"
+)
+
+// fakeLoginKeyring replaces the keyring with a map and makes the tests
+// interactive
+func fakeLoginKeyring(t *testing.T) map[string]string {
+	tokens := map[string]string{}
+	fakeKeyring(t, tokens)
+	originalSet, originalDelete, originalTerminal := keyringSetToken, keyringDeleteToken, stdinIsTerminal
+	keyringSetToken = func(key, token string) error {
+		tokens[key] = token
+		return nil
+	}
+	keyringDeleteToken = func(key string) error {
+		if _, ok := tokens[key]; !ok {
+			return errors.New("The specified item could not be found in the keyring")
+		}
+		delete(tokens, key)
+		return nil
+	}
+	stdinIsTerminal = func() bool { return true }
+	t.Cleanup(func() {
+		keyringSetToken, keyringDeleteToken, stdinIsTerminal = originalSet, originalDelete, originalTerminal
+	})
+	return tokens
+}
+
+// storedLogin decodes the login stored in the fake keyring
+func storedLogin(t *testing.T, tokens map[string]string, key string) keyringLogin {
+	var l keyringLogin
+	if err := json.Unmarshal([]byte(tokens[key]), &l); err != nil {
+		t.Fatalf("Expected a login in the keyring under %s, got %q: %v", key, tokens[key], err)
+	}
+	return l
+}
+
+func TestOAuthWebURL(t *testing.T) {
+	var testCases = []struct {
+		service    string
+		gitHostURL string
+		expected   string
+	}{
+		{"github", "", "https://github.com/"},
+		{"gitlab", "", "https://gitlab.com/"},
+		{"forgejo", "", "https://codeberg.org/"},
+		{"github", "https://github.example.com/api/v3/", "https://github.example.com/"},
+		{"gitlab", "https://example.com/gitlab", "https://example.com/gitlab/"},
+		{"forgejo", "http://localhost:3000/", "http://localhost:3000/"},
+	}
+	for _, tc := range testCases {
+		u, err := oauthWebURL(tc.service, tc.gitHostURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.String() != tc.expected {
+			t.Errorf("%s %q: expected %s, got %s", tc.service, tc.gitHostURL, tc.expected, u)
+		}
+	}
+}
+
+func TestLoginDeviceFlow(t *testing.T) {
+	tokens := fakeLoginKeyring(t)
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/oauth/authorize_device", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("client_id") != "my-app" || r.Form.Get("scope") != "api" {
+			t.Errorf("Unexpected device authorization request: %v", r.Form)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"device_code": "device123", "user_code": "ABCD-EFGH", "verification_uri": "%s/oauth/device", "interval": 1, "expires_in": 300}`, server.URL)
+	})
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("device_code") != "device123" || r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:device_code" {
+			t.Errorf("Unexpected token request: %v", r.Form)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token": "gitlab-oauth-token", "refresh_token": "gitlab-refresh-token", "token_type": "Bearer", "expires_in": 7200}`)
+	})
+
+	c := &appConfig{service: "gitlab", gitHostURL: server.URL + "/"}
+	if _, err := login(c, loginOptions{}); err == nil || !strings.Contains(err.Error(), "-client-id") {
+		t.Fatalf("Expected an error asking for the client ID, got %v", err)
+	}
+
+	if err := handleLogin(c, loginOptions{clientID: "my-app"}); err != nil {
+		t.Fatal(err)
+	}
+	l := storedLogin(t, tokens, "GITLAB")
+	if l.ClientID != "my-app" || l.TokenURL != server.URL+"/oauth/token" || l.Token.AccessToken != "gitlab-oauth-token" || l.Token.RefreshToken != "gitlab-refresh-token" {
+		t.Errorf("Unexpected login stored: %+v", l)
+	}
+
+	// The stored login is used to back up the target
+	t.Setenv("GITLAB_TOKEN", "")
+	os.Unsetenv("GITLAB_TOKEN")
+	cred, err := resolveCredentials("gitlab", credentialHost(c.service, c.gitHostURL), credentialsConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.Token != "gitlab-oauth-token" || cred.Source != "keyring" {
+		t.Errorf("Expected the token from the login, got %+v", cred)
+	}
+
+	if err := handleLogout(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tokens["GITLAB"]; ok {
+		t.Error("Expected the token to be removed from the keyring")
+	}
+	if err := handleLogout(c); err == nil {
+		t.Error("Expected an error logging out twice")
+	}
+}
+
+func TestLoginPKCEFlow(t *testing.T) {
+	tokens := fakeLoginKeyring(t)
+	defer func(f func(string)) {
+		openBrowser = f
+	}(openBrowser)
+
+	var challenge string
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != "authcode" || r.Form.Get("code_verifier") == "" || !strings.HasPrefix(r.Form.Get("redirect_uri"), "http://127.0.0.1:") {
+			t.Errorf("Unexpected token request: %v", r.Form)
+		}
+		if oauth2.S256ChallengeFromVerifier(r.Form.Get("code_verifier")) != challenge {
+			t.Error("The code verifier doesn't match the challenge")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token": "forgejo-oauth-token", "token_type": "bearer"}`)
+	})
+
+	// The browser authorizes gitbackup and is redirected to the callback
+	state := ""
+	openBrowser = func(authURL string) {
+		u, _ := url.Parse(authURL)
+		q := u.Query()
+		if u.Path != "/login/oauth/authorize" || q.Get("client_id") != "my-app" || q.Get("code_challenge_method") != "S256" {
+			t.Errorf("Unexpected authorization URL: %s", authURL)
+		}
+		challenge = q.Get("code_challenge")
+		if state == "" {
+			state = q.Get("state")
+		}
+		resp, err := http.Get(q.Get("redirect_uri") + "?code=authcode&state=" + url.QueryEscape(state))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+	}
+
+	c := &appConfig{
+		service:     "forgejo",
+		gitHostURL:  server.URL + "/",
+		credentials: credentialsConfig{KeyringKey: "WORK_FORGEJO_TOKEN"},
+	}
+	if _, err := login(c, loginOptions{clientID: "my-app", flow: oauthFlowDevice}); err == nil {
+		t.Fatal("Expected an error for the device flow, which Forgejo doesn't support")
+	}
+	if _, err := login(c, loginOptions{clientID: "my-app"}); err != nil {
+		t.Fatal(err)
+	}
+	if l := storedLogin(t, tokens, "WORK_FORGEJO"); l.Token.AccessToken != "forgejo-oauth-token" {
+		t.Errorf("Unexpected login stored: %+v", l)
+	}
+
+	// A callback with another state is rejected
+	state = "forged"
+	if _, err := login(c, loginOptions{clientID: "my-app"}); err == nil || !strings.Contains(err.Error(), "invalid state") {
+		t.Errorf("Expected an invalid state error, got %v", err)
+	}
+}
+
+func TestLoginNonInteractive(t *testing.T) {
+	fakeLoginKeyring(t)
+	stdinIsTerminal = func() bool { return false }
+
+	for _, service := range []string{"github", "gitlab", "forgejo"} {
+		_, err := login(&appConfig{service: service}, loginOptions{clientID: "my-app"})
+		if err == nil || !strings.Contains(err.Error(), "interactive") {
+			t.Errorf("%s: expected logging in to fail without a terminal, got %v", service, err)
+		}
+	}
+	if _, err := login(&appConfig{service: "bitbucket"}, loginOptions{}); err == nil {
+		t.Error("Expected logging in to Bitbucket to fail")
+	}
+}
+
+func TestKeyringToken(t *testing.T) {
+	tokens := fakeLoginKeyring(t)
+
+	refreshes := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "refresh1" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "invalid_grant"}`)
+			return
+		}
+		refreshes++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token": "access2", "refresh_token": "refresh2", "token_type": "Bearer", "expires_in": 7200}`)
+	}))
+	defer server.Close()
+
+	save := func(key string, token *oauth2.Token) {
+		if err := saveKeyringLogin(key, keyringLogin{ClientID: "my-app", TokenURL: server.URL, Token: token}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expired := time.Now().Add(-time.Hour)
+	save("VALID", &oauth2.Token{AccessToken: "access1", Expiry: time.Now().Add(time.Hour)})
+	save("EXPIRED", &oauth2.Token{AccessToken: "access1", RefreshToken: "refresh1", Expiry: expired})
+	save("NO_REFRESH", &oauth2.Token{AccessToken: "access1", Expiry: expired})
+	save("REVOKED", &oauth2.Token{AccessToken: "access1", RefreshToken: "revoked", Expiry: expired})
+	tokens["PLAIN"] = "plaintoken"
+
+	var testCases = []struct {
+		key      string
+		expected string
+		expired  bool
+	}{
+		{"PLAIN", "plaintoken", false},
+		{"VALID", "access1", false},
+		{"EXPIRED", "access2", false},
+		{"NO_REFRESH", "", true},
+		{"REVOKED", "", true},
+	}
+	for _, tc := range testCases {
+		token, err := keyringToken(tc.key)
+		if tc.expired != errors.Is(err, errLoginExpired) {
+			t.Errorf("%s: unexpected error %v", tc.key, err)
+		}
+		if token != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.key, tc.expected, token)
+		}
+	}
+
+	// The refreshed token is stored, so it isn't refreshed again
+	if l := storedLogin(t, tokens, "EXPIRED"); l.Token.RefreshToken != "refresh2" {
+		t.Errorf("Expected the refreshed login to be stored, got %+v", l.Token)
+	}
+	if token, _ := keyringToken("EXPIRED"); token != "access2" || refreshes != 1 {
+		t.Errorf("Expected the stored token to be reused, got %q after %d refreshes", token, refreshes)
+	}
+
+	// An expired login is reported rather than skipped
+	if _, err := resolveCredentials("gitlab", "gitlab.com", credentialsConfig{KeyringKey: "NO_REFRESH"}); !errors.Is(err, errLoginExpired) {
+		t.Errorf("Expected errLoginExpired, got %v", err)
+	}
+}
+
+func TestAuthTarget(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), defaultConfigFile)
+	err := os.WriteFile(configPath, []byte(`
+targets:
+  - name: personal
+    service: gitlab
+  - name: work
+    service: gitlab
+    githost_url: https://gitlab.example.com/
+    credentials:
+      keyring_key: WORK_GITLAB_TOKEN
+  - name: oss
+    service: forgejo
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(args ...string) (*appConfig, error) {
+		var c *appConfig
+		app := &cli.App{
+			Name:  "gitbackup",
+			Flags: authFlags(),
+			Action: func(cCtx *cli.Context) error {
+				var err error
+				c, err = authTarget(cCtx)
+				return err
+			},
+		}
+		err := app.Run(append([]string{"gitbackup"}, args...))
+		return c, err
+	}
+
+	var testCases = []struct {
+		args        []string
+		service     string
+		gitHostURL  string
+		expectedErr string
+	}{
+		{[]string{"-config", configPath, "-target", "work"}, "gitlab", "https://gitlab.example.com/", ""},
+		{[]string{"-config", configPath, "-service", "forgejo"}, "forgejo", "", ""},
+		{[]string{"-config", configPath, "-service", "gitlab", "-githost.url", "https://gitlab.example.com/"}, "gitlab", "https://gitlab.example.com/", ""},
+		{[]string{"-config", configPath, "-service", "gitlab"}, "", "", "-target"},
+		{[]string{"-config", configPath, "-target", "nope"}, "", "", "no target"},
+		// Services without a target in the config file
+		{[]string{"-config", configPath, "-service", "github"}, "github", "", ""},
+		{[]string{"-config", filepath.Join(t.TempDir(), "missing.yml")}, "", "", "-service"},
+	}
+	for _, tc := range testCases {
+		c, err := run(tc.args...)
+		if tc.expectedErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+				t.Errorf("%v: expected an error containing %q, got %v", tc.args, tc.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tc.args, err)
+			continue
+		}
+		if c.service != tc.service || c.gitHostURL != tc.gitHostURL {
+			t.Errorf("%v: unexpected target %s %s", tc.args, c.service, c.gitHostURL)
+		}
+	}
+
+	c, _ := run("-config", configPath, "-target", "work")
+	if keyringKey(c.service, c.credentials) != "WORK_GITLAB" {
+		t.Errorf("Expected the keyring key of the target, got %s", keyringKey(c.service, c.credentials))
+	}
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/urfave/cli/v2"
 )
 
-// MaxConcurrentClones is the upper limit of the maximum number of
+// MaxConcurrentClones is the default upper limit of the maximum number of
 // concurrent git clones
 const MaxConcurrentClones = 20
 
@@ -16,6 +19,7 @@ const defaultMaxUserMigrationRetry = 5
 
 var gitHostToken string
 var useHTTPSClone *bool
+var sshPort int
 var ignorePrivate *bool
 var gitHostUsername string
 
@@ -32,28 +36,51 @@ func main() {
 		Name:  "gitbackup",
 		Usage: "Backup your Git repositories from GitHub, GitLab, Bitbucket, or Forgejo",
 		Flags: appFlags(),
+		Before: func(cCtx *cli.Context) error {
+			// -verbose is a shorthand for -log-level debug
+			level := cCtx.String("log-level")
+			if cCtx.Bool("verbose") && !cCtx.IsSet("log-level") {
+				level = "debug"
+			}
+			nonInteractive = cCtx.Bool("non-interactive")
+			return setupLogging(level, cCtx.String("log-format"))
+		},
 		Action: func(cCtx *cli.Context) error {
-			c, err := buildConfig(cCtx)
+			configs, err := buildConfigs(cCtx)
 			if err != nil {
 				return err
 			}
-			err = validateConfig(c)
-			if err != nil {
-				return err
+			for _, c := range configs {
+				if err := validateConfig(c); err != nil {
+					return targetError(c, err)
+				}
 			}
 
-			client := newClient(c.service, c.gitHostURL)
+			metricsPath := cCtx.String("metrics-textfile")
+			if metricsPath != "" {
+				runMetrics = newBackupMetrics()
+				if err := runMetrics.restoreTextfile(metricsPath); err != nil {
+					slog.Warn("Error reading the previous metrics", "error", err)
+				}
+			}
 
-			if c.githubListUserMigrations {
-				handleGithubListUserMigrations(client, c)
-			} else if c.githubCreateUserMigration {
-				handleGithubCreateUserMigration(client, c)
-			} else {
-				if err := handleGitRepositoryClone(client, c); err != nil {
-					return err
+			// A failing target doesn't stop the others from being backed up
+			var errs []error
+			for _, c := range configs {
+				if _, err := backUpTarget(c); err != nil {
+					err = targetError(c, err)
+					if len(configs) > 1 {
+						slog.Error("Backing up target failed", "target", c.name, "error", err)
+					}
+					errs = append(errs, err)
+				}
+			}
+			if metricsPath != "" {
+				if err := runMetrics.writeTextfile(metricsPath); err != nil {
+					errs = append(errs, err)
 				}
 			}
-			return nil
+			return errors.Join(errs...)
 		},
 		Commands: []*cli.Command{
 			{
@@ -82,11 +109,381 @@ func main() {
 					return handleValidateConfig(cCtx.String("config"))
 				},
 			},
+			{
+				Name:  "doctor",
+				Usage: "Check that the targets can be backed up: credentials, token scopes, git access and the backup directory",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "Path to config file (default: OS config directory)",
+					},
+					&cli.StringFlag{
+						Name:  "target",
+						Usage: "Only check the target with this name from the config file",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					configs, err := buildConfigs(cCtx)
+					if err != nil {
+						return err
+					}
+					return handleDoctor(configs, os.Stdout)
+				},
+			},
+			{
+				Name:  "daemon",
+				Usage: "Run the backups of the targets on their schedules",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "Path to config file (default: OS config directory)",
+					},
+					&cli.StringFlag{
+						Name:  "target",
+						Usage: "Only back up the target with this name from the config file",
+					},
+					&cli.StringFlag{
+						Name:  "schedule",
+						Usage: "Cron-style schedule of the targets without a schedule in the config file, e.g. '0 3 * * *' or '@every 6h'",
+					},
+					&cli.BoolFlag{
+						Name:  "run-now",
+						Usage: "Back up all the targets when the daemon starts",
+					},
+					&cli.StringFlag{
+						Name:  "history-file",
+						Usage: "File keeping the reports of the recent runs (default: OS cache directory)",
+					},
+					&cli.IntFlag{
+						Name:  "history-size",
+						Usage: "Number of runs to keep in the history",
+						Value: defaultHistorySize,
+					},
+					&cli.StringFlag{
+						Name:  "listen",
+						Usage: "Address to serve the Prometheus metrics (/metrics) and the health of the targets (/healthz) on, e.g. ':9100'",
+					},
+					&cli.DurationFlag{
+						Name:        "stale-after",
+						Usage:       "How long after its last successful backup a target is reported as stale by /healthz",
+						DefaultText: "twice the interval of its schedule",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					load := func() ([]*appConfig, error) {
+						return buildConfigs(cCtx)
+					}
+					return handleDaemon(load, daemonOptions{
+						historyPath: cCtx.String("history-file"),
+						historySize: cCtx.Int("history-size"),
+						runNow:      cCtx.Bool("run-now"),
+						listen:      cCtx.String("listen"),
+						staleAfter:  cCtx.Duration("stale-after"),
+					})
+				},
+			},
+			{
+				Name:  "serve-webhooks",
+				Usage: "Back up the repositories when they are pushed to, on receiving their push webhooks",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "Path to config file (default: OS config directory)",
+					},
+					&cli.StringFlag{
+						Name:  "target",
+						Usage: "Only receive the webhooks of the target with this name from the config file",
+					},
+					&cli.StringFlag{
+						Name:  "listen",
+						Usage: "Address to receive the webhooks on",
+						Value: defaultWebhooksAddress,
+					},
+					&cli.DurationFlag{
+						Name:  "debounce",
+						Usage: "How long to wait for further pushes to a repository before backing it up",
+						Value: defaultWebhookDebounce,
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					configs, err := buildConfigs(cCtx)
+					if err != nil {
+						return err
+					}
+					return handleServeWebhooks(configs, cCtx.String("listen"), cCtx.Duration("debounce"))
+				},
+			},
+			{
+				Name:  "serve",
+				Usage: "Serve the backups read-only over git smart HTTP, with an HTML index of the repositories",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "Path to config file (default: OS config directory)",
+					},
+					&cli.StringFlag{
+						Name:  "target",
+						Usage: "Only serve the backups of the target with this name from the config file",
+					},
+					&cli.StringFlag{
+						Name:  "listen",
+						Usage: "Address to serve the backups on",
+						Value: defaultServeAddress,
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					configs, err := buildConfigs(cCtx)
+					if err != nil {
+						return err
+					}
+					return handleServe(configs, cCtx.String("listen"))
+				},
+			},
+			{
+				Name:      "restore",
+				Usage:     "Restore the repositories of the targets from the object storage they are uploaded to",
+				ArgsUsage: "[repository patterns, e.g. owner/repo or owner/*]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "Path to config file (default: OS config directory)",
+					},
+					&cli.StringFlag{
+						Name:  "target",
+						Usage: "Only restore the repositories of the target with this name from the config file",
+					},
+					&cli.StringFlag{
+						Name:        "to",
+						Usage:       "Directory to restore the repositories into",
+						DefaultText: "the backup directory of the target",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					configs, err := buildConfigs(cCtx)
+					if err != nil {
+						return err
+					}
+					for _, c := range configs {
+						if err := validateConfig(c); err != nil {
+							return targetError(c, err)
+						}
+					}
+					return handleRestore(configs, cCtx.Args().Slice(), cCtx.String("to"), os.Stdout)
+				},
+			},
+			{
+				Name:      "verify",
+				Usage:     "Check that the repositories of the targets can be restored from the storage they are uploaded to",
+				ArgsUsage: "[repository patterns, e.g. owner/repo or owner/*]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "Path to config file (default: OS config directory)",
+					},
+					&cli.StringFlag{
+						Name:  "target",
+						Usage: "Only verify the repositories of the target with this name from the config file",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					configs, err := buildConfigs(cCtx)
+					if err != nil {
+						return err
+					}
+					for _, c := range configs {
+						if err := validateConfig(c); err != nil {
+							return targetError(c, err)
+						}
+					}
+					return handleVerify(configs, cCtx.Args().Slice(), os.Stdout)
+				},
+			},
+			{
+				Name:      "reassemble",
+				Usage:     "Recreate a repository from a full bundle and its incremental bundles, downloaded from the storage",
+				ArgsUsage: "<bundles in order, or their .chain.json index>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "Path to config file with the keys decrypting the bundles (default: OS config directory)",
+					},
+					&cli.StringFlag{
+						Name:  "target",
+						Usage: "Decrypt the bundles with the keys of the target with this name from the config file",
+					},
+					&cli.StringFlag{
+						Name:  "to",
+						Usage: "Directory to recreate the repository into",
+					},
+					&cli.BoolFlag{
+						Name:  "bare",
+						Usage: "Recreate the repository as a bare mirror",
+					},
+					&cli.StringFlag{
+						Name:  "clone-url",
+						Usage: "URL to point the origin remote of the repository to",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					keys := func() (encryptionConfig, error) {
+						configs, err := buildConfigs(cCtx)
+						if err != nil {
+							return encryptionConfig{}, err
+						}
+						if len(configs) > 1 {
+							return encryptionConfig{}, errors.New("the bundles are encrypted, please specify the target with their keys with -target")
+						}
+						return configs[0].encryption, nil
+					}
+					return handleReassemble(cCtx.Args().Slice(), cCtx.String("to"), cCtx.Bool("bare"), cCtx.String("clone-url"), keys, os.Stdout)
+				},
+			},
+			{
+				Name:  "history",
+				Usage: "Show the recent runs of the daemon",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "history-file",
+						Usage: "File keeping the reports of the recent runs (default: OS cache directory)",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					return handleHistory(cCtx.String("history-file"), os.Stdout)
+				},
+			},
+			{
+				Name:  "pin-host-keys",
+				Usage: "Add the SSH host keys of the git hosts of the targets to their known_hosts files",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "Path to config file (default: OS config directory)",
+					},
+					&cli.StringFlag{
+						Name:  "target",
+						Usage: "Only pin the host keys of the target with this name from the config file",
+					},
+					&cli.StringFlag{
+						Name:  "host",
+						Usage: "SSH host name, if it differs from the one of the git host",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					configs, err := buildConfigs(cCtx)
+					if err != nil {
+						return err
+					}
+					return handlePinHostKeys(configs, cCtx.String("host"), os.Stdout)
+				},
+			},
+			{
+				Name:  "login",
+				Usage: "Log in to a git host with OAuth and store the token in the keyring",
+				Flags: append(authFlags(),
+					&cli.StringFlag{
+						Name:  "client-id",
+						Usage: "Client ID of the OAuth application (required for GitLab and Forgejo)",
+					},
+					&cli.StringFlag{
+						Name:  "flow",
+						Usage: "OAuth flow: device or pkce (default: device, or pkce for Forgejo)",
+					},
+					&cli.StringFlag{
+						Name:  "scopes",
+						Usage: "OAuth scopes to request (separate each value by a comma, default: the ones gitbackup needs)",
+					},
+					&cli.IntFlag{
+						Name:  "callback-port",
+						Usage: "Port of the local server receiving the OAuth callback in the pkce flow (default: random)",
+					},
+				),
+				Action: func(cCtx *cli.Context) error {
+					c, err := authTarget(cCtx)
+					if err != nil {
+						return err
+					}
+					opts := loginOptions{
+						clientID:     cCtx.String("client-id"),
+						flow:         cCtx.String("flow"),
+						callbackPort: cCtx.Int("callback-port"),
+					}
+					if scopes := cCtx.String("scopes"); scopes != "" {
+						opts.scopes = strings.Split(scopes, ",")
+					}
+					return handleLogin(c, opts)
+				},
+			},
+			{
+				Name:  "logout",
+				Usage: "Remove the token of a git host from the keyring",
+				Flags: authFlags(),
+				Action: func(cCtx *cli.Context) error {
+					c, err := authTarget(cCtx)
+					if err != nil {
+						return err
+					}
+					return handleLogout(c)
+				},
+			},
+			{
+				Name:  "whoami",
+				Usage: "Show the user gitbackup is authenticated as on a git host",
+				Flags: authFlags(),
+				Action: func(cCtx *cli.Context) error {
+					c, err := authTarget(cCtx)
+					if err != nil {
+						return err
+					}
+					return handleWhoami(c)
+				},
+			},
+			{
+				// Used as the SSH ProxyCommand when a bandwidth limit is set
+				Name:      "netcat",
+				Hidden:    true,
+				ArgsUsage: "<proxy address> <host> <port>",
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() != 3 {
+						return fmt.Errorf("usage: gitbackup netcat <proxy address> <host> <port>")
+					}
+					return handleNetcat(cCtx.Args().Get(0), cCtx.Args().Get(1), cCtx.Args().Get(2))
+				},
+			},
 		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		log.Fatal(err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", redact(err.Error()))
+		os.Exit(1)
+	}
+}
+
+// backUpTarget creates the client for a target and runs the backup (or
+// the migration) configured for it
+func backUpTarget(c *appConfig) (report *runReport, err error) {
+	startedAt := time.Now()
+	defer func() {
+		runMetrics.recordRun(c, startedAt, report, err)
+		notifyRun(c, startedAt, report, err)
+	}()
+
+	client, err := newClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.githubListUserMigrations {
+		return nil, handleGithubListUserMigrations(client, c)
+	} else if c.githubCreateUserMigration {
+		return nil, handleGithubCreateUserMigration(client, c)
+	}
+	return handleGitRepositoryClone(client, c)
+}
+
+// targetError adds the name of the target to err, if the target has one
+func targetError(c *appConfig, err error) error {
+	if c.name == "" {
+		return err
 	}
+	return fmt.Errorf("target %s: %w", c.name, err)
 }
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maintenanceConfig configures the git maintenance of the repositories
+// after they are updated
+type maintenanceConfig struct {
+	// How often each repository is maintained, maintenance is disabled if
+	// it isn't set
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// The tasks, in the order they are run (default: gc)
+	Tasks []string `yaml:"tasks,omitempty"`
+	// Unreachable objects more recent than this are kept by gc, e.g.
+	// 2.weeks.ago (the default)
+	PruneExpire string `yaml:"prune_expire,omitempty"`
+}
+
+// The maintenance tasks
+const (
+	maintenanceTaskMaintenance = "maintenance"
+	maintenanceTaskRepack      = "repack"
+	maintenanceTaskCommitGraph = "commit-graph"
+	maintenanceTaskGC          = "gc"
+)
+
+var maintenanceTasks = []string{maintenanceTaskMaintenance, maintenanceTaskRepack, maintenanceTaskCommitGraph, maintenanceTaskGC}
+
+const defaultPruneExpire = "2.weeks.ago"
+
+// maintenanceFile keeps track of when the repositories in the backup
+// directory were last maintained
+const maintenanceFile = ".maintenance.json"
+
+func (mc maintenanceConfig) validate() error {
+	if mc.Interval < 0 {
+		return errors.New("the interval can't be negative")
+	}
+	for _, task := range mc.Tasks {
+		if !contains(maintenanceTasks, task) {
+			return fmt.Errorf("unknown task: %q (must be one of %s)", task, strings.Join(maintenanceTasks, ", "))
+		}
+	}
+	// A fetch writes its objects before the refs pointing to them, so gc
+	// mustn't remove recent unreachable objects
+	switch strings.ToLower(mc.PruneExpire) {
+	case "now", "all":
+		return fmt.Errorf("prune_expire %q could remove the objects of a fetch in progress, please use a window such as %s", mc.PruneExpire, defaultPruneExpire)
+	}
+	return nil
+}
+
+// commands returns the git commands running the maintenance tasks in
+// repoDir
+func (mc maintenanceConfig) commands(repoDir string) [][]string {
+	tasks := mc.Tasks
+	if len(tasks) == 0 {
+		tasks = []string{maintenanceTaskGC}
+	}
+	pruneExpire := mc.PruneExpire
+	if pruneExpire == "" {
+		pruneExpire = defaultPruneExpire
+	}
+	var commands [][]string
+	for _, task := range tasks {
+		var args []string
+		switch task {
+		case maintenanceTaskMaintenance:
+			// The incremental tasks of git maintenance, which are cheaper
+			// than gc for large repositories
+			args = []string{"maintenance", "run", "--quiet", "--task=commit-graph", "--task=loose-objects", "--task=pack-refs"}
+		case maintenanceTaskRepack:
+			// -l leaves out the objects of an object pool. git doesn't write
+			// bitmaps for the repositories sharing one.
+			args = []string{"repack", "-a", "-d", "-l", "-q", "--write-bitmap-index"}
+		case maintenanceTaskCommitGraph:
+			args = []string{"commit-graph", "write", "--reachable", "--no-progress"}
+		case maintenanceTaskGC:
+			args = []string{"gc", "--quiet", "--prune=" + pruneExpire}
+		}
+		commands = append(commands, append([]string{"-C", repoDir}, args...))
+	}
+	return commands
+}
+
+// maintenanceRecord is the last maintenance of a repository
+type maintenanceRecord struct {
+	LastRun time.Time `json:"last_run"`
+	// Size of the repository after the maintenance, and how much smaller
+	// the maintenance made it
+	Size      int64 `json:"size"`
+	Reclaimed int64 `json:"reclaimed"`
+}
+
+type maintenanceState struct {
+	Repositories map[string]maintenanceRecord `json:"repositories"`
+}
+
+// maintainer runs the maintenance of the repositories of a target when it
+// is due
+type maintainer struct {
+	config    maintenanceConfig
+	backupDir string
+	path      string
+
+	mu    sync.Mutex
+	state maintenanceState
+	// The repositories maintained since the state was loaded
+	changes map[string]maintenanceRecord
+}
+
+// The maintainer of the repositories of the current target, if their
+// maintenance is enabled
+var repoMaintainer *maintainer
+
+func newMaintainer(mc maintenanceConfig, backupDir string) (*maintainer, error) {
+	m := &maintainer{
+		config:    mc,
+		backupDir: backupDir,
+		path:      filepath.Join(backupDir, maintenanceFile),
+		changes:   make(map[string]maintenanceRecord),
+	}
+	state, err := loadMaintenanceState(m.path)
+	if err != nil {
+		return nil, err
+	}
+	m.state = state
+	return m, nil
+}
+
+// loadMaintenanceState reads the maintenance state saved at path, which is
+// empty if it doesn't exist yet
+func loadMaintenanceState(path string) (maintenanceState, error) {
+	state := maintenanceState{Repositories: make(map[string]maintenanceRecord)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	if state.Repositories == nil {
+		state.Repositories = make(map[string]maintenanceRecord)
+	}
+	return state, nil
+}
+
+// maintain runs the maintenance of the repository at repoDir if it is due,
+// and reports how much space it reclaimed
+func (m *maintainer) maintain(repoDir string, repo *Repository, bare bool) error {
+	if m == nil {
+		return nil
+	}
+	name := repoFullName(repo)
+	m.mu.Lock()
+	record, ok := m.state.Repositories[name]
+	m.mu.Unlock()
+	if ok && time.Since(record.LastRun) < m.config.Interval {
+		return nil
+	}
+
+	logger := repoLogger(repo)
+	gitDir := repoDir
+	if !bare {
+		gitDir = filepath.Join(repoDir, ".git")
+	}
+	before, err := dirSize(gitDir)
+	if err != nil {
+		return err
+	}
+	logger.Info("Running git maintenance", "size", before)
+	for _, args := range m.config.commands(repoDir) {
+		if out, err := newGitCommand(args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("error running git %s: %v: %s", args[2], err, out)
+		}
+	}
+	after, err := dirSize(gitDir)
+	if err != nil {
+		return err
+	}
+	logger.Info("Git maintenance finished", "size", after, "reclaimed", before-after)
+	runEvents.repoMaintained(repo, before-after)
+
+	record = maintenanceRecord{LastRun: time.Now().UTC(), Size: after, Reclaimed: before - after}
+	m.mu.Lock()
+	m.state.Repositories[name] = record
+	m.changes[name] = record
+	m.mu.Unlock()
+	return nil
+}
+
+// save records when the repositories were maintained. Another gitbackup
+// process sharing the backup directory, e.g. serve-webhooks and the daemon,
+// may have saved the state since it was loaded: the changes are applied to
+// the latest one, under the lock of the manifest of the uploads.
+func (m *maintainer) save() error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.changes) == 0 {
+		return nil
+	}
+	unlock, err := lockManifest(m.backupDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	state, err := loadMaintenanceState(m.path)
+	if err != nil {
+		return err
+	}
+	// The latest maintenance of a repository wins
+	for name, record := range m.changes {
+		if saved, ok := state.Repositories[name]; !ok || !saved.LastRun.After(record.LastRun) {
+			state.Repositories[name] = record
+		}
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		return err
+	}
+	m.state = state
+	m.changes = make(map[string]maintenanceRecord)
+	return nil
+}
+
+// setupMaintenance sets the maintenance of the repositories of a target up
+// and returns a function saving when they were maintained once the backups
+// are done
+func setupMaintenance(c *appConfig) (func(), error) {
+	if c.maintenance.Interval == 0 {
+		return func() {}, nil
+	}
+	m, err := newMaintainer(c.maintenance, c.backupDir)
+	if err != nil {
+		return nil, err
+	}
+	repoMaintainer = m
+	return func() {
+		repoMaintainer = nil
+		if err := m.save(); err != nil {
+			slog.Error("Error saving the maintenance state, the repositories will be maintained again", "path", m.path, "error", err)
+		}
+	}, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestMaintenanceConfigValidate(t *testing.T) {
+	var tests = []struct {
+		name  string
+		mc    maintenanceConfig
+		valid bool
+	}{
+		{"disabled", maintenanceConfig{}, true},
+		{"weekly", maintenanceConfig{Interval: 7 * 24 * time.Hour, Tasks: []string{"repack", "commit-graph"}}, true},
+		{"negative interval", maintenanceConfig{Interval: -time.Hour}, false},
+		{"unknown task", maintenanceConfig{Interval: time.Hour, Tasks: []string{"fsck"}}, false},
+		{"prune window", maintenanceConfig{Interval: time.Hour, PruneExpire: "3.days.ago"}, true},
+		{"prune now", maintenanceConfig{Interval: time.Hour, PruneExpire: "now"}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.mc.validate()
+			if (err == nil) != tc.valid {
+				t.Errorf("validate() = %v, want valid %v", err, tc.valid)
+			}
+		})
+	}
+}
+
+func TestMaintenanceCommands(t *testing.T) {
+	got := maintenanceConfig{}.commands("repo")
+	want := [][]string{{"-C", "repo", "gc", "--quiet", "--prune=2.weeks.ago"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("default commands = %v, want %v", got, want)
+	}
+	got = maintenanceConfig{Tasks: []string{"commit-graph", "gc"}, PruneExpire: "1.day.ago"}.commands("repo")
+	want = [][]string{
+		{"-C", "repo", "commit-graph", "write", "--reachable", "--no-progress"},
+		{"-C", "repo", "gc", "--quiet", "--prune=1.day.ago"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %v, want %v", got, want)
+	}
+}
+
+func TestMaintainer(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	// A repository with loose objects only, which a local clone keeps
+	work := filepath.Join(t.TempDir(), "work")
+	newTestRepository(t, work)
+	for i := 0; i < 50; i++ {
+		os.WriteFile(filepath.Join(work, "file"+strconv.Itoa(i)), []byte(strings.Repeat("content ", i+1)), 0644)
+		gitTest(t, "-C", work, "add", ".")
+		gitTest(t, "-C", work, "commit", "-q", "-m", "commit "+strconv.Itoa(i))
+	}
+	backupDir := t.TempDir()
+	repoDir := filepath.Join(backupDir, "octocat", "repo.git")
+	gitTest(t, "clone", "-q", "--mirror", work, repoDir)
+	repo := &Repository{Namespace: "octocat", Name: "repo"}
+
+	sink := &recordingSink{}
+	runEvents = newRunProgress("github", "github.com", sink)
+	defer func() { runEvents = nil }()
+
+	mc := maintenanceConfig{Interval: time.Hour, Tasks: []string{"maintenance", "repack", "commit-graph", "gc"}}
+	m, err := newMaintainer(mc, backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.maintain(repoDir, repo, true); err != nil {
+		t.Fatal(err)
+	}
+	record := m.state.Repositories["octocat/repo"]
+	if record.Reclaimed <= 0 || record.Size <= 0 {
+		t.Errorf("unexpected maintenance record: %+v", record)
+	}
+	gitTest(t, "-C", repoDir, "fsck", "--no-progress")
+	if err := m.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next maintenance isn't due yet
+	m, err = newMaintainer(mc, backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.state.Repositories["octocat/repo"]; !got.LastRun.Equal(record.LastRun) {
+		t.Errorf("saved maintenance record = %+v, want %+v", got, record)
+	}
+	if err := m.maintain(repoDir, repo, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.changes) != 0 {
+		t.Error("repository was maintained again before the interval elapsed")
+	}
+
+	report := runEvents.runFinished()
+	if report.Maintained != 1 || report.Reclaimed != record.Reclaimed {
+		t.Errorf("reported %d maintained repositories reclaiming %d bytes, want 1 and %d", report.Maintained, report.Reclaimed, record.Reclaimed)
+	}
+	if e := sink.events[0]; e.Type != eventRepoMaintained || e.Repository != "octocat/repo" || e.Bytes != record.Reclaimed {
+		t.Errorf("unexpected event: %+v", e)
+	}
+}
+
+func TestMaintainerSaveMerges(t *testing.T) {
+	defer func(fs afero.Fs) { appFS = fs }(appFS)
+	appFS = afero.NewOsFs()
+	backupDir := t.TempDir()
+	mc := maintenanceConfig{Interval: time.Hour}
+
+	// Two processes sharing the backup directory maintain different
+	// repositories, and the same one
+	first, err := newMaintainer(mc, backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newMaintainer(mc, backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	first.changes["octocat/a"] = maintenanceRecord{LastRun: now, Size: 1}
+	first.changes["octocat/c"] = maintenanceRecord{LastRun: now.Add(time.Minute), Size: 3}
+	second.changes["octocat/b"] = maintenanceRecord{LastRun: now, Size: 2}
+	second.changes["octocat/c"] = maintenanceRecord{LastRun: now, Size: 4}
+	if err := first.save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := newMaintainer(mc, backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, size := range map[string]int64{"octocat/a": 1, "octocat/b": 2, "octocat/c": 3} {
+		if got := m.state.Repositories[name]; got.Size != size {
+			t.Errorf("saved record of %s = %+v, want the size %d", name, got, size)
+		}
+	}
+}
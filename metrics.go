@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// backupMetrics are the Prometheus metrics of the backups, served by the
+// daemon or written to a node-exporter textfile after a one-shot run
+type backupMetrics struct {
+	registry *prometheus.Registry
+
+	discovered         *prometheus.GaugeVec
+	repositories       *prometheus.GaugeVec
+	backupSize         *prometheus.GaugeVec
+	runDuration        *prometheus.GaugeVec
+	lastRun            *prometheus.GaugeVec
+	lastRunSuccess     *prometheus.GaugeVec
+	lastSuccess        *prometheus.GaugeVec
+	repoLastSuccess    *prometheus.GaugeVec
+	rateLimitRemaining *prometheus.GaugeVec
+}
+
+// The metrics of the backups, if they are enabled. All the methods are
+// safe to call on a nil *backupMetrics.
+var runMetrics *backupMetrics
+
+func newBackupMetrics() *backupMetrics {
+	m := &backupMetrics{
+		registry: prometheus.NewRegistry(),
+		discovered: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gitbackup_repositories_discovered",
+			Help: "Number of repositories discovered by the last run of the target",
+		}, []string{"target"}),
+		repositories: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gitbackup_repositories",
+			Help: "Number of repositories cloned, updated, skipped or failed by the last run of the target",
+		}, []string{"target", "result"}),
+		backupSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gitbackup_backup_size_bytes",
+			Help: "Size of the backup directory of the target",
+		}, []string{"target"}),
+		runDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gitbackup_run_duration_seconds",
+			Help: "Duration of the last run of the target",
+		}, []string{"target"}),
+		lastRun: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gitbackup_last_run_timestamp_seconds",
+			Help: "Time the last run of the target finished",
+		}, []string{"target"}),
+		lastRunSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gitbackup_last_run_success",
+			Help: "Whether the last run of the target backed up all the repositories (1) or not (0)",
+		}, []string{"target"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gitbackup_last_success_timestamp_seconds",
+			Help: "Time the last successful run of the target finished",
+		}, []string{"target"}),
+		repoLastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gitbackup_repository_last_success_timestamp_seconds",
+			Help: "Time the repository was last backed up successfully",
+		}, []string{"target", "repository"}),
+		rateLimitRemaining: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gitbackup_api_rate_limit_remaining",
+			Help: "Number of API requests left in the current rate limit window of the git host",
+		}, []string{"host"}),
+	}
+	m.registry.MustRegister(m.discovered, m.repositories, m.backupSize, m.runDuration,
+		m.lastRun, m.lastRunSuccess, m.lastSuccess, m.repoLastSuccess, m.rateLimitRemaining)
+	return m
+}
+
+// runSucceeded reports whether a run backed up all the repositories of
+// its target
+func runSucceeded(report *runReport, err error) bool {
+	return err == nil && (report == nil || report.Failed == 0)
+}
+
+// recordRun updates the metrics of a target after a run
+func (m *backupMetrics) recordRun(c *appConfig, startedAt time.Time, report *runReport, err error) {
+	if m == nil {
+		return
+	}
+	name := targetName(c)
+	finishedAt := time.Now()
+	m.runDuration.WithLabelValues(name).Set(finishedAt.Sub(startedAt).Seconds())
+	m.lastRun.WithLabelValues(name).Set(float64(finishedAt.Unix()))
+	if runSucceeded(report, err) {
+		m.lastRunSuccess.WithLabelValues(name).Set(1)
+		m.lastSuccess.WithLabelValues(name).Set(float64(finishedAt.Unix()))
+	} else {
+		m.lastRunSuccess.WithLabelValues(name).Set(0)
+	}
+	if report != nil {
+		m.discovered.WithLabelValues(name).Set(float64(report.Discovered))
+		m.repositories.WithLabelValues(name, "cloned").Set(float64(report.Cloned))
+		m.repositories.WithLabelValues(name, "updated").Set(float64(report.Updated))
+		m.repositories.WithLabelValues(name, "skipped").Set(float64(report.Skipped))
+		m.repositories.WithLabelValues(name, "failed").Set(float64(report.Failed))
+	}
+	if c.backupDir != "" {
+		size, err := dirSize(c.backupDir)
+		if err != nil {
+			slog.Warn("Error measuring the size of the backup directory", "path", c.backupDir, "error", err)
+		} else {
+			m.backupSize.WithLabelValues(name).Set(float64(size))
+		}
+	}
+}
+
+// setLastSuccess records the last successful run of a target from a
+// previous run of gitbackup
+func (m *backupMetrics) setLastSuccess(target string, t time.Time) {
+	if m == nil {
+		return
+	}
+	m.lastSuccess.WithLabelValues(target).Set(float64(t.Unix()))
+}
+
+// setRateLimitRemaining records the API quota left on a git host
+func (m *backupMetrics) setRateLimitRemaining(host string, remaining int) {
+	if m == nil {
+		return
+	}
+	m.rateLimitRemaining.WithLabelValues(host).Set(float64(remaining))
+}
+
+// sink returns the event sink recording when the repositories of a target
+// are backed up
+func (m *backupMetrics) sink(target string) *metricsSink {
+	return &metricsSink{metrics: m, target: target}
+}
+
+// metricsSink records the repositories backed up successfully. It isn't
+// interested in the transfer progress of the git commands.
+type metricsSink struct {
+	metrics *backupMetrics
+	target  string
+}
+
+func (s *metricsSink) handleEvent(e event, _ progressSnapshot) {
+	if e.Type == eventRepoFinished && e.Status == "success" {
+		s.metrics.repoLastSuccess.WithLabelValues(s.target, e.Repository).Set(float64(e.Time.Unix()))
+	}
+}
+
+// dirSize returns the size of the files under path
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// The metrics carried over from the previous textfile, so that a target
+// or a repository which fails keeps the time of its last success
+var restoredMetrics = []string{
+	"gitbackup_last_success_timestamp_seconds",
+	"gitbackup_repository_last_success_timestamp_seconds",
+}
+
+// restoreTextfile reads the last success times from the textfile written
+// by the previous run, if there is one
+func (m *backupMetrics) restoreTextfile(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	families, err := parser.TextToMetricFamilies(f)
+	if err != nil {
+		return fmt.Errorf("error parsing the metrics in %s: %v", path, err)
+	}
+	vecs := map[string]*prometheus.GaugeVec{
+		restoredMetrics[0]: m.lastSuccess,
+		restoredMetrics[1]: m.repoLastSuccess,
+	}
+	for _, name := range restoredMetrics {
+		family, ok := families[name]
+		if !ok {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := prometheus.Labels{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			gauge, err := vecs[name].GetMetricWith(labels)
+			if err != nil {
+				// Written by a different version of gitbackup
+				continue
+			}
+			gauge.Set(metric.GetGauge().GetValue())
+		}
+	}
+	return nil
+}
+
+// writeTextfile writes the metrics for the node-exporter textfile
+// collector. The file is replaced atomically.
+func (m *backupMetrics) writeTextfile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := prometheus.WriteToTextfile(path, m.registry); err != nil {
+		return fmt.Errorf("error writing the metrics to %s: %v", path, err)
+	}
+	return nil
+}
+
+// healthStatus is the response of /healthz
+type healthStatus struct {
+	Status  string         `json:"status"`
+	Targets []targetHealth `json:"targets"`
+}
+
+// targetHealth is the freshness of the backup of a target
+type targetHealth struct {
+	Target      string     `json:"target"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	StaleAfter  string     `json:"stale_after"`
+	Stale       bool       `json:"stale"`
+}
+
+// metricsHandler serves the metrics on /metrics and the health of the
+// daemon's targets on /healthz
+func metricsHandler(m *backupMetrics, d *daemon) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		health := d.health(time.Now())
+		w.Header().Set("Content-Type", "application/json")
+		if health.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(health)
+	})
+	return mux
+}
+
+// serveMetrics serves the metrics and the health of the daemon on address
+// until ctx is done
+func serveMetrics(ctx context.Context, address string, m *backupMetrics, d *daemon) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %v", address, err)
+	}
+	server := &http.Server{
+		Handler:           metricsHandler(m, d),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	slog.Info("Serving the metrics", "address", listener.Addr().String())
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Error serving the metrics", "error", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBackupMetrics(t *testing.T) {
+	backupDir := t.TempDir()
+	os.MkdirAll(filepath.Join(backupDir, "owner", "repo"), 0755)
+	os.WriteFile(filepath.Join(backupDir, "owner", "repo", "HEAD"), []byte("0123456789"), 0644)
+	os.WriteFile(filepath.Join(backupDir, "owner", "README"), []byte("01234"), 0644)
+
+	m := newBackupMetrics()
+	c := &appConfig{name: "work", service: "github", backupDir: backupDir}
+	p := newRunProgress("github", "github.com", m.sink("work"))
+	repo := &Repository{Namespace: "owner", Name: "repo"}
+	p.repoStarted(repo, actionUpdate)
+	p.repoFinished(repo, actionUpdate, nil, nil)
+	p.repoFinished(&Repository{Namespace: "owner", Name: "broken"}, actionUpdate, errors.New("exit status 128"), nil)
+	if p.trackTransfers() {
+		t.Error("Expected the metrics not to need the transfer progress")
+	}
+	report := p.runFinished()
+	report.Discovered = 2
+	m.recordRun(c, time.Now().Add(-time.Minute), report, nil)
+	m.setRateLimitRemaining("api.github.com", 4990)
+
+	var testCases = []struct {
+		name     string
+		got      float64
+		expected float64
+	}{
+		{"discovered", testutil.ToFloat64(m.discovered.WithLabelValues("work")), 2},
+		{"updated", testutil.ToFloat64(m.repositories.WithLabelValues("work", "updated")), 1},
+		{"failed", testutil.ToFloat64(m.repositories.WithLabelValues("work", "failed")), 1},
+		{"backup size", testutil.ToFloat64(m.backupSize.WithLabelValues("work")), 15},
+		{"last run success", testutil.ToFloat64(m.lastRunSuccess.WithLabelValues("work")), 0},
+		{"rate limit", testutil.ToFloat64(m.rateLimitRemaining.WithLabelValues("api.github.com")), 4990},
+	}
+	for _, tc := range testCases {
+		if tc.got != tc.expected {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, tc.got)
+		}
+	}
+	if got := testutil.CollectAndCount(m.lastSuccess); got != 0 {
+		t.Errorf("Expected no successful run, got %d", got)
+	}
+	if got := testutil.CollectAndCount(m.repoLastSuccess); got != 1 {
+		t.Errorf("Expected the last success of one repository, got %d", got)
+	}
+	if d := testutil.ToFloat64(m.runDuration.WithLabelValues("work")); d < 60 {
+		t.Errorf("Expected the duration of the run, got %v", d)
+	}
+
+	// A nil *backupMetrics is a no-op
+	var none *backupMetrics
+	none.recordRun(c, time.Now(), report, nil)
+	none.setRateLimitRemaining("api.github.com", 1)
+}
+
+func TestMetricsTextfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "textfile", "gitbackup.prom")
+	c := &appConfig{name: "work", service: "github"}
+
+	m := newBackupMetrics()
+	if err := m.restoreTextfile(path); err != nil {
+		t.Fatal(err)
+	}
+	m.sink("work").handleEvent(event{Type: eventRepoFinished, Repository: "owner/repo", Status: "success", Time: time.Unix(1700000000, 0)}, progressSnapshot{})
+	m.recordRun(c, time.Now(), &runReport{Discovered: 1, Updated: 1}, nil)
+	if err := m.writeTextfile(path); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	for _, line := range []string{
+		`gitbackup_repositories_discovered{target="work"} 1`,
+		`gitbackup_repository_last_success_timestamp_seconds{repository="owner/repo",target="work"} 1.7e+09`,
+		`gitbackup_last_run_success{target="work"} 1`,
+	} {
+		if !strings.Contains(string(data), line+"\n") {
+			t.Errorf("Expected %s in the textfile, got:\n%s", line, data)
+		}
+	}
+
+	// A failed run keeps the last success times of the previous one
+	m = newBackupMetrics()
+	if err := m.restoreTextfile(path); err != nil {
+		t.Fatal(err)
+	}
+	m.recordRun(c, time.Now(), nil, errors.New("401 Unauthorized"))
+	if got := testutil.ToFloat64(m.repoLastSuccess.WithLabelValues("work", "owner/repo")); got != 1700000000 {
+		t.Errorf("Expected the last success of the repository to be restored, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.lastSuccess.WithLabelValues("work")); got == 0 {
+		t.Error("Expected the last success of the target to be restored")
+	}
+	if got := testutil.ToFloat64(m.lastRunSuccess.WithLabelValues("work")); got != 0 {
+		t.Errorf("Expected the last run to have failed, got %v", got)
+	}
+
+	os.WriteFile(path, []byte("not metrics"), 0644)
+	if err := newBackupMetrics().restoreTextfile(path); err == nil {
+		t.Error("Expected an error for a corrupted textfile")
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	load := func() ([]*appConfig, error) {
+		return []*appConfig{daemonTestConfig("hourly", "@every 1h")}, nil
+	}
+	run := func(c *appConfig) (*runReport, error) {
+		return &runReport{}, nil
+	}
+	d := newDaemon(load, run, &runHistory{})
+	if err := d.reload(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	m := newBackupMetrics()
+	m.setRateLimitRemaining("api.github.com", 42)
+	server := httptest.NewServer(metricsHandler(m, d))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the metrics to be served, got %s", resp.Status)
+	}
+
+	resp, err = http.Get(server.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the daemon to be healthy, got %s", resp.Status)
+	}
+
+	d.started = time.Now().Add(-3 * time.Hour)
+	resp, err = http.Get(server.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected the target to be stale, got %s", resp.Status)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// notificationsConfig configures who is told about the runs of a target
+type notificationsConfig struct {
+	// When to notify: failure (the default) or always
+	When string `yaml:"when,omitempty"`
+	// Generic webhooks receiving the run summary as JSON
+	Webhooks []webhookConfig `yaml:"webhooks,omitempty"`
+	// Slack, Mattermost or Matrix (hookshot) compatible incoming webhooks
+	Chat  []chatConfig `yaml:"chat,omitempty"`
+	Email *emailConfig `yaml:"email,omitempty"`
+	// URL requested after every successful run, for dead man's switch
+	// services such as healthchecks.io, whatever When is set to
+	PingURL string `yaml:"ping_url,omitempty"`
+}
+
+type webhookConfig struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// text/template rendering the body of the request. The notification
+	// is sent as JSON by default.
+	Template string `yaml:"template,omitempty"`
+}
+
+type chatConfig struct {
+	URL string `yaml:"url"`
+}
+
+type emailConfig struct {
+	Host string `yaml:"host"`
+	// 587 by default. Port 465 uses implicit TLS, the other ports
+	// STARTTLS when the server supports it.
+	Port     int    `yaml:"port,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	// Environment variable or file holding the password
+	PasswordEnv  string   `yaml:"password_env,omitempty"`
+	PasswordFile string   `yaml:"password_file,omitempty"`
+	From         string   `yaml:"from"`
+	To           []string `yaml:"to"`
+}
+
+const (
+	notifyOnFailure = "failure"
+	notifyAlways    = "always"
+)
+
+// How long a notification may take, a var so that tests can shorten it
+var notificationTimeout = 30 * time.Second
+
+// enabled reports whether anything is notified about the runs
+func (nc notificationsConfig) enabled() bool {
+	return len(nc.Webhooks) != 0 || len(nc.Chat) != 0 || nc.Email != nil || nc.PingURL != ""
+}
+
+// validate checks the settings without sending anything
+func (nc notificationsConfig) validate() error {
+	if nc.When != "" && nc.When != notifyOnFailure && nc.When != notifyAlways {
+		return fmt.Errorf("invalid when: %q (must be failure or always)", nc.When)
+	}
+	for _, w := range nc.Webhooks {
+		if err := validateNotificationURL(w.URL); err != nil {
+			return err
+		}
+		if _, err := parseWebhookTemplate(w.Template); err != nil {
+			return fmt.Errorf("invalid webhook template: %v", err)
+		}
+	}
+	for _, c := range nc.Chat {
+		if err := validateNotificationURL(c.URL); err != nil {
+			return err
+		}
+	}
+	if nc.PingURL != "" {
+		if err := validateNotificationURL(nc.PingURL); err != nil {
+			return err
+		}
+	}
+	if e := nc.Email; e != nil {
+		if e.Host == "" || e.From == "" || len(e.To) == 0 {
+			return errors.New("email needs host, from and to")
+		}
+		if e.Port < 0 || e.Port > 65535 {
+			return fmt.Errorf("invalid email port: %d", e.Port)
+		}
+		if e.PasswordEnv != "" && e.PasswordFile != "" {
+			return errors.New("email needs either password_env or password_file, not both")
+		}
+	}
+	return nil
+}
+
+func validateNotificationURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid notification URL: %q (must be an http or https URL)", redact(rawURL))
+	}
+	return nil
+}
+
+// registerSecrets keeps the URLs out of the logs, as webhook URLs usually
+// embed a secret
+func (nc notificationsConfig) registerSecrets() {
+	for _, w := range nc.Webhooks {
+		registerSecret(w.URL)
+	}
+	for _, c := range nc.Chat {
+		registerSecret(c.URL)
+	}
+	registerSecret(nc.PingURL)
+}
+
+// notification is the summary of a run sent to the webhooks. It is also
+// the data of the webhook templates.
+type notification struct {
+	Target     string     `json:"target"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt time.Time  `json:"finished_at"`
+	Summary    string     `json:"summary"`
+	Report     *runReport `json:"report,omitempty"`
+}
+
+// The most failed repositories listed in a summary
+const maxNotifiedFailures = 10
+
+func newNotification(c *appConfig, startedAt time.Time, report *runReport, err error) notification {
+	n := notification{
+		Target:     targetName(c),
+		Status:     "success",
+		StartedAt:  startedAt,
+		FinishedAt: time.Now(),
+		Report:     report,
+	}
+	if !runSucceeded(report, err) {
+		n.Status = "failure"
+	}
+	if err != nil {
+		n.Error = redact(err.Error())
+	}
+
+	var summary strings.Builder
+	if n.Status == "success" {
+		fmt.Fprintf(&summary, "gitbackup: backing up %s succeeded", n.Target)
+	} else {
+		fmt.Fprintf(&summary, "gitbackup: backing up %s failed", n.Target)
+	}
+	if n.Error != "" {
+		fmt.Fprintf(&summary, ": %s", n.Error)
+	}
+	if report != nil {
+		fmt.Fprintf(&summary, "\n%d repositories: %d cloned, %d updated, %d skipped, %d failed",
+			report.Discovered, report.Cloned, report.Updated, report.Skipped, report.Failed)
+		for i, f := range report.Failures {
+			if i == maxNotifiedFailures {
+				fmt.Fprintf(&summary, "\n- and %d more", len(report.Failures)-i)
+				break
+			}
+			fmt.Fprintf(&summary, "\n- %s: %s", f.Repository, f.Error)
+		}
+	}
+	n.Summary = summary.String()
+	return n
+}
+
+// notificationClient returns the client sending the notifications. The
+// notification endpoints are usually outside the network of the git host,
+// so the target's TLS and proxy settings don't apply.
+func notificationClient() *http.Client {
+	return &http.Client{Timeout: notificationTimeout}
+}
+
+// notifyRun sends the notifications configured for a target about a run.
+// Failing to notify is logged, it doesn't fail the run.
+func notifyRun(c *appConfig, startedAt time.Time, report *runReport, err error) {
+	nc := c.notifications
+	if !nc.enabled() {
+		return
+	}
+	nc.registerSecrets()
+	n := newNotification(c, startedAt, report, err)
+
+	if n.Status == "success" && nc.PingURL != "" {
+		if err := ping(nc.PingURL); err != nil {
+			slog.Warn("Error pinging the dead man's switch", "target", n.Target, "error", err)
+		}
+	}
+	if n.Status == "success" && nc.When != notifyAlways {
+		return
+	}
+
+	for _, w := range nc.Webhooks {
+		if err := sendWebhook(w, n); err != nil {
+			slog.Warn("Error sending the webhook notification", "target", n.Target, "error", err)
+		}
+	}
+	for _, chat := range nc.Chat {
+		if err := sendChat(chat, n); err != nil {
+			slog.Warn("Error sending the chat notification", "target", n.Target, "error", err)
+		}
+	}
+	if nc.Email != nil {
+		if err := sendEmail(*nc.Email, n); err != nil {
+			slog.Warn("Error sending the email notification", "target", n.Target, "error", err)
+		}
+	}
+}
+
+// ping requests the dead man's switch URL
+func ping(pingURL string) error {
+	resp, err := notificationClient().Get(pingURL)
+	if err != nil {
+		return errors.New(redact(err.Error()))
+	}
+	return checkNotificationResponse(resp)
+}
+
+// parseWebhookTemplate parses the template of a webhook, which can use
+// json to encode a value
+func parseWebhookTemplate(text string) (*template.Template, error) {
+	return template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}).Parse(text)
+}
+
+// renderWebhook returns the body of a webhook request
+func renderWebhook(w webhookConfig, n notification) ([]byte, error) {
+	if w.Template == "" {
+		return json.Marshal(n)
+	}
+	tmpl, err := parseWebhookTemplate(w.Template)
+	if err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, n); err != nil {
+		return nil, err
+	}
+	return body.Bytes(), nil
+}
+
+func sendWebhook(w webhookConfig, n notification) error {
+	body, err := renderWebhook(w, n)
+	if err != nil {
+		return fmt.Errorf("error rendering the webhook template: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.New(redact(err.Error()))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range w.Headers {
+		req.Header.Set(name, value)
+	}
+	return postNotification(req)
+}
+
+// sendChat posts the summary to an incoming webhook in the format shared
+// by Slack, Mattermost and Matrix hookshot
+func sendChat(chat chatConfig, n notification) error {
+	body, err := json.Marshal(map[string]string{"text": n.Summary})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, chat.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.New(redact(err.Error()))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return postNotification(req)
+}
+
+func postNotification(req *http.Request) error {
+	resp, err := notificationClient().Do(req)
+	if err != nil {
+		return errors.New(redact(err.Error()))
+	}
+	return checkNotificationResponse(resp)
+}
+
+func checkNotificationResponse(resp *http.Response) error {
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return nil
+}
+
+// emailMessage returns the message sent by email about a run
+func emailMessage(e emailConfig, n notification) []byte {
+	var msg bytes.Buffer
+	subject, body, _ := strings.Cut(n.Summary, "\n")
+	fmt.Fprintf(&msg, "From: %s\r\n", e.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", n.FinishedAt.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	if body != "" {
+		msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n") + "\r\n")
+	}
+	return msg.Bytes()
+}
+
+// emailPassword returns the password of the SMTP account, if one is
+// configured
+func emailPassword(e emailConfig) (string, error) {
+	return readPassword(e.PasswordEnv, e.PasswordFile)
+}
+
+// We have it here so that we can override it in the tests
+var smtpSend = sendSMTP
+
+func sendEmail(e emailConfig, n notification) error {
+	password, err := emailPassword(e)
+	if err != nil {
+		return err
+	}
+	port := e.Port
+	if port == 0 {
+		port = 587
+	}
+	var auth smtp.Auth
+	if e.Username != "" {
+		auth = smtp.PlainAuth("", e.Username, password, e.Host)
+	}
+	return smtpSend(net.JoinHostPort(e.Host, strconv.Itoa(port)), auth, e.From, e.To, emailMessage(e, n))
+}
+
+// sendSMTP sends a message like smtp.SendMail does, but with implicit TLS
+// on port 465 and a timeout, so that a mail server which doesn't answer
+// can't hang the run
+func sendSMTP(address string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	host, port, _ := net.SplitHostPort(address)
+	dialer := &net.Dialer{Timeout: notificationTimeout}
+	var conn net.Conn
+	var err error
+	if port == "465" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(notificationTimeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if port != "465" {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+				return err
+			}
+		}
+	}
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
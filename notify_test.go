@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotificationsConfigValidate(t *testing.T) {
+	var testCases = []struct {
+		config  notificationsConfig
+		wantErr bool
+	}{
+		{notificationsConfig{}, false},
+		{notificationsConfig{When: "always", Chat: []chatConfig{{URL: "https://hooks.slack.com/services/T0/B0/x"}}}, false},
+		{notificationsConfig{When: "sometimes"}, true},
+		{notificationsConfig{PingURL: "hc-ping.com/uuid"}, true},
+		{notificationsConfig{Webhooks: []webhookConfig{{URL: "https://example.com/hook", Template: `{"text": {{json .Summary}}}`}}}, false},
+		{notificationsConfig{Webhooks: []webhookConfig{{URL: "https://example.com/hook", Template: `{{.Summary`}}}, true},
+		{notificationsConfig{Email: &emailConfig{Host: "smtp.example.com", From: "gitbackup@example.com", To: []string{"ops@example.com"}}}, false},
+		{notificationsConfig{Email: &emailConfig{Host: "smtp.example.com", From: "gitbackup@example.com"}}, true},
+		{notificationsConfig{Email: &emailConfig{Host: "smtp.example.com", From: "gitbackup@example.com", To: []string{"ops@example.com"}, PasswordEnv: "SMTP_PASSWORD", PasswordFile: "/etc/smtp"}}, true},
+	}
+	for _, tc := range testCases {
+		if err := tc.config.validate(); (err != nil) != tc.wantErr {
+			t.Errorf("%+v: expected an error: %v, got %v", tc.config, tc.wantErr, err)
+		}
+	}
+}
+
+func TestNewNotification(t *testing.T) {
+	c := &appConfig{name: "work", service: "gitlab"}
+	report := &runReport{Discovered: 3, Updated: 2, Failed: 1, Failures: []repoFailure{{Repository: "group/project", Error: "exit status 128"}}}
+	n := newNotification(c, time.Now(), report, nil)
+	expected := "gitbackup: backing up work failed\n3 repositories: 0 cloned, 2 updated, 0 skipped, 1 failed\n- group/project: exit status 128"
+	if n.Status != "failure" || n.Summary != expected {
+		t.Errorf("Expected a failure with the summary:\n%s\ngot %s:\n%s", expected, n.Status, n.Summary)
+	}
+
+	n = newNotification(c, time.Now(), nil, errors.New("401 Unauthorized"))
+	if n.Status != "failure" || n.Summary != "gitbackup: backing up work failed: 401 Unauthorized" {
+		t.Errorf("Unexpected notification: %+v", n)
+	}
+	n = newNotification(c, time.Now(), &runReport{Discovered: 1, Updated: 1}, nil)
+	if n.Status != "success" || !strings.HasPrefix(n.Summary, "gitbackup: backing up work succeeded\n") {
+		t.Errorf("Unexpected notification: %+v", n)
+	}
+}
+
+// notificationServer records the requests it receives
+type notificationServer struct {
+	mu       sync.Mutex
+	requests map[string]string
+}
+
+func startNotificationServer(t *testing.T) (*notificationServer, string) {
+	ns := &notificationServer{requests: map[string]string{}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		ns.mu.Lock()
+		ns.requests[r.Method+" "+r.URL.Path] = r.Header.Get("X-Token") + string(body)
+		ns.mu.Unlock()
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return ns, server.URL
+}
+
+func TestNotifyRun(t *testing.T) {
+	ns, serverURL := startNotificationServer(t)
+	var mails []string
+	smtpSend = func(address string, auth smtp.Auth, from string, to []string, msg []byte) error {
+		mails = append(mails, address+" "+from+" "+strings.Join(to, ",")+"\n"+string(msg))
+		return nil
+	}
+	defer func() {
+		smtpSend = sendSMTP
+	}()
+
+	c := &appConfig{name: "work", service: "github", notifications: notificationsConfig{
+		Webhooks: []webhookConfig{
+			{URL: serverURL + "/webhook", Headers: map[string]string{"X-Token": "s3cr3t"}},
+			{URL: serverURL + "/templated", Template: `{"msg": {{json .Summary}}, "status": "{{.Status}}"}`},
+			{URL: serverURL + "/broken"},
+		},
+		Chat:    []chatConfig{{URL: serverURL + "/chat"}},
+		Email:   &emailConfig{Host: "smtp.example.com", From: "gitbackup@example.com", To: []string{"ops@example.com", "dev@example.com"}},
+		PingURL: serverURL + "/ping",
+	}}
+
+	// Only the dead man's switch is told about successful runs by default
+	notifyRun(c, time.Now(), &runReport{Discovered: 1, Updated: 1}, nil)
+	if len(ns.requests) != 1 || len(mails) != 0 {
+		t.Fatalf("Expected only the ping, got %v and %d emails", ns.requests, len(mails))
+	}
+	if _, ok := ns.requests["GET /ping"]; !ok {
+		t.Errorf("Expected the ping, got %v", ns.requests)
+	}
+
+	ns.requests = map[string]string{}
+	notifyRun(c, time.Now(), nil, errors.New("401 Unauthorized"))
+	if _, ok := ns.requests["GET /ping"]; ok {
+		t.Error("Expected no ping after a failed run")
+	}
+	var n notification
+	body := strings.TrimPrefix(ns.requests["POST /webhook"], "s3cr3t")
+	if err := json.Unmarshal([]byte(body), &n); err != nil || body == ns.requests["POST /webhook"] || n.Target != "work" || n.Status != "failure" || n.Error != "401 Unauthorized" {
+		t.Errorf("Unexpected webhook notification: %s", ns.requests["POST /webhook"])
+	}
+	expected := `{"msg": "gitbackup: backing up work failed: 401 Unauthorized", "status": "failure"}`
+	if got := ns.requests["POST /templated"]; got != expected {
+		t.Errorf("Expected the templated body %s, got %s", expected, got)
+	}
+	if got := ns.requests["POST /chat"]; got != `{"text":"gitbackup: backing up work failed: 401 Unauthorized"}` {
+		t.Errorf("Unexpected chat notification: %s", got)
+	}
+	if len(mails) != 1 || !strings.HasPrefix(mails[0], "smtp.example.com:587 gitbackup@example.com ops@example.com,dev@example.com\n") ||
+		!strings.Contains(mails[0], "\r\nSubject: gitbackup: backing up work failed: 401 Unauthorized\r\n") {
+		t.Errorf("Unexpected emails: %q", mails)
+	}
+
+	// Successful runs are notified too when asked for
+	ns.requests = map[string]string{}
+	c.notifications.When = notifyAlways
+	notifyRun(c, time.Now(), &runReport{}, nil)
+	if len(ns.requests) != 5 {
+		t.Errorf("Expected all the notifications, got %v", ns.requests)
+	}
+}
+
+func TestNotificationTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// An endpoint which never answers
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	defer func(timeout time.Duration) {
+		notificationTimeout = timeout
+	}(notificationTimeout)
+	notificationTimeout = 200 * time.Millisecond
+
+	start := time.Now()
+	if err := ping(server.URL); err == nil {
+		t.Error("Expected an error from a ping URL which doesn't answer")
+	}
+	if err := sendWebhook(webhookConfig{URL: server.URL}, notification{}); err == nil {
+		t.Error("Expected an error from a webhook which doesn't answer")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the timeout to apply, took %s", elapsed)
+	}
+}
+
+func TestSendSMTP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// A minimal mail server, without STARTTLS
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+		var message string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch strings.ToUpper(strings.Fields(line)[0]) {
+			case "EHLO":
+				fmt.Fprint(conn, "250-localhost\r\n250 8BITMIME\r\n")
+			case "DATA":
+				fmt.Fprint(conn, "354 go ahead\r\n")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					message += line
+				}
+				fmt.Fprint(conn, "250 queued\r\n")
+			case "QUIT":
+				received <- message
+				fmt.Fprint(conn, "221 bye\r\n")
+				return
+			default:
+				fmt.Fprint(conn, "250 ok\r\n")
+			}
+		}
+	}()
+	if err := sendSMTP(listener.Addr().String(), nil, "gitbackup@example.com", []string{"ops@example.com"}, []byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if message := <-received; message != "Subject: test\r\n\r\nbody\r\n" {
+		t.Errorf("Unexpected message: %q", message)
+	}
+
+	// A mail server which accepts the connection but never answers
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	defer func(timeout time.Duration) {
+		notificationTimeout = timeout
+	}(notificationTimeout)
+	notificationTimeout = 200 * time.Millisecond
+	start := time.Now()
+	if err := sendSMTP(silent.Addr().String(), nil, "gitbackup@example.com", []string{"ops@example.com"}, []byte("body")); err == nil {
+		t.Error("Expected an error from a mail server which doesn't answer")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the timeout to apply, took %s", elapsed)
+	}
+}
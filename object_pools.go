@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// objectPools is set per target: whether the repositories of a fork
+// network share their objects through an object pool
+var objectPools bool
+
+// objectPoolsDir is the directory of the object pools in the backup
+// directory. Namespaces can't start with a dot, so it doesn't clash with
+// one.
+const objectPoolsDir = ".pools"
+
+// objectPoolLocks serializes the changes to each object pool, as the
+// repositories of a fork network may be backed up concurrently
+var objectPoolLocks sync.Map
+
+// lockObjectPool takes the lock of an object pool, in this process and in
+// the other gitbackup processes sharing the backup directory
+func lockObjectPool(pool string) (unlock func(), err error) {
+	mu, _ := objectPoolLocks.LoadOrStore(pool, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	unlockFile, err := lockPath(pool+".lock", slog.Default())
+	if err != nil {
+		mu.(*sync.Mutex).Unlock()
+		return nil, fmt.Errorf("error locking the object pool: %v", err)
+	}
+	return func() {
+		unlockFile()
+		mu.(*sync.Mutex).Unlock()
+	}, nil
+}
+
+// forkRoots caches the roots of the fork networks by git host and full
+// name of the repositories, for the life of the process, e.g. the runs of
+// the daemon, as finding them takes API calls
+var forkRoots sync.Map
+
+// maxForkDepth bounds the lookups of the parents of a fork
+const maxForkDepth = 50
+
+// forkNetworkRoot returns the full name of the repository at the root of
+// the fork network of the repository name of host, looking up the parent
+// of each repository with parentOf, which returns "" for a repository
+// which isn't a fork. The root is cached for every repository on the way,
+// so that the forks of a repository share the lookups. It returns "" if
+// the root can't be found.
+func forkNetworkRoot(host, name string, parentOf func(name string) (string, error)) string {
+	var visited []string
+	root := ""
+	for root == "" && len(visited) < maxForkDepth {
+		if cached, ok := forkRoots.Load(host + " " + name); ok {
+			root = cached.(string)
+			break
+		}
+		visited = append(visited, name)
+		parent, err := parentOf(name)
+		if err != nil {
+			slog.Warn("Error looking up the fork network of the repository, its objects won't be shared", "repo", visited[0], "error", err)
+			return ""
+		}
+		if parent == "" {
+			root = name
+		}
+		name = parent
+	}
+	if root == "" {
+		return ""
+	}
+	for _, name := range visited {
+		forkRoots.Store(host+" "+name, root)
+	}
+	return root
+}
+
+// repoNetworkName returns the full name identifying repo in fork networks
+func repoNetworkName(repo *Repository) string {
+	if repo.FullName != "" {
+		return repo.FullName
+	}
+	return repoFullName(repo)
+}
+
+// objectPool returns the object pool repo shares its objects through, or ""
+// if it doesn't share them. Forks share the pool named after the repository
+// at the root of their fork network, which joins the pool once it exists.
+func objectPool(backupDir string, repo *Repository) string {
+	if !objectPools {
+		return ""
+	}
+	network := repo.ForkOf
+	if network == "" {
+		network = repoNetworkName(repo)
+	}
+	// The full name comes from the git host, it mustn't escape the
+	// directory of the pools
+	if cleaned := path.Clean(network); cleaned != network || path.IsAbs(network) || strings.HasPrefix(network, "..") {
+		return ""
+	}
+	pool := path.Join(backupDir, objectPoolsDir, network+".git")
+	if repo.ForkOf == "" {
+		if _, err := os.Stat(pool); err != nil {
+			return ""
+		}
+	}
+	return pool
+}
+
+// initObjectPool creates the object pool if it doesn't exist. The pool
+// never prunes objects, so that the repositories sharing it can't lose
+// any.
+func initObjectPool(pool string) error {
+	if _, err := os.Stat(filepath.Join(pool, "objects")); err == nil {
+		return nil
+	}
+	for _, args := range [][]string{
+		{"init", "--bare", "--quiet", pool},
+		{"-C", pool, "config", "gc.pruneExpire", "never"},
+		{"-C", pool, "config", "gc.reflogExpireUnreachable", "never"},
+	} {
+		if out, err := newGitCommand(args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("error creating the object pool %s: %v: %s", pool, err, out)
+		}
+	}
+	return nil
+}
+
+// shareObjects links the repository at repoDir to the object pool and
+// copies its objects into the pool, under refs/members/<repository>/ so
+// that they stay reachable in the pool. The refs of the repositories are
+// never removed from the pool, even when their branches are deleted, as the
+// repositories may still borrow the objects of those branches. Once its
+// objects are in the pool, the repository drops its own copy of them if it
+// was just cloned or linked to the pool.
+func shareObjects(pool, repoDir string, repo *Repository, bare, cloned bool) error {
+	unlock, err := lockObjectPool(pool)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := initObjectPool(pool); err != nil {
+		return err
+	}
+	poolObjects, err := filepath.Abs(filepath.Join(pool, "objects"))
+	if err != nil {
+		return err
+	}
+	gitDir := repoDir
+	if !bare {
+		gitDir = filepath.Join(repoDir, ".git")
+	}
+	linked, err := linkAlternates(filepath.Join(gitDir, "objects", "info", "alternates"), poolObjects)
+	if err != nil {
+		return err
+	}
+
+	source, err := filepath.Abs(repoDir)
+	if err != nil {
+		return err
+	}
+	refspec := "+refs/*:refs/members/" + repoFullName(repo) + "/*"
+	if out, err := newGitCommand("-C", pool, "fetch", "--quiet", "--no-tags", source, refspec).CombinedOutput(); err != nil {
+		return fmt.Errorf("error copying the objects into the object pool %s: %v: %s", pool, err, out)
+	}
+	if cloned || linked {
+		// Loose objects are only removed once they are in a local pack, so
+		// everything is packed first, then repacked without the objects of
+		// the pool
+		for _, args := range [][]string{
+			{"-C", repoDir, "repack", "-a", "-d", "-q"},
+			{"-C", repoDir, "repack", "-a", "-d", "-l", "-q"},
+		} {
+			if out, err := newGitCommand(args...).CombinedOutput(); err != nil {
+				return fmt.Errorf("error removing the objects shared with the object pool: %v: %s", err, out)
+			}
+		}
+	}
+	return nil
+}
+
+// linkAlternates adds the objects of the pool to the alternates of a
+// repository, and reports whether they weren't there yet
+func linkAlternates(alternates, poolObjects string) (bool, error) {
+	data, err := os.ReadFile(alternates)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == poolObjects {
+			return false, nil
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(alternates), 0755); err != nil {
+		return false, err
+	}
+	f, err := os.OpenFile(alternates, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return false, err
+	}
+	if len(data) > 0 && !strings.HasSuffix(string(data), "\n") {
+		poolObjects = "\n" + poolObjects
+	}
+	_, err = fmt.Fprintln(f, poolObjects)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return true, err
+}
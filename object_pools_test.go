@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestObjectPool(t *testing.T) {
+	backupDir := t.TempDir()
+	oldObjectPools := objectPools
+	defer func() { objectPools = oldObjectPools }()
+
+	var tests = []struct {
+		name        string
+		objectPools bool
+		repo        *Repository
+		want        string
+	}{
+		{"disabled", false, &Repository{Namespace: "fork", Name: "repo", ForkOf: "octocat/repo"}, ""},
+		{"fork", true, &Repository{Namespace: "fork", Name: "repo", ForkOf: "octocat/repo"}, filepath.ToSlash(filepath.Join(backupDir, ".pools", "octocat", "repo.git"))},
+		{"not a fork", true, &Repository{Namespace: "octocat", Name: "other"}, ""},
+		{"escaping fork", true, &Repository{Namespace: "fork", Name: "repo", ForkOf: "../../etc"}, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			objectPools = tc.objectPools
+			if got := objectPool(backupDir, tc.repo); got != tc.want {
+				t.Errorf("objectPool() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// countLocalObjects returns the number of objects stored in the repository
+// itself, not counting those of its alternates
+func countLocalObjects(t *testing.T, repoDir string) int {
+	t.Helper()
+	total := 0
+	for _, line := range strings.Split(gitTest(t, "-C", repoDir, "count-objects", "-v"), "\n") {
+		key, value, _ := strings.Cut(line, ": ")
+		if key == "count" || key == "in-pack" {
+			n, _ := strconv.Atoi(value)
+			total += n
+		}
+	}
+	return total
+}
+
+func TestBackUpSharesObjectPool(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	oldFS, oldObjectPools := appFS, objectPools
+	defer func() { appFS, objectPools = oldFS, oldObjectPools }()
+	appFS = afero.NewOsFs()
+	objectPools = true
+
+	// The upstream repository and a fork of it with a commit of its own
+	hosted := t.TempDir()
+	upstream := filepath.Join(hosted, "octocat", "repo.git")
+	newTestRepository(t, filepath.Join(hosted, "work"))
+	work := filepath.Join(hosted, "work")
+	for i := 0; i < 20; i++ {
+		os.WriteFile(filepath.Join(work, "file"+strconv.Itoa(i)), []byte(strings.Repeat("content ", i+1)), 0644)
+	}
+	gitTest(t, "-C", work, "add", ".")
+	gitTest(t, "-C", work, "commit", "-q", "-m", "files")
+	gitTest(t, "clone", "-q", "--bare", work, upstream)
+	fork := filepath.Join(hosted, "fork", "repo.git")
+	gitTest(t, "clone", "-q", "--bare", upstream, fork)
+	gitTest(t, "-C", work, "commit", "-q", "--allow-empty", "-m", "fork")
+	gitTest(t, "-C", work, "push", "-q", fork, "HEAD:refs/heads/feature")
+
+	backupDir := t.TempDir()
+	root := &Repository{Namespace: "octocat", Name: "repo", CloneURL: upstream}
+	forked := &Repository{Namespace: "fork", Name: "repo", CloneURL: fork, ForkOf: "octocat/repo"}
+	backUpRepo := func(repo *Repository) {
+		t.Helper()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		if out, err := backUp(backupDir, repo, true, &wg); err != nil {
+			t.Fatalf("backUp(%s): %v: %s", repoFullName(repo), err, out)
+		}
+	}
+
+	// The repository the fork is a fork of isn't in a pool until one of
+	// its forks creates it
+	backUpRepo(root)
+	rootDir := filepath.Join(backupDir, "octocat", "repo.git")
+	if _, err := os.Stat(filepath.Join(rootDir, "objects", "info", "alternates")); !os.IsNotExist(err) {
+		t.Fatalf("repository without forks was linked to a pool: %v", err)
+	}
+	rootObjects := countLocalObjects(t, rootDir)
+
+	backUpRepo(forked)
+	forkDir := filepath.Join(backupDir, "fork", "repo.git")
+	if n := countLocalObjects(t, forkDir); n >= rootObjects {
+		t.Errorf("fork stores %d objects, the repository it is a fork of %d", n, rootObjects)
+	}
+	gitTest(t, "-C", forkDir, "fsck", "--no-progress")
+
+	// The next backup links the repository to the pool of its forks
+	backUpRepo(root)
+	if n := countLocalObjects(t, rootDir); n != 0 {
+		t.Errorf("repository stores %d objects which are in the pool", n)
+	}
+	alternates, _ := os.ReadFile(filepath.Join(rootDir, "objects", "info", "alternates"))
+	if strings.Count(string(alternates), "\n") != 1 {
+		t.Errorf("unexpected alternates: %q", alternates)
+	}
+	backUpRepo(forked)
+	alternates, _ = os.ReadFile(filepath.Join(forkDir, "objects", "info", "alternates"))
+	if strings.Count(string(alternates), "\n") != 1 {
+		t.Errorf("fork linked to the pool twice: %q", alternates)
+	}
+
+	// Deleting a branch and pruning a repository doesn't remove objects
+	// another repository borrows
+	gitTest(t, "-C", fork, "branch", "-D", "feature")
+	backUpRepo(forked)
+	gitTest(t, "-C", forkDir, "gc", "--quiet", "--prune=now")
+	gitTest(t, "-C", filepath.Join(backupDir, ".pools", "octocat", "repo.git"), "gc", "--quiet")
+	gitTest(t, "-C", rootDir, "fsck", "--no-progress")
+	gitTest(t, "-C", forkDir, "fsck", "--no-progress")
+	if got := gitTest(t, "-C", rootDir, "log", "--format=%s"); got != "files\ninitial" {
+		t.Errorf("history of the repository after pruning = %q", got)
+	}
+}
+
+func TestObjectPoolsConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, defaultConfigFile)
+	os.WriteFile(configPath, []byte("service: github\nobject_pools: true\ngitlab:\n  project_membership_type: all\n"), 0644)
+
+	c, err := buildTestConfig([]string{"-config", configPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.objectPools {
+		t.Error("object_pools wasn't read from the config file")
+	}
+	if err := validateConfig(c); err != nil {
+		t.Errorf("validateConfig() = %v", err)
+	}
+
+	// The archives would lack the objects in the pools
+	c, err = buildTestConfig([]string{"-config", configPath, "-s3.endpoint", "s3.amazonaws.com", "-s3.bucket", "backups", "-s3.format", "tar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateConfig(c); err == nil || !strings.Contains(err.Error(), "tar archives") {
+		t.Errorf("validateConfig() with tar archives = %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"strings"
 
@@ -16,6 +17,10 @@ func appFlags() []cli.Flag {
 			Name:  "config",
 			Usage: "Path to config file (default: OS config directory)",
 		},
+		&cli.StringFlag{
+			Name:  "target",
+			Usage: "Only back up the target with this name from the config file",
+		},
 
 		// Generic flags
 		&cli.StringFlag{
@@ -46,6 +51,182 @@ func appFlags() []cli.Flag {
 			Name:  "bare",
 			Usage: "Clone bare repositories",
 		},
+		&cli.BoolFlag{
+			Name:  "object-pools",
+			Usage: "Share the objects of forks and the repositories they are forks of through object pools",
+		},
+		&cli.StringFlag{
+			Name:        "clone.strategy",
+			Usage:       "How the repositories are cloned (full, blobless, shallow, single-branch)",
+			DefaultText: cloneStrategyFull,
+		},
+		&cli.IntFlag{
+			Name:  "clone.depth",
+			Usage: "Number of commits of history the shallow clones keep",
+		},
+		&cli.StringFlag{
+			Name:        "clone.branch",
+			Usage:       "Branch of the single-branch clones",
+			DefaultText: "the default branch",
+		},
+		&cli.StringFlag{
+			Name:        "clone.repositories",
+			Usage:       "Repositories the clone strategy applies to, e.g. owner/* (separate each value by a comma)",
+			DefaultText: "all",
+		},
+		&cli.IntFlag{
+			Name:        "concurrency",
+			Usage:       "Maximum number of concurrent clones",
+			DefaultText: "20",
+			Value:       MaxConcurrentClones,
+		},
+		&cli.StringFlag{
+			Name:  "concurrency.perHost",
+			Usage: "Maximum number of concurrent clones per git host (separate each value by a comma: 'host1=2,host2=10')",
+		},
+		&cli.StringFlag{
+			Name:        "order",
+			Usage:       "Order in which to backup repositories (listed, pushed, largest, smallest)",
+			DefaultText: "listed",
+			Value:       orderListed,
+		},
+		&cli.StringFlag{
+			Name:  "bandwidth-limit",
+			Usage: "Maximum bandwidth per second shared by all git transfers, e.g. 512K or 10M",
+		},
+		&cli.StringFlag{
+			Name:  "http.caFile",
+			Usage: "CA bundle to verify the certificates of the Git host with, instead of the system's",
+		},
+		&cli.StringFlag{
+			Name:  "http.clientCert",
+			Usage: "Client certificate for Git hosts requiring mutual TLS",
+		},
+		&cli.StringFlag{
+			Name:  "http.clientKey",
+			Usage: "Private key of the client certificate",
+		},
+		&cli.BoolFlag{
+			Name:  "http.insecureSkipVerify",
+			Usage: "Don't verify the certificates of the Git host (for test setups only)",
+		},
+		&cli.StringFlag{
+			Name:        "http.proxy",
+			Usage:       "HTTP(S) proxy for the API requests and HTTPS clones",
+			DefaultText: "$HTTPS_PROXY/$HTTP_PROXY",
+		},
+		&cli.DurationFlag{
+			Name:        "http.timeout",
+			Usage:       "Timeout for connecting and waiting for responses, and for stalled HTTPS transfers, e.g. 30s",
+			DefaultText: "none",
+		},
+		&cli.StringFlag{
+			Name:  "ssh.privateKey",
+			Usage: "SSH private key for the SSH clones, e.g. a deploy key",
+		},
+		&cli.StringFlag{
+			Name:  "ssh.knownHosts",
+			Usage: "known_hosts file with the host keys of the Git host",
+		},
+		&cli.StringFlag{
+			Name:        "ssh.strictHostKeyChecking",
+			Usage:       "Host key policy of the SSH clones (yes, accept-new, no)",
+			DefaultText: "ssh's default",
+		},
+		&cli.IntFlag{
+			Name:        "ssh.port",
+			Usage:       "SSH port of the Git host, if it isn't part of the SSH clone URLs",
+			DefaultText: "22",
+		},
+		&cli.StringFlag{
+			Name:  "s3.endpoint",
+			Usage: "Host of the S3-compatible object storage to upload the backups to, e.g. s3.amazonaws.com",
+		},
+		&cli.StringFlag{
+			Name:  "s3.bucket",
+			Usage: "Bucket to upload the backups to",
+		},
+		&cli.StringFlag{
+			Name:        "s3.prefix",
+			Usage:       "Prefix of the uploaded objects",
+			DefaultText: "the Git host name",
+		},
+		&cli.StringFlag{
+			Name:  "s3.region",
+			Usage: "Region of the bucket",
+		},
+		&cli.BoolFlag{
+			Name:  "s3.insecure",
+			Usage: "Use plain HTTP to upload the backups, e.g. to a local MinIO",
+		},
+		&cli.StringFlag{
+			Name:        "s3.format",
+			Usage:       "Upload the repositories as git bundles, tar archives or a full bundle followed by incremental ones (bundle, tar, incremental)",
+			DefaultText: uploadFormatBundle,
+		},
+		&cli.BoolFlag{
+			Name:  "s3.prune",
+			Usage: "Remove the uploaded repositories which are no longer in the backup directory",
+		},
+		&cli.StringFlag{
+			Name:  "s3.storageClass",
+			Usage: "Storage class of the uploaded objects, e.g. STANDARD_IA",
+		},
+		&cli.StringFlag{
+			Name:  "s3.sse",
+			Usage: "Server-side encryption of the uploaded objects (AES256, aws:kms)",
+		},
+		&cli.StringFlag{
+			Name:  "s3.sseKMSKeyID",
+			Usage: "KMS key of the server-side encryption with aws:kms",
+		},
+		&cli.DurationFlag{
+			Name:        "maintenance.interval",
+			Usage:       "Run git maintenance on the repositories which are updated, at most once per interval, e.g. 168h",
+			DefaultText: "no maintenance",
+		},
+		&cli.StringFlag{
+			Name:        "maintenance.tasks",
+			Usage:       "Maintenance tasks to run, in order (separate each value by a comma: maintenance, repack, commit-graph, gc)",
+			DefaultText: "gc",
+		},
+		&cli.StringFlag{
+			Name:        "maintenance.pruneExpire",
+			Usage:       "Unreachable objects more recent than this are kept by gc",
+			DefaultText: defaultPruneExpire,
+		},
+		&cli.BoolFlag{
+			Name:  "verbose",
+			Usage: "Verbose logging, including the remaining API rate limit quota (same as -log-level debug)",
+		},
+		&cli.StringFlag{
+			Name:        "log-level",
+			Usage:       "Log level (debug, info, warn, error)",
+			DefaultText: "info",
+			Value:       "info",
+		},
+		&cli.StringFlag{
+			Name:        "log-format",
+			Usage:       "Log format (text, json)",
+			DefaultText: "text",
+			Value:       logFormatText,
+		},
+		&cli.StringFlag{
+			Name:  "events",
+			Usage: "Write a machine-readable event stream to standard output (json)",
+		},
+		&cli.StringFlag{
+			Name:  "metrics-textfile",
+			Usage: "Write Prometheus metrics of the run to this file, for the node-exporter textfile collector",
+		},
+		&cli.BoolFlag{
+			Name:  "no-progress",
+			Usage: "Don't show the progress display, even when attached to a terminal",
+		},
+		&cli.BoolFlag{
+			Name:  "non-interactive",
+			Usage: "Never prompt for input, e.g. to log in (implied when stdin isn't a terminal)",
+		},
 
 		// GitHub specific flags
 		&cli.StringFlag{
@@ -54,10 +235,33 @@ func appFlags() []cli.Flag {
 			DefaultText: "all",
 			Value:       "all",
 		},
+		&cli.StringFlag{
+			Name:        "github.apiURL",
+			Usage:       "API URL of the GitHub Enterprise Server",
+			DefaultText: "derived from -githost.url",
+		},
+		&cli.StringFlag{
+			Name:        "github.uploadURL",
+			Usage:       "Upload API URL of the GitHub Enterprise Server",
+			DefaultText: "derived from the API URL",
+		},
 		&cli.StringFlag{
 			Name:  "github.namespaceWhitelist",
 			Usage: "Organizations/Users from where we should clone (separate each value by a comma: 'user1,org2')",
 		},
+		&cli.Int64Flag{
+			Name:  "github.appID",
+			Usage: "Authenticate as the GitHub App with this ID instead of with a token",
+		},
+		&cli.StringFlag{
+			Name:  "github.appPrivateKeyFile",
+			Usage: "Path to the private key (PEM) of the GitHub App",
+		},
+		&cli.Int64Flag{
+			Name:        "github.appInstallationID",
+			Usage:       "ID of the GitHub App installation",
+			DefaultText: "discovered if the app has a single installation",
+		},
 		&cli.BoolFlag{
 			Name:  "github.createUserMigration",
 			Usage: "Download user data",
@@ -109,14 +313,16 @@ func appFlags() []cli.Flag {
 	}
 }
 
-// buildConfig builds an appConfig from the CLI context, respecting config file precedence.
-// If a config file exists, its values are used as the base and only explicitly-set
+// buildConfigs builds an appConfig for each target from the CLI context,
+// respecting config file precedence. If a config file exists, its values
+// (and those of its targets) are used as the base and only explicitly-set
 // CLI flags override them.
-func buildConfig(cCtx *cli.Context) (*appConfig, error) {
+func buildConfigs(cCtx *cli.Context) ([]*appConfig, error) {
 	configPath := cCtx.String("config")
+	selected := cCtx.String("target")
 
 	// Try to load config file as the base configuration
-	var c appConfig
+	var configs []*appConfig
 	configFileLoaded := false
 
 	resolvedPath, pathErr := resolveConfigPath(configPath)
@@ -126,96 +332,396 @@ func buildConfig(cCtx *cli.Context) (*appConfig, error) {
 			if err != nil {
 				return nil, err
 			}
-			c = *fileConfigToAppConfig(fc)
+			targets, err := fc.targets()
+			if err != nil {
+				return nil, err
+			}
+			for _, t := range targets {
+				if selected != "" && t.Name != selected {
+					continue
+				}
+				c := fileConfigToAppConfig(&t)
+				if err := applyFlagOverrides(cCtx, c); err != nil {
+					return nil, err
+				}
+				configs = append(configs, c)
+			}
+			if len(configs) == 0 {
+				return nil, fmt.Errorf("no target named %q in %s", selected, resolvedPath)
+			}
 			configFileLoaded = true
 		}
 	}
 
-	if configFileLoaded {
-		// Only override config file values with flags that were explicitly set
-		if cCtx.IsSet("service") {
-			c.service = cCtx.String("service")
-		}
-		if cCtx.IsSet("githost.url") {
-			c.gitHostURL = cCtx.String("githost.url")
-		}
-		if cCtx.IsSet("backupdir") {
-			c.backupDir = cCtx.String("backupdir")
-		}
-		if cCtx.IsSet("ignore-private") {
-			c.ignorePrivate = cCtx.Bool("ignore-private")
-		}
-		if cCtx.IsSet("ignore-fork") {
-			c.ignoreFork = cCtx.Bool("ignore-fork")
-		}
-		if cCtx.IsSet("use-https-clone") {
-			c.useHTTPSClone = cCtx.Bool("use-https-clone")
-		}
-		if cCtx.IsSet("bare") {
-			c.bare = cCtx.Bool("bare")
+	if !configFileLoaded {
+		if selected != "" {
+			return nil, errors.New("-target requires a config file with targets")
 		}
-		if cCtx.IsSet("github.repoType") {
-			c.githubRepoType = cCtx.String("github.repoType")
-		}
-		if cCtx.IsSet("github.namespaceWhitelist") {
-			ns := cCtx.String("github.namespaceWhitelist")
-			if len(ns) > 0 {
-				c.githubNamespaceWhitelist = strings.Split(ns, ",")
-			}
-		}
-		if cCtx.IsSet("gitlab.projectVisibility") {
-			c.gitlabProjectVisibility = cCtx.String("gitlab.projectVisibility")
-		}
-		if cCtx.IsSet("gitlab.projectMembershipType") {
-			c.gitlabProjectMembershipType = cCtx.String("gitlab.projectMembershipType")
+		// No config file — read all values from CLI context directly
+		c, err := configFromFlags(cCtx)
+		if err != nil {
+			return nil, err
 		}
-		if cCtx.IsSet("forgejo.repoType") {
-			c.forgejoRepoType = cCtx.String("forgejo.repoType")
+		configs = append(configs, c)
+	}
+
+	for _, c := range configs {
+		c.verbose = cCtx.Bool("verbose")
+		c.events = cCtx.String("events")
+		c.noProgress = cCtx.Bool("no-progress")
+
+		backupDir, err := setupBackupDir(&c.backupDir, &c.service, &c.gitHostURL)
+		if err != nil {
+			return nil, err
 		}
+		c.backupDir = backupDir
+	}
+	return configs, nil
+}
 
-		// Migration flags are always from CLI (not in config file)
-		c.githubCreateUserMigration = cCtx.Bool("github.createUserMigration")
-		c.githubCreateUserMigrationRetry = cCtx.Bool("github.createUserMigrationRetry")
-		c.githubCreateUserMigrationRetryMax = cCtx.Int("github.createUserMigrationRetryMax")
-		c.githubListUserMigrations = cCtx.Bool("github.listUserMigrations")
-		c.githubWaitForMigrationComplete = cCtx.Bool("github.waitForUserMigration")
-	} else {
-		// No config file — read all values from CLI context directly
+// applyFlagOverrides overrides the config file values in c with the flags
+// that were explicitly set
+func applyFlagOverrides(cCtx *cli.Context, c *appConfig) error {
+	if cCtx.IsSet("service") {
 		c.service = cCtx.String("service")
+	}
+	if cCtx.IsSet("githost.url") {
 		c.gitHostURL = cCtx.String("githost.url")
+	}
+	if cCtx.IsSet("backupdir") {
 		c.backupDir = cCtx.String("backupdir")
+	}
+	if cCtx.IsSet("ignore-private") {
 		c.ignorePrivate = cCtx.Bool("ignore-private")
+	}
+	if cCtx.IsSet("ignore-fork") {
 		c.ignoreFork = cCtx.Bool("ignore-fork")
+	}
+	if cCtx.IsSet("use-https-clone") {
 		c.useHTTPSClone = cCtx.Bool("use-https-clone")
+	}
+	if cCtx.IsSet("github.apiURL") {
+		c.githubAPIURL = cCtx.String("github.apiURL")
+	}
+	if cCtx.IsSet("github.uploadURL") {
+		c.githubUploadURL = cCtx.String("github.uploadURL")
+	}
+	if cCtx.IsSet("bare") {
 		c.bare = cCtx.Bool("bare")
+	}
+	if cCtx.IsSet("object-pools") {
+		c.objectPools = cCtx.Bool("object-pools")
+	}
+	// The clone strategy of the flags comes before those of the config file
+	if cCtx.IsSet("clone.strategy") {
+		c.cloneStrategies = append([]cloneStrategyRule{cloneStrategyFromFlags(cCtx)}, c.cloneStrategies...)
+	}
+	if cCtx.IsSet("concurrency") {
+		c.maxConcurrentClones = cCtx.Int("concurrency")
+	}
+	if cCtx.IsSet("concurrency.perHost") {
+		perHost, err := parsePerHostConcurrency(cCtx.String("concurrency.perHost"))
+		if err != nil {
+			return err
+		}
+		c.perHostConcurrency = perHost
+	}
+	if cCtx.IsSet("order") {
+		c.order = cCtx.String("order")
+	}
+	if cCtx.IsSet("bandwidth-limit") {
+		c.bandwidthLimit = cCtx.String("bandwidth-limit")
+	}
+	// Only the daemon command has a schedule flag, for the targets
+	// without a schedule of their own
+	if cCtx.IsSet("schedule") && c.schedule == "" {
+		c.schedule = cCtx.String("schedule")
+	}
+	if cCtx.IsSet("http.caFile") {
+		c.http.CAFile = cCtx.String("http.caFile")
+	}
+	if cCtx.IsSet("http.clientCert") {
+		c.http.ClientCert = cCtx.String("http.clientCert")
+	}
+	if cCtx.IsSet("http.clientKey") {
+		c.http.ClientKey = cCtx.String("http.clientKey")
+	}
+	if cCtx.IsSet("http.insecureSkipVerify") {
+		c.http.InsecureSkipVerify = cCtx.Bool("http.insecureSkipVerify")
+	}
+	if cCtx.IsSet("http.proxy") {
+		c.http.Proxy = cCtx.String("http.proxy")
+	}
+	if cCtx.IsSet("http.timeout") {
+		c.http.Timeout = cCtx.Duration("http.timeout")
+	}
+	if cCtx.IsSet("ssh.privateKey") {
+		c.ssh.PrivateKey = cCtx.String("ssh.privateKey")
+	}
+	if cCtx.IsSet("ssh.knownHosts") {
+		c.ssh.KnownHosts = cCtx.String("ssh.knownHosts")
+	}
+	if cCtx.IsSet("ssh.strictHostKeyChecking") {
+		c.ssh.StrictHostKeyChecking = cCtx.String("ssh.strictHostKeyChecking")
+	}
+	if cCtx.IsSet("ssh.port") {
+		c.ssh.Port = cCtx.Int("ssh.port")
+	}
+	if cCtx.IsSet("s3.endpoint") {
+		c.s3.Endpoint = cCtx.String("s3.endpoint")
+	}
+	if cCtx.IsSet("s3.bucket") {
+		c.s3.Bucket = cCtx.String("s3.bucket")
+	}
+	if cCtx.IsSet("s3.prefix") {
+		c.s3.Prefix = cCtx.String("s3.prefix")
+	}
+	if cCtx.IsSet("s3.region") {
+		c.s3.Region = cCtx.String("s3.region")
+	}
+	if cCtx.IsSet("s3.insecure") {
+		c.s3.Insecure = cCtx.Bool("s3.insecure")
+	}
+	if cCtx.IsSet("s3.format") {
+		c.s3.Format = cCtx.String("s3.format")
+	}
+	if cCtx.IsSet("s3.prune") {
+		c.s3.Prune = cCtx.Bool("s3.prune")
+	}
+	if cCtx.IsSet("s3.storageClass") {
+		c.s3.StorageClass = cCtx.String("s3.storageClass")
+	}
+	if cCtx.IsSet("s3.sse") {
+		c.s3.SSE = cCtx.String("s3.sse")
+	}
+	if cCtx.IsSet("s3.sseKMSKeyID") {
+		c.s3.SSEKMSKeyID = cCtx.String("s3.sseKMSKeyID")
+	}
+	if cCtx.IsSet("maintenance.interval") {
+		c.maintenance.Interval = cCtx.Duration("maintenance.interval")
+	}
+	if cCtx.IsSet("maintenance.tasks") {
+		c.maintenance.Tasks = strings.Split(cCtx.String("maintenance.tasks"), ",")
+	}
+	if cCtx.IsSet("maintenance.pruneExpire") {
+		c.maintenance.PruneExpire = cCtx.String("maintenance.pruneExpire")
+	}
+	if cCtx.IsSet("github.repoType") {
 		c.githubRepoType = cCtx.String("github.repoType")
-		c.gitlabProjectVisibility = cCtx.String("gitlab.projectVisibility")
-		c.gitlabProjectMembershipType = cCtx.String("gitlab.projectMembershipType")
-		c.forgejoRepoType = cCtx.String("forgejo.repoType")
-		c.githubCreateUserMigration = cCtx.Bool("github.createUserMigration")
-		c.githubCreateUserMigrationRetry = cCtx.Bool("github.createUserMigrationRetry")
-		c.githubCreateUserMigrationRetryMax = cCtx.Int("github.createUserMigrationRetryMax")
-		c.githubListUserMigrations = cCtx.Bool("github.listUserMigrations")
-		c.githubWaitForMigrationComplete = cCtx.Bool("github.waitForUserMigration")
-
+	}
+	if cCtx.IsSet("github.namespaceWhitelist") {
 		ns := cCtx.String("github.namespaceWhitelist")
 		if len(ns) > 0 {
 			c.githubNamespaceWhitelist = strings.Split(ns, ",")
 		}
 	}
+	if cCtx.IsSet("github.appID") {
+		c.githubApp.AppID = cCtx.Int64("github.appID")
+	}
+	if cCtx.IsSet("github.appPrivateKeyFile") {
+		c.githubApp.PrivateKeyFile = cCtx.String("github.appPrivateKeyFile")
+	}
+	if cCtx.IsSet("github.appInstallationID") {
+		c.githubApp.InstallationID = cCtx.Int64("github.appInstallationID")
+	}
+	if cCtx.IsSet("gitlab.projectVisibility") {
+		c.gitlabProjectVisibility = cCtx.String("gitlab.projectVisibility")
+	}
+	if cCtx.IsSet("gitlab.projectMembershipType") {
+		c.gitlabProjectMembershipType = cCtx.String("gitlab.projectMembershipType")
+	}
+	if cCtx.IsSet("forgejo.repoType") {
+		c.forgejoRepoType = cCtx.String("forgejo.repoType")
+	}
+
+	// Migration flags are always from CLI (not in config file)
+	c.githubCreateUserMigration = cCtx.Bool("github.createUserMigration")
+	c.githubCreateUserMigrationRetry = cCtx.Bool("github.createUserMigrationRetry")
+	c.githubCreateUserMigrationRetryMax = cCtx.Int("github.createUserMigrationRetryMax")
+	c.githubListUserMigrations = cCtx.Bool("github.listUserMigrations")
+	c.githubWaitForMigrationComplete = cCtx.Bool("github.waitForUserMigration")
+	return nil
+}
+
+// configFromFlags builds an appConfig from the CLI flags alone
+func configFromFlags(cCtx *cli.Context) (*appConfig, error) {
+	var c appConfig
+	c.service = cCtx.String("service")
+	c.gitHostURL = cCtx.String("githost.url")
+	c.backupDir = cCtx.String("backupdir")
+	c.ignorePrivate = cCtx.Bool("ignore-private")
+	c.ignoreFork = cCtx.Bool("ignore-fork")
+	c.useHTTPSClone = cCtx.Bool("use-https-clone")
+	c.bare = cCtx.Bool("bare")
+	c.objectPools = cCtx.Bool("object-pools")
+	if cCtx.String("clone.strategy") != "" {
+		c.cloneStrategies = []cloneStrategyRule{cloneStrategyFromFlags(cCtx)}
+	}
+	c.maxConcurrentClones = cCtx.Int("concurrency")
+	c.order = cCtx.String("order")
+	c.bandwidthLimit = cCtx.String("bandwidth-limit")
+	c.schedule = cCtx.String("schedule")
+	c.http = httpConfig{
+		CAFile:             cCtx.String("http.caFile"),
+		ClientCert:         cCtx.String("http.clientCert"),
+		ClientKey:          cCtx.String("http.clientKey"),
+		InsecureSkipVerify: cCtx.Bool("http.insecureSkipVerify"),
+		Proxy:              cCtx.String("http.proxy"),
+		Timeout:            cCtx.Duration("http.timeout"),
+	}
+	c.ssh = sshConfig{
+		PrivateKey:            cCtx.String("ssh.privateKey"),
+		KnownHosts:            cCtx.String("ssh.knownHosts"),
+		StrictHostKeyChecking: cCtx.String("ssh.strictHostKeyChecking"),
+		Port:                  cCtx.Int("ssh.port"),
+	}
+	c.s3 = s3Config{
+		Endpoint: cCtx.String("s3.endpoint"),
+		Bucket:   cCtx.String("s3.bucket"),
+		Prefix:   cCtx.String("s3.prefix"),
+		Region:   cCtx.String("s3.region"),
+		Insecure: cCtx.Bool("s3.insecure"),
+		uploadOptions: uploadOptions{
+			Format: cCtx.String("s3.format"),
+			Prune:  cCtx.Bool("s3.prune"),
+		},
+		StorageClass: cCtx.String("s3.storageClass"),
+		SSE:          cCtx.String("s3.sse"),
+		SSEKMSKeyID:  cCtx.String("s3.sseKMSKeyID"),
+	}
+	c.maintenance = maintenanceConfig{
+		Interval:    cCtx.Duration("maintenance.interval"),
+		PruneExpire: cCtx.String("maintenance.pruneExpire"),
+	}
+	if tasks := cCtx.String("maintenance.tasks"); tasks != "" {
+		c.maintenance.Tasks = strings.Split(tasks, ",")
+	}
+	c.githubRepoType = cCtx.String("github.repoType")
+	c.githubAPIURL = cCtx.String("github.apiURL")
+	c.githubUploadURL = cCtx.String("github.uploadURL")
+	c.githubApp = githubAppConfig{
+		AppID:          cCtx.Int64("github.appID"),
+		PrivateKeyFile: cCtx.String("github.appPrivateKeyFile"),
+		InstallationID: cCtx.Int64("github.appInstallationID"),
+	}
+	c.gitlabProjectVisibility = cCtx.String("gitlab.projectVisibility")
+	c.gitlabProjectMembershipType = cCtx.String("gitlab.projectMembershipType")
+	c.forgejoRepoType = cCtx.String("forgejo.repoType")
+	c.githubCreateUserMigration = cCtx.Bool("github.createUserMigration")
+	c.githubCreateUserMigrationRetry = cCtx.Bool("github.createUserMigrationRetry")
+	c.githubCreateUserMigrationRetryMax = cCtx.Int("github.createUserMigrationRetryMax")
+	c.githubListUserMigrations = cCtx.Bool("github.listUserMigrations")
+	c.githubWaitForMigrationComplete = cCtx.Bool("github.waitForUserMigration")
 
-	c.backupDir = setupBackupDir(&c.backupDir, &c.service, &c.gitHostURL)
+	ns := cCtx.String("github.namespaceWhitelist")
+	if len(ns) > 0 {
+		c.githubNamespaceWhitelist = strings.Split(ns, ",")
+	}
+
+	perHost, err := parsePerHostConcurrency(cCtx.String("concurrency.perHost"))
+	if err != nil {
+		return nil, err
+	}
+	c.perHostConcurrency = perHost
 	return &c, nil
 }
 
+// cloneStrategyFromFlags returns the clone strategy rule of the flags
+func cloneStrategyFromFlags(cCtx *cli.Context) cloneStrategyRule {
+	r := cloneStrategyRule{cloneStrategy: cloneStrategy{
+		Strategy: cCtx.String("clone.strategy"),
+		Depth:    cCtx.Int("clone.depth"),
+		Branch:   cCtx.String("clone.branch"),
+	}}
+	if repositories := cCtx.String("clone.repositories"); repositories != "" {
+		r.Repositories = strings.Split(repositories, ",")
+	}
+	return r
+}
+
 // validateConfig validates the configuration and returns an error if invalid
 func validateConfig(c *appConfig) error {
 	if _, ok := knownServices[c.service]; !ok {
 		return errors.New("please specify the git service type: github, gitlab, bitbucket, forgejo")
 	}
 
+	if c.schedule != "" {
+		if _, err := parseSchedule(c.schedule); err != nil {
+			return err
+		}
+	}
+	if err := c.ssh.validate(); err != nil {
+		return fmt.Errorf("please specify valid SSH settings: %v", err)
+	}
+	if (c.githubAPIURL != "" || c.githubUploadURL != "") && c.service != "github" {
+		return errors.New("the GitHub API URLs can only be used with the github service")
+	}
+
 	if !validGitlabProjectMembership(c.gitlabProjectMembershipType) {
 		return errors.New("please specify a valid gitlab project membership - all/owner/member/starred")
 	}
+
+	if c.maxConcurrentClones <= 0 {
+		return errors.New("please specify a positive number of concurrent clones")
+	}
+	if !contains(validOrders, c.order) {
+		return errors.New("please specify a valid order - listed/pushed/largest/smallest")
+	}
+	if _, err := parseByteSize(c.bandwidthLimit); err != nil {
+		return fmt.Errorf("please specify a valid bandwidth limit: %v", err)
+	}
+	if err := c.http.validate(); err != nil {
+		return fmt.Errorf("please specify valid HTTP settings: %v", err)
+	}
+	if err := c.s3.validate(); err != nil {
+		return fmt.Errorf("please specify valid S3 settings: %v", err)
+	}
+	if err := c.sftp.validate(); err != nil {
+		return fmt.Errorf("please specify valid SFTP settings: %v", err)
+	}
+	if err := c.webdav.validate(); err != nil {
+		return fmt.Errorf("please specify valid WebDAV settings: %v", err)
+	}
+	if err := validateStorage(c); err != nil {
+		return err
+	}
+	// The archive of a repository sharing an object pool lacks the objects
+	// in the pool
+	if c.objectPools && (c.s3.Format == uploadFormatTar || c.sftp.Format == uploadFormatTar || c.webdav.Format == uploadFormatTar) {
+		return errors.New("repositories sharing object pools can't be uploaded as tar archives, please use bundles")
+	}
+	if err := validateCloneStrategies(c.cloneStrategies, c.objectPools, targetUploadFormat(c)); err != nil {
+		return fmt.Errorf("please specify valid clone strategies: %v", err)
+	}
+	if err := c.encryption.validate(); err != nil {
+		return fmt.Errorf("please specify valid encryption settings: %v", err)
+	}
+	if err := c.maintenance.validate(); err != nil {
+		return fmt.Errorf("please specify valid maintenance settings: %v", err)
+	}
+	if err := c.notifications.validate(); err != nil {
+		return fmt.Errorf("please specify valid notifications settings: %v", err)
+	}
+	if err := c.serve.validate(); err != nil {
+		return fmt.Errorf("please specify valid serve settings: %v", err)
+	}
+	if c.githubApp.enabled() {
+		if c.service != "github" {
+			return errors.New("GitHub App authentication is only supported for github")
+		}
+		if c.githubApp.AppID == 0 || c.githubApp.PrivateKeyFile == "" {
+			return errors.New("please specify both the GitHub App ID and private key file")
+		}
+		// The installation tokens can't authenticate SSH clones
+		if !c.useHTTPSClone {
+			return errors.New("GitHub App authentication needs HTTPS clones, please set use_https_clone")
+		}
+		if c.githubCreateUserMigration || c.githubListUserMigrations {
+			return errors.New("user migrations need a user token, not GitHub App authentication")
+		}
+	}
+	if c.events != "" && c.events != "json" {
+		return errors.New("please specify a valid event stream format - json")
+	}
 	return nil
 }
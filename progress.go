@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// progressDisplay draws a status line with the overall progress and the
+// active backups at the bottom of the terminal. Log output written through
+// it is printed above the status line.
+type progressDisplay struct {
+	mutex    sync.Mutex
+	out      io.Writer
+	width    func() int
+	last     progressSnapshot
+	drawn    bool
+	finished bool
+	lastDraw time.Time
+}
+
+// We have it here so that we can override it in the tests
+var stderrIsTerminal = func() bool {
+	return term.IsTerminal(int(os.Stderr.Fd()))
+}
+
+func newProgressDisplay(out io.Writer) *progressDisplay {
+	return &progressDisplay{
+		out: out,
+		width: func() int {
+			if w, _, err := term.GetSize(int(os.Stderr.Fd())); err == nil && w > 0 {
+				return w
+			}
+			return 80
+		},
+	}
+}
+
+func (d *progressDisplay) handleEvent(e event, s progressSnapshot) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.last = s
+
+	// Don't redraw more often than the terminal can sensibly show
+	if e.Type == eventRepoProgress && time.Since(d.lastDraw) < 100*time.Millisecond {
+		return
+	}
+	if e.Type == eventRunFinished {
+		d.clear()
+		d.finished = true
+		return
+	}
+	d.draw()
+}
+
+// Write prints log output above the status line
+func (d *progressDisplay) Write(p []byte) (int, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.clear()
+	n, err := d.out.Write(p)
+	d.draw()
+	return n, err
+}
+
+func (d *progressDisplay) clear() {
+	if d.drawn {
+		fmt.Fprint(d.out, "\r\033[2K")
+		d.drawn = false
+	}
+}
+
+func (d *progressDisplay) draw() {
+	if d.finished {
+		return
+	}
+	line := formatProgressLine(d.last)
+	if width := d.width(); len(line) > width-1 {
+		line = line[:width-1]
+	}
+	fmt.Fprint(d.out, "\r\033[2K"+line)
+	d.drawn = true
+	d.lastDraw = time.Now()
+}
+
+// formatProgressLine renders the status line, e.g.
+// [12/40] 1 failed, 3 active, 120.5 MiB | org/repo1 45% | org/repo2 updating
+func formatProgressLine(s progressSnapshot) string {
+	total := strconv.Itoa(s.Listed)
+	if !s.ListingDone {
+		total += "+"
+	}
+	parts := []string{fmt.Sprintf("[%d/%s]", s.Done, total)}
+	if s.Failed > 0 {
+		parts = append(parts, fmt.Sprintf("%d failed,", s.Failed))
+	}
+	parts = append(parts, fmt.Sprintf("%d active, %s", len(s.Active), formatBytes(s.Bytes)))
+	line := strings.Join(parts, " ")
+
+	for _, rp := range s.Active {
+		status := rp.Action
+		if rp.Phase != "" {
+			status = fmt.Sprintf("%d%%", rp.Percent)
+		}
+		line += fmt.Sprintf(" | %s %s", rp.Repository, status)
+	}
+	return line
+}
+
+// formatBytes renders a byte count the way git does
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+// Matches git's --progress output, e.g.
+// Receiving objects:  45% (450/1000), 1.20 MiB | 2.00 MiB/s
+var gitProgressRegexp = regexp.MustCompile(`^(?:remote: )?([A-Za-z ]+):\s+(\d+)% \(\d+/\d+\)(?:, ([\d.]+) (GiB|MiB|KiB|bytes))?`)
+
+// parseGitProgress parses a line of git's progress output
+func parseGitProgress(line string) (phase string, percent int, bytes int64, ok bool) {
+	m := gitProgressRegexp.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		return "", 0, 0, false
+	}
+	percent, _ = strconv.Atoi(m[2])
+	if m[3] != "" {
+		n, _ := strconv.ParseFloat(m[3], 64)
+		switch m[4] {
+		case "GiB":
+			n *= 1 << 30
+		case "MiB":
+			n *= 1 << 20
+		case "KiB":
+			n *= 1 << 10
+		}
+		bytes = int64(n)
+	}
+	return m[1], percent, bytes, true
+}
+
+// gitProgressWriter collects the output of a git command while reporting
+// its transfer progress. Intermediate progress updates (terminated by \r)
+// are left out of the collected output.
+type gitProgressWriter struct {
+	mutex   sync.Mutex
+	repo    *Repository
+	partial []byte
+	output  bytes.Buffer
+}
+
+func (w *gitProgressWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, b := range p {
+		if b != '\r' && b != '\n' {
+			w.partial = append(w.partial, b)
+			continue
+		}
+		line := string(w.partial)
+		w.partial = w.partial[:0]
+		if phase, percent, bytes, ok := parseGitProgress(line); ok {
+			runEvents.repoTransfer(w.repo, phase, percent, bytes)
+		}
+		if b == '\n' {
+			w.output.WriteString(line + "\n")
+		}
+	}
+	return len(p), nil
+}
+
+func (w *gitProgressWriter) Bytes() []byte {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return append(w.output.Bytes(), w.partial...)
+}
+
+// runGitCommand runs a git command for repo and returns its combined
+// output, reporting the transfer progress of the command if needed
+func runGitCommand(cmd *exec.Cmd, repo *Repository) ([]byte, error) {
+	if !runEvents.trackTransfers() {
+		return cmd.CombinedOutput()
+	}
+	w := gitProgressWriter{repo: repo}
+	cmd.Stdout = &w
+	cmd.Stderr = &w
+	err := cmd.Run()
+	return w.Bytes(), err
+}
+
+// gitProgressArgs returns the arguments to make git report its progress
+// even though its output is not a terminal
+func gitProgressArgs() []string {
+	if runEvents.trackTransfers() {
+		return []string{"--progress"}
+	}
+	return nil
+}
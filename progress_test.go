@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGitProgress(t *testing.T) {
+	var testCases = []struct {
+		line        string
+		wantOK      bool
+		wantPhase   string
+		wantPercent int
+		wantBytes   int64
+	}{
+		{"Receiving objects:  45% (450/1000), 1.50 MiB | 2.00 MiB/s", true, "Receiving objects", 45, 3 << 19},
+		{"remote: Counting objects: 100% (20/20), done.", true, "Counting objects", 100, 0},
+		{"Resolving deltas:   3% (3/100)", true, "Resolving deltas", 3, 0},
+		{"Receiving objects: 100% (10/10), 512 bytes | 512.00 KiB/s, done.", true, "Receiving objects", 100, 512},
+		{"Cloning into bare repository 'repo'...", false, "", 0, 0},
+		{"Already up to date.", false, "", 0, 0},
+	}
+
+	for _, tc := range testCases {
+		phase, percent, bytes, ok := parseGitProgress(tc.line)
+		if ok != tc.wantOK || phase != tc.wantPhase || percent != tc.wantPercent || bytes != tc.wantBytes {
+			t.Errorf("parseGitProgress(%q): got %q %d %d %v", tc.line, phase, percent, bytes, ok)
+		}
+	}
+}
+
+func TestGitProgressWriter(t *testing.T) {
+	sink := recordingSink{}
+	runEvents = newRunProgress("github", "github.com", &sink)
+	defer func() {
+		runEvents = nil
+	}()
+	repo := &Repository{Namespace: "org", Name: "repo"}
+	runEvents.repoStarted(repo, actionClone)
+
+	w := gitProgressWriter{repo: repo}
+	w.Write([]byte("Cloning into 'repo'...\nReceiving objects:  10% (1/10)\rReceiving obj"))
+	w.Write([]byte("ects: 100% (10/10), 1.00 KiB | 1.00 KiB/s, done.\nerror"))
+
+	expected := "Cloning into 'repo'...\nReceiving objects: 100% (10/10), 1.00 KiB | 1.00 KiB/s, done.\nerror"
+	if got := string(w.Bytes()); got != expected {
+		t.Errorf("Expected output %q, got %q", expected, got)
+	}
+
+	var progress int
+	for _, e := range sink.events {
+		if e.Type == eventRepoProgress {
+			progress++
+		}
+	}
+	if progress != 2 {
+		t.Errorf("Expected 2 progress events, got %d", progress)
+	}
+	last := sink.snapshots[len(sink.snapshots)-1]
+	if len(last.Active) != 1 || last.Active[0].Percent != 100 || last.Active[0].Bytes != 1024 {
+		t.Errorf("Unexpected snapshot: %+v", last)
+	}
+}
+
+func TestFormatProgressLine(t *testing.T) {
+	s := progressSnapshot{
+		Listed: 40,
+		Done:   12,
+		Failed: 1,
+		Bytes:  5 << 20,
+		Active: []repoProgress{
+			{Repository: "org/repo1", Action: actionClone, Phase: "Receiving objects", Percent: 45},
+			{Repository: "org/repo2", Action: actionUpdate},
+		},
+	}
+	expected := "[12/40+] 1 failed, 2 active, 5.0 MiB | org/repo1 45% | org/repo2 update"
+	if got := formatProgressLine(s); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+
+	s = progressSnapshot{Listed: 3, ListingDone: true, Done: 3}
+	expected = "[3/3] 0 active, 0 bytes"
+	if got := formatProgressLine(s); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestProgressDisplayWrite(t *testing.T) {
+	var out bytes.Buffer
+	d := newProgressDisplay(&out)
+	d.width = func() int { return 20 }
+
+	d.handleEvent(event{Type: eventRepoStarted}, progressSnapshot{Listed: 100, Done: 1, Active: []repoProgress{{Repository: "org/a-very-long-repository-name", Action: actionClone}}})
+	d.Write([]byte("a log line\n"))
+	d.handleEvent(event{Type: eventRunFinished, Time: time.Now()}, progressSnapshot{})
+	d.Write([]byte("summary\n"))
+
+	got := out.String()
+	// The log line is printed on a cleared line, followed by the status line
+	// truncated to the width of the terminal
+	if !strings.Contains(got, "\r\033[2Ka log line\n\r\033[2K[1/100+] 1 active, \r") {
+		t.Errorf("Unexpected output: %q", got)
+	}
+	// Once the run has finished, the status line is not drawn again
+	if !strings.HasSuffix(got, "\r\033[2Ksummary\n") {
+		t.Errorf("Unexpected output: %q", got)
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+// pushWebhooksConfig configures the push webhooks of a target, received
+// by gitbackup serve-webhooks
+type pushWebhooksConfig struct {
+	// Environment variable or file holding the secret of the webhooks
+	SecretEnv  string `yaml:"secret_env,omitempty"`
+	SecretFile string `yaml:"secret_file,omitempty"`
+}
+
+// secret returns the secret of the webhooks, or "" if none is configured
+func (pc pushWebhooksConfig) secret() (string, error) {
+	switch {
+	case pc.SecretEnv != "" && pc.SecretFile != "":
+		return "", errors.New("push_webhooks needs either secret_env or secret_file, not both")
+	case pc.SecretEnv != "":
+		secret := os.Getenv(pc.SecretEnv)
+		if secret == "" {
+			return "", fmt.Errorf("environment variable %s not set", pc.SecretEnv)
+		}
+		registerSecret(secret)
+		return secret, nil
+	case pc.SecretFile != "":
+		secret, err := readTokenFile(pc.SecretFile)
+		if err != nil {
+			return "", err
+		}
+		registerSecret(secret)
+		return secret, nil
+	}
+	return "", nil
+}
+
+const (
+	defaultWebhooksAddress = ":8080"
+	defaultWebhookDebounce = 10 * time.Second
+	// GitHub doesn't send payloads larger than this
+	maxWebhookPayload = 25 << 20
+)
+
+// pushRepository is the repository in the push payloads of GitHub and
+// Forgejo
+type pushRepository struct {
+	Name     string `json:"name"`
+	FullName string `json:"full_name"`
+	CloneURL string `json:"clone_url"`
+	SSHURL   string `json:"ssh_url"`
+	Private  bool   `json:"private"`
+	Fork     bool   `json:"fork"`
+}
+
+type gitlabPushPayload struct {
+	Project struct {
+		Name              string `json:"name"`
+		Path              string `json:"path"`
+		PathWithNamespace string `json:"path_with_namespace"`
+		GitHTTPURL        string `json:"git_http_url"`
+		GitSSHURL         string `json:"git_ssh_url"`
+		// 0 for private, 10 for internal and 20 for public projects
+		VisibilityLevel int `json:"visibility_level"`
+	} `json:"project"`
+}
+
+// errIgnoredEvent is returned for the events which don't trigger a backup
+var errIgnoredEvent = errors.New("ignored event")
+
+// errInvalidSignature is returned when a webhook can't be authenticated
+var errInvalidSignature = errors.New("invalid signature")
+
+// validHMAC reports whether signature is the hex encoded HMAC-SHA256 of
+// body with secret
+func validHMAC(body []byte, secret, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// pushCloneURL returns the URL the target clones a repository with
+func pushCloneURL(c *appConfig, httpsURL, sshURL string) string {
+	if c.useHTTPSClone {
+		return httpsURL
+	}
+	return withSSHPort(sshURL, c.ssh.Port)
+}
+
+// parsePushWebhook authenticates a webhook request sent to a target and
+// returns the repository which was pushed to
+func parsePushWebhook(c *appConfig, secret string, header http.Header, body []byte) (*Repository, error) {
+	var event string
+	switch c.service {
+	case "github":
+		event = header.Get("X-GitHub-Event")
+		signature, ok := strings.CutPrefix(header.Get("X-Hub-Signature-256"), "sha256=")
+		if !ok || !validHMAC(body, secret, signature) {
+			return nil, errInvalidSignature
+		}
+	case "gitlab":
+		event = header.Get("X-Gitlab-Event")
+		if subtle.ConstantTimeCompare([]byte(header.Get("X-Gitlab-Token")), []byte(secret)) != 1 {
+			return nil, errInvalidSignature
+		}
+	case "forgejo":
+		// Forgejo still sends the headers of Gitea
+		event = header.Get("X-Forgejo-Event")
+		if event == "" {
+			event = header.Get("X-Gitea-Event")
+		}
+		signature := header.Get("X-Forgejo-Signature")
+		if signature == "" {
+			signature = header.Get("X-Gitea-Signature")
+		}
+		if !validHMAC(body, secret, signature) {
+			return nil, errInvalidSignature
+		}
+	default:
+		return nil, fmt.Errorf("push webhooks aren't supported for %s", c.service)
+	}
+
+	if c.service == "gitlab" {
+		if event != "Push Hook" && event != "Tag Push Hook" {
+			return nil, errIgnoredEvent
+		}
+		var payload gitlabPushPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, fmt.Errorf("invalid payload: %v", err)
+		}
+		p := payload.Project
+		if p.PathWithNamespace == "" {
+			return nil, errors.New("invalid payload: no project")
+		}
+		project := &gitlab.Project{
+			Name:              p.Name,
+			Path:              p.Path,
+			PathWithNamespace: p.PathWithNamespace,
+			Visibility:        gitlab.PublicVisibility,
+		}
+		switch p.VisibilityLevel {
+		case 0:
+			project.Visibility = gitlab.PrivateVisibility
+		case 10:
+			project.Visibility = gitlab.InternalVisibility
+		}
+		return gitlabRepository(project, pushCloneURL(c, p.GitHTTPURL, p.GitSSHURL)), nil
+	}
+
+	if event != "push" {
+		return nil, errIgnoredEvent
+	}
+	var payload struct {
+		Repository pushRepository `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid payload: %v", err)
+	}
+	r := payload.Repository
+	if r.FullName == "" {
+		return nil, errors.New("invalid payload: no repository")
+	}
+	namespace := strings.Split(r.FullName, "/")[0]
+	if r.Fork && c.ignoreFork {
+		return nil, errIgnoredEvent
+	}
+	if c.service == "github" && len(c.githubNamespaceWhitelist) > 0 && !contains(c.githubNamespaceWhitelist, namespace) {
+		return nil, errIgnoredEvent
+	}
+	return &Repository{
+		CloneURL:  pushCloneURL(c, r.CloneURL, r.SSHURL),
+		Name:      r.Name,
+		Namespace: namespace,
+		Private:   r.Private,
+	}, nil
+}
+
+// listsRepository reports whether the listing of the target includes repo,
+// so that a webhook can't back up a repository its filters leave out, e.g.
+// one the user only is a member of when the target backs up the owned ones
+func listsRepository(client any, c *appConfig, repo *Repository) (bool, error) {
+	found := false
+	err := walkRepositories(
+		client,
+		c.service,
+		c.githubRepoType,
+		c.githubNamespaceWhitelist,
+		c.gitlabProjectVisibility,
+		c.gitlabProjectMembershipType,
+		c.ignoreFork,
+		c.forgejoRepoType,
+		func(r *Repository) error {
+			if strings.EqualFold(repoFullName(r), repoFullName(repo)) {
+				found = true
+				return errStopListing
+			}
+			return nil
+		},
+	)
+	if err != nil && !errors.Is(err, errStopListing) {
+		return false, err
+	}
+	return found, nil
+}
+
+// pendingBackup is a backup of a repository waiting for its pushes to
+// settle down, queued or running
+type pendingBackup struct {
+	key    string
+	config *appConfig
+	repo   *Repository
+	timer  *time.Timer
+	// queued is set once the debounce delay has passed
+	queued  bool
+	running bool
+	// again is set when the repository is pushed to while it is being
+	// backed up
+	again bool
+}
+
+// repoBackupQueue backs up the repositories pushed to one at a time, as
+// the backups share the git settings of the process. A repository is only
+// backed up once no pushes were received for the debounce delay, and a
+// backup isn't queued twice.
+type repoBackupQueue struct {
+	backUp   func(*appConfig, *Repository) error
+	debounce time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*pendingBackup
+	ready   chan *pendingBackup
+}
+
+func newRepoBackupQueue(backUp func(*appConfig, *Repository) error, debounce time.Duration) *repoBackupQueue {
+	return &repoBackupQueue{
+		backUp:   backUp,
+		debounce: debounce,
+		pending:  make(map[string]*pendingBackup),
+		ready:    make(chan *pendingBackup),
+	}
+}
+
+// enqueue schedules a backup of repo
+func (q *repoBackupQueue) enqueue(c *appConfig, repo *Repository) {
+	key := targetName(c) + "/" + repoFullName(repo)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	p, ok := q.pending[key]
+	switch {
+	case !ok:
+		p = &pendingBackup{key: key, config: c, repo: repo}
+		q.pending[key] = p
+		p.timer = time.AfterFunc(q.debounce, func() { q.queue(p) })
+	case p.running:
+		// The running backup may have missed the push
+		p.again = true
+	case p.queued:
+		// The backup hasn't started yet, it will get the push
+	default:
+		p.timer.Reset(q.debounce)
+	}
+	p.repo = repo
+}
+
+func (q *repoBackupQueue) queue(p *pendingBackup) {
+	q.mu.Lock()
+	// The timer may have been reset after it fired
+	if q.pending[p.key] != p || p.queued || p.running {
+		q.mu.Unlock()
+		return
+	}
+	p.queued = true
+	q.mu.Unlock()
+	q.ready <- p
+}
+
+// worker runs the queued backups one after the other until ctx is done
+func (q *repoBackupQueue) worker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-q.ready:
+			q.run(p)
+		}
+	}
+}
+
+func (q *repoBackupQueue) run(p *pendingBackup) {
+	q.mu.Lock()
+	p.queued, p.running = false, true
+	c, repo := p.config, p.repo
+	q.mu.Unlock()
+
+	slog.Info("Backing up pushed repository", "target", targetName(c), "repo", repoFullName(repo))
+	if err := q.backUp(c, repo); err != nil {
+		slog.Error("Backing up pushed repository failed", "target", targetName(c), "repo", repoFullName(repo), "error", err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	p.running = false
+	if p.again {
+		p.again = false
+		p.timer.Reset(q.debounce)
+		return
+	}
+	delete(q.pending, p.key)
+}
+
+// webhookTarget is a target receiving push webhooks
+type webhookTarget struct {
+	config *appConfig
+	secret string
+}
+
+// webhookHandler receives the push webhooks of the targets on
+// /hooks/<target name>, or on /hooks if there is a single target
+func webhookHandler(targets map[string]*webhookTarget, queue *repoBackupQueue) http.Handler {
+	handle := func(w http.ResponseWriter, r *http.Request, t *webhookTarget) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookPayload))
+		if err != nil {
+			http.Error(w, "error reading the payload", http.StatusBadRequest)
+			return
+		}
+		repo, err := parsePushWebhook(t.config, t.secret, r.Header, body)
+		switch {
+		case errors.Is(err, errInvalidSignature):
+			slog.Warn("Rejected webhook with an invalid signature", "target", targetName(t.config), "remote", r.RemoteAddr)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case errors.Is(err, errIgnoredEvent):
+			w.WriteHeader(http.StatusNoContent)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			slog.Debug("Received push webhook", "target", targetName(t.config), "repo", repoFullName(repo))
+			queue.enqueue(t.config, repo)
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /hooks/{target}", func(w http.ResponseWriter, r *http.Request) {
+		t, ok := targets[r.PathValue("target")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		handle(w, r, t)
+	})
+	mux.HandleFunc("POST /hooks", func(w http.ResponseWriter, r *http.Request) {
+		if len(targets) != 1 {
+			http.Error(w, "there are several targets, use /hooks/<target>", http.StatusNotFound)
+			return
+		}
+		for _, t := range targets {
+			handle(w, r, t)
+		}
+	})
+	return mux
+}
+
+// webhookTargets returns the targets which have a webhook secret
+func webhookTargets(configs []*appConfig) (map[string]*webhookTarget, error) {
+	targets := make(map[string]*webhookTarget)
+	for _, c := range configs {
+		if err := validateConfig(c); err != nil {
+			return nil, targetError(c, err)
+		}
+		secret, err := c.pushWebhooks.secret()
+		if err != nil {
+			return nil, targetError(c, err)
+		}
+		if secret == "" {
+			slog.Warn("Target has no push webhook secret, its webhooks won't be received", "target", targetName(c))
+			continue
+		}
+		if c.service == "bitbucket" {
+			return nil, targetError(c, errors.New("push webhooks aren't supported for bitbucket"))
+		}
+		// The daemon's output goes to the logs
+		c.noProgress = true
+		targets[targetName(c)] = &webhookTarget{config: c, secret: secret}
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("none of the targets has a push webhook secret")
+	}
+	return targets, nil
+}
+
+// handleServeWebhooks receives push webhooks and backs up the repositories
+// pushed to until gitbackup is interrupted or terminated
+func handleServeWebhooks(configs []*appConfig, address string, debounce time.Duration) error {
+	targets, err := webhookTargets(configs)
+	if err != nil {
+		return err
+	}
+	queue := newRepoBackupQueue(backUpRepository, debounce)
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %v", address, err)
+	}
+	server := &http.Server{
+		Handler:           webhookHandler(targets, queue),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		queue.worker(ctx)
+	}()
+
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	go func() {
+		<-stop
+		slog.Info("Stopping once the running backup has finished, interrupt again to stop now")
+		server.Close()
+		cancel()
+		<-stop
+		os.Exit(1)
+	}()
+
+	for name := range targets {
+		slog.Info("Receiving push webhooks", "target", name, "path", "/hooks/"+name)
+	}
+	slog.Info("Listening for push webhooks", "address", listener.Addr().String())
+	err = server.Serve(listener)
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-done
+	return nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func hmacSignature(body, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+const githubPushBody = `{"ref": "refs/heads/main", "repository": {"name": "gitbackup", "full_name": "amitsaha/gitbackup",
+"clone_url": "https://github.com/amitsaha/gitbackup.git", "ssh_url": "git@github.com:amitsaha/gitbackup.git", "private": false, "fork": false}}`
+
+const gitlabPushBody = `{"object_kind": "push", "project": {"name": "Project", "path": "project", "path_with_namespace": "group/sub/project",
+"web_url": "https://gitlab.example.com/group/sub/project", "git_http_url": "https://gitlab.example.com/group/sub/project.git",
+"git_ssh_url": "git@gitlab.example.com:group/sub/project.git", "visibility_level": 0}}`
+
+func TestParsePushWebhook(t *testing.T) {
+	secret := "s3cr3t-webhook"
+	github := &appConfig{service: "github"}
+	whitelisted := &appConfig{service: "github", githubNamespaceWhitelist: []string{"other"}}
+	gitlab := &appConfig{service: "gitlab", useHTTPSClone: true}
+	forgejo := &appConfig{service: "forgejo", ssh: sshConfig{Port: 2222}}
+	forgejoPayload := strings.Replace(githubPushBody, "git@github.com:", "git@codeberg.org:", 1)
+
+	var testCases = []struct {
+		name     string
+		config   *appConfig
+		header   map[string]string
+		body     string
+		expected *Repository
+		err      error
+	}{
+		{"github push", github, map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + hmacSignature(githubPushBody, secret)}, githubPushBody,
+			&Repository{CloneURL: "git@github.com:amitsaha/gitbackup.git", Name: "gitbackup", Namespace: "amitsaha"}, nil},
+		{"github bad signature", github, map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + hmacSignature(githubPushBody, "guess")}, githubPushBody, nil, errInvalidSignature},
+		{"github unsigned", github, map[string]string{"X-GitHub-Event": "push"}, githubPushBody, nil, errInvalidSignature},
+		{"github ping", github, map[string]string{"X-GitHub-Event": "ping", "X-Hub-Signature-256": "sha256=" + hmacSignature(`{}`, secret)}, `{}`, nil, errIgnoredEvent},
+		{"github not whitelisted", whitelisted, map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + hmacSignature(githubPushBody, secret)}, githubPushBody, nil, errIgnoredEvent},
+		{"gitlab push", gitlab, map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": secret}, gitlabPushBody,
+			&Repository{CloneURL: "https://gitlab.example.com/group/sub/project.git", Name: "Project", Namespace: "group", Private: true, FullName: "group/sub/project"}, nil},
+		{"gitlab bad token", gitlab, map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "guess"}, gitlabPushBody, nil, errInvalidSignature},
+		{"gitlab merge request", gitlab, map[string]string{"X-Gitlab-Event": "Merge Request Hook", "X-Gitlab-Token": secret}, gitlabPushBody, nil, errIgnoredEvent},
+		{"forgejo push", forgejo, map[string]string{"X-Forgejo-Event": "push", "X-Forgejo-Signature": hmacSignature(forgejoPayload, secret)}, forgejoPayload,
+			&Repository{CloneURL: "ssh://git@codeberg.org:2222/amitsaha/gitbackup.git", Name: "gitbackup", Namespace: "amitsaha"}, nil},
+		{"gitea push", forgejo, map[string]string{"X-Gitea-Event": "push", "X-Gitea-Signature": hmacSignature(forgejoPayload, secret)}, forgejoPayload,
+			&Repository{CloneURL: "ssh://git@codeberg.org:2222/amitsaha/gitbackup.git", Name: "gitbackup", Namespace: "amitsaha"}, nil},
+	}
+	for _, tc := range testCases {
+		header := http.Header{}
+		for name, value := range tc.header {
+			header.Set(name, value)
+		}
+		repo, err := parsePushWebhook(tc.config, secret, header, []byte(tc.body))
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+			continue
+		}
+		if tc.expected != nil && (repo == nil || *repo != *tc.expected) {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.expected, repo)
+		}
+	}
+
+	if _, err := parsePushWebhook(github, secret, http.Header{"X-Github-Event": {"push"}, "X-Hub-Signature-256": {"sha256=" + hmacSignature("{", secret)}}, []byte("{")); err == nil {
+		t.Error("Expected an error for an invalid payload")
+	}
+}
+
+func TestPushWebhookSecretFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(file, []byte("file-webhook-secret\n"), 0600)
+	secret, err := pushWebhooksConfig{SecretFile: file}.secret()
+	if err != nil || secret != "file-webhook-secret" {
+		t.Fatalf("secret() = %q, %v", secret, err)
+	}
+	if got := redact("signed with " + secret); strings.Contains(got, secret) {
+		t.Errorf("Expected the secret to be redacted, got %q", got)
+	}
+}
+
+func TestGitLabPushWebhookRepository(t *testing.T) {
+	setupRepositoryTests()
+	defer teardownRepositoryTests()
+
+	mux.HandleFunc("/api/v4/projects", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"id": 1, "name": "Project", "path": "project", "path_with_namespace": "group/sub/project",
+"web_url": "https://gitlab.example.com/group/sub/project", "ssh_url_to_repo": "git@gitlab.example.com:group/sub/project.git",
+"visibility": "private"}]`)
+	})
+	c := &appConfig{service: "gitlab", gitlabProjectVisibility: "all", gitlabProjectMembershipType: "owner"}
+	repos, err := getRepositories(GitLabClient, "gitlab", "all", nil, "all", "owner", false, "")
+	if err != nil || len(repos) != 1 {
+		t.Fatalf("Expected a repository, got %v (%v)", repos, err)
+	}
+	repo, err := parsePushWebhook(c, "s3cr3t-webhook", http.Header{"X-Gitlab-Event": {"Push Hook"}, "X-Gitlab-Token": {"s3cr3t-webhook"}}, []byte(gitlabPushBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A pushed repository is backed up where the listed one is
+	backupDir := t.TempDir()
+	if listedDir, pushedDir := getRepoDir(backupDir, repos[0], false), getRepoDir(backupDir, repo, false); listedDir != pushedDir {
+		t.Errorf("Pushed repository backed up in %s, listed one in %s", pushedDir, listedDir)
+	}
+	if listed, err := listsRepository(GitLabClient, c, repo); err != nil || !listed {
+		t.Errorf("listsRepository() = %v, %v, expected the pushed repository to be listed", listed, err)
+	}
+
+	// A repository the listing leaves out isn't backed up
+	other := &Repository{Namespace: "group", Name: "other"}
+	if listed, err := listsRepository(GitLabClient, c, other); err != nil || listed {
+		t.Errorf("listsRepository() = %v, %v, expected a repository which isn't listed to be left out", listed, err)
+	}
+}
+
+// recordingBackUp records the backups and lets the test decide when they
+// finish
+type recordingBackUp struct {
+	mu      sync.Mutex
+	backups []string
+	started chan string
+	finish  chan struct{}
+}
+
+func (r *recordingBackUp) backUp(c *appConfig, repo *Repository) error {
+	r.mu.Lock()
+	r.backups = append(r.backups, repoFullName(repo))
+	r.mu.Unlock()
+	r.started <- repoFullName(repo)
+	<-r.finish
+	return nil
+}
+
+func TestRepoBackupQueue(t *testing.T) {
+	r := &recordingBackUp{started: make(chan string, 10), finish: make(chan struct{})}
+	q := newRepoBackupQueue(r.backUp, 50*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.worker(ctx)
+
+	c := &appConfig{name: "work", service: "github"}
+	repo := &Repository{Namespace: "owner", Name: "repo"}
+	other := &Repository{Namespace: "owner", Name: "other"}
+
+	// Pushes in quick succession are backed up once
+	for i := 0; i < 3; i++ {
+		q.enqueue(c, repo)
+		time.Sleep(10 * time.Millisecond)
+	}
+	q.enqueue(c, other)
+	first := <-r.started
+
+	// A push while the repository is being backed up backs it up again
+	q.enqueue(c, &Repository{Namespace: "owner", Name: first[len("owner/"):]})
+	r.finish <- struct{}{}
+	second := <-r.started
+	r.finish <- struct{}{}
+	third := <-r.started
+	r.finish <- struct{}{}
+
+	select {
+	case name := <-r.started:
+		t.Errorf("Unexpected backup of %s", name)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if first == second || third != first {
+		t.Errorf("Expected both repositories to be backed up and the first one again, got %v", r.backups)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) != 0 {
+		t.Errorf("Expected no pending backups, got %v", q.pending)
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	secret := "s3cr3t-webhook"
+	var mu sync.Mutex
+	var backups []string
+	q := newRepoBackupQueue(func(c *appConfig, repo *Repository) error {
+		mu.Lock()
+		defer mu.Unlock()
+		backups = append(backups, c.name+":"+repoFullName(repo))
+		return nil
+	}, time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.worker(ctx)
+
+	targets := map[string]*webhookTarget{
+		"personal": {config: &appConfig{name: "personal", service: "github"}, secret: secret},
+		"work":     {config: &appConfig{name: "work", service: "gitlab"}, secret: secret},
+	}
+	server := httptest.NewServer(webhookHandler(targets, q))
+	defer server.Close()
+
+	post := func(path string, header map[string]string, body string) int {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader(body))
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	var testCases = []struct {
+		path     string
+		header   map[string]string
+		body     string
+		expected int
+	}{
+		{"/hooks/personal", map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + hmacSignature(githubPushBody, secret)}, githubPushBody, http.StatusAccepted},
+		{"/hooks/work", map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": secret}, gitlabPushBody, http.StatusAccepted},
+		{"/hooks/work", map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "guess"}, gitlabPushBody, http.StatusUnauthorized},
+		{"/hooks/work", map[string]string{"X-Gitlab-Event": "Issue Hook", "X-Gitlab-Token": secret}, `{}`, http.StatusNoContent},
+		{"/hooks/nope", nil, githubPushBody, http.StatusNotFound},
+		{"/hooks", nil, githubPushBody, http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		if status := post(tc.path, tc.header, tc.body); status != tc.expected {
+			t.Errorf("%s %v: expected %d, got %d", tc.path, tc.header, tc.expected, status)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(backups)
+		mu.Unlock()
+		if n == 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(backups) != 2 || !contains(backups, "personal:amitsaha/gitbackup") || !contains(backups, "work:group/Project") {
+		t.Errorf("Expected the pushed repositories to be backed up, got %v", backups)
+	}
+}
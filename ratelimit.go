@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRateLimitRetries is the number of times a request is retried after
+// being rejected because of a (primary or secondary) rate limit
+const maxRateLimitRetries = 5
+
+// maxRateLimitWait is the longest we are prepared to sleep for a rate limit
+// to reset before giving up and handing the response back to the caller
+var maxRateLimitWait = 65 * time.Minute
+
+// secondaryRateLimitWait is how long we back off when GitHub reports a
+// secondary rate limit without telling us how long to wait
+var secondaryRateLimitWait = 60 * time.Second
+
+// We have it here so that we can override it in the tests
+var rateLimitSleep = func(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// rateLimitTransport is an http.RoundTripper shared by all the provider
+// API clients. It reads the rate limit headers returned by GitHub, GitLab
+// and Forgejo (as well as Retry-After) and sleeps or throttles requests
+// instead of letting the run abort when the quota is exhausted. The quota
+// is tracked per host and per X-RateLimit-Resource since GitHub counts
+// search and GraphQL requests separately from the core API.
+type rateLimitTransport struct {
+	base http.RoundTripper
+
+	mutex  sync.Mutex
+	quotas map[string]rateLimitQuota
+}
+
+// rateLimitQuota is the quota last reported for a resource
+type rateLimitQuota struct {
+	limit     int
+	remaining int
+	reset     time.Time
+}
+
+func newRateLimitTransport(base http.RoundTripper) *rateLimitTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &rateLimitTransport{base: base, quotas: make(map[string]rateLimitQuota)}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		// A retry has already waited for the limit to reset
+		if attempt == 0 {
+			if err := t.throttle(ctx, req); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		t.update(req, resp)
+
+		wait, limited := rateLimitWait(resp, time.Now())
+		if !limited {
+			// The next request waits for the reset in throttle. Some
+			// SDKs (go-github) refuse to send further requests while
+			// they know the quota is exhausted, so we hide the reset
+			// time from them when we are going to wait for it.
+			if wait > 0 && wait <= maxRateLimitWait {
+				resp.Header.Del("X-RateLimit-Reset")
+			}
+			return resp, nil
+		}
+		if attempt >= maxRateLimitRetries || wait > maxRateLimitWait {
+			return resp, nil
+		}
+
+		// We can only retry requests whose body we can send again
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return resp, nil
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return resp, nil
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		slog.Warn("API rate limit hit, retrying", "host", req.URL.Host, "status", resp.StatusCode, "wait", wait)
+		if err := rateLimitSleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// throttle waits for the reset of the quota the request counts against
+// once it is exhausted, and spreads the remaining requests evenly until
+// the reset time once we are down to the last 10% of the quota
+func (t *rateLimitTransport) throttle(ctx context.Context, req *http.Request) error {
+	t.mutex.Lock()
+	q, ok := t.quotas[rateLimitKey(req.URL.Host, requestRateLimitResource(req))]
+	if !ok {
+		// Services which don't report a resource have a single quota
+		q, ok = t.quotas[rateLimitKey(req.URL.Host, "")]
+	}
+	t.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+
+	untilReset := time.Until(q.reset)
+	if untilReset <= 0 {
+		return nil
+	}
+	if q.remaining <= 0 {
+		// Add a second of slack since the reset time is truncated
+		wait := untilReset + time.Second
+		if wait > maxRateLimitWait {
+			return nil
+		}
+		slog.Warn("API rate limit exhausted, waiting for it to reset", "host", req.URL.Host, "wait", wait)
+		return rateLimitSleep(ctx, wait)
+	}
+	if q.limit <= 0 || q.remaining >= q.limit/10 {
+		return nil
+	}
+	delay := untilReset / time.Duration(q.remaining+1)
+	if delay > maxRateLimitWait {
+		delay = maxRateLimitWait
+	}
+	slog.Debug("API quota low, throttling requests", "remaining", q.remaining, "limit", q.limit, "delay", delay)
+	return rateLimitSleep(ctx, delay)
+}
+
+// update records the quota reported in the response headers
+func (t *rateLimitTransport) update(req *http.Request, resp *http.Response) {
+	remaining, ok := rateLimitHeaderInt(resp.Header, "Remaining")
+	if !ok {
+		return
+	}
+	limit, _ := rateLimitHeaderInt(resp.Header, "Limit")
+	reset, _ := rateLimitReset(resp.Header)
+	resource := resp.Header.Get("X-RateLimit-Resource")
+
+	t.mutex.Lock()
+	t.quotas[rateLimitKey(req.URL.Host, resource)] = rateLimitQuota{limit: limit, remaining: remaining, reset: reset}
+	t.mutex.Unlock()
+	runMetrics.setRateLimitRemaining(req.URL.Host, remaining)
+
+	slog.Debug("API rate limit", "host", req.URL.Host, "resource", resource, "remaining", remaining, "limit", limit, "reset", reset.Format(time.RFC3339))
+}
+
+func rateLimitKey(host, resource string) string {
+	return host + " " + resource
+}
+
+// requestRateLimitResource returns the GitHub rate limit resource a
+// request counts against
+func requestRateLimitResource(req *http.Request) string {
+	path := req.URL.Path
+	switch {
+	case strings.HasSuffix(path, "/graphql"):
+		return "graphql"
+	case strings.Contains(path, "/search/"):
+		return "search"
+	}
+	return "core"
+}
+
+// rateLimitWait inspects a response and returns how long we should wait
+// before sending another request. limited is true when the request itself
+// was rejected and needs to be retried.
+func rateLimitWait(resp *http.Response, now time.Time) (wait time.Duration, limited bool) {
+	retryAfter, hasRetryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	remaining, hasRemaining := rateLimitHeaderInt(resp.Header, "Remaining")
+	reset, hasReset := rateLimitReset(resp.Header)
+
+	untilReset := time.Duration(0)
+	if hasReset && reset.After(now) {
+		// Add a second of slack since the reset time is truncated
+		untilReset = reset.Sub(now) + time.Second
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusForbidden:
+		switch {
+		case hasRetryAfter:
+			return retryAfter, true
+		case hasRemaining && remaining == 0:
+			return untilReset, true
+		case resp.StatusCode == http.StatusTooManyRequests:
+			return secondaryRateLimitWait, true
+		case isSecondaryRateLimit(resp):
+			return secondaryRateLimitWait, true
+		}
+		return 0, false
+	}
+
+	if hasRemaining && remaining == 0 {
+		return untilReset, false
+	}
+	return 0, false
+}
+
+// isSecondaryRateLimit reports whether a 403 response from GitHub is caused
+// by a secondary rate limit. The body is restored so that the SDK can
+// still decode the error.
+func isSecondaryRateLimit(resp *http.Response) bool {
+	if resp.Body == nil {
+		return false
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	rest := resp.Body
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(strings.NewReader(string(data)), rest), rest}
+	if err != nil {
+		return false
+	}
+	body := strings.ToLower(string(data))
+	return strings.Contains(body, "secondary rate limit") || strings.Contains(body, "abuse detection")
+}
+
+// rateLimitHeaderInt reads one of the rate limit headers. GitHub and Forgejo
+// use the X-RateLimit- prefix while GitLab uses RateLimit-.
+func rateLimitHeaderInt(h http.Header, name string) (int, bool) {
+	for _, prefix := range []string{"X-RateLimit-", "RateLimit-"} {
+		v := h.Get(prefix + name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		return n, true
+	}
+	return 0, false
+}
+
+// rateLimitReset returns the time at which the quota resets
+func rateLimitReset(h http.Header) (time.Time, bool) {
+	epoch, ok := rateLimitHeaderInt(h, "Reset")
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(epoch), 0), true
+}
+
+// parseRetryAfter parses a Retry-After header which is either a number
+// of seconds or an HTTP date
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			secs = 0
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if t.Before(now) {
+			return 0, true
+		}
+		return t.Sub(now), true
+	}
+	return 0, false
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fakeRateLimitSleep(slept *[]time.Duration) func(context.Context, time.Duration) error {
+	return func(ctx context.Context, d time.Duration) error {
+		*slept = append(*slept, d)
+		return nil
+	}
+}
+
+func TestRateLimitTransportRetriesPrimaryRateLimit(t *testing.T) {
+	var slept []time.Duration
+	originalSleep := rateLimitSleep
+	rateLimitSleep = fakeRateLimitSleep(&slept)
+	defer func() {
+		rateLimitSleep = originalSleep
+	}()
+
+	numRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numRequests++
+		if numRequests == 1 {
+			w.Header().Set("X-RateLimit-Limit", "5000")
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(30*time.Second).Unix(), 10))
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"message": "API rate limit exceeded"}`)
+			return
+		}
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		fmt.Fprint(w, `[]`)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newRateLimitTransport(http.DefaultTransport)}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected request to be retried and succeed, got: %d", resp.StatusCode)
+	}
+	if numRequests != 2 {
+		t.Errorf("Expected 2 requests, got: %d", numRequests)
+	}
+	if len(slept) != 1 || slept[0] <= 0 || slept[0] > 32*time.Second {
+		t.Errorf("Expected a single wait until the reset, got: %v", slept)
+	}
+}
+
+func TestRateLimitTransportRetryAfter(t *testing.T) {
+	var slept []time.Duration
+	originalSleep := rateLimitSleep
+	rateLimitSleep = fakeRateLimitSleep(&slept)
+	defer func() {
+		rateLimitSleep = originalSleep
+	}()
+
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(data))
+		if len(bodies) == 1 {
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newRateLimitTransport(http.DefaultTransport)}
+	resp, err := client.Post(server.URL, "application/json", strings.NewReader(`{"repositories": []}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("Expected request to be retried and succeed, got: %d", resp.StatusCode)
+	}
+	if len(bodies) != 2 || bodies[1] != bodies[0] {
+		t.Errorf("Expected the request body to be sent again, got: %q", bodies)
+	}
+	if len(slept) != 1 || slept[0] != 7*time.Second {
+		t.Errorf("Expected to wait 7s, got: %v", slept)
+	}
+}
+
+func TestRateLimitTransportSecondaryRateLimit(t *testing.T) {
+	var slept []time.Duration
+	originalSleep := rateLimitSleep
+	rateLimitSleep = fakeRateLimitSleep(&slept)
+	defer func() {
+		rateLimitSleep = originalSleep
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"message": "You have exceeded a secondary rate limit."}`)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newRateLimitTransport(http.DefaultTransport)}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// We give up after the maximum number of retries and the caller still
+	// gets to see the original error
+	if len(slept) != maxRateLimitRetries {
+		t.Errorf("Expected %d retries, got: %d", maxRateLimitRetries, len(slept))
+	}
+	for _, d := range slept {
+		if d != secondaryRateLimitWait {
+			t.Errorf("Expected to wait %v, got: %v", secondaryRateLimitWait, d)
+		}
+	}
+	data, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(data), "secondary rate limit") {
+		t.Errorf("Expected response body to be preserved, got: %s", data)
+	}
+}
+
+func TestRateLimitTransportForbiddenIsNotRetried(t *testing.T) {
+	var slept []time.Duration
+	originalSleep := rateLimitSleep
+	rateLimitSleep = fakeRateLimitSleep(&slept)
+	defer func() {
+		rateLimitSleep = originalSleep
+	}()
+
+	numRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numRequests++
+		w.Header().Set("X-RateLimit-Remaining", "4000")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"message": "Resource not accessible by integration"}`)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newRateLimitTransport(http.DefaultTransport)}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if numRequests != 1 || len(slept) != 0 {
+		t.Errorf("Expected a plain 403 not to be retried, got %d requests and waits %v", numRequests, slept)
+	}
+}
+
+func TestRateLimitTransportWaitsForResetWhenExhausted(t *testing.T) {
+	var slept []time.Duration
+	originalSleep := rateLimitSleep
+	rateLimitSleep = fakeRateLimitSleep(&slept)
+	defer func() {
+		rateLimitSleep = originalSleep
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// GitLab style headers
+		w.Header().Set("RateLimit-Limit", "600")
+		w.Header().Set("RateLimit-Remaining", "0")
+		w.Header().Set("RateLimit-Reset", strconv.FormatInt(time.Now().Add(10*time.Second).Unix(), 10))
+		fmt.Fprint(w, `[]`)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newRateLimitTransport(http.DefaultTransport)}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200, got: %d", resp.StatusCode)
+	}
+	if len(slept) != 0 {
+		t.Errorf("Expected the response to be returned without waiting, got: %v", slept)
+	}
+
+	resp, err = client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if len(slept) != 1 || slept[0] <= 0 || slept[0] > 12*time.Second {
+		t.Errorf("Expected the next request to wait for the quota to reset, got: %v", slept)
+	}
+}
+
+func TestRateLimitTransportTracksResources(t *testing.T) {
+	var slept []time.Duration
+	originalSleep := rateLimitSleep
+	rateLimitSleep = fakeRateLimitSleep(&slept)
+	defer func() {
+		rateLimitSleep = originalSleep
+	}()
+
+	reset := strconv.FormatInt(time.Now().Add(10*time.Second).Unix(), 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Limit", "30")
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", reset)
+		w.Header().Set("X-RateLimit-Resource", "search")
+		if !strings.HasPrefix(r.URL.Path, "/search/") {
+			w.Header().Set("X-RateLimit-Limit", "5000")
+			w.Header().Set("X-RateLimit-Remaining", "4999")
+			w.Header().Set("X-RateLimit-Resource", "core")
+		}
+		fmt.Fprint(w, `{}`)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newRateLimitTransport(http.DefaultTransport)}
+	for _, path := range []string{"/search/repositories", "/user/repos", "/search/repositories"} {
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if path == "/search/repositories" && resp.Header.Get("X-RateLimit-Reset") != "" {
+			t.Errorf("Expected the reset time to be hidden while the transport waits for it")
+		}
+	}
+
+	if len(slept) != 1 {
+		t.Errorf("Expected only the second search request to wait, got: %v", slept)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var testCases = []struct {
+		value    string
+		wantWait time.Duration
+		wantOk   bool
+	}{
+		{"", 0, false},
+		{"120", 120 * time.Second, true},
+		{"-1", 0, true},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{now.Add(-90 * time.Second).Format(http.TimeFormat), 0, true},
+		{"soon", 0, false},
+	}
+
+	for _, tc := range testCases {
+		wait, ok := parseRetryAfter(tc.value, now)
+		if wait != tc.wantWait || ok != tc.wantOk {
+			t.Errorf("parseRetryAfter(%q): expected (%v, %v), got (%v, %v)", tc.value, tc.wantWait, tc.wantOk, wait, ok)
+		}
+	}
+}
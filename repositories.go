@@ -1,8 +1,9 @@
 package main
 
 import (
-	"log"
+	"fmt"
 	"net/http"
+	"time"
 
 	forgejo "codeberg.org/mvdkleijn/forgejo-sdk/forgejo/v2"
 	"github.com/google/go-github/v34/github"
@@ -33,6 +34,19 @@ type Repository struct {
 	Name      string
 	Namespace string
 	Private   bool
+
+	// Used for ordering the backups. Not every service reports them,
+	// in which case they are left at their zero values.
+	PushedAt time.Time
+	Size     int64 // in bytes
+
+	// Full name of the repository at the root of the fork network of this
+	// one, if it is a fork. Forks share the objects of their fork network
+	// with -object-pools, so it is only looked up then.
+	ForkOf string
+	// Full name of the repository on the git host if it isn't
+	// Namespace/Name, e.g. for the GitLab projects of subgroups
+	FullName string
 }
 
 // getRepositories retrieves all repositories from the specified git service
@@ -43,39 +57,68 @@ func getRepositories(
 	gitlabProjectVisibility string, gitlabProjectMembershipType string,
 	ignoreFork bool, forgejoRepoType string,
 ) ([]*Repository, error) {
-	if client == nil {
-		log.Fatalf("Couldn't acquire a client to talk to %s", service)
+	var repositories []*Repository
+	err := walkRepositories(
+		client,
+		service, githubRepoType, githubNamespaceWhitelist,
+		gitlabProjectVisibility, gitlabProjectMembershipType,
+		ignoreFork, forgejoRepoType,
+		func(repo *Repository) error {
+			repositories = append(repositories, repo)
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
 	}
+	return repositories, nil
+}
 
-	var repositories []*Repository
-	var err error
+// walkRepositories lists the repositories matching the same criteria as
+// getRepositories, but calls fn for each repository as soon as the page it
+// is on has been retrieved instead of waiting for the whole listing.
+// Listing stops at the first error returned by fn.
+func walkRepositories(
+	client interface{},
+	service string, githubRepoType string, githubNamespaceWhitelist []string,
+	gitlabProjectVisibility string, gitlabProjectMembershipType string,
+	ignoreFork bool, forgejoRepoType string,
+	fn func(*Repository) error,
+) error {
+	if client == nil {
+		return fmt.Errorf("couldn't acquire a client to talk to %s", service)
+	}
 
 	switch service {
 	case "github":
-		repositories, err = getGithubRepositories(
+		return listGithubRepositories(
 			client.(*github.Client),
 			githubRepoType,
 			githubNamespaceWhitelist,
 			ignoreFork,
+			fn,
 		)
 	case "gitlab":
-		repositories, err = getGitlabRepositories(
+		return listGitlabRepositories(
 			client.(*gitlab.Client),
 			gitlabProjectVisibility,
 			gitlabProjectMembershipType,
 			ignoreFork,
+			fn,
 		)
 	case "bitbucket":
-		repositories, err = getBitbucketRepositories(
+		return listBitbucketRepositories(
 			client.(*bitbucket.Client),
 			ignoreFork,
+			fn,
 		)
 	case "forgejo":
-		repositories, err = getForgejoRepositories(
+		return listForgejoRepositories(
 			client.(*forgejo.Client),
 			forgejoRepoType,
 			ignoreFork,
+			fn,
 		)
 	}
-	return repositories, err
+	return nil
 }
@@ -7,7 +7,9 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	forgejo "codeberg.org/mvdkleijn/forgejo-sdk/forgejo/v2"
@@ -307,3 +309,179 @@ func TestGetForgejoStarredRepositories(t *testing.T) {
 		}
 	}
 }
+
+func TestWalkGitHubRepositoriesStreamsPages(t *testing.T) {
+	setupRepositoryTests()
+	defer teardownRepositoryTests()
+
+	var requestedPages []string
+	var seenBeforePage2 int
+	var walked []string
+
+	mux.HandleFunc("/user/repos", func(w http.ResponseWriter, r *http.Request) {
+		page := r.URL.Query().Get("page")
+		requestedPages = append(requestedPages, page)
+		if page == "2" {
+			seenBeforePage2 = len(walked)
+			fmt.Fprint(w, `[{"full_name": "test/r2", "id":2, "ssh_url": "https://github.com/u/r2", "name": "r2", "private": false, "fork": false}]`)
+			return
+		}
+		w.Header().Set("Link", fmt.Sprintf(`<%s/user/repos?page=2>; rel="next"`, server.URL))
+		fmt.Fprint(w, `[{"full_name": "test/r1", "id":1, "ssh_url": "https://github.com/u/r1", "name": "r1", "private": false, "fork": false}]`)
+	})
+
+	err := walkRepositories(GitHubClient, "github", "all", []string{}, "", "", false, "", func(repo *Repository) error {
+		walked = append(walked, repo.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(walked, []string{"r1", "r2"}) {
+		t.Errorf("Expected r1 and r2 to be walked, got: %v", walked)
+	}
+	if seenBeforePage2 != 1 {
+		t.Errorf("Expected the first page to be handed over before the second was requested, got %d repos", seenBeforePage2)
+	}
+	if len(requestedPages) != 2 {
+		t.Errorf("Expected 2 pages to be requested, got: %v", requestedPages)
+	}
+}
+
+func TestWalkRepositoriesStopsOnError(t *testing.T) {
+	setupRepositoryTests()
+	defer teardownRepositoryTests()
+
+	numRequests := 0
+	mux.HandleFunc("/user/repos", func(w http.ResponseWriter, r *http.Request) {
+		numRequests++
+		w.Header().Set("Link", fmt.Sprintf(`<%s/user/repos?page=2>; rel="next"`, server.URL))
+		fmt.Fprint(w, `[{"full_name": "test/r1", "id":1, "ssh_url": "https://github.com/u/r1", "name": "r1", "private": false, "fork": false}]`)
+	})
+
+	stopErr := fmt.Errorf("stop")
+	err := walkRepositories(GitHubClient, "github", "all", []string{}, "", "", false, "", func(repo *Repository) error {
+		return stopErr
+	})
+	if err != stopErr {
+		t.Errorf("Expected the error from the callback, got: %v", err)
+	}
+	if numRequests != 1 {
+		t.Errorf("Expected listing to stop after the first page, got %d requests", numRequests)
+	}
+}
+
+func TestGetBitbucketRepositoriesPaginated(t *testing.T) {
+	setupRepositoryTests()
+	defer teardownRepositoryTests()
+	os.Setenv("BITBUCKET_WORKSPACES", "ws1")
+
+	mux.HandleFunc("/repositories/ws1", func(w http.ResponseWriter, r *http.Request) {
+		page := r.URL.Query().Get("page")
+		fmt.Fprintf(w, `{"pagelen": 1, "page": %s, "size": 2, "values": [{"full_name":"ws1/repo%s", "slug":"repo%s", "is_private":false, "links":{"clone":[{"name":"ssh", "href":"git@bitbucket.org:ws1/repo%s.git"}]}}]}`, page, page, page, page)
+	})
+
+	repos, err := getRepositories(BitbucketClient, "bitbucket", "", []string{}, "", "", false, "")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var expected []*Repository
+	expected = append(
+		expected,
+		&Repository{Namespace: "ws1", CloneURL: "git@bitbucket.org:ws1/repo1.git", Name: "repo1"},
+		&Repository{Namespace: "ws1", CloneURL: "git@bitbucket.org:ws1/repo2.git", Name: "repo2"},
+	)
+	if !reflect.DeepEqual(repos, expected) {
+		t.Errorf("Expected %+v, Got %+v", expected, repos)
+	}
+}
+
+func TestGetGitHubForkRepositories(t *testing.T) {
+	setupRepositoryTests()
+	defer teardownRepositoryTests()
+	defer func(old bool) { objectPools = old }(objectPools)
+	objectPools = true
+	forkRoots.Clear()
+	defer forkRoots.Clear()
+
+	mux.HandleFunc("/user/repos", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"full_name": "test/r1", "id":1, "ssh_url": "https://github.com/u/r1", "name": "r1", "private": false, "fork": true}]`)
+	})
+	// The lists of repositories don't include the source of the forks
+	lookups := 0
+	mux.HandleFunc("/repos/test/r1", func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		fmt.Fprint(w, `{"full_name": "test/r1", "name": "r1", "fork": true, "source": {"full_name": "upstream/r1"}}`)
+	})
+
+	// The source is only looked up once, e.g. by the runs of the daemon
+	for i := 0; i < 2; i++ {
+		repos, err := getRepositories(GitHubClient, "github", "all", []string{}, "", "", false, "")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		expected := []*Repository{{Namespace: "test", CloneURL: "https://github.com/u/r1", Name: "r1", ForkOf: "upstream/r1"}}
+		if !reflect.DeepEqual(repos, expected) {
+			t.Errorf("Expected %+v, Got %+v", expected, repos)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("Expected the fork to be looked up once, got %d lookups", lookups)
+	}
+}
+
+func TestGetGitLabForkRepositories(t *testing.T) {
+	setupRepositoryTests()
+	defer teardownRepositoryTests()
+	defer func(old bool) { objectPools = old }(objectPools)
+	objectPools = true
+	forkRoots.Clear()
+	defer forkRoots.Clear()
+
+	// A fork of a fork, and a fork of the same fork, in a subgroup and
+	// with a display name
+	mux.HandleFunc("/api/v4/projects", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"path_with_namespace": "test/r1", "id":1, "ssh_url_to_repo": "https://gitlab.com/u/r1", "name": "r1",
+"forked_from_project": {"path_with_namespace": "middle/sub/r1", "name": "Middle R1"}},
+{"path_with_namespace": "other/r1", "id":2, "ssh_url_to_repo": "https://gitlab.com/o/r1", "name": "r1",
+"forked_from_project": {"path_with_namespace": "middle/sub/r1", "name": "Middle R1"}}]`)
+	})
+	lookups := map[string]int{}
+	mux.HandleFunc("/api/v4/projects/", func(w http.ResponseWriter, r *http.Request) {
+		project := strings.TrimPrefix(r.URL.Path, "/api/v4/projects/")
+		lookups[project]++
+		switch project {
+		case "middle/sub/r1":
+			fmt.Fprint(w, `{"path_with_namespace": "middle/sub/r1", "name": "Middle R1", "forked_from_project": {"path_with_namespace": "upstream/r1", "name": "R1"}}`)
+		case "upstream/r1":
+			fmt.Fprint(w, `{"path_with_namespace": "upstream/r1", "name": "R1"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	repos, err := getRepositories(GitLabClient, "gitlab", "internal", []string{}, "", "", false, "")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := []*Repository{
+		{Namespace: "test", CloneURL: "https://gitlab.com/u/r1", Name: "r1", ForkOf: "upstream/r1"},
+		{Namespace: "other", CloneURL: "https://gitlab.com/o/r1", Name: "r1", ForkOf: "upstream/r1"},
+	}
+	if !reflect.DeepEqual(repos, expected) {
+		t.Errorf("Expected %+v, Got %+v", expected, repos)
+	}
+	// The forks of a repository share the lookups
+	if lookups["middle/sub/r1"] != 1 || lookups["upstream/r1"] != 1 {
+		t.Errorf("Expected each parent to be looked up once, got %v", lookups)
+	}
+
+	// The root of the network joins the pool of its forks
+	root := &Repository{Namespace: "upstream", Name: "R1", FullName: "upstream/r1"}
+	backupDir := t.TempDir()
+	pool := filepath.Join(backupDir, objectPoolsDir, "upstream", "r1.git")
+	os.MkdirAll(pool, 0755)
+	if got := objectPool(backupDir, root); got != filepath.ToSlash(pool) {
+		t.Errorf("Expected the root in the pool %s, got %q", pool, got)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// s3Config configures the upload of the backups to S3-compatible object
+// storage (AWS S3, MinIO, Ceph, ...)
+type s3Config struct {
+	// Host (and port) of the S3 API, e.g. s3.amazonaws.com or
+	// minio.example.com:9000
+	Endpoint string `yaml:"endpoint,omitempty"`
+	Bucket   string `yaml:"bucket,omitempty"`
+	// Prefix of the objects in the bucket (default: the git host name)
+	Prefix string `yaml:"prefix,omitempty"`
+	Region string `yaml:"region,omitempty"`
+	// Talk plain HTTP to the endpoint, e.g. to a local MinIO
+	Insecure bool `yaml:"insecure,omitempty"`
+	// Environment variables holding the access keys, instead of the AWS
+	// ones, the MinIO ones or ~/.aws/credentials
+	AccessKeyEnv string `yaml:"access_key_env,omitempty"`
+	SecretKeyEnv string `yaml:"secret_key_env,omitempty"`
+	// e.g. STANDARD_IA or GLACIER_IR
+	StorageClass string `yaml:"storage_class,omitempty"`
+	// Server-side encryption: AES256 or aws:kms
+	SSE         string `yaml:"sse,omitempty"`
+	SSEKMSKeyID string `yaml:"sse_kms_key_id,omitempty"`
+
+	uploadOptions `yaml:",inline"`
+}
+
+// enabled reports whether the backups are uploaded
+func (sc s3Config) enabled() bool {
+	return sc.Bucket != ""
+}
+
+// validate checks the settings without connecting to the endpoint
+func (sc s3Config) validate() error {
+	if !sc.enabled() {
+		if sc.Endpoint != "" {
+			return errors.New("s3 needs a bucket")
+		}
+		return nil
+	}
+	if sc.Endpoint == "" {
+		return errors.New("s3 needs an endpoint")
+	}
+	if strings.Contains(sc.Endpoint, "://") {
+		return fmt.Errorf("invalid s3 endpoint: %q (must be a host name, use insecure for plain HTTP)", sc.Endpoint)
+	}
+	switch sc.SSE {
+	case "", "AES256":
+		if sc.SSEKMSKeyID != "" {
+			return errors.New("sse_kms_key_id needs sse: aws:kms")
+		}
+	case "aws:kms":
+	default:
+		return fmt.Errorf("invalid s3 sse: %q (must be AES256 or aws:kms)", sc.SSE)
+	}
+	if (sc.AccessKeyEnv == "") != (sc.SecretKeyEnv == "") {
+		return errors.New("s3 needs both access_key_env and secret_key_env")
+	}
+	return sc.uploadOptions.validate()
+}
+
+// credentials returns where the access keys come from
+func (sc s3Config) credentials() (*credentials.Credentials, error) {
+	if sc.AccessKeyEnv != "" {
+		accessKey, secretKey := os.Getenv(sc.AccessKeyEnv), os.Getenv(sc.SecretKeyEnv)
+		if accessKey == "" || secretKey == "" {
+			return nil, fmt.Errorf("environment variables %s and %s must be set", sc.AccessKeyEnv, sc.SecretKeyEnv)
+		}
+		registerSecret(secretKey)
+		return credentials.NewStaticV4(accessKey, secretKey, ""), nil
+	}
+	return credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.FileAWSCredentials{},
+		&credentials.IAM{},
+	}), nil
+}
+
+// s3Store stores objects under a prefix of a bucket
+type s3Store struct {
+	client *minio.Client
+	bucket string
+	prefix string
+	opts   minio.PutObjectOptions
+}
+
+// newS3Store connects to the bucket. defaultPrefix is used if the settings
+// don't have a prefix.
+func newS3Store(sc s3Config, defaultPrefix string) (*s3Store, error) {
+	creds, err := sc.credentials()
+	if err != nil {
+		return nil, err
+	}
+	client, err := minio.New(sc.Endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: !sc.Insecure,
+		Region: sc.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating the S3 client: %v", err)
+	}
+
+	opts := minio.PutObjectOptions{StorageClass: sc.StorageClass}
+	switch sc.SSE {
+	case "AES256":
+		opts.ServerSideEncryption = encrypt.NewSSE()
+	case "aws:kms":
+		opts.ServerSideEncryption, err = encrypt.NewSSEKMS(sc.SSEKMSKeyID, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	prefix := sc.Prefix
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	return &s3Store{client: client, bucket: sc.Bucket, prefix: strings.Trim(prefix, "/"), opts: opts}, nil
+}
+
+func (s *s3Store) key(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+func (s *s3Store) String() string {
+	return "s3://" + path.Join(s.bucket, s.prefix)
+}
+
+// streamPartSize is the size of the parts of streamed uploads, which are
+// buffered in memory. It limits the objects to 10000 parts, 640 GiB.
+const streamPartSize = 64 << 20
+
+func (s *s3Store) put(ctx context.Context, name string, r io.Reader, size int64) error {
+	opts := s.opts
+	opts.ContentType = "application/octet-stream"
+	if size < 0 && opts.PartSize == 0 {
+		opts.PartSize = streamPartSize
+	}
+	_, err := s.client.PutObject(ctx, s.bucket, s.key(name), r, size, opts)
+	if err != nil {
+		return fmt.Errorf("error uploading %s to %s: %v", name, s, err)
+	}
+	return nil
+}
+
+func (s *s3Store) remove(ctx context.Context, name string) error {
+	err := s.client.RemoveObject(ctx, s.bucket, s.key(name), minio.RemoveObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("error removing %s from %s: %v", name, s, err)
+	}
+	return nil
+}
+
+func (s *s3Store) get(ctx context.Context, name string) (io.ReadCloser, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error downloading %s from %s: %v", name, s, err)
+	}
+	// GetObject doesn't send the request until the object is read
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		if minio.ToErrorResponse(err).Code == minio.NoSuchKey {
+			return nil, errObjectNotFound
+		}
+		return nil, fmt.Errorf("error downloading %s from %s: %v", name, s, err)
+	}
+	return object, nil
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const defaultServeAddress = ":8081"
+
+// serveConfig configures how gitbackup serve serves the backups of a
+// target
+type serveConfig struct {
+	// htpasswd file with the bcrypt hashed passwords of the users
+	// (htpasswd -B). Basic authentication is required if it is set.
+	HtpasswdFile string `yaml:"htpasswd_file,omitempty"`
+	// Who can read which namespaces, the first rule matching a namespace
+	// applies. Without rules, all the namespaces can be read.
+	Access []serveAccessRule `yaml:"access,omitempty"`
+}
+
+// serveAccessRule lets users read the repositories of namespaces
+type serveAccessRule struct {
+	// Patterns of the namespaces, e.g. octocat or acme-*
+	Namespaces []string `yaml:"namespaces"`
+	// Users who can read them, * for everyone
+	Users []string `yaml:"users"`
+}
+
+func (sc serveConfig) validate() error {
+	for i, rule := range sc.Access {
+		if len(rule.Namespaces) == 0 || len(rule.Users) == 0 {
+			return fmt.Errorf("access rule %d needs namespaces and users", i+1)
+		}
+		for _, pattern := range rule.Namespaces {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("access rule %d: invalid namespace pattern %q: %v", i+1, pattern, err)
+			}
+		}
+		if sc.HtpasswdFile == "" && !contains(rule.Users, "*") {
+			return fmt.Errorf("access rule %d lists users, which needs an htpasswd_file", i+1)
+		}
+	}
+	return nil
+}
+
+// canRead reports whether user can read the repositories of namespace
+func (sc serveConfig) canRead(user, namespace string) bool {
+	if len(sc.Access) == 0 {
+		return true
+	}
+	for _, rule := range sc.Access {
+		for _, pattern := range rule.Namespaces {
+			if ok, _ := path.Match(pattern, namespace); !ok {
+				continue
+			}
+			return contains(rule.Users, "*") || user != "" && contains(rule.Users, user)
+		}
+	}
+	return false
+}
+
+// readHtpasswd reads the users and bcrypt password hashes of an htpasswd
+// file
+func readHtpasswd(file string) (map[string][]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", file, n)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: the password of %s isn't hashed with bcrypt (htpasswd -B)", file, n, user)
+		}
+		users[user] = []byte(hash)
+	}
+	return users, scanner.Err()
+}
+
+// servedTarget is a target whose backups are served under prefix
+type servedTarget struct {
+	config *appConfig
+	name   string
+	prefix string
+	// Users of the basic authentication and their password hashes, nil
+	// if it isn't required
+	users map[string][]byte
+}
+
+// authenticate returns the user of the request, "" for anonymous ones, and
+// whether the request may go on
+func (t *servedTarget) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if t.users == nil {
+		return "", true
+	}
+	user, password, ok := r.BasicAuth()
+	if ok {
+		hash, known := t.users[user]
+		if !known {
+			// Comparing with a hash takes as long for unknown users
+			hash = unknownUserHash()
+		}
+		if bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && known {
+			return user, true
+		}
+		slog.Warn("Rejected the credentials of a user", "target", t.name, "user", user, "remote", r.RemoteAddr)
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", "gitbackup "+t.name))
+	http.Error(w, "authentication required", http.StatusUnauthorized)
+	return "", false
+}
+
+// unknownUserHash is compared with the passwords of unknown users
+var unknownUserHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("unknown user"), bcrypt.DefaultCost)
+	return hash
+})
+
+// servedRepository is a repository of the backup directory
+type servedRepository struct {
+	Namespace string
+	Name      string
+	// git directory of the repository
+	gitDir string
+}
+
+// findServedRepository returns the repository backed up as namespace/name
+// in backupDir, bare or not
+func findServedRepository(backupDir, namespace, name string) (*servedRepository, bool) {
+	// The namespaces come from the request, they mustn't escape the backup
+	// directory or reach the object pools
+	full := namespace + "/" + name
+	if path.Clean(full) != full || path.IsAbs(full) || name == "" {
+		return nil, false
+	}
+	for _, segment := range strings.Split(full, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return nil, false
+		}
+	}
+	repo := &Repository{Namespace: namespace, Name: name}
+	for _, gitDir := range []string{
+		getRepoDir(backupDir, repo, true),
+		filepath.Join(getRepoDir(backupDir, repo, false), ".git"),
+	} {
+		if info, err := os.Stat(filepath.Join(gitDir, "HEAD")); err == nil && info.Mode().IsRegular() {
+			return &servedRepository{Namespace: namespace, Name: name, gitDir: gitDir}, true
+		}
+	}
+	return nil, false
+}
+
+// listServedRepositories returns the repositories of backupDir, sorted by
+// their full name
+func listServedRepositories(backupDir string) ([]servedRepository, error) {
+	var repos []servedRepository
+	err := filepath.WalkDir(backupDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || p == backupDir {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(backupDir, p)
+		if err != nil {
+			return err
+		}
+		namespace, name := path.Split(filepath.ToSlash(rel))
+		namespace = strings.TrimSuffix(namespace, "/")
+		if namespace == "" {
+			return nil
+		}
+		name = strings.TrimSuffix(name, ".git")
+		if repo, ok := findServedRepository(backupDir, namespace, name); ok && (repo.gitDir == p || repo.gitDir == filepath.Join(p, ".git")) {
+			repos = append(repos, *repo)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	sort.Slice(repos, func(i, j int) bool {
+		return repos[i].Namespace+"/"+repos[i].Name < repos[j].Namespace+"/"+repos[j].Name
+	})
+	return repos, err
+}
+
+var serveIndexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Targets}}<ul>
+{{range .Targets}}<li><a href="{{.URL}}">{{.Name}}</a></li>
+{{end}}</ul>
+{{else}}{{if .Repositories}}<table>
+<tr><th>Repository</th><th>Clone URL</th></tr>
+{{range .Repositories}}<tr><td>{{.Name}}</td><td><code>git clone {{.URL}}</code></td></tr>
+{{end}}</table>
+{{else}}<p>No repositories</p>
+{{end}}{{end}}</body>
+</html>
+`))
+
+type serveIndexLink struct {
+	Name string
+	URL  string
+}
+
+type serveIndex struct {
+	Title        string
+	Targets      []serveIndexLink
+	Repositories []serveIndexLink
+}
+
+// requestBaseURL returns the scheme and host the request was sent to
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// serveHandler serves the backups of the targets read-only over the git
+// smart HTTP protocol, through git http-backend, with an HTML index of the
+// repositories each user can read. The repositories of a target are served
+// under /<target name>/<namespace>/<repository>.git, or
+// /<namespace>/<repository>.git if there is a single target.
+func serveHandler(targets []*servedTarget, gitBinary string) http.Handler {
+	serveIndexPage := func(w http.ResponseWriter, r *http.Request, index serveIndex) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := serveIndexTemplate.Execute(w, index); err != nil {
+			slog.Error("Error rendering the index", "error", err)
+		}
+	}
+	serveTarget := func(w http.ResponseWriter, r *http.Request, t *servedTarget, rest string) {
+		user, ok := t.authenticate(w, r)
+		if !ok {
+			return
+		}
+		if rest == "" || rest == "/" {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			repos, err := listServedRepositories(t.config.backupDir)
+			if err != nil {
+				slog.Error("Error listing the repositories", "target", t.name, "error", err)
+				http.Error(w, "error listing the repositories", http.StatusInternalServerError)
+				return
+			}
+			index := serveIndex{Title: "Backups of " + t.name}
+			for _, repo := range repos {
+				if t.config.serve.canRead(user, repo.Namespace) {
+					full := repo.Namespace + "/" + repo.Name
+					index.Repositories = append(index.Repositories, serveIndexLink{Name: full, URL: requestBaseURL(r) + t.prefix + "/" + full + ".git"})
+				}
+			}
+			serveIndexPage(w, r, index)
+			return
+		}
+
+		// <namespace>/<repository>.git/<git path>
+		repoPath, gitPath, ok := strings.Cut(strings.TrimPrefix(rest, "/"), ".git/")
+		namespace, name := path.Split(repoPath)
+		namespace = strings.TrimSuffix(namespace, "/")
+		if !ok || namespace == "" {
+			http.NotFound(w, r)
+			return
+		}
+		// Repositories the user can't read are as good as missing
+		repo, found := findServedRepository(t.config.backupDir, namespace, name)
+		if !found || !t.config.serve.canRead(user, namespace) {
+			http.NotFound(w, r)
+			return
+		}
+		if gitPath == "git-receive-pack" || r.URL.Query().Get("service") == "git-receive-pack" {
+			http.Error(w, "the backups are read-only", http.StatusForbidden)
+			return
+		}
+		if r.Method == http.MethodPost && gitPath != "git-upload-pack" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if gitPath == "git-upload-pack" {
+			slog.Info("Serving repository", "target", t.name, "repository", namespace+"/"+name, "user", user, "remote", r.RemoteAddr)
+		}
+		gitBackend(gitBinary, t.prefix+"/"+repoPath+".git", repo.gitDir, user).ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(targets) == 1 {
+			serveTarget(w, r, targets[0], r.URL.Path)
+			return
+		}
+		if r.URL.Path == "/" {
+			index := serveIndex{Title: "gitbackup"}
+			for _, t := range targets {
+				index.Targets = append(index.Targets, serveIndexLink{Name: t.name, URL: t.prefix + "/"})
+			}
+			serveIndexPage(w, r, index)
+			return
+		}
+		for _, t := range targets {
+			if rest, ok := strings.CutPrefix(r.URL.Path, t.prefix); ok && (rest == "" || strings.HasPrefix(rest, "/")) {
+				serveTarget(w, r, t, rest)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+}
+
+// gitBackend returns the CGI handler running git http-backend for the
+// repository at gitDir, served under root. Pushes are disabled even for
+// authenticated users.
+func gitBackend(gitBinary, root, gitDir, user string) http.Handler {
+	env := []string{
+		"GIT_PROJECT_ROOT=" + gitDir,
+		"GIT_HTTP_EXPORT_ALL=1",
+		// The backups may belong to the user running the backups rather
+		// than the one serving them
+		"GIT_CONFIG_COUNT=2",
+		"GIT_CONFIG_KEY_0=http.receivepack",
+		"GIT_CONFIG_VALUE_0=false",
+		"GIT_CONFIG_KEY_1=safe.directory",
+		"GIT_CONFIG_VALUE_1=*",
+	}
+	if user != "" {
+		env = append(env, "REMOTE_USER="+user)
+	}
+	return &cgi.Handler{
+		Path: gitBinary,
+		Args: []string{"http-backend"},
+		Root: root,
+		Env:  env,
+	}
+}
+
+// servedTargets returns the targets to serve and loads their users
+func servedTargets(configs []*appConfig) ([]*servedTarget, error) {
+	var targets []*servedTarget
+	for _, c := range configs {
+		if err := validateConfig(c); err != nil {
+			return nil, targetError(c, err)
+		}
+		t := &servedTarget{config: c, name: targetName(c)}
+		if len(configs) > 1 {
+			t.prefix = "/" + url.PathEscape(t.name)
+		}
+		if c.serve.HtpasswdFile != "" {
+			users, err := readHtpasswd(c.serve.HtpasswdFile)
+			if err != nil {
+				return nil, targetError(c, fmt.Errorf("error reading the users: %v", err))
+			}
+			t.users = users
+		} else {
+			slog.Warn("Target has no htpasswd_file, its backups can be read without authentication", "target", t.name)
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// handleServe serves the backups of the targets read-only over git smart
+// HTTP until gitbackup is interrupted or terminated
+func handleServe(configs []*appConfig, address string) error {
+	targets, err := servedTargets(configs)
+	if err != nil {
+		return err
+	}
+	gitBinary, err := exec.LookPath(gitCommand)
+	if err != nil {
+		return fmt.Errorf("git is needed to serve the backups: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %v", address, err)
+	}
+	server := &http.Server{
+		Handler:           serveHandler(targets, gitBinary),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	go func() {
+		<-stop
+		slog.Info("Stopping once the running clones have finished")
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	for _, t := range targets {
+		slog.Info("Serving the backups", "target", t.name, "path", t.prefix+"/", "directory", t.config.backupDir)
+	}
+	slog.Info("Listening for git clones", "address", listener.Addr().String())
+	err = server.Serve(listener)
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
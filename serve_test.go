@@ -0,0 +1,211 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestServeConfigCanRead(t *testing.T) {
+	sc := serveConfig{
+		HtpasswdFile: "htpasswd",
+		Access: []serveAccessRule{
+			{Namespaces: []string{"public"}, Users: []string{"*"}},
+			{Namespaces: []string{"acme-*"}, Users: []string{"alice", "bob"}},
+			{Namespaces: []string{"acme-secret"}, Users: []string{"*"}},
+		},
+	}
+	var testCases = []struct {
+		user      string
+		namespace string
+		expected  bool
+	}{
+		{"", "public", true},
+		{"alice", "public", true},
+		{"alice", "acme-web", true},
+		{"carol", "acme-web", false},
+		{"", "acme-web", false},
+		// The first matching rule applies
+		{"carol", "acme-secret", false},
+		{"alice", "octocat", false},
+		{"alice", "acme-web/nested", false},
+	}
+	for _, tc := range testCases {
+		if got := sc.canRead(tc.user, tc.namespace); got != tc.expected {
+			t.Errorf("canRead(%q, %q) = %v, expected %v", tc.user, tc.namespace, got, tc.expected)
+		}
+	}
+	if !(serveConfig{}).canRead("", "anything") {
+		t.Error("Expected everything to be readable without access rules")
+	}
+}
+
+func TestServeConfigValidate(t *testing.T) {
+	var testCases = []struct {
+		config serveConfig
+		valid  bool
+	}{
+		{serveConfig{}, true},
+		{serveConfig{Access: []serveAccessRule{{Namespaces: []string{"*"}, Users: []string{"*"}}}}, true},
+		{serveConfig{Access: []serveAccessRule{{Namespaces: []string{"*"}, Users: []string{"alice"}}}}, false},
+		{serveConfig{HtpasswdFile: "htpasswd", Access: []serveAccessRule{{Namespaces: []string{"*"}, Users: []string{"alice"}}}}, true},
+		{serveConfig{HtpasswdFile: "htpasswd", Access: []serveAccessRule{{Namespaces: []string{"["}, Users: []string{"alice"}}}}, false},
+		{serveConfig{HtpasswdFile: "htpasswd", Access: []serveAccessRule{{Users: []string{"alice"}}}}, false},
+	}
+	for _, tc := range testCases {
+		if err := tc.config.validate(); (err == nil) != tc.valid {
+			t.Errorf("validate(%+v) = %v, expected valid: %v", tc.config, err, tc.valid)
+		}
+	}
+}
+
+func TestReadHtpasswd(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	os.WriteFile(file, []byte("# users\nalice:"+string(hash)+"\n\n"), 0600)
+	users, err := readHtpasswd(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || bcrypt.CompareHashAndPassword(users["alice"], []byte("secret")) != nil {
+		t.Errorf("Expected alice's hash, got %q", users)
+	}
+
+	// Passwords hashed with MD5 or SHA1 aren't supported
+	os.WriteFile(file, []byte("alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0600)
+	if _, err := readHtpasswd(file); err == nil || !strings.Contains(err.Error(), "bcrypt") {
+		t.Errorf("Expected an error about bcrypt, got %v", err)
+	}
+}
+
+func TestServeHandler(t *testing.T) {
+	gitBinary, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+
+	// A mirror, a working copy and an object pool
+	backupDir := t.TempDir()
+	source := filepath.Join(t.TempDir(), "source")
+	newTestRepository(t, source)
+	gitTest(t, "clone", "-q", "--mirror", source, filepath.Join(backupDir, "public", "tools.git"))
+	gitTest(t, "clone", "-q", source, filepath.Join(backupDir, "acme", "team", "web"))
+	gitTest(t, "clone", "-q", "--mirror", source, filepath.Join(backupDir, ".pools", "pool.git"))
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	target := &servedTarget{
+		config: &appConfig{
+			backupDir: backupDir,
+			serve: serveConfig{
+				HtpasswdFile: "htpasswd",
+				Access: []serveAccessRule{
+					{Namespaces: []string{"public"}, Users: []string{"*"}},
+					{Namespaces: []string{"acme/*"}, Users: []string{"alice"}},
+				},
+			},
+		},
+		name:  "github",
+		users: map[string][]byte{"alice": hash, "bob": hash},
+	}
+	server := httptest.NewServer(serveHandler([]*servedTarget{target}, gitBinary))
+	defer server.Close()
+
+	get := func(user, path string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if user != "" {
+			req.SetBasicAuth(user, "secret")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	var testCases = []struct {
+		user     string
+		path     string
+		expected int
+	}{
+		{"", "/", http.StatusUnauthorized},
+		{"", "/public/tools.git/info/refs?service=git-upload-pack", http.StatusUnauthorized},
+		{"bob", "/public/tools.git/info/refs?service=git-upload-pack", http.StatusOK},
+		{"bob", "/acme/team/web.git/info/refs?service=git-upload-pack", http.StatusNotFound},
+		{"alice", "/acme/team/web.git/info/refs?service=git-upload-pack", http.StatusOK},
+		{"alice", "/public/tools.git/info/refs?service=git-receive-pack", http.StatusForbidden},
+		{"alice", "/public/missing.git/info/refs?service=git-upload-pack", http.StatusNotFound},
+		{"alice", "/.pools/pool.git/info/refs?service=git-upload-pack", http.StatusNotFound},
+		{"alice", "/public/../.pools/pool.git/info/refs?service=git-upload-pack", http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		if status, body := get(tc.user, tc.path); status != tc.expected {
+			t.Errorf("%s as %q: expected %d, got %d: %s", tc.path, tc.user, tc.expected, status, body)
+		}
+	}
+
+	// The index lists the repositories the user can read
+	_, index := get("bob", "/")
+	if !strings.Contains(index, server.URL+"/public/tools.git") || strings.Contains(index, "acme/team/web") || strings.Contains(index, "pool") {
+		t.Errorf("Unexpected index for bob:\n%s", index)
+	}
+	_, index = get("alice", "/")
+	if !strings.Contains(index, server.URL+"/public/tools.git") || !strings.Contains(index, server.URL+"/acme/team/web.git") {
+		t.Errorf("Unexpected index for alice:\n%s", index)
+	}
+
+	// The repositories can be cloned but not pushed to
+	u := strings.Replace(server.URL, "http://", "http://alice:secret@", 1)
+	clone := filepath.Join(t.TempDir(), "clone")
+	gitTest(t, "clone", "-q", u+"/acme/team/web.git", clone)
+	if got, want := gitTest(t, "-C", clone, "rev-parse", "HEAD"), gitTest(t, "-C", source, "rev-parse", "HEAD"); got != want {
+		t.Errorf("Cloned HEAD %s, expected %s", got, want)
+	}
+	gitTest(t, "-C", clone, "commit", "-q", "--allow-empty", "-m", "pushed")
+	if out, err := exec.Command("git", "-C", clone, "push", "-q", "origin", "HEAD").CombinedOutput(); err == nil {
+		t.Errorf("Expected the push to be rejected: %s", out)
+	}
+	if got, want := gitTest(t, "-C", filepath.Join(backupDir, "acme", "team", "web"), "rev-parse", "HEAD"), gitTest(t, "-C", source, "rev-parse", "HEAD"); got != want {
+		t.Errorf("The backup was changed by the push")
+	}
+}
+
+func TestServeHandlerTargets(t *testing.T) {
+	targets := []*servedTarget{
+		{config: &appConfig{backupDir: t.TempDir()}, name: "personal", prefix: "/personal"},
+		{config: &appConfig{backupDir: t.TempDir()}, name: "work", prefix: "/work"},
+	}
+	server := httptest.NewServer(serveHandler(targets, "git"))
+	defer server.Close()
+
+	var testCases = []struct {
+		path     string
+		expected int
+		contains string
+	}{
+		{"/", http.StatusOK, `href="/work/"`},
+		{"/work/", http.StatusOK, "Backups of work"},
+		{"/personal", http.StatusOK, "No repositories"},
+		{"/workshop/", http.StatusNotFound, ""},
+		{"/work/octocat/repo.git/info/refs", http.StatusNotFound, ""},
+	}
+	for _, tc := range testCases {
+		resp, err := http.Get(server.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.expected || !strings.Contains(string(body), tc.contains) {
+			t.Errorf("%s: expected %d containing %q, got %d: %s", tc.path, tc.expected, tc.contains, resp.StatusCode, body)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpConfig configures the upload of the backups to an SFTP server, e.g.
+// a NAS
+type sftpConfig struct {
+	Host     string `yaml:"host,omitempty"`
+	Port     int    `yaml:"port,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	// Private key to authenticate with. Without a key or a password, the
+	// keys of the SSH agent are used.
+	PrivateKey   string `yaml:"private_key,omitempty"`
+	PasswordEnv  string `yaml:"password_env,omitempty"`
+	PasswordFile string `yaml:"password_file,omitempty"`
+	// known_hosts file with the host key of the server (default:
+	// ~/.ssh/known_hosts)
+	KnownHosts string `yaml:"known_hosts,omitempty"`
+	// Directory of the backups on the server (default: the git host name,
+	// relative to the home directory)
+	Path string `yaml:"path,omitempty"`
+
+	uploadOptions `yaml:",inline"`
+}
+
+// enabled reports whether the backups are uploaded
+func (sc sftpConfig) enabled() bool {
+	return sc.Host != ""
+}
+
+// validate checks the settings without connecting to the server
+func (sc sftpConfig) validate() error {
+	if !sc.enabled() {
+		if sc.Username != "" || sc.Path != "" {
+			return errors.New("sftp needs a host")
+		}
+		return nil
+	}
+	if sc.Username == "" {
+		return errors.New("sftp needs a username")
+	}
+	if sc.Port < 0 || sc.Port > 65535 {
+		return fmt.Errorf("invalid sftp port: %d", sc.Port)
+	}
+	if sc.PasswordEnv != "" && sc.PasswordFile != "" {
+		return errors.New("only one of password_env and password_file can be specified")
+	}
+	return sc.uploadOptions.validate()
+}
+
+func (sc sftpConfig) address() string {
+	port := sc.Port
+	if port == 0 {
+		port = 22
+	}
+	return net.JoinHostPort(sc.Host, strconv.Itoa(port))
+}
+
+// clientConfig returns the SSH settings to connect to the server with
+func (sc sftpConfig) clientConfig() (*ssh.ClientConfig, error) {
+	var auth []ssh.AuthMethod
+	if sc.PrivateKey != "" {
+		keyPath, err := expandHome(sc.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		key, err := os.ReadFile(keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the private key: %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing the private key %s: %v (keys with a passphrase must be added to the SSH agent)", keyPath, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	password, err := readPassword(sc.PasswordEnv, sc.PasswordFile)
+	if err != nil {
+		return nil, err
+	}
+	if password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+	if len(auth) == 0 {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil, errors.New("sftp needs a private key, a password or an SSH agent")
+		}
+		auth = append(auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			conn, err := net.Dial("unix", socket)
+			if err != nil {
+				return nil, fmt.Errorf("error connecting to the SSH agent: %v", err)
+			}
+			defer conn.Close()
+			return agent.NewClient(conn).Signers()
+		}))
+	}
+
+	knownHosts, err := knownHostsPath(sshConfig{KnownHosts: sc.KnownHosts})
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the host keys: %v (pin the host key with gitbackup pin-host-keys -host %s)", err, sc.Host)
+	}
+	return &ssh.ClientConfig{
+		User:            sc.Username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}, nil
+}
+
+// newSFTPStore connects to the server. defaultPath is used if the settings
+// don't have a path.
+func newSFTPStore(sc sftpConfig, defaultPath string) (*fsStore, error) {
+	config, err := sc.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := ssh.Dial("tcp", sc.address(), config)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %v", sc.address(), err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error starting SFTP on %s: %v", sc.address(), err)
+	}
+
+	dir := sc.Path
+	if dir == "" {
+		dir = defaultPath
+	}
+	return &fsStore{
+		fs:   &sftpFs{client: client, conn: conn},
+		dir:  dir,
+		name: "sftp://" + sc.Username + "@" + sc.address() + "/" + dir,
+	}, nil
+}
+
+// sftpFs is the file system of an SFTP server
+type sftpFs struct {
+	client *sftp.Client
+	// The SSH connection the client runs over, if any
+	conn *ssh.Client
+}
+
+var _ afero.Fs = (*sftpFs)(nil)
+
+func (s *sftpFs) Name() string {
+	return "sftp"
+}
+
+func (s *sftpFs) Create(name string) (afero.File, error) {
+	return s.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+func (s *sftpFs) Mkdir(name string, _ os.FileMode) error {
+	return s.client.Mkdir(name)
+}
+
+func (s *sftpFs) MkdirAll(name string, _ os.FileMode) error {
+	return s.client.MkdirAll(name)
+}
+
+func (s *sftpFs) Open(name string) (afero.File, error) {
+	info, err := s.client.Stat(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	// SFTP can't open directories as files, they are listed instead
+	if info.IsDir() {
+		return &sftpFile{client: s.client, name: name}, nil
+	}
+	return s.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (s *sftpFs) OpenFile(name string, flag int, _ os.FileMode) (afero.File, error) {
+	f, err := s.client.OpenFile(name, flag)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &sftpFile{client: s.client, name: name, file: f}, nil
+}
+
+func (s *sftpFs) Remove(name string) error {
+	return s.client.Remove(name)
+}
+
+func (s *sftpFs) RemoveAll(name string) error {
+	return s.client.RemoveAll(name)
+}
+
+// Rename replaces newname, which plain SFTP renames don't
+func (s *sftpFs) Rename(oldname, newname string) error {
+	if err := s.client.PosixRename(oldname, newname); err == nil {
+		return nil
+	}
+	if err := s.client.Remove(newname); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return s.client.Rename(oldname, newname)
+}
+
+func (s *sftpFs) Stat(name string) (os.FileInfo, error) {
+	return s.client.Stat(name)
+}
+
+func (s *sftpFs) Chmod(name string, mode os.FileMode) error {
+	return s.client.Chmod(name, mode)
+}
+
+func (s *sftpFs) Chown(name string, uid, gid int) error {
+	return s.client.Chown(name, uid, gid)
+}
+
+func (s *sftpFs) Chtimes(name string, atime, mtime time.Time) error {
+	return s.client.Chtimes(name, atime, mtime)
+}
+
+// Close closes the connection to the server
+func (s *sftpFs) Close() error {
+	err := s.client.Close()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	return err
+}
+
+// sftpFile is a file or a directory on an SFTP server
+type sftpFile struct {
+	client *sftp.Client
+	name   string
+	// nil for directories
+	file *sftp.File
+}
+
+func (f *sftpFile) handle(op string) (*sftp.File, error) {
+	if f.file == nil {
+		return nil, &os.PathError{Op: op, Path: f.name, Err: syscall.EISDIR}
+	}
+	return f.file, nil
+}
+
+func (f *sftpFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+func (f *sftpFile) Read(b []byte) (int, error) {
+	file, err := f.handle("read")
+	if err != nil {
+		return 0, err
+	}
+	return file.Read(b)
+}
+
+func (f *sftpFile) ReadAt(b []byte, off int64) (int, error) {
+	file, err := f.handle("read")
+	if err != nil {
+		return 0, err
+	}
+	return file.ReadAt(b, off)
+}
+
+func (f *sftpFile) Seek(offset int64, whence int) (int64, error) {
+	file, err := f.handle("seek")
+	if err != nil {
+		return 0, err
+	}
+	return file.Seek(offset, whence)
+}
+
+func (f *sftpFile) Write(b []byte) (int, error) {
+	file, err := f.handle("write")
+	if err != nil {
+		return 0, err
+	}
+	return file.Write(b)
+}
+
+func (f *sftpFile) WriteAt(b []byte, off int64) (int, error) {
+	file, err := f.handle("write")
+	if err != nil {
+		return 0, err
+	}
+	return file.WriteAt(b, off)
+}
+
+func (f *sftpFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *sftpFile) Name() string {
+	return f.name
+}
+
+func (f *sftpFile) Readdir(count int) ([]os.FileInfo, error) {
+	entries, err := f.client.ReadDir(f.name)
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 && len(entries) > count {
+		entries = entries[:count]
+	}
+	return entries, nil
+}
+
+func (f *sftpFile) Readdirnames(count int) ([]string, error) {
+	entries, err := f.Readdir(count)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = path.Base(entry.Name())
+	}
+	return names, nil
+}
+
+func (f *sftpFile) Stat() (os.FileInfo, error) {
+	if f.file == nil {
+		return f.client.Stat(f.name)
+	}
+	return f.file.Stat()
+}
+
+func (f *sftpFile) Sync() error {
+	file, err := f.handle("sync")
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func (f *sftpFile) Truncate(size int64) error {
+	file, err := f.handle("truncate")
+	if err != nil {
+		return err
+	}
+	return file.Truncate(size)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshConfig configures how git connects to a git host over SSH. The
+// settings are passed to git as GIT_SSH_COMMAND, so that each target can
+// use its own deploy key and known_hosts file.
+type sshConfig struct {
+	// Private key to authenticate with, instead of the ones from
+	// ~/.ssh and the SSH agent
+	PrivateKey string `yaml:"private_key,omitempty"`
+	// known_hosts file with the host keys of the git host
+	KnownHosts string `yaml:"known_hosts,omitempty"`
+	// Host key policy: yes, accept-new or no
+	StrictHostKeyChecking string `yaml:"strict_host_key_checking,omitempty"`
+	// SSH port of the git host, for hosts which don't use the default port
+	// and don't include it in their SSH clone URLs
+	Port int `yaml:"port,omitempty"`
+}
+
+var validStrictHostKeyChecking = []string{"yes", "accept-new", "no"}
+
+// validate checks the settings without loading any of the files
+func (sc sshConfig) validate() error {
+	if sc.Port < 0 || sc.Port > 65535 {
+		return fmt.Errorf("invalid SSH port: %d", sc.Port)
+	}
+	if sc.StrictHostKeyChecking != "" && !contains(validStrictHostKeyChecking, sc.StrictHostKeyChecking) {
+		return fmt.Errorf("invalid host key policy: %q (must be yes, accept-new or no)", sc.StrictHostKeyChecking)
+	}
+	return nil
+}
+
+// options returns the ssh command line options applying the settings
+func (sc sshConfig) options() ([]string, error) {
+	var options []string
+	if sc.PrivateKey != "" {
+		path, err := absPath(sc.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		// Don't let the agent or the default keys pick another account
+		options = append(options, "-i", path, "-o", "IdentitiesOnly=yes")
+	}
+	if sc.KnownHosts != "" {
+		path, err := absPath(sc.KnownHosts)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, "-o", "UserKnownHostsFile="+path)
+	}
+	if sc.StrictHostKeyChecking != "" {
+		options = append(options, "-o", "StrictHostKeyChecking="+sc.StrictHostKeyChecking)
+	}
+	return options, nil
+}
+
+// absPath expands a leading ~ in path and makes it absolute, as git runs
+// ssh from the directory of the repository
+func absPath(path string) (string, error) {
+	path, err := expandHome(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(path)
+}
+
+// gitSSHCommand returns the command line running ssh with options, for
+// GIT_SSH_COMMAND
+func gitSSHCommand(options []string) string {
+	command := []string{"ssh"}
+	for _, option := range options {
+		command = append(command, shellQuote(option))
+	}
+	return strings.Join(command, " ")
+}
+
+// gitSSHEnv returns the environment making git run ssh with options, if
+// there are any
+func gitSSHEnv(options []string) []string {
+	if len(options) == 0 {
+		return nil
+	}
+	return []string{"GIT_SSH_COMMAND=" + gitSSHCommand(options)}
+}
+
+// knownHostsPath returns the known_hosts file of a target
+func knownHostsPath(sc sshConfig) (string, error) {
+	if sc.KnownHosts != "" {
+		return expandHome(sc.KnownHosts)
+	}
+	homeDir, err := gethomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".ssh", "known_hosts"), nil
+}
+
+// The host key types we pin, one handshake each
+var pinnedHostKeyAlgorithms = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoRSASHA512,
+}
+
+const hostKeyTimeout = 30 * time.Second
+
+var errHostKeyReceived = errors.New("host key received")
+
+// fetchHostKey connects to the SSH server at address and returns its host
+// key of the given algorithm, without authenticating
+func fetchHostKey(address, algorithm string) (ssh.PublicKey, net.Addr, error) {
+	conn, err := net.DialTimeout("tcp", address, hostKeyTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(hostKeyTimeout))
+
+	var key ssh.PublicKey
+	var remote net.Addr
+	config := &ssh.ClientConfig{
+		User:              "git",
+		HostKeyAlgorithms: []string{algorithm},
+		HostKeyCallback: func(hostname string, r net.Addr, k ssh.PublicKey) error {
+			key, remote = k, r
+			// We only wanted the key
+			return errHostKeyReceived
+		},
+	}
+	_, _, _, err = ssh.NewClientConn(conn, address, config)
+	if key == nil {
+		return nil, nil, err
+	}
+	return key, remote, nil
+}
+
+// pinHostKeys fetches the host keys of the SSH server at host:port and
+// adds the ones which aren't known yet to the known_hosts file at path.
+// Keys conflicting with the known ones are an error.
+func pinHostKeys(path, host string, port int, out io.Writer) error {
+	if port == 0 {
+		port = 22
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+
+	var known ssh.HostKeyCallback
+	if _, err := os.Stat(path); err == nil {
+		known, err = knownhosts.New(path)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", path, err)
+		}
+	}
+
+	var lines []string
+	var fetched int
+	var lastErr error
+	for _, algorithm := range pinnedHostKeyAlgorithms {
+		key, remote, err := fetchHostKey(address, algorithm)
+		if err != nil {
+			// The server may not have a key of this type
+			lastErr = err
+			continue
+		}
+		fetched++
+		fingerprint := ssh.FingerprintSHA256(key)
+
+		if known != nil {
+			err = known(address, remote, key)
+			var keyErr *knownhosts.KeyError
+			if err == nil {
+				fmt.Fprintf(out, "%s %s %s is already pinned\n", address, key.Type(), fingerprint)
+				continue
+			}
+			if !errors.As(err, &keyErr) {
+				return err
+			}
+			for _, want := range keyErr.Want {
+				if want.Key.Type() == key.Type() {
+					return fmt.Errorf("the %s host key of %s (%s) doesn't match the one in %s:%d, it may have been rotated or the connection intercepted",
+						key.Type(), address, fingerprint, want.Filename, want.Line)
+				}
+			}
+		}
+		lines = append(lines, knownhosts.Line([]string{knownhosts.Normalize(address)}, key))
+		fmt.Fprintf(out, "%s %s %s pinned in %s\n", address, key.Type(), fingerprint, path)
+	}
+	if fetched == 0 {
+		return fmt.Errorf("error fetching the host keys of %s: %v", address, lastErr)
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(strings.Join(lines, "\n") + "\n")
+	return err
+}
+
+// handlePinHostKeys pins the SSH host keys of the git hosts of the targets
+// in their known_hosts files. host overrides the SSH host name, for git
+// hosts whose SSH server has a name of its own.
+func handlePinHostKeys(configs []*appConfig, host string, out io.Writer) error {
+	for _, c := range configs {
+		if err := c.ssh.validate(); err != nil {
+			return targetError(c, err)
+		}
+		path, err := knownHostsPath(c.ssh)
+		if err != nil {
+			return err
+		}
+		sshHost := host
+		if sshHost == "" {
+			sshHost = credentialHost(c.service, c.gitHostURL)
+		}
+		if err := pinHostKeys(path, sshHost, c.ssh.Port, out); err != nil {
+			return targetError(c, err)
+		}
+	}
+	fmt.Fprintln(out, "Please compare the fingerprints with the ones published by your git host")
+	return nil
+}
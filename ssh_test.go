@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestSSHConfigOptions(t *testing.T) {
+	var testCases = []struct {
+		config   sshConfig
+		expected []string
+	}{
+		{sshConfig{}, nil},
+		{sshConfig{Port: 2222}, nil},
+		{
+			sshConfig{PrivateKey: "/keys/deploy", KnownHosts: "/keys/known_hosts", StrictHostKeyChecking: "yes"},
+			[]string{"-i", "/keys/deploy", "-o", "IdentitiesOnly=yes", "-o", "UserKnownHostsFile=/keys/known_hosts", "-o", "StrictHostKeyChecking=yes"},
+		},
+		{sshConfig{StrictHostKeyChecking: "accept-new"}, []string{"-o", "StrictHostKeyChecking=accept-new"}},
+	}
+	for _, tc := range testCases {
+		options, err := tc.config.options()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(options, tc.expected) {
+			t.Errorf("%+v: expected %v, got %v", tc.config, tc.expected, options)
+		}
+	}
+
+	env := gitSSHEnv([]string{"-i", "/my keys/deploy", "-o", "IdentitiesOnly=yes"})
+	expected := []string{`GIT_SSH_COMMAND=ssh '-i' '/my keys/deploy' '-o' 'IdentitiesOnly=yes'`}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("Expected %v, got %v", expected, env)
+	}
+	if env := gitSSHEnv(nil); env != nil {
+		t.Errorf("Expected no environment without options, got %v", env)
+	}
+}
+
+func TestSSHConfigValidate(t *testing.T) {
+	var testCases = []struct {
+		config  sshConfig
+		wantErr bool
+	}{
+		{sshConfig{}, false},
+		{sshConfig{Port: 2222, StrictHostKeyChecking: "accept-new"}, false},
+		{sshConfig{Port: 70000}, true},
+		{sshConfig{StrictHostKeyChecking: "ask"}, true},
+	}
+	for _, tc := range testCases {
+		if err := tc.config.validate(); (err != nil) != tc.wantErr {
+			t.Errorf("%+v: expected an error: %v, got %v", tc.config, tc.wantErr, err)
+		}
+	}
+}
+
+// startSSHServer starts an SSH server with the given host key which only
+// does the key exchange
+func startSSHServer(t *testing.T, hostKey ssh.Signer) (string, int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				ssh.NewServerConn(conn, config)
+			}()
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func newHostKey(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestPinHostKeys(t *testing.T) {
+	hostKey := newHostKey(t)
+	host, port := startSSHServer(t, hostKey)
+	path := filepath.Join(t.TempDir(), "ssh", "known_hosts")
+	fingerprint := ssh.FingerprintSHA256(hostKey.PublicKey())
+
+	var out bytes.Buffer
+	if err := pinHostKeys(path, host, port, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "ssh-ed25519 "+fingerprint+" pinned in "+path) {
+		t.Errorf("Expected the key to be pinned, got:\n%s", out.String())
+	}
+	data, _ := os.ReadFile(path)
+	expected := knownhosts.Line([]string{"[" + host + "]:" + strconv.Itoa(port)}, hostKey.PublicKey()) + "\n"
+	if string(data) != expected {
+		t.Errorf("Expected known_hosts to be:\n%s\ngot:\n%s", expected, data)
+	}
+
+	// Pinning again doesn't add the key twice
+	out.Reset()
+	if err := pinHostKeys(path, host, port, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "is already pinned") {
+		t.Errorf("Expected the key to be already pinned, got:\n%s", out.String())
+	}
+	if data, _ := os.ReadFile(path); string(data) != expected {
+		t.Errorf("Expected known_hosts not to change, got:\n%s", data)
+	}
+
+	// A different key is refused
+	otherKey := newHostKey(t)
+	otherHost, otherPort := startSSHServer(t, otherKey)
+	os.WriteFile(path, []byte(knownhosts.Line([]string{"[" + otherHost + "]:" + strconv.Itoa(otherPort)}, hostKey.PublicKey())+"\n"), 0600)
+	err := pinHostKeys(path, otherHost, otherPort, &out)
+	if err == nil || !strings.Contains(err.Error(), "doesn't match") {
+		t.Errorf("Expected a host key mismatch, got %v", err)
+	}
+
+	// Nothing is listening
+	if err := pinHostKeys(path, "127.0.0.1", 1, &out); err == nil {
+		t.Error("Expected an error when the host can't be reached")
+	}
+}
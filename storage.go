@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// How the repositories are uploaded
+const (
+	uploadFormatBundle      = "bundle"
+	uploadFormatTar         = "tar"
+	uploadFormatIncremental = "incremental"
+)
+
+// uploadOptions are the settings shared by the storages the backups are
+// uploaded to
+type uploadOptions struct {
+	// How the repositories are uploaded: bundle (the default), tar or
+	// incremental
+	Format string `yaml:"format,omitempty"`
+	// Remove the uploaded repositories which are no longer in the backup
+	// directory
+	Prune bool `yaml:"prune,omitempty"`
+}
+
+func (uo uploadOptions) validate() error {
+	switch uo.Format {
+	case "", uploadFormatBundle, uploadFormatTar, uploadFormatIncremental:
+	default:
+		return fmt.Errorf("invalid format: %q (must be bundle, tar or incremental)", uo.Format)
+	}
+	return nil
+}
+
+// validateStorage checks that the backups of a target are uploaded to one
+// storage at most
+func validateStorage(c *appConfig) error {
+	var enabled []string
+	if c.s3.enabled() {
+		enabled = append(enabled, "s3")
+	}
+	if c.sftp.enabled() {
+		enabled = append(enabled, "sftp")
+	}
+	if c.webdav.enabled() {
+		enabled = append(enabled, "webdav")
+	}
+	if len(enabled) > 1 {
+		return fmt.Errorf("the backups can only be uploaded to one storage, got %s", strings.Join(enabled, " and "))
+	}
+	return nil
+}
+
+// targetUploadFormat returns the format the backups of a target are
+// uploaded in, or "" if they aren't uploaded
+func targetUploadFormat(c *appConfig) string {
+	var format string
+	switch {
+	case c.s3.enabled():
+		format = c.s3.Format
+	case c.sftp.enabled():
+		format = c.sftp.Format
+	case c.webdav.enabled():
+		format = c.webdav.Format
+	default:
+		return ""
+	}
+	if format == "" {
+		return uploadFormatBundle
+	}
+	return format
+}
+
+// newTargetStore returns the storage the backups of a target are uploaded
+// to and its settings, or a nil store if they aren't uploaded
+func newTargetStore(c *appConfig) (objectStore, uploadOptions, error) {
+	defaultPrefix := gitHostName(c.service, c.gitHostURL)
+	switch {
+	case c.s3.enabled():
+		store, err := newS3Store(c.s3, defaultPrefix)
+		if err != nil {
+			return nil, uploadOptions{}, err
+		}
+		return store, c.s3.uploadOptions, nil
+	case c.sftp.enabled():
+		store, err := newSFTPStore(c.sftp, defaultPrefix)
+		if err != nil {
+			return nil, uploadOptions{}, err
+		}
+		return store, c.sftp.uploadOptions, nil
+	case c.webdav.enabled():
+		store, err := newWebDAVStore(c.webdav, defaultPrefix)
+		if err != nil {
+			return nil, uploadOptions{}, err
+		}
+		return store, c.webdav.uploadOptions, nil
+	}
+	return nil, uploadOptions{}, nil
+}
+
+// closeStore closes the connection to a storage, if it has one
+func closeStore(store objectStore) {
+	if closer, ok := store.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// fsStore stores objects under a directory of an afero file system, e.g.
+// the one of an SFTP server
+type fsStore struct {
+	fs   afero.Fs
+	dir  string
+	name string
+}
+
+func (s *fsStore) path(name string) string {
+	return path.Join(s.dir, name)
+}
+
+func (s *fsStore) String() string {
+	return s.name
+}
+
+// partialSuffix marks the objects being uploaded
+const partialSuffix = ".partial"
+
+// put writes r next to the object and renames it into place once it is
+// complete, so that an interrupted upload doesn't leave a truncated object
+func (s *fsStore) put(_ context.Context, name string, r io.Reader, size int64) error {
+	target := s.path(name)
+	if err := s.fs.MkdirAll(path.Dir(target), 0755); err != nil {
+		return fmt.Errorf("error creating the directory of %s on %s: %v", name, s, err)
+	}
+	partial := target + partialSuffix
+	if err := afero.WriteReader(s.fs, partial, r); err != nil {
+		return fmt.Errorf("error uploading %s to %s: %v", name, s, err)
+	}
+	return s.complete(partial, target, size)
+}
+
+// resume uploads the content identified by id, continuing where a previous
+// upload of the same content was interrupted
+func (s *fsStore) resume(_ context.Context, name, id string, r io.ReadSeeker, size int64) error {
+	target := s.path(name)
+	if err := s.fs.MkdirAll(path.Dir(target), 0755); err != nil {
+		return fmt.Errorf("error creating the directory of %s on %s: %v", name, s, err)
+	}
+	partial := target + "." + id + partialSuffix
+	var offset int64
+	if info, err := s.fs.Stat(partial); err == nil && info.Size() <= size {
+		offset = info.Size()
+	}
+
+	f, err := s.fs.OpenFile(partial, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error uploading %s to %s: %v", name, s, err)
+	}
+	if offset == 0 {
+		err = f.Truncate(0)
+	} else {
+		slog.Info("Resuming interrupted upload", "store", s.String(), "object", name, "offset", offset, "size", size)
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err == nil {
+		_, err = r.Seek(offset, io.SeekStart)
+	}
+	if err == nil {
+		_, err = io.Copy(f, r)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error uploading %s to %s: %v", name, s, err)
+	}
+	if err := s.complete(partial, target, size); err != nil {
+		return err
+	}
+	s.removePartials(target)
+	return nil
+}
+
+// complete checks the size of an upload, if it is known, and renames it to
+// target
+func (s *fsStore) complete(partial, target string, size int64) error {
+	info, err := s.fs.Stat(partial)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && info.Size() != size {
+		return fmt.Errorf("error uploading %s to %s: uploaded %d bytes instead of %d", target, s, info.Size(), size)
+	}
+	if err := s.fs.Rename(partial, target); err != nil {
+		return fmt.Errorf("error renaming %s on %s: %v", partial, s, err)
+	}
+	return nil
+}
+
+// removePartials removes the interrupted uploads of other contents of
+// target
+func (s *fsStore) removePartials(target string) {
+	entries, err := afero.ReadDir(s.fs, path.Dir(target))
+	if err != nil {
+		return
+	}
+	prefix := path.Base(target) + "."
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), prefix) && strings.HasSuffix(entry.Name(), partialSuffix) {
+			s.fs.Remove(path.Join(path.Dir(target), entry.Name()))
+		}
+	}
+}
+
+func (s *fsStore) get(_ context.Context, name string) (io.ReadCloser, error) {
+	f, err := s.fs.Open(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errObjectNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error downloading %s from %s: %v", name, s, err)
+	}
+	return f, nil
+}
+
+func (s *fsStore) remove(_ context.Context, name string) error {
+	err := s.fs.Remove(s.path(name))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error removing %s from %s: %v", name, s, err)
+	}
+	return nil
+}
+
+// Close closes the file system, if it has a connection
+func (s *fsStore) Close() error {
+	if closer, ok := s.fs.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+	"golang.org/x/net/webdav"
+)
+
+func TestSFTPConfigValidate(t *testing.T) {
+	var tests = []struct {
+		name  string
+		sc    sftpConfig
+		valid bool
+	}{
+		{"disabled", sftpConfig{}, true},
+		{"username without host", sftpConfig{Username: "backup"}, false},
+		{"minimal", sftpConfig{Host: "nas.example.com", Username: "backup"}, true},
+		{"host without username", sftpConfig{Host: "nas.example.com"}, false},
+		{"invalid port", sftpConfig{Host: "nas.example.com", Username: "backup", Port: 70000}, false},
+		{"two passwords", sftpConfig{Host: "nas.example.com", Username: "backup", PasswordEnv: "PASSWORD", PasswordFile: "password"}, false},
+		{"unknown format", sftpConfig{Host: "nas.example.com", Username: "backup", uploadOptions: uploadOptions{Format: "zip"}}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.sc.validate()
+			if (err == nil) != tc.valid {
+				t.Errorf("validate() = %v, want valid %v", err, tc.valid)
+			}
+		})
+	}
+}
+
+func TestWebDAVConfigValidate(t *testing.T) {
+	var tests = []struct {
+		name  string
+		wc    webdavConfig
+		valid bool
+	}{
+		{"disabled", webdavConfig{}, true},
+		{"username without url", webdavConfig{Username: "backup"}, false},
+		{"minimal", webdavConfig{URL: "https://cloud.example.com/dav"}, true},
+		{"not HTTP", webdavConfig{URL: "ftp://cloud.example.com/dav"}, false},
+		{"no host", webdavConfig{URL: "https:///dav"}, false},
+		{"two passwords", webdavConfig{URL: "https://cloud.example.com/dav", PasswordEnv: "PASSWORD", PasswordFile: "password"}, false},
+		{"tar", webdavConfig{URL: "https://cloud.example.com/dav", uploadOptions: uploadOptions{Format: "tar"}}, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.wc.validate()
+			if (err == nil) != tc.valid {
+				t.Errorf("validate() = %v, want valid %v", err, tc.valid)
+			}
+		})
+	}
+}
+
+func TestValidateStorage(t *testing.T) {
+	c := &appConfig{sftp: sftpConfig{Host: "nas.example.com", Username: "backup"}}
+	if err := validateStorage(c); err != nil {
+		t.Errorf("validateStorage() with one storage = %v", err)
+	}
+	c.webdav = webdavConfig{URL: "https://cloud.example.com/dav"}
+	err := validateStorage(c)
+	if err == nil || !strings.Contains(err.Error(), "sftp and webdav") {
+		t.Errorf("validateStorage() with two storages = %v", err)
+	}
+}
+
+// newTestSFTPStore returns a store on an SFTP server serving a temporary
+// directory over a pipe
+func newTestSFTPStore(t *testing.T) (*fsStore, string) {
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverReader, serverWriter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		server.Serve()
+		close(served)
+	}()
+	client, err := sftp.NewClientPipe(clientReader, clientWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	store := &fsStore{fs: &sftpFs{client: client}, dir: filepath.ToSlash(dir), name: "sftp://test"}
+	t.Cleanup(func() {
+		// The client waits for the server to hang up
+		clientReader.Close()
+		store.Close()
+		<-served
+	})
+	return store, dir
+}
+
+func TestFSStore(t *testing.T) {
+	stores := map[string]func(t *testing.T) objectStore{
+		"memory": func(t *testing.T) objectStore {
+			return &fsStore{fs: afero.NewMemMapFs(), dir: "/backups", name: "memory"}
+		},
+		"sftp": func(t *testing.T) objectStore {
+			store, _ := newTestSFTPStore(t)
+			return store
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			testObjectStore(t, newStore(t))
+		})
+	}
+}
+
+func TestWebDAVStore(t *testing.T) {
+	fs := webdav.NewMemFS()
+	if err := fs.Mkdir(context.Background(), "/dav", 0755); err != nil {
+		t.Fatal(err)
+	}
+	handler := &webdav.Handler{
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "backup" || password != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="dav"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	t.Setenv("TEST_WEBDAV_PASSWORD", "secret")
+	store, err := newWebDAVStore(webdavConfig{URL: server.URL + "/dav", Username: "backup", PasswordEnv: "TEST_WEBDAV_PASSWORD"}, "github.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testObjectStore(t, store)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestWebDAVStoreTransport(t *testing.T) {
+	fs := webdav.NewMemFS()
+	if err := fs.Mkdir(context.Background(), "/dav", 0755); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewTLSServer(&webdav.Handler{
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+	})
+	defer server.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+
+	// The git host's transport doesn't apply to the storage server
+	oldTransport := httpTransport
+	defer func() { httpTransport = oldTransport }()
+	httpTransport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("the git host's transport was used")
+	})
+
+	store, err := newWebDAVStore(webdavConfig{URL: server.URL + "/dav", CAFile: caFile}, "github.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testObjectStore(t, store)
+
+	// Nor does its CA bundle: the server isn't signed by the system's CAs
+	store, err = newWebDAVStore(webdavConfig{URL: server.URL + "/dav"}, "github.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.get(context.Background(), "octocat/repo.bundle"); err == nil || errors.Is(err, errObjectNotFound) {
+		t.Errorf("Expected the certificate of the server not to be verified, got %v", err)
+	}
+}
+
+// testObjectStore uploads, downloads and removes an object
+func testObjectStore(t *testing.T, store objectStore) {
+	ctx := context.Background()
+	if _, err := store.get(ctx, "octocat/repo.bundle"); !errors.Is(err, errObjectNotFound) {
+		t.Fatalf("get() of a missing object = %v, want errObjectNotFound", err)
+	}
+	content := []byte("bundle content")
+	if err := store.put(ctx, "octocat/repo.bundle", bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	r, err := store.get(ctx, "octocat/repo.bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("get() = %q, %v, want %q", got, err, content)
+	}
+	if err := store.remove(ctx, "octocat/repo.bundle"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.get(ctx, "octocat/repo.bundle"); !errors.Is(err, errObjectNotFound) {
+		t.Errorf("get() of a removed object = %v, want errObjectNotFound", err)
+	}
+	if err := store.remove(ctx, "octocat/repo.bundle"); err != nil {
+		t.Errorf("remove() of a missing object = %v", err)
+	}
+
+	// Streams are uploaded without knowing their size
+	stream := io.MultiReader(bytes.NewReader(content), strings.NewReader(" streamed"))
+	if err := store.put(ctx, "octocat/repo.bundle", stream, -1); err != nil {
+		t.Fatal(err)
+	}
+	r, err = store.get(ctx, "octocat/repo.bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = io.ReadAll(r)
+	r.Close()
+	if err != nil || string(got) != "bundle content streamed" {
+		t.Errorf("get() of a streamed object = %q, %v", got, err)
+	}
+}
+
+func TestFSStoreResume(t *testing.T) {
+	store, dir := newTestSFTPStore(t)
+	content := []byte("0123456789abcdefghij")
+	id, err := fileDigest(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An interrupted upload of this content and one of an older content
+	repoDir := filepath.Join(dir, "octocat")
+	os.MkdirAll(repoDir, 0755)
+	os.WriteFile(filepath.Join(repoDir, "repo.bundle."+id+partialSuffix), content[:8], 0644)
+	os.WriteFile(filepath.Join(repoDir, "repo.bundle.0123456789abcdef"+partialSuffix), []byte("old"), 0644)
+	// Written after the interruption, so it mustn't be uploaded again
+	resumed := &countingReader{ReadSeeker: bytes.NewReader(content)}
+
+	if err := store.resume(context.Background(), "octocat/repo.bundle", id, resumed, int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(repoDir, "repo.bundle"))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("uploaded object = %q, %v, want %q", got, err, content)
+	}
+	if resumed.read != int64(len(content)-8) {
+		t.Errorf("uploaded %d bytes, want the %d missing ones", resumed.read, len(content)-8)
+	}
+	entries, _ := os.ReadDir(repoDir)
+	if len(entries) != 1 {
+		t.Errorf("partial uploads were left behind: %v", entries)
+	}
+}
+
+type countingReader struct {
+	io.ReadSeeker
+	read int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(b)
+	r.read += int64(n)
+	return n, err
+}
+
+func TestUploaderPrune(t *testing.T) {
+	oldFS := appFS
+	defer func() { appFS = oldFS }()
+	appFS = afero.NewMemMapFs()
+	appFS.MkdirAll("/backup/octocat/kept", 0755)
+	appFS.MkdirAll("/backup/octocat/bare.git", 0755)
+
+	ctx := context.Background()
+	store := &fsStore{fs: afero.NewMemMapFs(), dir: "/github.com", name: "memory"}
+	m := &manifest{Repositories: map[string]manifestEntry{
+		"octocat/kept":    {Object: "octocat/kept.bundle"},
+		"octocat/bare":    {Object: "octocat/bare.bundle", Bare: true},
+		"octocat/deleted": {Object: "octocat/deleted.bundle"},
+	}}
+	for _, entry := range m.Repositories {
+		store.put(ctx, entry.Object, strings.NewReader("bundle"), 6)
+	}
+	u := &uploader{store: store, format: uploadFormatBundle, manifest: m}
+
+	u.prune("/backup")
+	if _, ok := m.Repositories["octocat/deleted"]; ok {
+		t.Error("repository which is no longer backed up wasn't pruned")
+	}
+	if _, err := store.get(ctx, "octocat/deleted.bundle"); !errors.Is(err, errObjectNotFound) {
+		t.Errorf("object of the pruned repository wasn't removed: %v", err)
+	}
+	if len(m.Repositories) != 2 || !u.changed {
+		t.Errorf("unexpected manifest after pruning: %+v", m.Repositories)
+	}
+
+	// Nothing is pruned when none of the repositories are in the backup
+	// directory
+	u.changed = false
+	u.prune("/elsewhere")
+	if len(m.Repositories) != 2 || u.changed {
+		t.Errorf("repositories were pruned from an unrelated directory: %+v", m.Repositories)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// httpConfig configures how gitbackup and git connect to a git host over
+// HTTP(S): the API requests, the migration archive downloads and the
+// HTTPS clones
+type httpConfig struct {
+	// CA bundle to verify the certificates of the git host with, instead
+	// of the system's
+	CAFile string `yaml:"ca_file,omitempty"`
+	// Client certificate and key for git hosts requiring mutual TLS
+	ClientCert string `yaml:"client_cert,omitempty"`
+	ClientKey  string `yaml:"client_key,omitempty"`
+	// Don't verify the certificates of the git host, for test setups only
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify,omitempty"`
+	// Proxy URL, instead of $HTTPS_PROXY/$HTTP_PROXY
+	Proxy string `yaml:"proxy,omitempty"`
+	// Timeout for connecting and waiting for a response. git aborts
+	// transfers which are stalled for this long.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// httpTransport is the transport for the HTTP requests to the current
+// target's git host
+var httpTransport http.RoundTripper = http.DefaultTransport
+
+// configureHTTP sets up httpTransport for a target
+func configureHTTP(hc httpConfig) error {
+	transport, err := newTransport(hc)
+	if err != nil {
+		return err
+	}
+	httpTransport = transport
+	return nil
+}
+
+// validate checks the settings without loading any of the files
+func (hc httpConfig) validate() error {
+	if (hc.ClientCert == "") != (hc.ClientKey == "") {
+		return errors.New("the client certificate needs both the certificate and the key file")
+	}
+	if _, err := hc.proxyURL(); err != nil {
+		return err
+	}
+	if hc.Timeout < 0 {
+		return errors.New("the HTTP timeout can't be negative")
+	}
+	return nil
+}
+
+// proxyURL parses the configured proxy URL, if any
+func (hc httpConfig) proxyURL() (*url.URL, error) {
+	if hc.Proxy == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(hc.Proxy)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL: %s (must be an http:// or https:// URL)", redact(hc.Proxy))
+	}
+	if password, ok := u.User.Password(); ok {
+		registerSecret(password)
+	}
+	return u, nil
+}
+
+// proxyFunc returns the function selecting the proxy for a request: the
+// configured proxy, or the one from the environment
+func (hc httpConfig) proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	u, err := hc.proxyURL()
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return http.ProxyFromEnvironment, nil
+	}
+	return http.ProxyURL(u), nil
+}
+
+// tlsConfig returns the TLS configuration for connecting to the git host
+func (hc httpConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: hc.InsecureSkipVerify}
+
+	if hc.CAFile != "" {
+		path, err := expandHome(hc.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in the CA bundle %s", path)
+		}
+		config.RootCAs = pool
+	}
+
+	if hc.ClientCert != "" {
+		certPath, err := expandHome(hc.ClientCert)
+		if err != nil {
+			return nil, err
+		}
+		keyPath, err := expandHome(hc.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("error loading the client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// newTransport returns a transport with the TLS, proxy and timeout
+// settings of hc
+func newTransport(hc httpConfig) (*http.Transport, error) {
+	if err := hc.validate(); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := hc.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := hc.proxyFunc()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = proxy
+	if hc.Timeout > 0 {
+		dialer := &net.Dialer{Timeout: hc.Timeout, KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+		transport.TLSHandshakeTimeout = hc.Timeout
+		transport.ResponseHeaderTimeout = hc.Timeout
+	}
+	return transport, nil
+}
+
+// gitSettings returns the git configuration applying hc to the HTTPS
+// clones. The proxy is left out when git goes through the bandwidth
+// limiting proxy, which forwards to it instead.
+func (hc httpConfig) gitSettings(throttled bool) ([][2]string, error) {
+	var settings [][2]string
+	for _, file := range []struct {
+		key  string
+		path string
+	}{
+		{"http.sslCAInfo", hc.CAFile},
+		{"http.sslCert", hc.ClientCert},
+		{"http.sslKey", hc.ClientKey},
+	} {
+		if file.path == "" {
+			continue
+		}
+		path, err := expandHome(file.path)
+		if err != nil {
+			return nil, err
+		}
+		settings = append(settings, [2]string{file.key, path})
+	}
+	if hc.InsecureSkipVerify {
+		settings = append(settings, [2]string{"http.sslVerify", "false"})
+	}
+	if hc.Proxy != "" && !throttled {
+		settings = append(settings, [2]string{"http.proxy", hc.Proxy})
+	}
+	if hc.Timeout > 0 {
+		// git has no connection timeout, but it can give up on
+		// transfers which are stalled
+		seconds := int(math.Ceil(hc.Timeout.Seconds()))
+		settings = append(settings,
+			[2]string{"http.lowSpeedLimit", "1"},
+			[2]string{"http.lowSpeedTime", strconv.Itoa(seconds)},
+		)
+	}
+	return settings, nil
+}
@@ -0,0 +1,853 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// objectStore is where the backups are uploaded to
+type objectStore interface {
+	// put uploads r as name. size is -1 when r is streamed and its size
+	// isn't known in advance.
+	put(ctx context.Context, name string, r io.Reader, size int64) error
+	// get returns errObjectNotFound if there is no object called name
+	get(ctx context.Context, name string) (io.ReadCloser, error)
+	// remove doesn't fail if there is no object called name
+	remove(ctx context.Context, name string) error
+	String() string
+}
+
+// resumableStore is an objectStore which can continue interrupted uploads
+type resumableStore interface {
+	objectStore
+	// resume uploads r as name, continuing an interrupted upload of the
+	// content identified by id
+	resume(ctx context.Context, name, id string, r io.ReadSeeker, size int64) error
+}
+
+var errObjectNotFound = errors.New("object not found")
+
+// manifestName is the object listing the uploaded repositories
+const manifestName = "manifest.json"
+
+// manifest lists the repositories uploaded to an object store, so that
+// unchanged repositories aren't uploaded again and the backups can be
+// restored
+type manifest struct {
+	Repositories map[string]manifestEntry `json:"repositories"`
+}
+
+type manifestEntry struct {
+	Object string `json:"object"`
+	Format string `json:"format"`
+	// Digest of the refs of the repository when it was uploaded
+	State      string    `json:"state"`
+	Size       int64     `json:"size"`
+	CloneURL   string    `json:"clone_url"`
+	Bare       bool      `json:"bare"`
+	UploadedAt time.Time `json:"uploaded_at"`
+	// Encryption scheme of the object, if it is encrypted
+	Encryption string `json:"encryption,omitempty"`
+	// Tips of the refs of the repository, for the incremental format
+	Refs map[string]string `json:"refs,omitempty"`
+	// Clone strategy of the repository, if it isn't a full clone
+	Clone *cloneStrategy `json:"clone,omitempty"`
+}
+
+// loadManifest reads the manifest of store, if there is one
+func loadManifest(ctx context.Context, store objectStore) (*manifest, error) {
+	m := &manifest{Repositories: make(map[string]manifestEntry)}
+	r, err := store.get(ctx, manifestName)
+	if errors.Is(err, errObjectNotFound) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, fmt.Errorf("error parsing the manifest of %s: %v", store, err)
+	}
+	if m.Repositories == nil {
+		m.Repositories = make(map[string]manifestEntry)
+	}
+	return m, nil
+}
+
+func saveManifest(ctx context.Context, store objectStore, m *manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.put(ctx, manifestName, bytes.NewReader(data), int64(len(data)))
+}
+
+// repoState returns a digest of the refs of the repository at repoDir, or
+// "" if it doesn't have any
+func repoState(repoDir string) (string, error) {
+	cmd := newGitCommand("-C", repoDir, "for-each-ref", "--format=%(objectname) %(refname)")
+	refs, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("error listing the refs of %s: %v", repoDir, err)
+	}
+	if len(bytes.TrimSpace(refs)) == 0 {
+		return "", nil
+	}
+	digest := sha256.Sum256(refs)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// writeBundle writes a bundle of all the refs of the repository at repoDir
+// to w
+func writeBundle(repoDir string, w io.Writer) error {
+	cmd := newGitCommand("-C", repoDir, "bundle", "create", "-", "--all")
+	var stderr bytes.Buffer
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error creating the bundle of %s: %v: %s", repoDir, err, stderr.Bytes())
+	}
+	return nil
+}
+
+// writeTarArchive writes the directory dir as a gzipped tar archive to w
+func writeTarArchive(dir string, w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, p)
+		if err != nil || name == "." {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// extractTarArchive extracts a gzipped tar archive written by
+// writeTarArchive into dir. The archive comes from the storage, which may
+// be compromised: nothing is written outside dir, through a path or to a
+// symbolic link.
+func extractTarArchive(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !filepath.IsLocal(header.Name) {
+			return fmt.Errorf("invalid path in the archive: %s", header.Name)
+		}
+		if err := checkArchivePath(dir, header.Name); err != nil {
+			return err
+		}
+		target := filepath.Join(dir, header.Name)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if filepath.IsAbs(header.Linkname) || !filepath.IsLocal(filepath.Join(filepath.Dir(header.Name), header.Linkname)) {
+				return fmt.Errorf("invalid symbolic link in the archive: %s -> %s", header.Name, header.Linkname)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, header.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// checkArchivePath checks that the path of an entry of an archive doesn't
+// go through a symbolic link created by the archive, nor replace one
+func checkArchivePath(dir, name string) error {
+	p := dir
+	for _, segment := range strings.Split(filepath.Clean(name), string(filepath.Separator)) {
+		p = filepath.Join(p, segment)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("invalid path in the archive: %s goes through a symbolic link", name)
+		}
+	}
+	return nil
+}
+
+// objectName returns the name of the object of a repository
+func objectName(repo string, format string) string {
+	if format == uploadFormatTar {
+		return repo + ".tar.gz"
+	}
+	return repo + ".bundle"
+}
+
+// uploader uploads the repositories of a target once they are backed up
+type uploader struct {
+	store     objectStore
+	format    string
+	encrypter *encrypter
+
+	mu       sync.Mutex
+	manifest *manifest
+	changed  bool
+	// The entries uploaded or removed since the manifest was loaded,
+	// nil for the removed ones
+	changes map[string]*manifestEntry
+	// Backup directory whose gitbackup processes share the manifest
+	backupDir string
+}
+
+// The uploader of the target being backed up, if its backups are
+// uploaded. All the methods are safe to call on a nil *uploader.
+var repoUploader *uploader
+
+func newUploader(ctx context.Context, store objectStore, format string, e *encrypter) (*uploader, error) {
+	if format == "" {
+		format = uploadFormatBundle
+	}
+	m, err := loadManifest(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+	return &uploader{store: store, format: format, encrypter: e, manifest: m}, nil
+}
+
+// upload uploads the repository backed up at repoDir, unless it hasn't
+// changed since it was last uploaded
+func (u *uploader) upload(repoDir string, repo *Repository, bare bool) error {
+	if u == nil {
+		return nil
+	}
+	logger := repoLogger(repo)
+	name := repoFullName(repo)
+	state, err := repoState(repoDir)
+	if err != nil {
+		return err
+	}
+	if state == "" {
+		logger.Debug("Repository is empty, not uploading it")
+		return nil
+	}
+	strategy, err := readCloneStrategy(repoDir, bare)
+	if err != nil {
+		return err
+	}
+	// git bundles need the objects partial clones lack
+	if strategy.partial() && u.format != uploadFormatTar {
+		return fmt.Errorf("repository is a %s, it can only be uploaded as a tar archive", strategy)
+	}
+	var clone *cloneStrategy
+	if !strategy.full() {
+		clone = &strategy
+	}
+	u.mu.Lock()
+	entry, ok := u.manifest.Repositories[name]
+	u.mu.Unlock()
+	if ok && entry.State == state && entry.Format == u.format && entry.Encryption == u.encrypter.name() && reflect.DeepEqual(entry.Clone, clone) {
+		logger.Debug("Repository hasn't changed since it was uploaded", "store", u.store.String())
+		return nil
+	}
+
+	if u.format == uploadFormatIncremental {
+		return u.uploadIncremental(repoDir, repo, bare, state, clone, entry, ok)
+	}
+
+	object := objectName(name, u.format) + u.encrypter.extension()
+	size, err := u.writeObject(logger, object, func(w io.Writer) error {
+		if u.format == uploadFormatTar {
+			return writeTarArchive(repoDir, w)
+		}
+		return writeBundle(repoDir, w)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The format or the encryption changed
+	if ok && entry.Object != object {
+		if err := u.removeUpload(entry); err != nil {
+			logger.Warn("Error removing the previous upload of the repository", "object", entry.Object, "error", err)
+		}
+	}
+
+	u.mu.Lock()
+	u.setEntry(name, &manifestEntry{
+		Object:     object,
+		Format:     u.format,
+		State:      state,
+		Size:       size,
+		CloneURL:   repo.CloneURL,
+		Bare:       bare,
+		UploadedAt: time.Now().UTC(),
+		Encryption: u.encrypter.name(),
+		Clone:      clone,
+	})
+	u.mu.Unlock()
+	return nil
+}
+
+// setEntry records the upload of a repository in the manifest, or its
+// removal if entry is nil. u.mu must be held.
+func (u *uploader) setEntry(name string, entry *manifestEntry) {
+	if entry == nil {
+		delete(u.manifest.Repositories, name)
+	} else {
+		u.manifest.Repositories[name] = *entry
+	}
+	if u.changes == nil {
+		u.changes = make(map[string]*manifestEntry)
+	}
+	u.changes[name] = entry
+	u.changed = true
+}
+
+// writeObject uploads what write writes as object and returns its size.
+// It is encrypted and streamed to the store as it is written, so that
+// uploading a repository doesn't need a copy of it on disk.
+func (u *uploader) writeObject(logger *slog.Logger, object string, write func(io.Writer) error) (int64, error) {
+	if _, ok := u.store.(resumableStore); ok {
+		return u.writeResumableObject(logger, object, write)
+	}
+
+	logger.Info("Uploading repository", "store", u.store.String(), "object", object)
+	pr, pw := io.Pipe()
+	written := make(chan error, 1)
+	cw := &countingWriter{w: pw}
+	go func() {
+		err := u.encryptTo(cw, write)
+		pw.CloseWithError(err)
+		written <- err
+	}()
+	err := u.store.put(context.Background(), object, pr, -1)
+	// Unblock write if the upload failed before reading everything
+	pr.Close()
+	if writeErr := <-written; writeErr != nil {
+		return 0, writeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return cw.n, nil
+}
+
+// encryptTo encrypts what write writes to w
+func (u *uploader) encryptTo(w io.Writer, write func(io.Writer) error) error {
+	ew, err := u.encrypter.encrypt(w)
+	if err != nil {
+		return err
+	}
+	err = write(ew)
+	if closeErr := ew.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// countingWriter counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// writeResumableObject uploads what write writes as object to a
+// resumableStore. An upload is resumed when its content is the same, so
+// the content is written to a temporary file first to know its digest.
+func (u *uploader) writeResumableObject(logger *slog.Logger, object string, write func(io.Writer) error) (int64, error) {
+	f, err := os.CreateTemp("", "gitbackup-upload-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := u.encryptTo(f, write); err != nil {
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	logger.Info("Uploading repository", "store", u.store.String(), "object", object, "size", info.Size())
+	id, err := fileDigest(f)
+	if err != nil {
+		return 0, err
+	}
+	if err := u.store.(resumableStore).resume(context.Background(), object, id, f, info.Size()); err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// removeUpload removes the objects of an uploaded repository
+func (u *uploader) removeUpload(entry manifestEntry) error {
+	ctx := context.Background()
+	if entry.Format == uploadFormatIncremental {
+		chain, err := loadChain(ctx, u.store, entry.Object)
+		if err != nil && !errors.Is(err, errObjectNotFound) {
+			return err
+		}
+		if chain != nil {
+			for _, link := range chain.Bundles {
+				if err := u.store.remove(ctx, link.Object); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return u.store.remove(ctx, entry.Object)
+}
+
+// fileDigest returns a short digest of the content of f, identifying an
+// upload when it is resumed
+func fileDigest(f io.ReadSeeker) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// manifestRepoDir returns the directory of a repository of the manifest
+// under dir
+func manifestRepoDir(dir, name string, entry manifestEntry) string {
+	repoDir := filepath.Join(dir, filepath.FromSlash(name))
+	if entry.Bare {
+		repoDir += ".git"
+	}
+	return repoDir
+}
+
+// prune removes the uploaded repositories which are no longer in
+// backupDir. Nothing is removed if none of them is, in case backupDir
+// isn't the directory they were backed up to.
+func (u *uploader) prune(backupDir string) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var missing []string
+	for name, entry := range u.manifest.Repositories {
+		if _, err := appFS.Stat(manifestRepoDir(backupDir, name, entry)); os.IsNotExist(err) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+	if len(missing) == len(u.manifest.Repositories) {
+		slog.Warn("None of the uploaded repositories are in the backup directory, not pruning them", "store", u.store.String(), "path", backupDir)
+		return
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		entry := u.manifest.Repositories[name]
+		slog.Info("Removing repository which is no longer backed up", "repository", name, "store", u.store.String(), "object", entry.Object)
+		if err := u.removeUpload(entry); err != nil {
+			slog.Error("Error removing repository", "repository", name, "error", err)
+			continue
+		}
+		u.setEntry(name, nil)
+	}
+}
+
+// saveManifest saves the manifest if any repository was uploaded
+func (u *uploader) saveManifest() error {
+	if u == nil {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.changed {
+		return nil
+	}
+
+	// Another gitbackup process sharing the backup directory, e.g.
+	// serve-webhooks and the daemon, may have saved the manifest since it
+	// was loaded: the changes are applied to the latest one
+	ctx := context.Background()
+	m := u.manifest
+	if u.backupDir != "" {
+		unlock, err := lockManifest(u.backupDir)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		if m, err = loadManifest(ctx, u.store); err != nil {
+			return err
+		}
+		mergeManifest(m, u.changes)
+	}
+	if err := saveManifest(ctx, u.store, m); err != nil {
+		return err
+	}
+	u.manifest = m
+	u.changes = nil
+	u.changed = false
+	return nil
+}
+
+// mergeManifest applies the changes of a process to the manifest m. The
+// latest upload of a repository wins.
+func mergeManifest(m *manifest, changes map[string]*manifestEntry) {
+	for name, entry := range changes {
+		if entry == nil {
+			delete(m.Repositories, name)
+		} else if saved, ok := m.Repositories[name]; !ok || !saved.UploadedAt.After(entry.UploadedAt) {
+			m.Repositories[name] = *entry
+		}
+	}
+}
+
+// setupUploads sets the uploads of the backups of a target up and returns
+// a function saving the manifest once the backups are done. prune is set
+// when all the repositories of the target are backed up, so that those
+// which are no longer in the backup directory can be removed.
+func setupUploads(c *appConfig, prune bool) (func(), error) {
+	store, opts, err := newTargetStore(c)
+	if err != nil || store == nil {
+		return func() {}, err
+	}
+	e, err := newEncrypter(c.encryption)
+	if err != nil {
+		closeStore(store)
+		return nil, err
+	}
+	u, err := newUploader(context.Background(), store, opts.Format, e)
+	if err != nil {
+		closeStore(store)
+		return nil, err
+	}
+	u.backupDir = c.backupDir
+	repoUploader = u
+	return func() {
+		repoUploader = nil
+		if prune && opts.Prune {
+			u.prune(c.backupDir)
+		}
+		if err := u.saveManifest(); err != nil {
+			slog.Error("Error saving the manifest, the repositories will be uploaded again", "store", store.String(), "error", err)
+		}
+		closeStore(store)
+	}, nil
+}
+
+// restoreRepository recreates the repository of entry at repoDir from its
+// object in store. The archives keep the clone strategy of the repository,
+// which is recorded again in those restored from bundles.
+func restoreRepository(ctx context.Context, store objectStore, d *decrypter, entry manifestEntry, repoDir string) error {
+	switch entry.Format {
+	case uploadFormatIncremental:
+		if err := restoreChain(ctx, store, d, entry, repoDir); err != nil {
+			return err
+		}
+		return restoreCloneStrategy(repoDir, entry)
+	case uploadFormatTar:
+		object, err := store.get(ctx, entry.Object)
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+		r, err := d.decrypt(entry.Encryption, object)
+		if err != nil {
+			return err
+		}
+		return extractTarArchive(r, repoDir)
+	}
+
+	bundle, err := downloadObject(ctx, store, d, entry.Object, entry.Encryption)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(bundle)
+	if err := assembleBundles([]string{bundle}, repoDir, entry.Bare, entry.CloneURL); err != nil {
+		return err
+	}
+	return restoreCloneStrategy(repoDir, entry)
+}
+
+// restoreCloneStrategy records the clone strategy of entry in the
+// repository restored at repoDir, so that its backups carry on with it
+func restoreCloneStrategy(repoDir string, entry manifestEntry) error {
+	if entry.Clone == nil {
+		return nil
+	}
+	return recordCloneStrategy(repoDir, entry.Bare, *entry.Clone)
+}
+
+// describeUpload returns how the repository of entry was uploaded, and
+// whether it is a partial backup
+func describeUpload(entry manifestEntry) string {
+	encryption := entry.Encryption
+	if encryption == "" {
+		encryption = "not encrypted"
+	}
+	description := entry.Format + ", " + encryption
+	if entry.Clone != nil {
+		description += ", partial backup: " + entry.Clone.String()
+	}
+	return description
+}
+
+// downloadObject downloads and decrypts an object into a temporary file
+// and returns its path
+func downloadObject(ctx context.Context, store objectStore, d *decrypter, object, encryption string) (string, error) {
+	r, err := store.get(ctx, object)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	plaintext, err := d.decrypt(encryption, r)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp("", "gitbackup-restore-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmp, plaintext)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("error downloading %s: %v", object, err)
+	}
+	return tmp.Name(), nil
+}
+
+// matchRepository reports whether the repository called name matches one
+// of the patterns, e.g. owner/repo or owner/*
+func matchRepository(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// openManifest connects to the storage of a target and loads its manifest
+func openManifest(ctx context.Context, c *appConfig) (objectStore, *manifest, error) {
+	store, _, err := newTargetStore(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if store == nil {
+		return nil, nil, errors.New("no storage the backups are uploaded to is configured")
+	}
+	m, err := loadManifest(ctx, store)
+	if err != nil {
+		closeStore(store)
+		return nil, nil, err
+	}
+	return store, m, nil
+}
+
+// matchingRepositories returns the sorted names of the repositories of the
+// manifest matching the patterns
+func matchingRepositories(m *manifest, patterns []string) []string {
+	var names []string
+	for name := range m.Repositories {
+		if matchRepository(name, patterns) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// handleRestore restores the repositories of the targets matching the
+// patterns from their storages, into dest or the backup directories of the
+// targets. Existing repositories are left alone.
+func handleRestore(configs []*appConfig, patterns []string, dest string, out io.Writer) error {
+	ctx := context.Background()
+	var errs []error
+	for _, c := range configs {
+		store, m, err := openManifest(ctx, c)
+		if err != nil {
+			return targetError(c, err)
+		}
+		defer closeStore(store)
+		d := &decrypter{ec: c.encryption}
+		dir := dest
+		if dir == "" {
+			dir = c.backupDir
+		}
+
+		names := matchingRepositories(m, patterns)
+		if len(names) == 0 {
+			fmt.Fprintf(out, "No repositories to restore from %s\n", store)
+			continue
+		}
+		for _, name := range names {
+			entry := m.Repositories[name]
+			repoDir := manifestRepoDir(dir, name, entry)
+			if _, err := os.Stat(repoDir); err == nil {
+				fmt.Fprintf(out, "%s already exists, skipping %s\n", repoDir, name)
+				continue
+			}
+			if err := restoreRepository(ctx, store, d, entry, repoDir); err != nil {
+				os.RemoveAll(repoDir)
+				errs = append(errs, targetError(c, fmt.Errorf("error restoring %s: %v", name, err)))
+				continue
+			}
+			fmt.Fprintf(out, "Restored %s (%s, uploaded %s) into %s\n", name, describeUpload(entry), entry.UploadedAt.Local().Format("2006-01-02 15:04:05"), repoDir)
+			if entry.Clone != nil && entry.Clone.Strategy == cloneStrategyBlobless {
+				fmt.Fprintf(out, "  The file contents missing from %s are fetched from %s when they are needed\n", name, entry.CloneURL)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// verifyRepository checks that the repository of entry can be restored
+// from its object in store: the object is decrypted, restored into a
+// temporary directory and checked with git fsck
+func verifyRepository(ctx context.Context, store objectStore, d *decrypter, entry manifestEntry) error {
+	dir, err := os.MkdirTemp("", "gitbackup-verify-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	repoDir := filepath.Join(dir, "repo")
+	if err := restoreRepository(ctx, store, d, entry, repoDir); err != nil {
+		return err
+	}
+	if out, err := newGitCommand("-C", repoDir, "fsck", "--no-progress", "--no-dangling").CombinedOutput(); err != nil {
+		return fmt.Errorf("git fsck failed: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// handleVerify checks that the uploaded repositories of the targets
+// matching the patterns can be restored
+func handleVerify(configs []*appConfig, patterns []string, out io.Writer) error {
+	ctx := context.Background()
+	var verified, failed int
+	for _, c := range configs {
+		store, m, err := openManifest(ctx, c)
+		if err != nil {
+			return targetError(c, err)
+		}
+		defer closeStore(store)
+		d := &decrypter{ec: c.encryption}
+		for _, name := range matchingRepositories(m, patterns) {
+			entry := m.Repositories[name]
+			if err := verifyRepository(ctx, store, d, entry); err != nil {
+				fmt.Fprintf(out, "FAILED %s: %v\n", name, err)
+				failed++
+				continue
+			}
+			fmt.Fprintf(out, "OK     %s (%s, %d bytes, uploaded %s)\n", name, describeUpload(entry), entry.Size, entry.UploadedAt.Local().Format("2006-01-02 15:04:05"))
+			verified++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of the %d repositories failed verification", failed, failed+verified)
+	}
+	if verified == 0 {
+		fmt.Fprintln(out, "No repositories to verify")
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+func TestS3ConfigValidate(t *testing.T) {
+	var tests = []struct {
+		name  string
+		sc    s3Config
+		valid bool
+	}{
+		{"disabled", s3Config{}, true},
+		{"endpoint without bucket", s3Config{Endpoint: "s3.amazonaws.com"}, false},
+		{"bucket without endpoint", s3Config{Bucket: "backups"}, false},
+		{"minimal", s3Config{Endpoint: "s3.amazonaws.com", Bucket: "backups"}, true},
+		{"URL endpoint", s3Config{Endpoint: "https://s3.amazonaws.com", Bucket: "backups"}, false},
+		{"tar", s3Config{Endpoint: "s3.amazonaws.com", Bucket: "backups", uploadOptions: uploadOptions{Format: "tar"}}, true},
+		{"unknown format", s3Config{Endpoint: "s3.amazonaws.com", Bucket: "backups", uploadOptions: uploadOptions{Format: "zip"}}, false},
+		{"AES256", s3Config{Endpoint: "s3.amazonaws.com", Bucket: "backups", SSE: "AES256"}, true},
+		{"KMS", s3Config{Endpoint: "s3.amazonaws.com", Bucket: "backups", SSE: "aws:kms", SSEKMSKeyID: "key"}, true},
+		{"KMS key without KMS", s3Config{Endpoint: "s3.amazonaws.com", Bucket: "backups", SSEKMSKeyID: "key"}, false},
+		{"unknown SSE", s3Config{Endpoint: "s3.amazonaws.com", Bucket: "backups", SSE: "rot13"}, false},
+		{"access key without secret key", s3Config{Endpoint: "s3.amazonaws.com", Bucket: "backups", AccessKeyEnv: "KEY"}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.sc.validate()
+			if (err == nil) != tc.valid {
+				t.Errorf("validate() = %v, want valid %v", err, tc.valid)
+			}
+		})
+	}
+}
+
+func TestMatchRepository(t *testing.T) {
+	var tests = []struct {
+		name     string
+		patterns []string
+		want     bool
+	}{
+		{"octocat/repo", nil, true},
+		{"octocat/repo", []string{"octocat/repo"}, true},
+		{"octocat/repo", []string{"octocat/*"}, true},
+		{"octocat/repo", []string{"other/*", "*/repo"}, true},
+		{"octocat/repo", []string{"octocat"}, false},
+		{"group/sub/repo", []string{"group/*"}, false},
+	}
+	for _, tc := range tests {
+		if got := matchRepository(tc.name, tc.patterns); got != tc.want {
+			t.Errorf("matchRepository(%q, %v) = %v, want %v", tc.name, tc.patterns, got, tc.want)
+		}
+	}
+}
+
+func TestExtractTarArchiveEscape(t *testing.T) {
+	file := func(name string) *tar.Header {
+		return &tar.Header{Name: name, Mode: 0644, Size: 1, Typeflag: tar.TypeReg}
+	}
+	symlink := func(name, target string) *tar.Header {
+		return &tar.Header{Name: name, Linkname: target, Mode: 0777, Typeflag: tar.TypeSymlink}
+	}
+	var tests = []struct {
+		name    string
+		headers []*tar.Header
+		valid   bool
+	}{
+		{"parent directory", []*tar.Header{file("../escape")}, false},
+		{"symbolic link outside", []*tar.Header{symlink("link", "..")}, false},
+		{"absolute symbolic link", []*tar.Header{symlink("link", "/tmp")}, false},
+		{"symbolic link outside from a subdirectory", []*tar.Header{symlink("sub/link", "../../escape")}, false},
+		{"file through a symbolic link", []*tar.Header{{Name: "dir", Mode: 0755, Typeflag: tar.TypeDir}, symlink("link", "dir"), file("link/escape")}, false},
+		{"file replacing a symbolic link", []*tar.Header{file("target"), symlink("link", "target"), file("link")}, false},
+		{"symbolic link inside", []*tar.Header{file("sub/target"), symlink("link", "sub/target"), symlink("sub/link", "../link")}, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			tw := tar.NewWriter(gz)
+			for _, header := range tc.headers {
+				tw.WriteHeader(header)
+				if header.Typeflag == tar.TypeReg {
+					tw.Write([]byte("x"))
+				}
+			}
+			tw.Close()
+			gz.Close()
+
+			dir := t.TempDir()
+			err := extractTarArchive(&buf, filepath.Join(dir, "repo"))
+			if (err == nil) != tc.valid {
+				t.Fatalf("extractTarArchive() = %v, want valid: %v", err, tc.valid)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "escape")); !os.IsNotExist(err) {
+				t.Errorf("file outside of the directory was written: %v", err)
+			}
+		})
+	}
+}
+
+// newTestS3Config starts an in-memory S3 server with a backups bucket
+func newTestS3Config(t *testing.T) s3Config {
+	backend := s3mem.New()
+	if err := backend.CreateBucket("backups"); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(decodeAWSChunked(gofakes3.New(backend).Server()))
+	t.Cleanup(server.Close)
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_S3_ACCESS_KEY", "access")
+	t.Setenv("TEST_S3_SECRET_KEY", "secret")
+	return s3Config{
+		Endpoint:     u.Host,
+		Bucket:       "backups",
+		Region:       "us-east-1",
+		Insecure:     true,
+		AccessKeyEnv: "TEST_S3_ACCESS_KEY",
+		SecretKeyEnv: "TEST_S3_SECRET_KEY",
+	}
+}
+
+// decodeAWSChunked decodes the bodies signed in chunks, which the client
+// sends over plain HTTP and gofakes3 only decodes for single part uploads
+func decodeAWSChunked(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") || r.URL.Query().Get("partNumber") == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		var body bytes.Buffer
+		br := bufio.NewReader(r.Body)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			size, err := strconv.ParseInt(strings.SplitN(line, ";", 2)[0], 16, 64)
+			if err != nil || size == 0 {
+				break
+			}
+			if _, err := io.CopyN(&body, br, size); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			br.Discard(2)
+		}
+		r.Body = io.NopCloser(&body)
+		r.ContentLength = int64(body.Len())
+		r.Header.Set("Content-Length", strconv.Itoa(body.Len()))
+		r.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+		h.ServeHTTP(w, r)
+	})
+}
+
+// newTestRepository creates a git repository with a commit
+func newTestRepository(t *testing.T, dir string) {
+	for _, args := range [][]string{
+		{"init", "-q", dir},
+		{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "initial"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+}
+
+func TestUploadAndRestore(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	var tests = []struct {
+		name       string
+		format     string
+		encryption func(t *testing.T) encryptionConfig
+	}{
+		{"bundle", uploadFormatBundle, nil},
+		{"tar", uploadFormatTar, nil},
+		{"age bundle", uploadFormatBundle, newTestAgeKeys},
+		{"OpenPGP tar", uploadFormatTar, func(t *testing.T) encryptionConfig { return newTestPGPKeys(t, "passphrase") }},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			format := tc.format
+			sc := newTestS3Config(t)
+			sc.Format = format
+			backupDir := t.TempDir()
+			repoDir := filepath.Join(backupDir, "octocat", "repo")
+			newTestRepository(t, repoDir)
+			repo := &Repository{Namespace: "octocat", Name: "repo", CloneURL: "https://github.com/octocat/repo.git"}
+
+			c := &appConfig{service: "github", backupDir: backupDir, s3: sc}
+			if tc.encryption != nil {
+				c.encryption = tc.encryption(t)
+			}
+			saveManifest, err := setupUploads(c, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := repoUploader.upload(repoDir, repo, false); err != nil {
+				t.Fatal(err)
+			}
+			entry := repoUploader.manifest.Repositories["octocat/repo"]
+			if want := objectName("octocat/repo", format) + repoUploader.encrypter.extension(); entry.Object != want || entry.Encryption != repoUploader.encrypter.name() {
+				t.Errorf("uploaded %s encrypted with %q, want %s", entry.Object, entry.Encryption, want)
+			}
+			saveManifest()
+
+			// The repository hasn't changed, so it isn't uploaded again
+			saveManifest, err = setupUploads(c, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := repoUploader.upload(repoDir, repo, false); err != nil {
+				t.Fatal(err)
+			}
+			if got := repoUploader.manifest.Repositories["octocat/repo"]; !reflect.DeepEqual(got, entry) {
+				t.Errorf("unchanged repository was uploaded again: %+v, was %+v", got, entry)
+			}
+			if repoUploader.changed {
+				t.Error("manifest of an unchanged repository would be saved again")
+			}
+			saveManifest()
+
+			dest := t.TempDir()
+			var out bytes.Buffer
+			if err := handleRestore([]*appConfig{c}, []string{"octocat/*"}, dest, &out); err != nil {
+				t.Fatalf("handleRestore: %v: %s", err, out.String())
+			}
+			restored := filepath.Join(dest, "octocat", "repo")
+			log, err := exec.Command("git", "-C", restored, "log", "--format=%s").Output()
+			if err != nil {
+				t.Fatalf("restored repository is invalid: %v: %s", err, out.String())
+			}
+			if strings.TrimSpace(string(log)) != "initial" {
+				t.Errorf("restored history = %q", log)
+			}
+			if format == uploadFormatBundle {
+				origin, _ := exec.Command("git", "-C", restored, "remote", "get-url", "origin").Output()
+				if strings.TrimSpace(string(origin)) != repo.CloneURL {
+					t.Errorf("origin of the restored repository = %q, want %q", origin, repo.CloneURL)
+				}
+			}
+
+			// Existing repositories are left alone
+			out.Reset()
+			if err := handleRestore([]*appConfig{c}, nil, dest, &out); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(out.String(), "already exists") {
+				t.Errorf("expected the existing repository to be skipped, got %q", out.String())
+			}
+
+			out.Reset()
+			if err := handleVerify([]*appConfig{c}, nil, &out); err != nil {
+				t.Fatalf("handleVerify: %v: %s", err, out.String())
+			}
+			if !strings.HasPrefix(out.String(), "OK     octocat/repo") {
+				t.Errorf("unexpected verification: %q", out.String())
+			}
+		})
+	}
+}
@@ -6,7 +6,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path"
@@ -72,7 +72,7 @@ func createGithubUserMigration(ctx context.Context, client interface{}, repos []
 			errResponse, _ = ioutil.ReadAll(resp.Body)
 			resp.Body.Close()
 		}
-		log.Printf("Attempt #%d: Error creating user migration: %v", i, string(errResponse))
+		slog.Warn("Error creating user migration", "attempt", i, "response", string(errResponse))
 	}
 	return m, err
 }
@@ -88,7 +88,7 @@ func createGithubOrgMigration(ctx context.Context, client interface{}, org strin
 	if err != nil {
 		defer resp.Body.Close()
 		data, _ := ioutil.ReadAll(resp.Body)
-		log.Printf("%v", string(data))
+		slog.Error("Error creating org migration", "org", org, "response", string(data))
 	}
 	return m, err
 }
@@ -116,7 +116,7 @@ func downloadGithubUserMigrationData(
 			archiveFilepath := getLocalMigrationFilepath(backupDir, *ms.ID)
 			return downloadMigrationArchive(archiveURL, archiveFilepath)
 		default:
-			log.Printf("Waiting for migration state to be exported: %s\n", *ms.State)
+			slog.Info("Waiting for migration state to be exported", "state", *ms.State)
 			time.Sleep(migrationStatePollingDuration)
 
 			ms, _, err = client.(*github.Client).Migrations.UserMigrationStatus(ctx, *ms.ID)
@@ -149,7 +149,7 @@ func downloadGithubOrgMigrationData(
 			archiveFilepath := getLocalOrgMigrationFilepath(backupDir, org, *ms.ID)
 			return downloadMigrationArchive(archiveURL, archiveFilepath)
 		default:
-			log.Printf("Waiting for migration state to be exported: %s\n", *ms.State)
+			slog.Info("Waiting for migration state to be exported", "state", *ms.State)
 			time.Sleep(migrationStatePollingDuration)
 			ms, _, err = client.(*github.Client).Migrations.MigrationStatus(ctx, org, *ms.ID)
 			if err != nil {
@@ -161,13 +161,18 @@ func downloadGithubOrgMigrationData(
 
 // downloadMigrationArchive downloads a migration archive from the given URL to the specified filepath
 func downloadMigrationArchive(archiveURL, archiveFilepath string) error {
-	log.Printf("Downloading file to: %s\n", archiveFilepath)
+	slog.Info("Downloading migration archive", "path", archiveFilepath)
 
-	resp, err := http.Get(archiveURL)
+	client := &http.Client{Transport: httpTransport}
+	resp, err := client.Get(archiveURL)
 	if err != nil {
 		return fmt.Errorf("error downloading archive:%v", err)
 	}
 	defer resp.Body.Close()
+	// The archive URLs are short lived, so don't save an error page
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error downloading archive: %s", resp.Status)
+	}
 
 	out, err := os.Create(archiveFilepath)
 	if err != nil {
@@ -224,13 +229,13 @@ type GithubUserMigrationDeleteResult struct {
 }
 
 // DeleteGithubUserMigration deletes an existing migration
-func DeleteGithubUserMigration(id *int64) GithubUserMigrationDeleteResult {
-	client := newClient("github", "https://github.com")
+func DeleteGithubUserMigration(client interface{}, id *int64) GithubUserMigrationDeleteResult {
+	result := GithubUserMigrationDeleteResult{}
 	ctx := context.Background()
 	response, err := client.(*github.Client).Migrations.DeleteUserMigration(ctx, *id)
-
-	result := GithubUserMigrationDeleteResult{}
-	result.GhStatusCode = response.StatusCode
+	if response != nil {
+		result.GhStatusCode = response.StatusCode
+	}
 	if err != nil {
 		result.GhResponseBody = err.Error()
 		return result
@@ -276,11 +281,7 @@ func getGithubOrgRepositories(ctx context.Context, client interface{}, o *github
 		}
 		for _, repo := range repos {
 			namespace := strings.Split(*repo.FullName, "/")[0]
-			if useHTTPSClone != nil && *useHTTPSClone {
-				cloneURL = *repo.CloneURL
-			} else {
-				cloneURL = *repo.SSHURL
-			}
+			cloneURL = getCloneURL(*repo.CloneURL, *repo.SSHURL)
 			repositories = append(repositories, &Repository{CloneURL: cloneURL, Name: *repo.Name, Namespace: namespace, Private: *repo.Private})
 		}
 		if resp.NextPage == 0 {
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/studio-b12/gowebdav"
+)
+
+// webdavConfig configures the upload of the backups to a WebDAV server,
+// e.g. Nextcloud
+type webdavConfig struct {
+	// URL of the WebDAV collection, e.g.
+	// https://cloud.example.com/remote.php/dav/files/backup
+	URL          string `yaml:"url,omitempty"`
+	Username     string `yaml:"username,omitempty"`
+	PasswordEnv  string `yaml:"password_env,omitempty"`
+	PasswordFile string `yaml:"password_file,omitempty"`
+	// Collection of the backups under the URL (default: the git host name)
+	Prefix string `yaml:"prefix,omitempty"`
+	// CA bundle to verify the certificate of the server with, instead of
+	// the system's
+	CAFile string `yaml:"ca_file,omitempty"`
+
+	uploadOptions `yaml:",inline"`
+}
+
+// enabled reports whether the backups are uploaded
+func (wc webdavConfig) enabled() bool {
+	return wc.URL != ""
+}
+
+// validate checks the settings without connecting to the server
+func (wc webdavConfig) validate() error {
+	if !wc.enabled() {
+		if wc.Username != "" || wc.Prefix != "" {
+			return errors.New("webdav needs a url")
+		}
+		return nil
+	}
+	u, err := url.Parse(wc.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webdav url: %q", wc.URL)
+	}
+	if wc.PasswordEnv != "" && wc.PasswordFile != "" {
+		return errors.New("only one of password_env and password_file can be specified")
+	}
+	return wc.uploadOptions.validate()
+}
+
+// webdavStore stores objects under a collection of a WebDAV server.
+// WebDAV can't append to a file, so interrupted uploads start over.
+type webdavStore struct {
+	client *gowebdav.Client
+	url    string
+	prefix string
+}
+
+// newWebDAVStore returns the store of the backups. defaultPrefix is used if
+// the settings don't have a prefix.
+func newWebDAVStore(wc webdavConfig, defaultPrefix string) (*webdavStore, error) {
+	password, err := readPassword(wc.PasswordEnv, wc.PasswordFile)
+	if err != nil {
+		return nil, err
+	}
+	// The storage server is usually outside the network of the git host,
+	// so the target's TLS and proxy settings don't apply
+	transport, err := newTransport(httpConfig{CAFile: wc.CAFile})
+	if err != nil {
+		return nil, fmt.Errorf("invalid webdav settings: %v", err)
+	}
+	base := strings.TrimSuffix(wc.URL, "/")
+	client := gowebdav.NewClient(base, wc.Username, password)
+	client.SetTransport(transport)
+	client.SetTimeout(30 * time.Minute)
+
+	prefix := wc.Prefix
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	return &webdavStore{client: client, url: base, prefix: strings.Trim(prefix, "/")}, nil
+}
+
+func (s *webdavStore) path(name string) string {
+	return "/" + path.Join(s.prefix, name)
+}
+
+func (s *webdavStore) String() string {
+	return s.url + "/" + s.prefix
+}
+
+// put uploads r next to the object and moves it into place once it is
+// complete, so that an interrupted upload doesn't leave a truncated object.
+// Streams are uploaded with a chunked PUT.
+func (s *webdavStore) put(_ context.Context, name string, r io.Reader, size int64) error {
+	target := s.path(name)
+	partial := target + partialSuffix
+	if _, ok := r.(io.Seeker); !ok {
+		r = &webdavStream{r: r}
+	}
+	if err := s.client.WriteStreamWithLength(partial, r, size, 0644); err != nil {
+		return fmt.Errorf("error uploading %s to %s: %v", name, s, err)
+	}
+	if err := s.client.Rename(partial, target, true); err != nil {
+		return fmt.Errorf("error renaming %s on %s: %v", partial, s, err)
+	}
+	return nil
+}
+
+// webdavStream keeps gowebdav from buffering a stream in memory, in case it
+// has to send it again to authenticate: a stream can't be sent again, but
+// the client already authenticated when it created the parent collection.
+type webdavStream struct {
+	r    io.Reader
+	read bool
+}
+
+func (s *webdavStream) Read(b []byte) (int, error) {
+	s.read = true
+	return s.r.Read(b)
+}
+
+func (s *webdavStream) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart || s.read {
+		return 0, errors.New("can't rewind a streamed upload")
+	}
+	return 0, nil
+}
+
+func (s *webdavStore) get(_ context.Context, name string) (io.ReadCloser, error) {
+	r, err := s.client.ReadStream(s.path(name))
+	if gowebdav.IsErrNotFound(err) {
+		return nil, errObjectNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error downloading %s from %s: %v", name, s, err)
+	}
+	return r, nil
+}
+
+func (s *webdavStore) remove(_ context.Context, name string) error {
+	err := s.client.Remove(s.path(name))
+	if err != nil && !gowebdav.IsErrNotFound(err) {
+		return fmt.Errorf("error removing %s from %s: %v", name, s, err)
+	}
+	return nil
+}
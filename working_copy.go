@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// updateWorkingCopy updates a repository which isn't bare: the branches and
+// tags of its remotes are fetched, then its default branch is checked out,
+// following the git host when it is renamed, and fast-forwarded. Local
+// changes and commits are never discarded: a checkout which can't be
+// updated is reported, and the backup carries on with the fetched refs.
+func updateWorkingCopy(repoDir string, repo *Repository, strategy cloneStrategy) ([]byte, error) {
+	logger := repoLogger(repo)
+	// The commits of the remote branches as they were before the fetch:
+	// the fetched shallow history doesn't reach them anymore
+	var fetchedTips []byte
+	if strategy.Strategy == cloneStrategyShallow {
+		out, err := newGitCommand("-C", repoDir, "for-each-ref", "--format=^%(objectname)", "refs/remotes").Output()
+		if err != nil {
+			return nil, fmt.Errorf("error reading the remote branches: %v", err)
+		}
+		fetchedTips = out
+	}
+	stdoutStderr, err := runGitCommand(newGitCommand(strategy.fetchArgs(repoDir, false)...), repo)
+	if err != nil {
+		return stdoutStderr, err
+	}
+	git := func(args ...string) (string, error) {
+		out, err := newGitCommand(append([]string{"-C", repoDir}, args...)...).CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("error running git %s: %v: %s", args[0], err, bytes.TrimSpace(out))
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	diverged := func(reason string) ([]byte, error) {
+		logger.Warn("Checkout of the repository wasn't updated", "reason", reason)
+		runEvents.repoDiverged(repo, reason)
+		return stdoutStderr, nil
+	}
+
+	branch, err := defaultBranch(repoDir, strategy)
+	if err != nil {
+		// Empty repositories have no default branch yet
+		logger.Warn("Error reading the default branch, the checkout wasn't updated", "error", err)
+		return stdoutStderr, nil
+	}
+	upstream := "refs/remotes/origin/" + branch
+	status, err := git("status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		return stdoutStderr, err
+	}
+	dirty := status != ""
+
+	// A detached HEAD has no branch
+	current, _ := git("symbolic-ref", "--quiet", "--short", "HEAD")
+	if current != branch {
+		if dirty {
+			return diverged(fmt.Sprintf("the working tree of %s has local changes, the default branch %s wasn't checked out", current, branch))
+		}
+		args := []string{"checkout", "--quiet", branch}
+		if _, err := git("rev-parse", "--verify", "--quiet", "refs/heads/"+branch); err != nil {
+			args = []string{"checkout", "--quiet", "-b", branch, "--track", "origin/" + branch}
+		}
+		if _, err := git(args...); err != nil {
+			return diverged(err.Error())
+		}
+		logger.Info("Checked out the default branch", "branch", branch, "previous", current)
+	}
+
+	// The shallow history fetched again doesn't have the commits which
+	// were checked out, so the checkout is reset rather than fast-forwarded,
+	// unless it has commits which were never fetched
+	if strategy.Strategy == cloneStrategyShallow {
+		if dirty {
+			return diverged("the working tree of the shallow clone has local changes")
+		}
+		cmd := newGitCommand("-C", repoDir, "rev-list", "--count", "--stdin", "HEAD", "--not", "--remotes")
+		cmd.Stdin = bytes.NewReader(fetchedTips)
+		out, err := cmd.Output()
+		if err != nil {
+			return stdoutStderr, fmt.Errorf("error looking for local commits: %v", err)
+		}
+		if local := strings.TrimSpace(string(out)); local != "0" {
+			return diverged(fmt.Sprintf("the local commits of %s aren't in the remote branches (%s ahead)", branch, local))
+		}
+		if _, err := git("reset", "--hard", "--quiet", upstream); err != nil {
+			return stdoutStderr, err
+		}
+		return stdoutStderr, nil
+	}
+
+	counts, err := git("rev-list", "--left-right", "--count", "HEAD..."+upstream)
+	if err != nil {
+		return stdoutStderr, err
+	}
+	ahead, behind, err := parseLeftRightCount(counts)
+	if err != nil {
+		return stdoutStderr, err
+	}
+	if ahead > 0 {
+		return diverged(fmt.Sprintf("the local commits of %s aren't in origin/%s (%d ahead, %d behind)", branch, branch, ahead, behind))
+	}
+	if behind > 0 {
+		if _, err := git("merge", "--ff-only", "--quiet", upstream); err != nil {
+			return diverged(err.Error())
+		}
+	}
+	return stdoutStderr, nil
+}
+
+// defaultBranch returns the branch a working copy checks out: the default
+// branch the git host currently reports, or the branch of the single-branch
+// clones
+func defaultBranch(repoDir string, strategy cloneStrategy) (string, error) {
+	if strategy.Strategy == cloneStrategySingleBranch && strategy.Branch != "" {
+		return strategy.Branch, nil
+	}
+	if out, err := newGitCommand("-C", repoDir, "remote", "set-head", "origin", "--auto").CombinedOutput(); err != nil {
+		return "", fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	out, err := newGitCommand("-C", repoDir, "symbolic-ref", "--short", "refs/remotes/origin/HEAD").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(strings.TrimSpace(string(out)), "origin/"), nil
+}
+
+// parseLeftRightCount parses the output of git rev-list --left-right --count
+func parseLeftRightCount(counts string) (left, right int, err error) {
+	fields := strings.Fields(counts)
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("unexpected output of git rev-list: %q", counts)
+	}
+	if left, err = strconv.Atoi(fields[0]); err != nil {
+		return 0, 0, err
+	}
+	if right, err = strconv.Atoi(fields[1]); err != nil {
+		return 0, 0, err
+	}
+	return left, right, nil
+}
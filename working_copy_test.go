@@ -0,0 +1,209 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestUpdateWorkingCopy(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	oldFS := appFS
+	defer func() { appFS = oldFS }()
+	appFS = afero.NewOsFs()
+
+	hosted := t.TempDir()
+	work := filepath.Join(hosted, "work")
+	newTestRepository(t, work)
+	os.WriteFile(filepath.Join(work, "README"), []byte("initial\n"), 0644)
+	gitTest(t, "-C", work, "add", "README")
+	gitTest(t, "-C", work, "commit", "-q", "-m", "readme")
+	gitTest(t, "-C", work, "branch", "-M", "master")
+	upstream := filepath.Join(hosted, "repo.git")
+	gitTest(t, "clone", "-q", "--bare", work, upstream)
+	gitTest(t, "-C", work, "remote", "add", "origin", upstream)
+	push := func(args ...string) {
+		t.Helper()
+		gitTest(t, append([]string{"-C", work, "push", "-q", "origin"}, args...)...)
+	}
+
+	backupDir := t.TempDir()
+	repo := &Repository{Namespace: "octocat", Name: "repo", CloneURL: upstream}
+	repoDir := getRepoDir(backupDir, repo, false)
+	sink := &recordingSink{}
+	runEvents = newRunProgress("github", "github.com", sink)
+	defer func() { runEvents = nil }()
+	backUpRepo := func() {
+		t.Helper()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		if out, err := backUp(backupDir, repo, false, &wg); err != nil {
+			t.Fatalf("backUp: %v: %s", err, out)
+		}
+	}
+	refs := func(patterns ...string) string {
+		return gitTest(t, append([]string{"-C", repoDir, "for-each-ref", "--format=%(refname)"}, patterns...)...)
+	}
+	backUpRepo()
+
+	// New branches, tags and commits of the default branch
+	gitTest(t, "-C", work, "commit", "-q", "--allow-empty", "-m", "second")
+	gitTest(t, "-C", work, "branch", "feature")
+	gitTest(t, "-C", work, "tag", "v1", "HEAD~1")
+	push("master", "feature", "v1")
+	gitTest(t, "-C", repoDir, "tag", "local")
+	backUpRepo()
+	if got := refs("refs/remotes/origin/feature", "refs/tags"); got != "refs/remotes/origin/feature\nrefs/tags/local\nrefs/tags/v1" {
+		t.Errorf("fetched refs = %q", got)
+	}
+	if head, want := gitTest(t, "-C", repoDir, "rev-parse", "HEAD"), gitTest(t, "-C", work, "rev-parse", "master"); head != want {
+		t.Errorf("checkout is at %s, want %s", head, want)
+	}
+
+	// Deleted branches are pruned, the tags and local branches are kept
+	gitTest(t, "-C", repoDir, "branch", "local-feature", "origin/feature")
+	push("--delete", "feature")
+	backUpRepo()
+	if got := refs("refs/remotes/origin/feature", "refs/heads/local-feature", "refs/tags/local"); got != "refs/heads/local-feature\nrefs/tags/local" {
+		t.Errorf("refs after deleting a branch = %q", got)
+	}
+
+	// A renamed default branch is checked out
+	gitTest(t, "-C", work, "branch", "-m", "master", "main")
+	push("main")
+	gitTest(t, "-C", upstream, "symbolic-ref", "HEAD", "refs/heads/main")
+	push("--delete", "master")
+	backUpRepo()
+	if got := gitTest(t, "-C", repoDir, "symbolic-ref", "--short", "HEAD"); got != "main" {
+		t.Errorf("checked out branch = %q, want main", got)
+	}
+	if got := gitTest(t, "-C", repoDir, "rev-parse", "--abbrev-ref", "main@{upstream}"); got != "origin/main" {
+		t.Errorf("upstream branch of main = %q", got)
+	}
+	for _, e := range sink.events {
+		if e.Type == eventRepoDiverged {
+			t.Fatalf("unexpected divergence: %+v", e)
+		}
+	}
+
+	// Local commits are reported rather than failing the backup, and the
+	// refs are fetched anyway
+	gitTest(t, "-C", repoDir, "commit", "-q", "--allow-empty", "-m", "local")
+	local := gitTest(t, "-C", repoDir, "rev-parse", "HEAD")
+	gitTest(t, "-C", work, "commit", "-q", "--allow-empty", "-m", "third")
+	push("main")
+	backUpRepo()
+	if got := gitTest(t, "-C", repoDir, "rev-parse", "HEAD"); got != local {
+		t.Errorf("diverged checkout was moved to %s", got)
+	}
+	if got, want := gitTest(t, "-C", repoDir, "rev-parse", "origin/main"), gitTest(t, "-C", work, "rev-parse", "main"); got != want {
+		t.Errorf("origin/main = %s, want %s", got, want)
+	}
+	gitTest(t, "-C", repoDir, "reset", "-q", "--hard", "origin/main~1")
+
+	// So are local changes which the update would overwrite
+	os.WriteFile(filepath.Join(repoDir, "README"), []byte("local\n"), 0644)
+	os.WriteFile(filepath.Join(work, "README"), []byte("upstream\n"), 0644)
+	gitTest(t, "-C", work, "commit", "-q", "-a", "-m", "fourth")
+	push("main")
+	backUpRepo()
+	if data, _ := os.ReadFile(filepath.Join(repoDir, "README")); string(data) != "local\n" {
+		t.Errorf("local changes were overwritten: %q", data)
+	}
+
+	var diverged []string
+	for _, e := range sink.events {
+		if e.Type == eventRepoDiverged {
+			diverged = append(diverged, e.Reason)
+		}
+	}
+	report := runEvents.runFinished()
+	if len(diverged) != 2 || len(report.Diverged) != 2 || !strings.Contains(diverged[0], "1 ahead, 1 behind") {
+		t.Errorf("reported divergences %q, summary %+v", diverged, report.Diverged)
+	}
+}
+
+func TestUpdateShallowWorkingCopy(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	oldFS := appFS
+	defer func() { appFS = oldFS }()
+	appFS = afero.NewOsFs()
+	defer func() { cloneStrategies = nil }()
+	cloneStrategies = []cloneStrategyRule{{cloneStrategy: cloneStrategy{Strategy: cloneStrategyShallow, Depth: 1}}}
+
+	hosted := t.TempDir()
+	work := filepath.Join(hosted, "work")
+	newTestRepository(t, work)
+	gitTest(t, "-C", work, "branch", "-M", "master")
+	upstream := filepath.Join(hosted, "repo.git")
+	gitTest(t, "clone", "-q", "--bare", work, upstream)
+	gitTest(t, "-C", work, "remote", "add", "origin", upstream)
+	commitAndPush := func(message string) string {
+		t.Helper()
+		gitTest(t, "-C", work, "commit", "-q", "--allow-empty", "-m", message)
+		gitTest(t, "-C", work, "push", "-q", "origin", "master")
+		return gitTest(t, "-C", work, "rev-parse", "HEAD")
+	}
+
+	backupDir := t.TempDir()
+	// Shallow clones need a file:// URL
+	repo := &Repository{Namespace: "octocat", Name: "repo", CloneURL: "file://" + filepath.ToSlash(upstream)}
+	repoDir := getRepoDir(backupDir, repo, false)
+	sink := &recordingSink{}
+	runEvents = newRunProgress("github", "github.com", sink)
+	defer func() { runEvents = nil }()
+	backUpRepo := func() {
+		t.Helper()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		if out, err := backUp(backupDir, repo, false, &wg); err != nil {
+			t.Fatalf("backUp: %v: %s", err, out)
+		}
+	}
+	backUpRepo()
+
+	// The checkout follows the upstream branch
+	pushed := commitAndPush("second")
+	backUpRepo()
+	if got := gitTest(t, "-C", repoDir, "rev-parse", "HEAD"); got != pushed {
+		t.Errorf("checkout is at %s, want %s", got, pushed)
+	}
+
+	// Local commits are kept and reported rather than reset away
+	gitTest(t, "-C", repoDir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "local")
+	local := gitTest(t, "-C", repoDir, "rev-parse", "HEAD")
+	pushed = commitAndPush("third")
+	backUpRepo()
+	if got := gitTest(t, "-C", repoDir, "rev-parse", "HEAD"); got != local {
+		t.Errorf("local commit was discarded, checkout is at %s", got)
+	}
+	if got := gitTest(t, "-C", repoDir, "rev-parse", "origin/master"); got != pushed {
+		t.Errorf("origin/master = %s, want %s", got, pushed)
+	}
+	var diverged []string
+	for _, e := range sink.events {
+		if e.Type == eventRepoDiverged {
+			diverged = append(diverged, e.Reason)
+		}
+	}
+	if len(diverged) != 1 || !strings.Contains(diverged[0], "1 ahead") {
+		t.Errorf("reported divergences %q", diverged)
+	}
+
+	// Once the local commit is dropped, the checkout follows again
+	gitTest(t, "-C", repoDir, "reset", "-q", "--hard", "origin/master")
+	pushed = commitAndPush("fourth")
+	backUpRepo()
+	if got := gitTest(t, "-C", repoDir, "rev-parse", "HEAD"); got != pushed {
+		t.Errorf("checkout is at %s, want %s", got, pushed)
+	}
+}